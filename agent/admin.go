@@ -0,0 +1,52 @@
+package agent
+
+import (
+	"context"
+	"github.com/paust-team/pirius/agent/pubsub"
+	"github.com/paust-team/pirius/logger"
+	"github.com/paust-team/pirius/proto/pb"
+	"github.com/paust-team/pirius/qerror"
+	"go.uber.org/zap"
+)
+
+// adminServer serves the admin API adjusting a running agent
+type adminServer struct {
+	pb.AdminServer
+	rateLimits *pubsub.RateLimits
+}
+
+func (a adminServer) SetRateLimit(_ context.Context, request *pb.SetRateLimitRequest) (*pb.SetRateLimitResponse, error) {
+	limit := pubsub.RateLimit{
+		RecordsPerSec: request.GetLimit().GetRecordsPerSec(),
+		BytesPerSec:   request.GetLimit().GetBytesPerSec(),
+	}
+	switch target := request.Target.(type) {
+	case *pb.SetRateLimitRequest_TopicName:
+		a.rateLimits.SetTopicLimit(target.TopicName, limit)
+		logger.Info("rate limit of topic changed", zap.String("topic", target.TopicName),
+			zap.Uint64("records-per-sec", limit.RecordsPerSec), zap.Uint64("bytes-per-sec", limit.BytesPerSec))
+	case *pb.SetRateLimitRequest_SubscriberHost:
+		a.rateLimits.SetSubscriberLimit(target.SubscriberHost, limit)
+		logger.Info("rate limit of subscriber changed", zap.String("subscriber-host", target.SubscriberHost),
+			zap.Uint64("records-per-sec", limit.RecordsPerSec), zap.Uint64("bytes-per-sec", limit.BytesPerSec))
+	default:
+		return nil, qerror.ValidationError{Value: "target", HintMsg: "topic name or subscriber host should be set"}
+	}
+	return &pb.SetRateLimitResponse{Magic: 1}, nil
+}
+
+func (a adminServer) GetRateLimits(context.Context, *pb.GetRateLimitsRequest) (*pb.GetRateLimitsResponse, error) {
+	return &pb.GetRateLimitsResponse{
+		Magic:       1,
+		Topics:      rateLimitsToProto(a.rateLimits.TopicLimits()),
+		Subscribers: rateLimitsToProto(a.rateLimits.SubscriberLimits()),
+	}, nil
+}
+
+func rateLimitsToProto(limits map[string]pubsub.RateLimit) map[string]*pb.RateLimit {
+	converted := make(map[string]*pb.RateLimit, len(limits))
+	for name, limit := range limits {
+		converted[name] = &pb.RateLimit{RecordsPerSec: limit.RecordsPerSec, BytesPerSec: limit.BytesPerSec}
+	}
+	return converted
+}
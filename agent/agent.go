@@ -8,16 +8,19 @@ import (
 	"github.com/paust-team/pirius/agent/pubsub"
 	"github.com/paust-team/pirius/agent/storage"
 	"github.com/paust-team/pirius/bootstrapping"
+	"github.com/paust-team/pirius/bootstrapping/topic"
 	"github.com/paust-team/pirius/constants"
 	"github.com/paust-team/pirius/coordinating"
 	"github.com/paust-team/pirius/helper"
 	"github.com/paust-team/pirius/logger"
 	"github.com/paust-team/pirius/proto/pb"
+	"github.com/paust-team/pirius/qerror"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"net"
 	"os"
 	"sync"
+	"time"
 )
 
 type instance struct {
@@ -30,6 +33,17 @@ type instance struct {
 	coordClient  coordinating.CoordClient
 	bootstrapper *bootstrapping.BootstrapService
 	grpcServer   *grpc.Server
+	adminGrpc    *grpc.Server // serves the admin API on the loopback address
+	rateLimits   *pubsub.RateLimits
+
+	publishedTopics  sync.Map // topics registered as a publisher, deregistered on graceful stop
+	subscribedTopics sync.Map // topics registered as a subscriber
+}
+
+// drainablePublisher is a publisher which can be stopped gracefully
+type drainablePublisher interface {
+	DrainPublications(ctx context.Context) error
+	DrainStreams()
 }
 
 func (s *instance) Start() error {
@@ -38,6 +52,14 @@ func (s *instance) Start() error {
 		logger.Error("Invalid retention period", zap.Uint32("retention", s.config.RetentionPeriod()))
 		return errors.New(fmt.Sprintf("Retention period should not be less than %d and should not be greater than %d", constants.MinRetentionPeriod, constants.MaxRetentionPeriod))
 	}
+	if _, err := pubsub.ParseQuotaPolicy(s.config.StoreQuotaPolicy()); err != nil {
+		logger.Error("Invalid quota policy", zap.String("policy", s.config.StoreQuotaPolicy()))
+		return err
+	}
+	if s.config.DedupWindow() < 0 {
+		logger.Error("Invalid dedup window", zap.Int("dedup-window", s.config.DedupWindow()))
+		return errors.New("dedup window should not be negative")
+	}
 
 	if err := os.MkdirAll(s.config.DataDir(), os.ModePerm); err != nil {
 		return err
@@ -52,12 +74,32 @@ func (s *instance) Start() error {
 	}
 	s.meta = &meta
 
-	db, err := storage.NewDB(s.config.DBName(), s.config.DataDir())
+	engineType, err := storage.ParseEngineType(s.config.StorageEngine())
+	if err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+	db, err := storage.NewDB(engineType, s.config.DBName(), s.config.DataDir())
 	if err != nil {
 		logger.Error(err.Error())
 		return err
 	}
 	s.db = db
+	if keyFile := s.config.EncryptionKeyFile(); len(keyFile) > 0 {
+		keyRing, err := storage.LoadKeyRing(keyFile)
+		if err != nil {
+			logger.Error(err.Error())
+			return err
+		}
+		db.SetKeyRing(keyRing)
+		logger.Info("records are encrypted", zap.Uint32("active-key-id", keyRing.ActiveKeyId()))
+	}
+	meta.DedupWindows.Resize(s.config.DedupWindow())
+	s.rateLimits = pubsub.NewRateLimits(s.topicRateLimit, s.subscriberRateLimit)
+	if err = meta.ReconcilePublishedOffsets(db); err != nil {
+		logger.Error(err.Error())
+		return err
+	}
 	s.coordClient = helper.BuildCoordClient(s.config.ZKQuorum(), s.config.ZKTimeout())
 	if err := s.coordClient.Connect(); err != nil {
 		logger.Error(err.Error())
@@ -68,6 +110,20 @@ func (s *instance) Start() error {
 	s.running = true
 	s.shouldQuit = make(chan struct{})
 	s.wg = sync.WaitGroup{}
+	s.publishedTopics = sync.Map{}
+	s.subscribedTopics = sync.Map{}
+
+	// checkpoint offsets periodically to not lose them on crash
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ctx, cancel := context.WithCancel(context.Background())
+		checkpointer := storage.NewMetaCheckpointer(s.GetMetaPath(), *s.meta, s.config.MetaCheckpointInterval())
+		checkpointer.Run(ctx)
+		<-s.shouldQuit
+		cancel()
+		checkpointer.Wait()
+	}()
 	logger.Info("agent started with ",
 		zap.String("publisher-id", meta.PublisherID),
 		zap.String("subscriber-id", meta.SubscriberID),
@@ -82,16 +138,222 @@ func (s *instance) Stop() {
 	if s.grpcServer != nil {
 		s.grpcServer.Stop()
 	}
+	if s.adminGrpc != nil {
+		s.adminGrpc.Stop()
+	}
 	// gracefully stop
 	s.wg.Wait()
 	s.db.Close()
 	s.coordClient.Close()
 	storage.SaveAgentMeta(s.GetMetaPath(), *s.meta)
 	s.grpcServer = nil
+	s.adminGrpc = nil
 	s.bootstrapper = nil
 	logger.Info("agent finished")
 }
 
+// stopGracefully stops the agent after the publisher is drained. Records waiting to be published are written,
+// and records written so far are sent to the connected subscribers before the server is stopped.
+// When ctx is done before, the remaining streams are canceled as Stop does and ctx.Err() is returned.
+// Waiting for the goroutines and deregistering the agent are bounded by ctx too. When ctx is done before they finish,
+// the store is closed in background after the goroutines exit
+func (s *instance) stopGracefully(ctx context.Context, publisher drainablePublisher) error {
+	if !s.running {
+		return errors.New("not running state")
+	}
+	err := publisher.DrainPublications(ctx)
+	if err == nil {
+		publisher.DrainStreams()
+		err = s.stopServerGracefully(ctx)
+	}
+	if err != nil {
+		logger.Warn("stop agent without draining", zap.Error(err))
+	}
+
+	close(s.shouldQuit)
+	s.running = false
+	if s.grpcServer != nil {
+		s.grpcServer.Stop()
+	}
+	if s.adminGrpc != nil {
+		s.adminGrpc.Stop()
+	}
+	metaPath, meta, db, coordClient, bootstrapper := s.GetMetaPath(), s.meta, s.db, s.coordClient, s.bootstrapper
+	released := make(chan error, 1)
+	go func() {
+		s.wg.Wait()
+		saveErr := storage.SaveAgentMeta(metaPath, *meta)
+		if saveErr != nil {
+			logger.Error("cannot save agent meta", zap.Error(saveErr))
+		}
+		s.deregister(bootstrapper, meta)
+		db.Close()
+		coordClient.Close()
+		released <- saveErr
+	}()
+	select {
+	case saveErr := <-released:
+		if err == nil {
+			err = saveErr
+		}
+	case <-ctx.Done():
+		logger.Warn("agent resources are released in background", zap.Error(ctx.Err()))
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+	s.grpcServer = nil
+	s.adminGrpc = nil
+	s.bootstrapper = nil
+	logger.Info("agent finished gracefully")
+	return err
+}
+
+// stopServerGracefully waits for the subscription streams to be drained until ctx is done
+func (s *instance) stopServerGracefully(ctx context.Context) error {
+	if s.grpcServer == nil {
+		return nil
+	}
+	stopped := make(chan struct{})
+	go func() {
+		s.grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		s.grpcServer.Stop()
+		<-stopped
+		return ctx.Err()
+	}
+}
+
+// startAdminServer serves the admin API on a listener bound to the loopback address, so that only the host of
+// the agent can change its limits. It is not served when the admin port is not set
+func (s *instance) startAdminServer() error {
+	if s.config.AdminPort() == 0 {
+		return nil
+	}
+	adminAddress := fmt.Sprintf("127.0.0.1:%d", s.config.AdminPort())
+	lis, err := net.Listen("tcp", adminAddress)
+	if err != nil {
+		return err
+	}
+	logger.Debug("admin server listening", zap.String("address", adminAddress))
+
+	adminGrpc := grpc.NewServer()
+	pb.RegisterAdminServer(adminGrpc, adminServer{rateLimits: s.rateLimits})
+	s.adminGrpc = adminGrpc
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if err := adminGrpc.Serve(lis); err != nil {
+			logger.Error(err.Error(), zap.String("address", adminAddress))
+		}
+	}()
+	return nil
+}
+
+// deregister removes the agent from the publishers and subscribers of the topics
+func (s *instance) deregister(bootstrapper *bootstrapping.BootstrapService, meta *storage.AgentMeta) {
+	s.publishedTopics.Range(func(k, _ interface{}) bool {
+		if err := bootstrapper.RemovePublisher(k.(string), meta.PublisherID); err != nil {
+			logger.Warn("cannot deregister publisher", zap.String("topic", k.(string)), zap.Error(err))
+		}
+		return true
+	})
+	s.subscribedTopics.Range(func(k, _ interface{}) bool {
+		if err := bootstrapper.RemoveSubscriber(k.(string), meta.SubscriberID); err != nil {
+			logger.Warn("cannot deregister subscriber", zap.String("topic", k.(string)), zap.Error(err))
+		}
+		return true
+	})
+}
+
+func (s *instance) reconnectPolicy() pubsub.ReconnectPolicy {
+	return pubsub.ReconnectPolicy{
+		InitialBackoff: time.Millisecond * time.Duration(s.config.ReconnectInitialBackoff()),
+		MaxBackoff:     time.Millisecond * time.Duration(s.config.ReconnectMaxBackoff()),
+		Multiplier:     s.config.ReconnectBackoffMultiplier(),
+		Jitter:         s.config.ReconnectBackoffJitter(),
+		MaxAttempts:    s.config.ReconnectMaxAttempts(),
+	}
+}
+
+// topicRetention resolves the retention policy of the topic.
+// Local overrides take precedence over the topic policy, and the agent's retention is used when neither is set.
+func (s *instance) topicRetention(topicName string) (topic.RetentionPolicy, error) {
+	frame, err := s.bootstrapper.GetTopic(topicName)
+	if err != nil {
+		return topic.RetentionPolicy{}, err
+	}
+	retention := frame.RetentionPolicy()
+	if period := s.config.TopicRetentionPeriod(topicName); period > 0 {
+		retention.PeriodSec = period
+	}
+	if maxBytes := s.config.TopicRetentionMaxBytes(topicName); maxBytes > 0 {
+		retention.MaxBytes = maxBytes
+	}
+	if retention.PeriodSec == 0 {
+		retention.PeriodSec = uint64(s.config.RetentionPeriod()) * 60 * 60 * 24
+	}
+	logger.Info("retention policy of topic",
+		zap.String("topic", topicName),
+		zap.Uint64("retention-period", retention.PeriodSec),
+		zap.Uint64("retention-max-bytes", retention.MaxBytes))
+	return retention, nil
+}
+
+func (s *instance) batchPolicy() pubsub.BatchPolicy {
+	return pubsub.BatchPolicy{
+		MaxRecords:    s.config.PublishBatchMaxRecords(),
+		MaxBytes:      s.config.PublishBatchMaxBytes(),
+		FlushInterval: time.Millisecond * time.Duration(s.config.PublishBatchFlushInterval()),
+	}
+}
+
+func (s *instance) storeQuota() pubsub.StoreQuota {
+	// the policy is validated on start
+	policy, _ := pubsub.ParseQuotaPolicy(s.config.StoreQuotaPolicy())
+	return pubsub.StoreQuota{
+		MaxBytes: s.config.StoreQuotaMaxBytes(),
+		Policy:   policy,
+	}
+}
+
+func (s *instance) topicRateLimit(topicName string) pubsub.RateLimit {
+	return pubsub.RateLimit{
+		RecordsPerSec: s.config.TopicRecordsPerSec(topicName),
+		BytesPerSec:   s.config.TopicBytesPerSec(topicName),
+	}
+}
+
+func (s *instance) subscriberRateLimit(host string) pubsub.RateLimit {
+	return pubsub.RateLimit{
+		RecordsPerSec: s.config.SubscriberRecordsPerSec(host),
+		BytesPerSec:   s.config.SubscriberBytesPerSec(host),
+	}
+}
+
+// SetTopicRateLimit changes the limit of records sent to all subscribers of the topic until the agent is stopped
+func (s *instance) SetTopicRateLimit(topicName string, limit pubsub.RateLimit) error {
+	if !s.running {
+		return errors.New("not running state")
+	}
+	s.rateLimits.SetTopicLimit(topicName, limit)
+	return nil
+}
+
+// SetSubscriberRateLimit changes the limit of records sent to the subscribers of the host until the agent is stopped
+func (s *instance) SetSubscriberRateLimit(host string, limit pubsub.RateLimit) error {
+	if !s.running {
+		return errors.New("not running state")
+	}
+	s.rateLimits.SetSubscriberLimit(host, limit)
+	return nil
+}
+
 func (s *instance) GetMetaPath() string {
 	return s.config.DataDir() + "/" + constants.AgentMetaFileName
 }
@@ -115,8 +377,15 @@ func (s *instance) CleanAllData() {
 
 type PubSubAgent struct {
 	instance
-	subscriber pubsub.Subscriber
-	publisher  pubsub.Publisher
+	subscriber   pubsub.Subscriber
+	publisher    pubsub.Publisher
+	publishMu    sync.Mutex
+	publications map[string]publication // publications started by Publish
+}
+
+type publication struct {
+	sendChan chan pubsub.TopicData
+	stopped  chan struct{}
 }
 
 func NewPubSubAgent(config config.AgentConfig) *PubSubAgent {
@@ -131,8 +400,8 @@ func (s *PubSubAgent) StartWithServer() error {
 		return err
 	}
 	agentAddress := fmt.Sprintf("%s:%d", s.config.Host(), s.config.Port())
-	s.subscriber = pubsub.NewSubscriber(s.meta.SubscriberID, s.bootstrapper, s.meta.SubscribedOffsets)
-	s.publisher = pubsub.NewPublisher(s.meta.PublisherID, agentAddress, s.db, s.bootstrapper, s.meta.PublishedOffsets, s.meta.LastFetchedOffset)
+	s.subscriber = pubsub.NewSubscriber(s.meta.SubscriberID, s.bootstrapper, s.meta.SubscribedOffsets, s.reconnectPolicy())
+	s.publisher = pubsub.NewPublisher(s.meta.PublisherID, agentAddress, s.db, s.bootstrapper, s.meta.PublishedOffsets, s.meta.LastFetchedOffset, s.meta.DedupWindows, s.rateLimits, s.batchPolicy(), s.storeQuota())
 
 	var opts []grpc.ServerOption
 	grpcServer := grpc.NewServer(opts...)
@@ -144,6 +413,11 @@ func (s *PubSubAgent) StartWithServer() error {
 		s.running = false
 		return err
 	}
+	if err = s.startAdminServer(); err != nil {
+		lis.Close()
+		s.running = false
+		return err
+	}
 
 	s.grpcServer = grpcServer
 	s.wg.Add(1)
@@ -169,34 +443,122 @@ func (s *PubSubAgent) Start() error {
 		return err
 	}
 	agentAddress := fmt.Sprintf("%s:%d", s.config.Host(), s.config.Port())
-	s.subscriber = pubsub.NewSubscriber(s.meta.SubscriberID, s.bootstrapper, s.meta.SubscribedOffsets)
-	s.publisher = pubsub.NewPublisher(s.meta.PublisherID, agentAddress, s.db, s.bootstrapper, s.meta.PublishedOffsets, s.meta.LastFetchedOffset)
+	s.subscriber = pubsub.NewSubscriber(s.meta.SubscriberID, s.bootstrapper, s.meta.SubscribedOffsets, s.reconnectPolicy())
+	s.publisher = pubsub.NewPublisher(s.meta.PublisherID, agentAddress, s.db, s.bootstrapper, s.meta.PublishedOffsets, s.meta.LastFetchedOffset, s.meta.DedupWindows, s.rateLimits, s.batchPolicy(), s.storeQuota())
 
 	return nil
 }
 
+// StopGracefully stops the agent after draining the publications and the subscription streams until ctx is done
+func (s *PubSubAgent) StopGracefully(ctx context.Context) error {
+	return s.stopGracefully(ctx, &s.publisher)
+}
+
 func (s *PubSubAgent) StartPublish(ctx context.Context, topicName string, sendChan chan pubsub.TopicData) error {
+	_, err := s.startPublication(ctx, topicName, sendChan)
+	return err
+}
+
+// Publish writes the data to the topic and waits until it is persisted.
+// The receipt has the fragments and offsets the record is written to. When ctx is done before the receipt,
+// ctx.Err() is returned while the record may still be persisted
+func (s *PubSubAgent) Publish(ctx context.Context, topicName string, data pubsub.TopicData) (pubsub.PublishReceipt, error) {
+	type result struct {
+		receipt pubsub.PublishReceipt
+		err     error
+	}
+	resultCh := make(chan result, 1)
+	err := s.PublishAsync(ctx, topicName, data, func(receipt pubsub.PublishReceipt, err error) {
+		resultCh <- result{receipt: receipt, err: err}
+	})
+	if err != nil {
+		return pubsub.PublishReceipt{}, err
+	}
+	select {
+	case <-ctx.Done():
+		return pubsub.PublishReceipt{}, ctx.Err()
+	case res := <-resultCh:
+		return res.receipt, res.err
+	}
+}
+
+// PublishAsync sends the data to the topic, and the callback is called when the record is persisted or failed.
+// The publication of the topic is started at the first call. It fails while the topic is published by StartPublish
+func (s *PubSubAgent) PublishAsync(ctx context.Context, topicName string, data pubsub.TopicData, callback pubsub.PublishCallback) error {
+	pub, err := s.topicPublication(topicName)
+	if err != nil {
+		return err
+	}
+	data.Callback = callback
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-pub.stopped:
+		return qerror.InvalidStateError{State: fmt.Sprintf("publication of topic(%s) stopped", topicName)}
+	case pub.sendChan <- data:
+		return nil
+	}
+}
+
+// topicPublication returns the publication of the topic started by Publish, starting it if not running
+func (s *PubSubAgent) topicPublication(topicName string) (publication, error) {
+	s.publishMu.Lock()
+	defer s.publishMu.Unlock()
+	if s.publications == nil {
+		s.publications = make(map[string]publication)
+	}
+	if pub, ok := s.publications[topicName]; ok {
+		select {
+		case <-pub.stopped: // restart the publication stopped by an error or the agent stopped before
+		default:
+			return pub, nil
+		}
+	}
+
+	sendChan := make(chan pubsub.TopicData)
+	stopped, err := s.startPublication(context.Background(), topicName, sendChan)
+	if err != nil {
+		return publication{}, err
+	}
+	pub := publication{sendChan: sendChan, stopped: stopped}
+	s.publications[topicName] = pub
+	return pub, nil
+}
+
+// startPublication starts to publish the data of sendChan to the topic.
+// The returned channel is closed when the publication is stopped
+func (s *PubSubAgent) startPublication(ctx context.Context, topicName string, sendChan chan pubsub.TopicData) (chan struct{}, error) {
 	if !s.running || s.grpcServer == nil {
-		return errors.New("not running state")
+		return nil, errors.New("not running state")
 	}
 
-	retentionPeriod := uint64(s.config.RetentionPeriod() * 60 * 60 * 24)
+	retention, err := s.topicRetention(topicName)
+	if err != nil {
+		return nil, err
+	}
 	ctx, cancel := context.WithCancel(ctx)
 
-	errCh, err := s.publisher.StartTopicPublication(ctx, topicName, retentionPeriod, sendChan)
+	errCh, err := s.publisher.StartTopicPublication(ctx, topicName, retention, sendChan)
 	if err != nil {
 		cancel()
-		return err
+		return nil, err
 	}
+	s.publishedTopics.Store(topicName, struct{}{})
 
+	stopped := make(chan struct{})
 	s.wg.Add(1)
 	go func() {
 		defer s.wg.Done()
 		defer s.publisher.Wait()
 		defer cancel()
+		defer close(stopped)
 		for {
 			select {
 			case err = <-errCh:
+				if _, ok := err.(qerror.QuotaExceededError); ok { // rejected records are discarded only
+					logger.Warn(err.Error())
+					continue
+				}
 				if err != nil {
 					logger.Error(err.Error())
 				}
@@ -208,20 +570,22 @@ func (s *PubSubAgent) StartPublish(ctx context.Context, topicName string, sendCh
 		}
 	}()
 
-	return nil
+	return stopped, nil
 }
 
-func (s *PubSubAgent) StartSubscribe(ctx context.Context, topicName string, batchSize, flushInterval uint32) (chan []pubsub.SubscriptionResult, error) {
+func (s *PubSubAgent) StartSubscribe(ctx context.Context, topicName string, batchSize, flushInterval uint32,
+	opts ...pubsub.SubscriptionOption) (chan pubsub.SubscriptionResults, error) {
 	if !s.running {
 		return nil, errors.New("not running state")
 	}
 
 	ctx, cancel := context.WithCancel(ctx)
-	recvCh, errCh, err := s.subscriber.StartTopicSubscription(ctx, topicName, batchSize, flushInterval)
+	recvCh, errCh, err := s.subscriber.StartTopicSubscription(ctx, topicName, batchSize, flushInterval, opts...)
 	if err != nil {
 		cancel()
 		return nil, err
 	}
+	s.subscribedTopics.Store(topicName, struct{}{})
 	s.wg.Add(1)
 	go func() {
 		defer s.wg.Done()
@@ -230,6 +594,10 @@ func (s *PubSubAgent) StartSubscribe(ctx context.Context, topicName string, batc
 		for {
 			select {
 			case err = <-errCh:
+				if _, ok := err.(qerror.CorruptedRecordError); ok { // corrupted records are skipped only
+					logger.Warn(err.Error())
+					continue
+				}
 				if err != nil {
 					logger.Error(err.Error())
 				}
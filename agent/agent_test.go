@@ -2,8 +2,11 @@ package agent_test
 
 import (
 	"context"
+	"encoding/binary"
+	"fmt"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gmeasure"
 	"github.com/paust-team/pirius/agent"
 	"github.com/paust-team/pirius/agent/config"
 	"github.com/paust-team/pirius/agent/pubsub"
@@ -14,7 +17,10 @@ import (
 	"github.com/paust-team/pirius/helper"
 	"github.com/paust-team/pirius/qerror"
 	"github.com/paust-team/pirius/test"
+	"sort"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -113,6 +119,7 @@ var _ = Describe("Agent", func() {
 						{'1', '2', '3', '4', '5', '6'},
 					})
 					tp.Set("startSeqNum", uint64(1000))
+					tp.Set("headers", map[string]string{"content-type": "text/plain", "producer-id": "test-producer"})
 
 					go func() {
 						time.Sleep(1 * time.Second)
@@ -134,8 +141,10 @@ var _ = Describe("Agent", func() {
 
 					for i, record := range tp.GetBytesList("records") {
 						sendCh <- pubsub.TopicData{
-							SeqNum: uint64(i) + tp.GetUint64("startSeqNum"),
-							Data:   record,
+							SeqNum:  uint64(i) + tp.GetUint64("startSeqNum"),
+							Data:    record,
+							Key:     record,
+							Headers: tp.Get("headers").(map[string]string),
 						}
 					}
 				})
@@ -181,17 +190,256 @@ var _ = Describe("Agent", func() {
 					Expect(err).NotTo(HaveOccurred())
 
 					idx := 0
+					nacked := false
 					totalRecords := len(tp.GetBytesList("records"))
 					for subscriptionResult := range recvCh {
 						Expect(subscriptionResult).To(HaveLen(1))
+						if !nacked { // the first record should be redelivered after nack
+							nacked = true
+							subscriptionResult.Nack()
+							continue
+						} else if idx == 0 && subscriptionResult[0].SeqNum != tp.GetUint64("startSeqNum") {
+							continue // skip the records received before redelivery
+						}
 						Expect(subscriptionResult[0].SeqNum).To(Equal(tp.GetUint64("startSeqNum") + uint64(idx)))
 						Expect(subscriptionResult[0].Data).To(Equal(tp.GetBytesList("records")[idx]))
+						Expect(subscriptionResult[0].Key).To(Equal(tp.GetBytesList("records")[idx]))
+						Expect(subscriptionResult[0].Headers).To(Equal(tp.Get("headers").(map[string]string)))
+						Expect(subscriptionResult[0].Timestamp).NotTo(BeZero())
+						subscriptionResult.Ack()
 						idx++
 						if idx == totalRecords {
 							break
 						}
 					}
 				})
+
+				It("can subscribe from the given start position", func() {
+					ctx, cancel := context.WithCancel(context.Background())
+					defer cancel()
+					startOffset := uint64(2)
+					recvCh, err := subscriber.StartSubscribe(ctx, tp.GetString("topic"), tp.GetUint32("batchSize"), tp.GetUint32("flushInterval"),
+						pubsub.StartFromOffsets(map[uint]uint64{uint(tp.GetUint32("fragmentId")): startOffset}))
+					Expect(err).NotTo(HaveOccurred())
+
+					idx := int(startOffset) - 1
+					totalRecords := len(tp.GetBytesList("records"))
+					for subscriptionResult := range recvCh {
+						Expect(subscriptionResult).To(HaveLen(1))
+						Expect(subscriptionResult[0].SeqNum).To(Equal(tp.GetUint64("startSeqNum") + uint64(idx)))
+						Expect(subscriptionResult[0].Data).To(Equal(tp.GetBytesList("records")[idx]))
+						subscriptionResult.Ack()
+						idx++
+						if idx == totalRecords {
+							break
+						}
+					}
+				})
+
+				It("can subscribe within the granted credit", func() {
+					ctx, cancel := context.WithCancel(context.Background())
+					defer cancel()
+					// a batch is limited to a record by the credit
+					recvCh, err := subscriber.StartSubscribe(ctx, tp.GetString("topic"), 2, tp.GetUint32("flushInterval"),
+						pubsub.StartFromEarliest(), pubsub.WithCredit(1, 0))
+					Expect(err).NotTo(HaveOccurred())
+
+					idx := 0
+					totalRecords := len(tp.GetBytesList("records"))
+					for subscriptionResult := range recvCh {
+						Expect(subscriptionResult).To(HaveLen(1))
+						Expect(subscriptionResult[0].SeqNum).To(Equal(tp.GetUint64("startSeqNum") + uint64(idx)))
+						subscriptionResult.Ack()
+						idx++
+						if idx == totalRecords {
+							break
+						}
+					}
+				})
+			})
+
+			When("records published synchronously to the topic", Ordered, func() {
+				BeforeAll(func() {
+					err := publisher.StartWithServer()
+					Expect(err).NotTo(HaveOccurred())
+
+					tp.Set("records", [][]byte{
+						{'g', 'o', 'o', 'g', 'l', 'e'},
+						{'p', 'a', 'u', 's', 't', 'q'},
+						{'1', '2', '3', '4', '5', '6'},
+					})
+
+					go func() {
+						time.Sleep(1 * time.Second)
+						// setup topic fragment
+						fragmentInfo := topic.FragMappingInfo{uint(tp.GetUint32("fragmentId")): topic.FragInfo{
+							State:       topic.Active,
+							PublisherId: publisher.GetPublisherID(),
+							Address:     "127.0.0.1:11010",
+						}}
+						topicFragmentFrame := topic.NewTopicFragmentsFrame(fragmentInfo)
+						err = topicClient.UpdateTopicFragments(tp.GetString("topic"), topicFragmentFrame)
+						Expect(err).NotTo(HaveOccurred())
+					}()
+				})
+				AfterAll(func() {
+					publisher.Stop()
+				})
+
+				It("returns receipts with the persisted offsets", func() {
+					for i, record := range tp.GetBytesList("records") {
+						receipt, err := publisher.Publish(context.Background(), tp.GetString("topic"), pubsub.TopicData{
+							SeqNum: uint64(i),
+							Data:   record,
+						})
+						Expect(err).NotTo(HaveOccurred())
+						Expect(receipt.SeqNum).To(Equal(uint64(i)))
+						Expect(receipt.Offsets).To(Equal([]pubsub.FragmentOffset{{FragmentId: tp.GetUint32("fragmentId"), Offset: uint64(i) + 1}}))
+					}
+				})
+
+				It("calls back asynchronously with the receipt", func() {
+					receiptCh := make(chan pubsub.PublishReceipt, 1)
+					err := publisher.PublishAsync(context.Background(), tp.GetString("topic"), pubsub.TopicData{SeqNum: 100, Data: []byte{'a'}},
+						func(receipt pubsub.PublishReceipt, err error) {
+							Expect(err).NotTo(HaveOccurred())
+							receiptCh <- receipt
+						})
+					Expect(err).NotTo(HaveOccurred())
+
+					var receipt pubsub.PublishReceipt
+					Eventually(receiptCh).Should(Receive(&receipt))
+					Expect(receipt.Offsets).To(HaveLen(1))
+					Expect(receipt.Offsets[0].Offset).To(Equal(uint64(len(tp.GetBytesList("records")) + 1)))
+				})
+
+				It("rejects another publication of the topic", func() {
+					err := publisher.StartPublish(context.Background(), tp.GetString("topic"), make(chan pubsub.TopicData))
+					Expect(err).To(BeAssignableToTypeOf(qerror.InvalidStateError{}))
+				})
+			})
+
+			When("records are waiting to be published on graceful stop", Ordered, func() {
+				BeforeAll(func() {
+					err := publisher.StartWithServer()
+					Expect(err).NotTo(HaveOccurred())
+
+					tp.Set("records", [][]byte{
+						{'g', 'o', 'o', 'g', 'l', 'e'},
+						{'p', 'a', 'u', 's', 't', 'q'},
+						{'1', '2', '3', '4', '5', '6'},
+					})
+
+					go func() {
+						time.Sleep(1 * time.Second)
+						// setup topic fragment
+						fragmentInfo := topic.FragMappingInfo{uint(tp.GetUint32("fragmentId")): topic.FragInfo{
+							State:       topic.Active,
+							PublisherId: publisher.GetPublisherID(),
+							Address:     "127.0.0.1:11010",
+						}}
+						topicFragmentFrame := topic.NewTopicFragmentsFrame(fragmentInfo)
+						err = topicClient.UpdateTopicFragments(tp.GetString("topic"), topicFragmentFrame)
+						Expect(err).NotTo(HaveOccurred())
+					}()
+				})
+
+				It("writes the waiting records before stopping", func() {
+					records := tp.GetBytesList("records")
+					sendCh := make(chan pubsub.TopicData, len(records))
+					err := publisher.StartPublish(context.Background(), tp.GetString("topic"), sendCh)
+					Expect(err).NotTo(HaveOccurred())
+					for i, record := range records {
+						sendCh <- pubsub.TopicData{SeqNum: uint64(i), Data: record}
+					}
+
+					ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+					defer cancel()
+					Expect(publisher.StopGracefully(ctx)).To(Succeed())
+
+					loaded, err := storage.LoadAgentMeta(publisher.GetMetaPath())
+					Expect(err).NotTo(HaveOccurred())
+					publishedOffset, ok := loaded.PublishedOffsets.Load(storage.NewFragmentKey(tp.GetString("topic"), uint(tp.GetUint32("fragmentId"))))
+					Expect(ok).To(BeTrue())
+					Expect(publishedOffset).To(Equal(uint64(len(records) + 1)))
+				})
+			})
+
+			When("a subscriber is connected on graceful stop", Ordered, func() {
+				BeforeAll(func() {
+					err := publisher.StartWithServer()
+					Expect(err).NotTo(HaveOccurred())
+					err = subscriber.Start()
+					Expect(err).NotTo(HaveOccurred())
+
+					tp.Set("records", [][]byte{
+						{'g', 'o', 'o', 'g', 'l', 'e'},
+						{'p', 'a', 'u', 's', 't', 'q'},
+						{'1', '2', '3', '4', '5', '6'},
+					})
+
+					go func() {
+						time.Sleep(1 * time.Second)
+						// setup topic fragment
+						fragmentInfo := topic.FragMappingInfo{uint(tp.GetUint32("fragmentId")): topic.FragInfo{
+							State:       topic.Active,
+							PublisherId: publisher.GetPublisherID(),
+							Address:     "127.0.0.1:11010",
+						}}
+						topicFragmentFrame := topic.NewTopicFragmentsFrame(fragmentInfo)
+						err = topicClient.UpdateTopicFragments(tp.GetString("topic"), topicFragmentFrame)
+						Expect(err).NotTo(HaveOccurred())
+					}()
+				})
+				AfterAll(func() {
+					subscriber.Stop()
+				})
+
+				It("sends the drained batch to the subscriber before stopping", func() {
+					records := tp.GetBytesList("records")
+					sendCh := make(chan pubsub.TopicData, len(records))
+					err := publisher.StartPublish(context.Background(), tp.GetString("topic"), sendCh)
+					Expect(err).NotTo(HaveOccurred())
+
+					go func() {
+						time.Sleep(1 * time.Second)
+						// setup subscription
+						subscriptionInfo := topic.SubscriptionInfo{subscriber.GetSubscriberID(): []uint{uint(tp.GetUint32("fragmentId"))}}
+						topicSubscriptionFrame := topic.NewTopicSubscriptionsFrame(subscriptionInfo)
+						err := topicClient.UpdateTopicSubscriptions(tp.GetString("topic"), topicSubscriptionFrame)
+						Expect(err).NotTo(HaveOccurred())
+					}()
+					ctx, cancel := context.WithCancel(context.Background())
+					defer cancel()
+					recvCh, err := subscriber.StartSubscribe(ctx, tp.GetString("topic"), tp.GetUint32("batchSize"), tp.GetUint32("flushInterval"))
+					Expect(err).NotTo(HaveOccurred())
+
+					receive := func(idx int) {
+						var subscriptionResult pubsub.SubscriptionResults
+						Eventually(recvCh, 5*time.Second).Should(Receive(&subscriptionResult))
+						Expect(subscriptionResult).To(HaveLen(1))
+						Expect(subscriptionResult[0].SeqNum).To(Equal(uint64(idx)))
+						Expect(subscriptionResult[0].Data).To(Equal(records[idx]))
+						subscriptionResult.Ack()
+					}
+					// the first record is received once the subscriber is connected
+					sendCh <- pubsub.TopicData{SeqNum: 0, Data: records[0]}
+					receive(0)
+
+					for i := 1; i < len(records); i++ {
+						sendCh <- pubsub.TopicData{SeqNum: uint64(i), Data: records[i]}
+					}
+					stopped := make(chan error, 1)
+					go func() {
+						stopCtx, stopCancel := context.WithTimeout(context.Background(), 5*time.Second)
+						defer stopCancel()
+						stopped <- publisher.StopGracefully(stopCtx)
+					}()
+					for i := 1; i < len(records); i++ {
+						receive(i)
+					}
+					Eventually(stopped, 5*time.Second).Should(Receive(BeNil()))
+				})
 			})
 
 			When("few records published and staled fragment exists", Ordered, func() {
@@ -263,7 +511,8 @@ var _ = Describe("Agent", func() {
 
 					idx := 0
 					totalRecords := len(tp.GetBytesList("old-records"))
-					for range recvCh {
+					for subscriptionResult := range recvCh {
+						subscriptionResult.Ack()
 						idx++
 						if idx == totalRecords {
 							break
@@ -338,6 +587,7 @@ var _ = Describe("Agent", func() {
 					for subscriptionResult := range recvCh {
 						Expect(subscriptionResult).To(HaveLen(1))
 						Expect(helper.IsContainBytes(subscriptionResult[0].Data, totalRecords)).To(BeTrue())
+						subscriptionResult.Ack()
 						idx++
 						if idx == len(totalRecords) {
 							break
@@ -415,6 +665,7 @@ var _ = Describe("Agent", func() {
 						{'1', '2', '3', '4', '5', '6'},
 					})
 					tp.Set("startSeqNum", uint64(1000))
+					tp.Set("headers", map[string]string{"content-type": "text/plain", "producer-id": "test-producer"})
 
 					go func() {
 						time.Sleep(1 * time.Second)
@@ -436,8 +687,10 @@ var _ = Describe("Agent", func() {
 
 					for i, record := range tp.GetBytesList("records") {
 						sendCh <- pubsub.TopicData{
-							SeqNum: uint64(i) + tp.GetUint64("startSeqNum"),
-							Data:   record,
+							SeqNum:  uint64(i) + tp.GetUint64("startSeqNum"),
+							Data:    record,
+							Key:     record,
+							Headers: tp.Get("headers").(map[string]string),
 						}
 					}
 				})
@@ -473,6 +726,7 @@ var _ = Describe("Agent", func() {
 							Expect(retrievedData[0].SeqNum).To(Equal(sentSubscriptionResults[rIdx].SeqNum))
 							Expect(uint(retrievedData[0].FragmentId)).To(Equal(sentSubscriptionResults[rIdx].FragmentId))
 							Expect(retrievedData[0].Data).To(Equal(sentSubscriptionResults[rIdx].Data))
+							Expect(retrievedData[0].Headers).To(Equal(sentSubscriptionResults[rIdx].Headers))
 							rIdx++
 							if rIdx == totalRecords {
 								break
@@ -486,14 +740,18 @@ var _ = Describe("Agent", func() {
 						Expect(subscriptionResult.Results).To(HaveLen(1))
 						Expect(subscriptionResult.Results[0].SeqNum).To(Equal(tp.GetUint64("startSeqNum") + uint64(idx)))
 						Expect(subscriptionResult.Results[0].Data).To(Equal(tp.GetBytesList("records")[idx]))
+						Expect(subscriptionResult.Results[0].Key).To(Equal(tp.GetBytesList("records")[idx]))
+						Expect(subscriptionResult.Results[0].Headers).To(Equal(tp.Get("headers").(map[string]string)))
 						results := []pubsub.SubscriptionResult{{
 							FragmentId: subscriptionResult.Results[0].FragmentId,
 							SeqNum:     subscriptionResult.Results[0].SeqNum,
 							Data:       append(subscriptionResult.Results[0].Data, retrievePostfix...),
+							Headers:    subscriptionResult.Results[0].Headers,
 						}}
 						sentSubscriptionResults = append(sentSubscriptionResults, results[0])
 						err := subscriptionResult.SendBack(results)
 						Expect(err).NotTo(HaveOccurred())
+						subscriptionResult.Ack()
 
 						idx++
 						if idx == totalRecords {
@@ -505,4 +763,218 @@ var _ = Describe("Agent", func() {
 			})
 		})
 	})
+
+	Context("Benchmark", Ordered, Label("benchmark"), func() {
+		Describe("Push-based tailing of published records", func() {
+			tp := test.NewTestParams()
+			var coordClient coordinating.CoordClient
+			var topicClient topic.CoordClientTopicWrapper
+			var publisher *agent.PubSubAgent
+			var subscriber *agent.PubSubAgent
+			var sendCh chan pubsub.TopicData
+			var engineType storage.EngineType
+
+			// fetch goroutines used to poll the storage every 10ms
+			pollingInterval := 10 * time.Millisecond
+
+			p99 := func(latencies []time.Duration) time.Duration {
+				sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+				return latencies[len(latencies)*99/100]
+			}
+
+			cpuTime := func() time.Duration {
+				var usage syscall.Rusage
+				Expect(syscall.Getrusage(syscall.RUSAGE_SELF, &usage)).To(Succeed())
+				return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+			}
+
+			BeforeAll(func() {
+				// run only if selected explicitly by `--label-filter=benchmark`
+				if suiteConfig, _ := GinkgoConfiguration(); !strings.Contains(suiteConfig.LabelFilter, "benchmark") {
+					Skip("benchmark runs only with --label-filter=benchmark")
+				}
+
+				agentConfig := config.NewAgentConfig()
+				coordClient = helper.BuildCoordClient(agentConfig.ZKQuorum(), agentConfig.ZKTimeout())
+				err := coordClient.Connect()
+				Expect(err).NotTo(HaveOccurred())
+				topicClient = topic.NewCoordClientTopicWrapper(coordClient)
+
+				pubConfig := config.NewAgentConfig()
+				pubConfig.SetPort(11010)
+				pubConfig.SetDataDir(constants.DefaultHomeDir + "/test-pub")
+				pubConfig.SetBindAddress("0.0.0.0")
+				publisher = agent.NewPubSubAgent(pubConfig)
+				engineType, err = storage.ParseEngineType(pubConfig.StorageEngine())
+				Expect(err).NotTo(HaveOccurred())
+
+				subConfig := config.NewAgentConfig()
+				subConfig.SetPort(11011)
+				subConfig.SetDataDir(constants.DefaultHomeDir + "/test-sub")
+				subscriber = agent.NewPubSubAgent(subConfig)
+
+				tp.Set("topic", "test_bench_topic")
+				tp.Set("fragmentId", uint32(2))
+				tp.Set("numRecords", 500)
+				tp.Set("idleDuration", 3*time.Second)
+				err = topicClient.CreateTopic(tp.GetString("topic"), topic.NewTopicFrame("", topic.UniquePerFragment))
+				Expect(err).NotTo(HaveOccurred())
+
+				err = publisher.StartWithServer()
+				Expect(err).NotTo(HaveOccurred())
+				err = subscriber.Start()
+				Expect(err).NotTo(HaveOccurred())
+
+				go func() {
+					defer GinkgoRecover()
+					time.Sleep(1 * time.Second)
+					fragmentInfo := topic.FragMappingInfo{uint(tp.GetUint32("fragmentId")): topic.FragInfo{
+						State:       topic.Active,
+						PublisherId: publisher.GetPublisherID(),
+						Address:     "127.0.0.1:11010",
+					}}
+					err := topicClient.UpdateTopicFragments(tp.GetString("topic"), topic.NewTopicFragmentsFrame(fragmentInfo))
+					Expect(err).NotTo(HaveOccurred())
+				}()
+				sendCh = make(chan pubsub.TopicData)
+				err = publisher.StartPublish(context.Background(), tp.GetString("topic"), sendCh)
+				Expect(err).NotTo(HaveOccurred())
+			})
+			AfterAll(func() {
+				close(sendCh)
+				publisher.Stop()
+				subscriber.Stop()
+				publisher.CleanAllData()
+				subscriber.CleanAllData()
+				topicClient.DeleteTopic(tp.GetString("topic"))
+				coordClient.Close()
+			})
+
+			It("reports idle cpu usage and p99 delivery latency against polling", func() {
+				experiment := gmeasure.NewExperiment("push-based tailing")
+				AddReportEntry(experiment.Name, experiment)
+
+				// idle cpu usage without any subscription stream
+				startCpu := cpuTime()
+				time.Sleep(tp.Get("idleDuration").(time.Duration))
+				experiment.RecordDuration("idle cpu time (no subscription)", cpuTime()-startCpu)
+
+				go func() {
+					defer GinkgoRecover()
+					time.Sleep(1 * time.Second)
+					subscriptionInfo := topic.SubscriptionInfo{subscriber.GetSubscriberID(): []uint{uint(tp.GetUint32("fragmentId"))}}
+					err := topicClient.UpdateTopicSubscriptions(tp.GetString("topic"), topic.NewTopicSubscriptionsFrame(subscriptionInfo))
+					Expect(err).NotTo(HaveOccurred())
+				}()
+				recvCh, err := subscriber.StartSubscribe(context.Background(), tp.GetString("topic"), 1, 0)
+				Expect(err).NotTo(HaveOccurred())
+
+				// idle cpu usage with a subscription stream waiting for new records
+				startCpu = cpuTime()
+				time.Sleep(tp.Get("idleDuration").(time.Duration))
+				subscribedCpu := cpuTime() - startCpu
+				experiment.RecordDuration("idle cpu time (subscribed)", subscribedCpu)
+
+				numRecords := tp.GetInt("numRecords")
+				go func() {
+					defer GinkgoRecover()
+					for i := 0; i < numRecords; i++ {
+						data := make([]byte, 8)
+						binary.BigEndian.PutUint64(data, uint64(time.Now().UnixNano()))
+						sendCh <- pubsub.TopicData{SeqNum: uint64(i), Data: data}
+						time.Sleep(1 * time.Millisecond)
+					}
+				}()
+
+				var latencies []time.Duration
+				for results := range recvCh {
+					for _, result := range results {
+						sentAt := time.Unix(0, int64(binary.BigEndian.Uint64(result.Data)))
+						latency := time.Since(sentAt)
+						latencies = append(latencies, latency)
+						experiment.RecordDuration("delivery latency", latency)
+					}
+					results.Ack()
+					if len(latencies) >= numRecords {
+						break
+					}
+				}
+				Expect(latencies).To(HaveLen(numRecords))
+				pushLatency := p99(latencies)
+				experiment.RecordDuration("p99 delivery latency (push)", pushLatency)
+
+				// polling baseline: a subscriber fetching new records from a store every pollingInterval, as fetch goroutines did
+				pollDB, err := storage.NewDB(engineType, "test-poll", constants.DefaultHomeDir+"/test-poll")
+				Expect(err).NotTo(HaveOccurred())
+				defer func() {
+					pollDB.Close()
+					pollDB.Destroy()
+				}()
+				pollCtx, pollCancel := context.WithCancel(context.Background())
+				defer pollCancel()
+				polled := make(chan []byte, numRecords)
+				go func() {
+					defer GinkgoRecover()
+					ticker := time.NewTicker(pollingInterval)
+					defer ticker.Stop()
+					nextOffset := uint64(1)
+					for {
+						select {
+						case <-pollCtx.Done():
+							return
+						case <-ticker.C:
+						}
+						for {
+							record, err := pollDB.GetRecord(tp.GetString("topic"), tp.GetUint32("fragmentId"), nextOffset)
+							Expect(err).NotTo(HaveOccurred())
+							if !record.Exists() {
+								record.Free()
+								break
+							}
+							value := storage.NewRecordValue(record)
+							data, err := pollDB.DecodedData(value)
+							value.Free()
+							Expect(err).NotTo(HaveOccurred())
+							polled <- data
+							nextOffset++
+						}
+					}
+				}()
+
+				// idle cpu usage with a subscriber polling for new records
+				startCpu = cpuTime()
+				time.Sleep(tp.Get("idleDuration").(time.Duration))
+				pollingCpu := cpuTime() - startCpu
+				experiment.RecordDuration("idle cpu time (polling)", pollingCpu)
+
+				go func() {
+					defer GinkgoRecover()
+					expirationDate := uint64(time.Now().Add(time.Hour).Unix())
+					for i := 0; i < numRecords; i++ {
+						data := make([]byte, 8)
+						binary.BigEndian.PutUint64(data, uint64(time.Now().UnixNano()))
+						err := pollDB.PutRecord(tp.GetString("topic"), tp.GetUint32("fragmentId"), uint64(i+1), uint64(i), data, expirationDate)
+						Expect(err).NotTo(HaveOccurred())
+						time.Sleep(1 * time.Millisecond)
+					}
+				}()
+
+				var pollingLatencies []time.Duration
+				for len(pollingLatencies) < numRecords {
+					var data []byte
+					Eventually(polled, 5*time.Second).Should(Receive(&data))
+					latency := time.Since(time.Unix(0, int64(binary.BigEndian.Uint64(data))))
+					pollingLatencies = append(pollingLatencies, latency)
+					experiment.RecordDuration("polling latency", latency)
+				}
+				pollingLatency := p99(pollingLatencies)
+				experiment.RecordDuration("p99 delivery latency (polling)", pollingLatency)
+
+				// compared, not asserted: timings depend on the machine running the benchmark
+				idleCpu := experiment.GetStats("idle cpu time (no subscription)").DurationFor(gmeasure.StatMin)
+				AddReportEntry("idle cpu time added by a subscription stream against polling", fmt.Sprintf("%v / %v", subscribedCpu-idleCpu, pollingCpu-idleCpu))
+				AddReportEntry("p99 delivery latency against polling", fmt.Sprintf("%v / %v", pushLatency, pollingLatency))
+			})
+		})
+	})
 })
@@ -16,6 +16,8 @@ func Main() {
 		NewStartPublishCmd(),
 		NewStartSubscribeCmd(),
 		NewTopicCmd(),
+		NewStoreCmd(),
+		NewRateLimitCmd(),
 	)
 
 	if err := agentCmd.Execute(); err != nil {
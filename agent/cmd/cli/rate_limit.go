@@ -0,0 +1,122 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/paust-team/pirius/constants"
+	"github.com/paust-team/pirius/proto/pb"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	agentAddr      string
+	subscriberHost string
+	recordsPerSec  uint64
+	bytesPerSec    uint64
+)
+
+// rate-limit commands change the limits of a running agent through its admin API
+func NewRateLimitCmd() *cobra.Command {
+
+	var rateLimitCmd = &cobra.Command{
+		Use:   "rate-limit",
+		Short: "rate limits of records sent to subscribers by a running agent",
+	}
+
+	rateLimitCmd.PersistentFlags().StringVar(&agentAddr, "agent", fmt.Sprintf("127.0.0.1:%d", constants.DefaultAdminPort), "admin address of the agent")
+
+	rateLimitCmd.AddCommand(
+		NewSetRateLimitCmd(),
+		NewGetRateLimitsCmd(),
+	)
+
+	return rateLimitCmd
+}
+
+func callAdmin(fn func(ctx context.Context, client pb.AdminClient) error) error {
+	conn, err := grpc.Dial(agentAddr, grpc.WithInsecure())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(3)*time.Second)
+	defer cancel()
+	return fn(ctx, pb.NewAdminClient(conn))
+}
+
+func NewSetRateLimitCmd() *cobra.Command {
+
+	var setCmd = &cobra.Command{
+		Use:   "set",
+		Short: "Set the rate limit of a topic or a subscriber. 0 means unlimited",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			request := &pb.SetRateLimitRequest{
+				Magic: 1,
+				Limit: &pb.RateLimit{RecordsPerSec: recordsPerSec, BytesPerSec: bytesPerSec},
+			}
+			if len(topic) > 0 {
+				request.Target = &pb.SetRateLimitRequest_TopicName{TopicName: topic}
+			} else if len(subscriberHost) > 0 {
+				request.Target = &pb.SetRateLimitRequest_SubscriberHost{SubscriberHost: subscriberHost}
+			} else {
+				return errors.New("topic or subscriber should be given")
+			}
+
+			return callAdmin(func(ctx context.Context, client pb.AdminClient) error {
+				if _, err := client.SetRateLimit(ctx, request); err != nil {
+					return err
+				}
+				fmt.Fprintln(cmd.OutOrStdout(), "rate limit changed")
+				return nil
+			})
+		},
+	}
+
+	setCmd.Flags().StringVarP(&topic, "topic", "t", "", "topic to limit")
+	setCmd.Flags().StringVar(&subscriberHost, "subscriber", "", "host address of the subscribers to limit")
+	setCmd.Flags().Uint64Var(&recordsPerSec, "records-per-sec", 0, "max records per second")
+	setCmd.Flags().Uint64Var(&bytesPerSec, "bytes-per-sec", 0, "max bytes per second")
+	setCmd.MarkFlagsMutuallyExclusive("topic", "subscriber")
+
+	return setCmd
+}
+
+func NewGetRateLimitsCmd() *cobra.Command {
+
+	var getCmd = &cobra.Command{
+		Use:   "get",
+		Short: "Show the rate limits of topics and subscribers which have been sent to or set",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return callAdmin(func(ctx context.Context, client pb.AdminClient) error {
+				response, err := client.GetRateLimits(ctx, &pb.GetRateLimitsRequest{Magic: 1})
+				if err != nil {
+					return err
+				}
+				w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+				fmt.Fprintln(w, "KIND\tNAME\tRECORDS/SEC\tBYTES/SEC")
+				printRateLimits(w, "topic", response.Topics)
+				printRateLimits(w, "subscriber", response.Subscribers)
+				return w.Flush()
+			})
+		},
+	}
+
+	return getCmd
+}
+
+func printRateLimits(w *tabwriter.Writer, kind string, limits map[string]*pb.RateLimit) {
+	names := make([]string, 0, len(limits))
+	for name := range limits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\n", kind, name, limits[name].RecordsPerSec, limits[name].BytesPerSec)
+	}
+}
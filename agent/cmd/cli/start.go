@@ -16,15 +16,22 @@ import (
 )
 
 var (
-	configPath string
-	logDir     string
-	dataDir    string
-	logLevel   uint8
-	port       uint
-	zkQuorum   []string
-	zkTimeout  uint
-	topic      string
-	unique     bool
+	configPath   string
+	logDir       string
+	dataDir      string
+	logLevel     uint8
+	port         uint
+	adminPort    uint
+	zkQuorum     []string
+	zkTimeout    uint
+	topic        string
+	unique       bool
+	keyRouting   bool
+	compacted    bool
+	retention    uint64
+	maxBytes     uint64
+	codecName    string
+	drainTimeout uint
 )
 
 func NewStartPublishCmd() *cobra.Command {
@@ -73,7 +80,12 @@ func NewStartPublishCmd() *cobra.Command {
 					return
 				case sig := <-sigCh:
 					fmt.Println("received signal:", sig)
-					publisher.Stop()
+					// records published so far are sent to the subscribers before stopping
+					stopCtx, stopCancel := context.WithTimeout(context.Background(), time.Duration(drainTimeout)*time.Millisecond)
+					if err := publisher.StopGracefully(stopCtx); err != nil {
+						fmt.Println("stopped without draining:", err)
+					}
+					stopCancel()
 				case <-time.After(time.Second):
 					sendCh <- pubsub.TopicData{
 						SeqNum: uint64(counter),
@@ -88,11 +100,13 @@ func NewStartPublishCmd() *cobra.Command {
 	startCmd.Flags().StringVarP(&topic, "topic", "t", "test", "topic name")
 	startCmd.Flags().StringVarP(&configPath, "config-path", "i", constants.DefaultAgentConfigPath, "agent config directory")
 	startCmd.Flags().UintVar(&port, "port", constants.DefaultAgentPort, "agent port")
+	startCmd.Flags().UintVar(&adminPort, "admin-port", 0, "port of the admin API listening on 127.0.0.1. 0 means disabled")
 	startCmd.Flags().StringVar(&logDir, "log-dir", "", "log directory")
 	startCmd.Flags().StringVar(&dataDir, "data-dir", "", "data directory")
 	startCmd.Flags().Uint8Var(&logLevel, "log-level", 0, "set log level [0=debug|1=info|2=warning|3=error]")
 	startCmd.Flags().StringSliceVar(&zkQuorum, "zk-quorum", []string{"127.0.0.1:2181"}, "zookeeper quorum")
 	startCmd.Flags().UintVar(&zkTimeout, "zk-timeout", 5000, "zookeeper timeout")
+	startCmd.Flags().UintVar(&drainTimeout, "drain-timeout", 5000, "max time(millisecond) to drain records on stop")
 
 	agentConfig.BindPFlags(startCmd.Flags())
 	agentConfig.BindPFlag("zookeeper.quorum", startCmd.Flags().Lookup("zk-quorum"))
@@ -144,6 +158,7 @@ func NewStartSubscribeCmd() *cobra.Command {
 					if err := result.SendBack(results); err != nil {
 						panic(err)
 					}
+					result.Ack()
 				}
 			}()
 
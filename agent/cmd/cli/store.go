@@ -0,0 +1,455 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/paust-team/pirius/agent/config"
+	"github.com/paust-team/pirius/agent/storage"
+	"github.com/paust-team/pirius/constants"
+	"github.com/paust-team/pirius/qerror"
+	"github.com/spf13/cobra"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+)
+
+var (
+	dbName       string
+	keyFile      string
+	fragmentId   uint32
+	fromOffset   uint64
+	toOffset     uint64
+	offsetKind   string
+	offset       uint64
+	deleteOffset bool
+	topics       []string
+	fragmentIds  []uint
+	decrypt      bool
+)
+
+// store commands open the files of the data directory directly. list, dump, verify and export open the store
+// read-only, and the other commands that write it need the agent to be stopped
+func NewStoreCmd() *cobra.Command {
+
+	agentConfig := config.NewAgentConfig()
+	var storeCmd = &cobra.Command{
+		Use:   "store",
+		Short: "inspect the records and meta of a stopped agent",
+	}
+
+	storeCmd.PersistentFlags().StringVar(&dataDir, "data-dir", "", "data directory")
+	storeCmd.PersistentFlags().StringVar(&dbName, "db-name", "", "name of the record store in the data directory")
+	storeCmd.PersistentFlags().StringVar(&keyFile, "key-file", "", "key file to decrypt encrypted records")
+
+	agentConfig.BindPFlags(storeCmd.PersistentFlags())
+	agentConfig.BindPFlag("encryption.key-file", storeCmd.PersistentFlags().Lookup("key-file"))
+
+	storeCmd.AddCommand(
+		NewListStoreCmd(agentConfig),
+		NewDumpStoreCmd(agentConfig),
+		NewVerifyStoreCmd(agentConfig),
+		NewShowMetaCmd(agentConfig),
+		NewSetOffsetCmd(agentConfig),
+		NewExportStoreCmd(agentConfig),
+		NewImportStoreCmd(agentConfig),
+	)
+
+	return storeCmd
+}
+
+// openStore opens the rocksdb store of the data directory. it is created only if `create` is set
+func openStore(agentConfig config.AgentConfig, create bool) (*storage.DB, error) {
+	if create {
+		if err := os.MkdirAll(agentConfig.DataDir(), os.ModePerm); err != nil {
+			return nil, err
+		}
+	} else if _, err := os.Stat(filepath.Join(agentConfig.DataDir(), agentConfig.DBName())); err != nil {
+		return nil, err
+	}
+	db, err := storage.NewDB(storage.RocksDBEngine, agentConfig.DBName(), agentConfig.DataDir())
+	if err != nil {
+		return nil, err
+	}
+	return setKeyRing(agentConfig, db)
+}
+
+// openReadOnlyStore opens the rocksdb store of the data directory without writing it. legacy record values are not upgraded
+func openReadOnlyStore(agentConfig config.AgentConfig) (*storage.DB, error) {
+	if _, err := os.Stat(filepath.Join(agentConfig.DataDir(), agentConfig.DBName())); err != nil {
+		return nil, err
+	}
+	db, err := storage.NewReadOnlyDB(storage.RocksDBEngine, agentConfig.DBName(), agentConfig.DataDir())
+	if err != nil {
+		return nil, err
+	}
+	return setKeyRing(agentConfig, db)
+}
+
+// setKeyRing sets the key ring of the key file to the db. the db is closed if the key file cannot be loaded
+func setKeyRing(agentConfig config.AgentConfig, db *storage.DB) (*storage.DB, error) {
+	if keyFile := agentConfig.EncryptionKeyFile(); len(keyFile) > 0 {
+		keyRing, err := storage.LoadKeyRing(keyFile)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		db.SetKeyRing(keyRing)
+	}
+	return db, nil
+}
+
+func metaPath(agentConfig config.AgentConfig) string {
+	return filepath.Join(agentConfig.DataDir(), constants.AgentMetaFileName)
+}
+
+func NewListStoreCmd(agentConfig config.AgentConfig) *cobra.Command {
+
+	var listCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List stored fragments with their offsets and sizes",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			db, err := openReadOnlyStore(agentConfig)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			fragments, err := db.Fragments()
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "TOPIC\tFRAGMENT\tFIRST OFFSET\tLAST OFFSET\tRECORDS\tBYTES")
+			for _, fragment := range fragments {
+				if len(topic) > 0 && fragment.Topic != topic {
+					continue
+				}
+				fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\n", fragment.Topic, fragment.FragmentId,
+					fragment.FirstOffset, fragment.LastOffset, fragment.NumRecords, fragment.Size)
+			}
+			return w.Flush()
+		},
+	}
+
+	listCmd.Flags().StringVarP(&topic, "topic", "t", "", "list fragments of the topic only")
+
+	return listCmd
+}
+
+// dumpedRecord is a line of the dump. key and data are base64-encoded
+type dumpedRecord struct {
+	Topic           string            `json:"topic"`
+	FragmentId      uint32            `json:"fragmentId"`
+	Offset          uint64            `json:"offset"`
+	Version         byte              `json:"version"`
+	Valid           bool              `json:"valid"`
+	SeqNum          uint64            `json:"seqNum"`
+	Timestamp       uint64            `json:"timestamp,omitempty"`
+	Key             []byte            `json:"key,omitempty"`
+	Headers         map[string]string `json:"headers,omitempty"`
+	Compression     string            `json:"compression,omitempty"`
+	EncryptionKeyId uint32            `json:"encryptionKeyId,omitempty"`
+	Data            []byte            `json:"data,omitempty"`
+	Error           string            `json:"error,omitempty"`
+}
+
+func newDumpedRecord(db *storage.DB, offset uint64, value *storage.RecordValue) dumpedRecord {
+	record := dumpedRecord{
+		Topic:      topic,
+		FragmentId: fragmentId,
+		Offset:     offset,
+		Version:    value.Version(),
+		Valid:      value.Verify(),
+	}
+	// fields of corrupted records can not be parsed safely
+	if !record.Valid {
+		record.Error = qerror.CorruptedRecordError{Topic: topic, FragmentId: fragmentId, Offset: offset}.Error()
+		return record
+	}
+	record.SeqNum = value.SeqNum()
+	record.Timestamp = value.Timestamp()
+	record.Key = value.Key()
+	record.Headers = value.Headers()
+	record.Compression = value.Compression().String()
+	record.EncryptionKeyId = value.EncryptionKeyId()
+	data, err := db.DecodedData(value)
+	if err != nil {
+		record.Error = err.Error()
+		return record
+	}
+	record.Data = data
+	return record
+}
+
+func NewDumpStoreCmd(agentConfig config.AgentConfig) *cobra.Command {
+
+	var dumpCmd = &cobra.Command{
+		Use:   "dump",
+		Short: "Dump records of a fragment as JSON lines",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if fromOffset > toOffset {
+				return qerror.ValidationError{Value: fmt.Sprintf("%d-%d", fromOffset, toOffset), HintMsg: "from offset should not be greater than to offset"}
+			}
+			db, err := openReadOnlyStore(agentConfig)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			encoder := json.NewEncoder(cmd.OutOrStdout())
+			return db.ForEachRecord(topic, fragmentId, fromOffset, toOffset, func(offset uint64, value *storage.RecordValue) error {
+				return encoder.Encode(newDumpedRecord(db, offset, value))
+			})
+		},
+	}
+
+	dumpCmd.Flags().StringVarP(&topic, "topic", "t", "", "topic of the records")
+	dumpCmd.Flags().Uint32VarP(&fragmentId, "fragment", "f", 0, "fragment id of the records")
+	dumpCmd.Flags().Uint64Var(&fromOffset, "from", 0, "first offset to dump")
+	dumpCmd.Flags().Uint64Var(&toOffset, "to", math.MaxUint64, "last offset to dump")
+
+	dumpCmd.MarkFlagRequired("topic")
+	dumpCmd.MarkFlagRequired("fragment")
+
+	return dumpCmd
+}
+
+func printLocations(w io.Writer, title string, locations []storage.RecordLocation) {
+	if len(locations) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%s:\n", title)
+	for _, location := range locations {
+		fmt.Fprintf(w, "  %s/%d@%d\n", location.Topic, location.FragmentId, location.Offset)
+	}
+}
+
+func NewVerifyStoreCmd(agentConfig config.AgentConfig) *cobra.Command {
+
+	var verifyCmd = &cobra.Command{
+		Use:   "verify",
+		Short: "Verify checksums of records and match records with their retention keys",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			db, err := openReadOnlyStore(agentConfig)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			report, err := db.VerifyRecords()
+			if err != nil {
+				return err
+			}
+			w := cmd.OutOrStdout()
+			fmt.Fprintf(w, "records: %d, retention keys: %d\n", report.NumRecords, report.NumRetentionKeys)
+			printLocations(w, "records without retention keys", report.MissingRetentionKeys)
+			printLocations(w, "corrupted records", report.CorruptedRecords)
+			// dangling keys are left by size-based deletion and quarantine, so they are not listed
+			fmt.Fprintf(w, "retention keys of deleted records: %d\n", len(report.DanglingRetentionKeys))
+			if !report.IsHealthy() {
+				return errors.New("store is not healthy")
+			}
+			fmt.Fprintln(w, "store is healthy")
+			return nil
+		},
+	}
+
+	return verifyCmd
+}
+
+// metaOffsets returns the offsets of the meta by kind: published, subscribed or fetched
+func metaOffsets(meta storage.AgentMeta, kind string) (storage.TopicFragmentOffsets, error) {
+	switch kind {
+	case "published":
+		return meta.PublishedOffsets, nil
+	case "subscribed":
+		return meta.SubscribedOffsets, nil
+	case "fetched":
+		return meta.LastFetchedOffset, nil
+	}
+	return storage.TopicFragmentOffsets{}, qerror.ValidationError{Value: kind, HintMsg: "offset kind should be one of published, subscribed and fetched"}
+}
+
+func NewShowMetaCmd(agentConfig config.AgentConfig) *cobra.Command {
+
+	var metaCmd = &cobra.Command{
+		Use:   "meta",
+		Short: "Show ids and offsets of the agent meta",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			meta, err := storage.ReadAgentMeta(metaPath(agentConfig))
+			if err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintf(w, "publisher id:\t%s\n", meta.PublisherID)
+			fmt.Fprintf(w, "subscriber id:\t%s\n", meta.SubscriberID)
+			for _, kind := range []string{"published", "subscribed", "fetched"} {
+				offsets, _ := metaOffsets(meta, kind)
+				offsetMap := offsets.ToMap()
+				fragmentKeys := make([]storage.FragmentKey, 0, len(offsetMap))
+				for fragmentKey := range offsetMap {
+					fragmentKeys = append(fragmentKeys, fragmentKey)
+				}
+				sort.Slice(fragmentKeys, func(i, j int) bool { return fragmentKeys[i] < fragmentKeys[j] })
+
+				fmt.Fprintf(w, "%s offsets:\n", kind)
+				for _, fragmentKey := range fragmentKeys {
+					fmt.Fprintf(w, "  %s\t%d\n", fragmentKey, offsetMap[fragmentKey])
+				}
+			}
+			return w.Flush()
+		},
+	}
+
+	return metaCmd
+}
+
+func NewSetOffsetCmd(agentConfig config.AgentConfig) *cobra.Command {
+
+	var setOffsetCmd = &cobra.Command{
+		Use:   "set-offset",
+		Short: "Rewrite an offset of the agent meta",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !deleteOffset && !cmd.Flags().Changed("offset") {
+				return qerror.ValidationError{Value: "set-offset", HintMsg: "either offset or delete should be given"}
+			}
+			path := metaPath(agentConfig)
+			meta, err := storage.ReadAgentMeta(path)
+			if err != nil {
+				return err
+			}
+			offsets, err := metaOffsets(meta, offsetKind)
+			if err != nil {
+				return err
+			}
+
+			fragmentKey := storage.NewFragmentKey(topic, uint(fragmentId))
+			prev := "none"
+			if value, ok := offsets.Load(fragmentKey); ok {
+				prev = fmt.Sprint(value)
+			}
+			next := "none"
+			if deleteOffset {
+				offsets.Delete(fragmentKey)
+			} else {
+				offsets.Store(fragmentKey, offset)
+				next = fmt.Sprint(offset)
+			}
+			if err = storage.SaveAgentMeta(path, meta); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%s offset of %s: %s -> %s\n", offsetKind, fragmentKey, prev, next)
+			return nil
+		},
+	}
+
+	setOffsetCmd.Flags().StringVar(&offsetKind, "kind", "", "kind of the offset: published/subscribed/fetched")
+	setOffsetCmd.Flags().StringVarP(&topic, "topic", "t", "", "topic of the offset")
+	setOffsetCmd.Flags().Uint32VarP(&fragmentId, "fragment", "f", 0, "fragment id of the offset")
+	setOffsetCmd.Flags().Uint64Var(&offset, "offset", 0, "new offset")
+	setOffsetCmd.Flags().BoolVar(&deleteOffset, "delete", false, "delete the offset instead of setting it")
+
+	setOffsetCmd.MarkFlagRequired("kind")
+	setOffsetCmd.MarkFlagRequired("topic")
+	setOffsetCmd.MarkFlagRequired("fragment")
+	setOffsetCmd.MarkFlagsMutuallyExclusive("offset", "delete")
+
+	return setOffsetCmd
+}
+
+func NewExportStoreCmd(agentConfig config.AgentConfig) *cobra.Command {
+
+	var exportCmd = &cobra.Command{
+		Use:   "export [archive file]",
+		Short: "Export records of topics to an archive file",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			db, err := openReadOnlyStore(agentConfig)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			selectedTopics := make(map[string]bool)
+			for _, topicName := range topics {
+				selectedTopics[topicName] = true
+			}
+			selectedFragments := make(map[uint32]bool)
+			for _, id := range fragmentIds {
+				selectedFragments[uint32(id)] = true
+			}
+
+			file, err := os.OpenFile(args[0], os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+			if err != nil {
+				return err
+			}
+			stats, err := db.ExportArchive(file, func(topic string, fragmentId uint32) bool {
+				return selectedTopics[topic] && (len(selectedFragments) == 0 || selectedFragments[fragmentId])
+			}, decrypt)
+			if err == nil {
+				err = file.Sync()
+			}
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(args[0])
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%d records exported to %s\n", stats.Records, args[0])
+			if stats.Corrupted > 0 {
+				fmt.Fprintf(cmd.OutOrStdout(), "%d corrupted records are not exported\n", stats.Corrupted)
+			}
+			return nil
+		},
+	}
+
+	exportCmd.Flags().StringSliceVarP(&topics, "topic", "t", nil, "topics to export")
+	exportCmd.Flags().UintSliceVarP(&fragmentIds, "fragment", "f", nil, "fragment ids to export (all fragments if not set)")
+	exportCmd.Flags().BoolVar(&decrypt, "decrypt", false, "export encrypted records decrypted by the key file. the archive should be kept safe")
+
+	exportCmd.MarkFlagRequired("topic")
+
+	return exportCmd
+}
+
+func NewImportStoreCmd(agentConfig config.AgentConfig) *cobra.Command {
+
+	var importCmd = &cobra.Command{
+		Use:   "import [archive file]",
+		Short: "Import records of an archive file",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			file, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			db, err := openStore(agentConfig, true)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			// the whole archive is verified before importing not to import a part of it
+			stats, err := db.ImportArchive(file)
+			if err != nil {
+				return err
+			}
+			if err = db.Flush(); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%d of %d records imported (expired: %d, already stored: %d)\n",
+				stats.Imported, stats.Records, stats.Expired, stats.Existing)
+			return nil
+		},
+	}
+
+	return importCmd
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/paust-team/pirius/bootstrapping/broker"
+	"github.com/paust-team/pirius/compression"
 	"github.com/paust-team/pirius/coordinating/zk"
 	"github.com/paust-team/pirius/proto/pb"
 	"github.com/spf13/cobra"
@@ -82,14 +83,40 @@ func NewCreateTopicCmd() *cobra.Command {
 			topicOption := uint32(pb.TopicOption_NONE)
 			if unique {
 				topicOption = uint32(pb.TopicOption_UNIQUE_PER_FRAGMENT)
+				if keyRouting {
+					topicOption |= uint32(pb.TopicOption_KEY_BASED_ROUTING)
+				}
+			} else if keyRouting {
+				return errors.New("key-based routing can be set only for UniquePerFragment topic")
+			}
+			if compacted {
+				if !keyRouting {
+					return errors.New("compaction can be set only for key-based routing topic")
+				}
+				topicOption |= uint32(pb.TopicOption_COMPACTED)
+			}
+			codec, err := compression.ParseCodec(codecName)
+			if err != nil {
+				return err
 			}
 
-			if _, err := topicClient.CreateTopic(ctx, &pb.CreateTopicRequest{
+			request := &pb.CreateTopicRequest{
 				Magic:       1,
 				Name:        topic,
 				Description: "",
 				Options:     &topicOption,
-			}); err != nil {
+			}
+			if retention > 0 {
+				request.RetentionPeriod = &retention
+			}
+			if maxBytes > 0 {
+				request.RetentionMaxBytes = &maxBytes
+			}
+			if codec != compression.None {
+				codecValue := uint32(codec)
+				request.Compression = &codecValue
+			}
+			if _, err := topicClient.CreateTopic(ctx, request); err != nil {
 				return err
 			}
 
@@ -100,6 +127,11 @@ func NewCreateTopicCmd() *cobra.Command {
 
 	createTopicCmd.Flags().StringVarP(&topic, "topic", "t", "", "new topic name to create")
 	createTopicCmd.Flags().BoolVarP(&unique, "unique", "u", false, "set topic as UniquePerFragment")
+	createTopicCmd.Flags().BoolVarP(&keyRouting, "key-routing", "k", false, "route records to fragments by key (UniquePerFragment only)")
+	createTopicCmd.Flags().BoolVarP(&compacted, "compacted", "c", false, "keep only the newest record of each key (key-based routing only)")
+	createTopicCmd.Flags().Uint64VarP(&retention, "retention", "r", 0, "retention period of the topic in seconds (the agent's retention is used if not set)")
+	createTopicCmd.Flags().Uint64Var(&maxBytes, "max-bytes", 0, "max size of the stored records of the topic per publisher")
+	createTopicCmd.Flags().StringVar(&codecName, "compression", "none", "codec compressing the published data: none/snappy/zstd/lz4")
 
 	createTopicCmd.MarkFlagRequired("topic")
 
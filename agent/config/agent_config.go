@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"github.com/paust-team/pirius/constants"
+	"github.com/spf13/cast"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -18,8 +19,31 @@ var (
 	defaultZKTimeout              uint = 3000
 	defaultRetentionPeriod             = 1
 	defaultRetentionCheckInterval uint = 10000
+	defaultMetaCheckpointInterval uint = 1000
+	defaultDedupWindow                 = 0 // disabled
 	defaultDBName                      = "pirius-store"
+	defaultStorageEngine               = "rocksdb"
 	defaultBindAddr                    = "127.0.0.1"
+	defaultAdminPort              uint = 0 // disabled
+	defaultReconnectBackoff            = map[string]interface{}{
+		"initial":      100,   // millisecond
+		"max":          10000, // millisecond
+		"multiplier":   2.0,
+		"jitter":       0.2,
+		"max-attempts": 0, // unlimited
+	}
+	defaultPublishBatch = map[string]interface{}{
+		"max-records":    100,
+		"max-bytes":      1 << 20,
+		"flush-interval": 0, // millisecond. write as soon as no more records are waiting
+	}
+	defaultQuota = map[string]interface{}{
+		"max-bytes": 0, // unlimited
+		"policy":    "drop-oldest",
+	}
+	defaultEncryption = map[string]interface{}{
+		"key-file": "", // not encrypted
+	}
 )
 
 type AgentConfig struct {
@@ -33,17 +57,25 @@ func NewAgentConfig() AgentConfig {
 	v.SetDefault("bind", defaultBindAddr)
 	v.SetDefault("host", defaultBindAddr)
 	v.SetDefault("port", constants.DefaultAgentPort)
+	v.SetDefault("admin-port", defaultAdminPort)
 	v.SetDefault("log-dir", constants.DefaultLogDir)
 	v.SetDefault("data-dir", constants.DefaultDataDir)
 	v.SetDefault("timeout", defaultTimeout)
 	v.SetDefault("log-level", defaultLogLevel)
 	v.SetDefault("retention", defaultRetentionPeriod)
 	v.SetDefault("db-name", defaultDBName)
+	v.SetDefault("storage-engine", defaultStorageEngine)
 	v.SetDefault("zookeeper", map[string]interface{}{
 		"quorum":  defaultZKQuorum,
 		"timeout": defaultZKTimeout,
 	})
 	v.SetDefault("retention-check-interval", defaultRetentionCheckInterval)
+	v.SetDefault("meta-checkpoint-interval", defaultMetaCheckpointInterval)
+	v.SetDefault("dedup-window", defaultDedupWindow)
+	v.SetDefault("reconnect-backoff", defaultReconnectBackoff)
+	v.SetDefault("publish-batch", defaultPublishBatch)
+	v.SetDefault("quota", defaultQuota)
+	v.SetDefault("encryption", defaultEncryption)
 
 	return AgentConfig{v}
 }
@@ -89,6 +121,15 @@ func (b AgentConfig) SetPort(port uint) {
 	b.Set("port", port)
 }
 
+// AdminPort is the port of the admin API served on the loopback address only. 0 means the admin API is disabled
+func (b AgentConfig) AdminPort() uint {
+	return b.GetUint("admin-port")
+}
+
+func (b AgentConfig) SetAdminPort(port uint) {
+	b.Set("admin-port", port)
+}
+
 func (b AgentConfig) LogDir() string {
 	return replaceTildeToHomePath(b.GetString("log-dir"))
 }
@@ -113,6 +154,15 @@ func (b AgentConfig) SetDBName(name string) {
 	b.Set("db-name", name)
 }
 
+// StorageEngine returns the engine to store records: rocksdb or memory
+func (b AgentConfig) StorageEngine() string {
+	return b.GetString("storage-engine")
+}
+
+func (b AgentConfig) SetStorageEngine(engine string) {
+	b.Set("storage-engine", engine)
+}
+
 func (b AgentConfig) RetentionPeriod() uint32 {
 	return b.GetUint32("retention")
 }
@@ -153,6 +203,185 @@ func (b AgentConfig) SetRetentionCheckInterval(interval uint) {
 	b.Set("retention-check-interval", interval)
 }
 
+func (b AgentConfig) MetaCheckpointInterval() uint {
+	return b.GetUint("meta-checkpoint-interval")
+}
+
+func (b AgentConfig) SetMetaCheckpointInterval(interval uint) {
+	b.Set("meta-checkpoint-interval", interval)
+}
+
+// DedupWindow returns the number of recent SeqNums kept per topic to drop duplicated records. 0 disables deduplication
+func (b AgentConfig) DedupWindow() int {
+	return b.GetInt("dedup-window")
+}
+
+func (b AgentConfig) SetDedupWindow(size int) {
+	b.Set("dedup-window", size)
+}
+
+func (b AgentConfig) ReconnectInitialBackoff() uint {
+	return b.GetUint("reconnect-backoff.initial")
+}
+
+func (b AgentConfig) SetReconnectInitialBackoff(backoff uint) {
+	b.Set("reconnect-backoff.initial", backoff)
+}
+
+func (b AgentConfig) ReconnectMaxBackoff() uint {
+	return b.GetUint("reconnect-backoff.max")
+}
+
+func (b AgentConfig) SetReconnectMaxBackoff(backoff uint) {
+	b.Set("reconnect-backoff.max", backoff)
+}
+
+func (b AgentConfig) ReconnectBackoffMultiplier() float64 {
+	return b.GetFloat64("reconnect-backoff.multiplier")
+}
+
+func (b AgentConfig) SetReconnectBackoffMultiplier(multiplier float64) {
+	b.Set("reconnect-backoff.multiplier", multiplier)
+}
+
+func (b AgentConfig) ReconnectBackoffJitter() float64 {
+	return b.GetFloat64("reconnect-backoff.jitter")
+}
+
+func (b AgentConfig) SetReconnectBackoffJitter(jitter float64) {
+	b.Set("reconnect-backoff.jitter", jitter)
+}
+
+func (b AgentConfig) ReconnectMaxAttempts() uint {
+	return b.GetUint("reconnect-backoff.max-attempts")
+}
+
+func (b AgentConfig) SetReconnectMaxAttempts(attempts uint) {
+	b.Set("reconnect-backoff.max-attempts", attempts)
+}
+
+func (b AgentConfig) PublishBatchMaxRecords() int {
+	return b.GetInt("publish-batch.max-records")
+}
+
+func (b AgentConfig) SetPublishBatchMaxRecords(maxRecords int) {
+	b.Set("publish-batch.max-records", maxRecords)
+}
+
+func (b AgentConfig) PublishBatchMaxBytes() int {
+	return b.GetInt("publish-batch.max-bytes")
+}
+
+func (b AgentConfig) SetPublishBatchMaxBytes(maxBytes int) {
+	b.Set("publish-batch.max-bytes", maxBytes)
+}
+
+func (b AgentConfig) PublishBatchFlushInterval() uint {
+	return b.GetUint("publish-batch.flush-interval")
+}
+
+func (b AgentConfig) SetPublishBatchFlushInterval(interval uint) {
+	b.Set("publish-batch.flush-interval", interval)
+}
+
+// StoreQuotaMaxBytes returns the max size of the agent store. 0 means unlimited
+func (b AgentConfig) StoreQuotaMaxBytes() uint64 {
+	return b.GetUint64("quota.max-bytes")
+}
+
+func (b AgentConfig) SetStoreQuotaMaxBytes(maxBytes uint64) {
+	b.Set("quota.max-bytes", maxBytes)
+}
+
+// StoreQuotaPolicy returns the policy applied when the store is over quota: drop-oldest, block or reject
+func (b AgentConfig) StoreQuotaPolicy() string {
+	return b.GetString("quota.policy")
+}
+
+func (b AgentConfig) SetStoreQuotaPolicy(policy string) {
+	b.Set("quota.policy", policy)
+}
+
+// EncryptionKeyFile returns the path of the key file to encrypt records. records are not encrypted when it is empty
+func (b AgentConfig) EncryptionKeyFile() string {
+	return replaceTildeToHomePath(b.GetString("encryption.key-file"))
+}
+
+func (b AgentConfig) SetEncryptionKeyFile(path string) {
+	b.Set("encryption.key-file", path)
+}
+
+// TopicRetentionPeriod returns the local retention period(second) of the topic. 0 means the topic policy is used
+func (b AgentConfig) TopicRetentionPeriod(topicName string) uint64 {
+	return b.GetUint64("topics." + topicName + ".retention-period")
+}
+
+func (b AgentConfig) SetTopicRetentionPeriod(topicName string, period uint64) {
+	b.Set("topics."+topicName+".retention-period", period)
+}
+
+// TopicRetentionMaxBytes returns the local max size of the topic. 0 means the topic policy is used
+func (b AgentConfig) TopicRetentionMaxBytes(topicName string) uint64 {
+	return b.GetUint64("topics." + topicName + ".retention-max-bytes")
+}
+
+func (b AgentConfig) SetTopicRetentionMaxBytes(topicName string, maxBytes uint64) {
+	b.Set("topics."+topicName+".retention-max-bytes", maxBytes)
+}
+
+// TopicRecordsPerSec returns the max records per second sent to subscribers of the topic. 0 means unlimited
+func (b AgentConfig) TopicRecordsPerSec(topicName string) uint64 {
+	return b.GetUint64("topics." + topicName + ".rate-limit.records-per-sec")
+}
+
+func (b AgentConfig) SetTopicRecordsPerSec(topicName string, recordsPerSec uint64) {
+	b.Set("topics."+topicName+".rate-limit.records-per-sec", recordsPerSec)
+}
+
+// TopicBytesPerSec returns the max bytes per second sent to subscribers of the topic. 0 means unlimited
+func (b AgentConfig) TopicBytesPerSec(topicName string) uint64 {
+	return b.GetUint64("topics." + topicName + ".rate-limit.bytes-per-sec")
+}
+
+func (b AgentConfig) SetTopicBytesPerSec(topicName string, bytesPerSec uint64) {
+	b.Set("topics."+topicName+".rate-limit.bytes-per-sec", bytesPerSec)
+}
+
+// SubscriberRecordsPerSec returns the max records per second sent to the subscribers of the host. 0 means unlimited
+func (b AgentConfig) SubscriberRecordsPerSec(host string) uint64 {
+	return b.subscriberRateLimit(host, "records-per-sec")
+}
+
+func (b AgentConfig) SetSubscriberRecordsPerSec(host string, recordsPerSec uint64) {
+	b.setSubscriberRateLimit(host, "records-per-sec", recordsPerSec)
+}
+
+// SubscriberBytesPerSec returns the max bytes per second sent to the subscribers of the host. 0 means unlimited
+func (b AgentConfig) SubscriberBytesPerSec(host string) uint64 {
+	return b.subscriberRateLimit(host, "bytes-per-sec")
+}
+
+func (b AgentConfig) SetSubscriberBytesPerSec(host string, bytesPerSec uint64) {
+	b.setSubscriberRateLimit(host, "bytes-per-sec", bytesPerSec)
+}
+
+// subscriberRateLimit looks up the host in the map of subscribers, as the dots of a host address are not key delimiters
+func (b AgentConfig) subscriberRateLimit(host string, field string) uint64 {
+	subscriber := cast.ToStringMap(b.GetStringMap("subscribers")[strings.ToLower(host)])
+	return cast.ToUint64(cast.ToStringMap(subscriber["rate-limit"])[field])
+}
+
+func (b AgentConfig) setSubscriberRateLimit(host string, field string, value uint64) {
+	host = strings.ToLower(host)
+	subscribers := b.GetStringMap("subscribers")
+	subscriber := cast.ToStringMap(subscribers[host])
+	rateLimit := cast.ToStringMap(subscriber["rate-limit"])
+	rateLimit[field] = value
+	subscriber["rate-limit"] = rateLimit
+	subscribers[host] = subscriber
+	b.Set("subscribers", subscribers)
+}
+
 func replaceTildeToHomePath(dir string) string {
 	if strings.HasPrefix(dir, "~/") {
 		home, _ := os.UserHomeDir()
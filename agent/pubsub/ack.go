@@ -0,0 +1,145 @@
+package pubsub
+
+import (
+	"context"
+	"github.com/paust-team/pirius/agent/storage"
+	"github.com/paust-team/pirius/constants"
+	"sync"
+)
+
+// pendingRecord is a delivered record waiting for an acknowledgement
+type pendingRecord struct {
+	tracker    *ackTracker
+	fragmentId uint
+	offset     uint64
+	acked      bool
+	released   bool // released records are redelivered, so acknowledgements for them are ignored
+	onNack     func()
+}
+
+func (r *pendingRecord) ack() {
+	r.tracker.ack(r)
+}
+
+func (r *pendingRecord) nack() {
+	r.tracker.mu.Lock()
+	released := r.released
+	r.tracker.mu.Unlock()
+	if !released {
+		r.onNack()
+	}
+}
+
+// ackTracker commits subscribed offsets only when the records are acknowledged.
+// Delivery waits while maxPending records are not committed, so records of callers not acknowledging are not piled up
+type ackTracker struct {
+	mu         sync.Mutex
+	topicName  string
+	committed  storage.TopicFragmentOffsets
+	pending    map[uint][]*pendingRecord // delivered records not committed yet, in offset order
+	numPending int
+	maxPending int
+	freed      chan struct{} // closed when pending records are committed or released
+}
+
+func newAckTracker(topicName string, committed storage.TopicFragmentOffsets) *ackTracker {
+	return &ackTracker{
+		topicName:  topicName,
+		committed:  committed,
+		pending:    make(map[uint][]*pendingRecord),
+		maxPending: constants.MaxUnackedRecords,
+		freed:      make(chan struct{}),
+	}
+}
+
+// waitCapacity blocks until the number of pending records is under the limit.
+// A whole batch is tracked after waiting, so the limit can be exceeded by a batch
+func (t *ackTracker) waitCapacity(ctx context.Context) error {
+	for {
+		t.mu.Lock()
+		if t.numPending < t.maxPending {
+			t.mu.Unlock()
+			return nil
+		}
+		freed := t.freed
+		t.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-freed:
+		}
+	}
+}
+
+// track registers a delivered record. onNack is called when the record is not acknowledged
+func (t *ackTracker) track(fragmentId uint, offset uint64, onNack func()) *pendingRecord {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	record := &pendingRecord{
+		tracker:    t,
+		fragmentId: fragmentId,
+		offset:     offset,
+		onNack:     onNack,
+	}
+	t.pending[fragmentId] = append(t.pending[fragmentId], record)
+	t.numPending++
+	return record
+}
+
+// ack commits the offsets of the fragment up to the last contiguously acknowledged record
+func (t *ackTracker) ack(record *pendingRecord) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if record.released {
+		return
+	}
+	record.acked = true
+
+	records := t.pending[record.fragmentId]
+	committed := 0
+	for committed < len(records) && records[committed].acked {
+		committed++
+	}
+	if committed > 0 {
+		t.committed.Store(storage.NewFragmentKey(t.topicName, record.fragmentId), records[committed-1].offset)
+		t.pending[record.fragmentId] = records[committed:]
+		t.free(committed)
+	}
+}
+
+// reset releases all unacknowledged records of the fragments. they will be redelivered from the committed offsets
+func (t *ackTracker) reset(fragmentIds []uint) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, fragmentId := range fragmentIds {
+		t.release(fragmentId)
+	}
+}
+
+func (t *ackTracker) resetAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for fragmentId := range t.pending {
+		t.release(fragmentId)
+	}
+}
+
+// release should be called with lock held
+func (t *ackTracker) release(fragmentId uint) {
+	for _, record := range t.pending[fragmentId] {
+		record.released = true
+	}
+	t.free(len(t.pending[fragmentId]))
+	delete(t.pending, fragmentId)
+}
+
+// free wakes up streams waiting for capacity. it should be called with lock held
+func (t *ackTracker) free(n int) {
+	if n == 0 {
+		return
+	}
+	t.numPending -= n
+	close(t.freed)
+	t.freed = make(chan struct{})
+}
@@ -0,0 +1,79 @@
+package pubsub
+
+import (
+	"context"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/paust-team/pirius/agent/storage"
+	"time"
+)
+
+var _ = Describe("AckTracker", func() {
+	var tracker *ackTracker
+	var committed storage.TopicFragmentOffsets
+	topicName := "acked"
+	fragKey := storage.NewFragmentKey(topicName, 1)
+
+	committedOffset := func() uint64 {
+		value, ok := committed.Load(fragKey)
+		if !ok {
+			return 0
+		}
+		return value.(uint64)
+	}
+
+	BeforeEach(func() {
+		committed = storage.NewTopicFragmentOffsets(map[storage.FragmentKey]uint64{})
+		tracker = newAckTracker(topicName, committed)
+		tracker.maxPending = 2
+	})
+
+	It("commits offsets acknowledged contiguously", func() {
+		first := tracker.track(1, 1, func() {})
+		second := tracker.track(1, 2, func() {})
+
+		second.ack()
+		Expect(committedOffset()).To(Equal(uint64(0)))
+		first.ack()
+		Expect(committedOffset()).To(Equal(uint64(2)))
+	})
+
+	When("unacknowledged records reach the limit", func() {
+		var first *pendingRecord
+
+		BeforeEach(func() {
+			first = tracker.track(1, 1, func() {})
+			tracker.track(1, 2, func() {})
+		})
+
+		It("waits until a record is committed", func() {
+			waited := make(chan error)
+			go func() {
+				waited <- tracker.waitCapacity(context.Background())
+			}()
+			Consistently(waited, 100*time.Millisecond).ShouldNot(Receive())
+
+			first.ack()
+			Eventually(waited).Should(Receive(BeNil()))
+		})
+
+		It("waits until the records are released", func() {
+			waited := make(chan error)
+			go func() {
+				waited <- tracker.waitCapacity(context.Background())
+			}()
+			Consistently(waited, 100*time.Millisecond).ShouldNot(Receive())
+
+			tracker.reset([]uint{1})
+			Eventually(waited).Should(Receive(BeNil()))
+			first.ack()
+			Expect(committedOffset()).To(Equal(uint64(0)))
+		})
+
+		It("stops waiting when the stream is canceled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			Expect(tracker.waitCapacity(ctx)).To(MatchError(context.Canceled))
+		})
+	})
+})
@@ -0,0 +1,51 @@
+package pubsub
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// ReconnectPolicy decides delays between reconnect attempts to a publisher
+type ReconnectPolicy struct {
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	Jitter         float64 // randomization factor in [0, 1]
+	MaxAttempts    uint    // 0 means retrying until the subscription is stopped
+}
+
+// Delay returns the exponential backoff of the attempt(starting from 0) randomized by jitter
+func (p ReconnectPolicy) Delay(attempt uint) time.Duration {
+	delay := float64(p.InitialBackoff) * math.Pow(p.Multiplier, float64(attempt))
+	if delay > float64(p.MaxBackoff) {
+		delay = float64(p.MaxBackoff)
+	}
+	// randomize within [delay*(1-jitter), delay*(1+jitter)] not to reconnect at the same time
+	delay *= 1 + p.Jitter*(2*rand.Float64()-1)
+	return time.Duration(delay)
+}
+
+// backoff counts consecutive reconnect attempts of a stream
+type backoff struct {
+	policy   ReconnectPolicy
+	attempts uint
+}
+
+func newBackoff(policy ReconnectPolicy) *backoff {
+	return &backoff{policy: policy}
+}
+
+// next returns the delay before the next attempt. it returns false when attempts are exhausted
+func (b *backoff) next() (time.Duration, bool) {
+	if b.policy.MaxAttempts > 0 && b.attempts >= b.policy.MaxAttempts {
+		return 0, false
+	}
+	delay := b.policy.Delay(b.attempts)
+	b.attempts++
+	return delay, true
+}
+
+func (b *backoff) reset() {
+	b.attempts = 0
+}
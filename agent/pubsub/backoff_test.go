@@ -0,0 +1,84 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/paust-team/pirius/qerror"
+	"time"
+)
+
+var _ = Describe("ReconnectPolicy", func() {
+
+	Describe("Calculating backoff delays", func() {
+		var policy ReconnectPolicy
+
+		BeforeEach(func() {
+			policy = ReconnectPolicy{
+				InitialBackoff: 100 * time.Millisecond,
+				MaxBackoff:     time.Second,
+				Multiplier:     2,
+				Jitter:         0.2,
+			}
+		})
+
+		It("grows exponentially within jitter", func() {
+			for attempt, expected := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond} {
+				delay := policy.Delay(uint(attempt))
+				Expect(delay).To(BeNumerically(">=", time.Duration(float64(expected)*0.8)))
+				Expect(delay).To(BeNumerically("<=", time.Duration(float64(expected)*1.2)))
+			}
+		})
+
+		It("does not exceed the max backoff with jitter", func() {
+			for attempt := uint(0); attempt < 20; attempt++ {
+				Expect(policy.Delay(attempt)).To(BeNumerically("<=", time.Duration(float64(policy.MaxBackoff)*1.2)))
+			}
+		})
+	})
+
+	Describe("Reconnecting a stream", func() {
+		var subscriber subscriberBase
+		var bo *backoff
+		cause := errors.New("stream closed")
+
+		BeforeEach(func() {
+			subscriber = subscriberBase{id: "reconnecting"}
+			bo = newBackoff(ReconnectPolicy{
+				InitialBackoff: time.Millisecond,
+				MaxBackoff:     time.Millisecond,
+				Multiplier:     2,
+				MaxAttempts:    2,
+			})
+		})
+
+		It("gives up when the attempts are exhausted", func() {
+			Expect(subscriber.waitReconnect(context.Background(), bo, "topic", "endpoint", cause)).To(Succeed())
+			Expect(subscriber.waitReconnect(context.Background(), bo, "topic", "endpoint", cause)).To(Succeed())
+
+			err := subscriber.waitReconnect(context.Background(), bo, "topic", "endpoint", cause)
+			var reconnectErr qerror.ReconnectFailedError
+			Expect(errors.As(err, &reconnectErr)).To(BeTrue())
+			Expect(reconnectErr.Attempts).To(Equal(uint(2)))
+		})
+
+		It("starts over from the initial backoff after the stream is reopened", func() {
+			Expect(subscriber.waitReconnect(context.Background(), bo, "topic", "endpoint", cause)).To(Succeed())
+			Expect(subscriber.waitReconnect(context.Background(), bo, "topic", "endpoint", cause)).To(Succeed())
+			subscriber.onStreamOpened(bo, "topic", "endpoint")
+
+			Expect(bo.attempts).To(BeZero())
+			Expect(subscriber.waitReconnect(context.Background(), bo, "topic", "endpoint", cause)).To(Succeed())
+		})
+
+		It("stops waiting when the subscription is stopped", func() {
+			bo.policy.InitialBackoff = time.Hour
+			bo.policy.MaxBackoff = time.Hour
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			Expect(subscriber.waitReconnect(ctx, bo, "topic", "endpoint", cause)).To(MatchError(context.Canceled))
+		})
+	})
+})
@@ -0,0 +1,55 @@
+package pubsub
+
+import (
+	"github.com/paust-team/pirius/agent/storage"
+	"github.com/paust-team/pirius/compression"
+	"github.com/paust-team/pirius/proto/pb"
+)
+
+// supportedCompressions are the codecs subscribers can decompress
+func supportedCompressions() []pb.Compression {
+	var compressions []pb.Compression
+	for _, codec := range compression.Codecs {
+		compressions = append(compressions, pb.Compression(codec))
+	}
+	return compressions
+}
+
+// acceptedCodecs are the codecs a subscriber negotiated with the Subscription.
+// Records are compressed one by one when they are published, not as a batch when it is flushed,
+// so the stored form of each record is sent without re-encoding
+type acceptedCodecs map[pb.Compression]bool
+
+func newAcceptedCodecs(compressions []pb.Compression) acceptedCodecs {
+	accepted := acceptedCodecs{pb.Compression_NONE: true}
+	for _, c := range compressions {
+		accepted[c] = true
+	}
+	return accepted
+}
+
+// negotiate returns the record to send to the subscriber. records compressed by a codec not accepted are sent decompressed.
+// fetched records can be shared by streams, so they are not modified
+func (a acceptedCodecs) negotiate(fetched *pb.SubscriptionResult_Fetched) (*pb.SubscriptionResult_Fetched, error) {
+	if a[fetched.Compression] {
+		return fetched, nil
+	}
+	data, err := compression.Decompress(compression.Codec(fetched.Compression), fetched.Data)
+	if err != nil {
+		return nil, err
+	}
+	decompressed := &pb.SubscriptionResult_Fetched{
+		FragmentId: fetched.FragmentId,
+		Offset:     fetched.Offset,
+		SeqNum:     fetched.SeqNum,
+		Data:       data,
+		Key:        fetched.Key,
+		Timestamp:  fetched.Timestamp,
+		Headers:    fetched.Headers,
+	}
+	if fetched.Checksum != nil {
+		checksum := storage.FieldsChecksum(fetched.SeqNum, fetched.Timestamp, fetched.Key, fetched.Headers, data)
+		decompressed.Checksum = &checksum
+	}
+	return decompressed, nil
+}
@@ -0,0 +1,84 @@
+package pubsub
+
+import (
+	"context"
+	"github.com/paust-team/pirius/qerror"
+	"sync"
+)
+
+// drainer stops publications and subscription streams of a publisher gracefully.
+// Publications are drained first, so subscription streams can send all records written by them
+type drainer struct {
+	mu           sync.Mutex
+	publications sync.WaitGroup // publications not drained yet
+	publishing   chan struct{}  // closed to drain publications
+	streaming    chan struct{}  // closed to drain subscription streams
+	streamOnce   sync.Once
+}
+
+func newDrainer() *drainer {
+	return &drainer{
+		publishing: make(chan struct{}),
+		streaming:  make(chan struct{}),
+	}
+}
+
+// startPublication registers a publication. the returned function should be called when the publication is drained or stopped
+func (d *drainer) startPublication() (func(), error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	select {
+	case <-d.publishing:
+		return nil, qerror.InvalidStateError{State: "publisher is draining"}
+	default:
+	}
+	d.publications.Add(1)
+	var once sync.Once
+	return func() { once.Do(d.publications.Done) }, nil
+}
+
+// DrainPublications makes publications write the records waiting in their streams and stop. New publications are rejected
+// after it is called. It waits until all publications are drained or ctx is done
+func (p publisherBase) DrainPublications(ctx context.Context) error {
+	p.drainer.mu.Lock()
+	select {
+	case <-p.drainer.publishing:
+	default:
+		close(p.drainer.publishing)
+	}
+	p.drainer.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		p.drainer.publications.Wait()
+		close(drained)
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-drained:
+		return nil
+	}
+}
+
+// DrainStreams makes subscription streams send the records written so far without waiting for full batches, and close
+func (p publisherBase) DrainStreams() {
+	p.drainer.streamOnce.Do(func() { close(p.drainer.streaming) })
+}
+
+// drainPublication writes the records waiting in the stream
+func (p publisherBase) drainPublication(ctx context.Context, batch *publishBatch, inStream chan TopicData,
+	getFragmentsToWrite func(key []byte) []uint, errCh chan error) error {
+	for {
+		opened := p.gatherRecords(batch, inStream, getFragmentsToWrite)
+		if batch.isEmpty() {
+			return nil
+		}
+		if err := p.flushBatch(ctx, batch, errCh); err != nil {
+			return err
+		}
+		if !opened {
+			return nil
+		}
+	}
+}
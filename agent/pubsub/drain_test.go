@@ -0,0 +1,114 @@
+package pubsub
+
+import (
+	"context"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/paust-team/pirius/agent/storage"
+	"github.com/paust-team/pirius/proto/pb"
+	"sync"
+	"time"
+)
+
+type collectingSender struct {
+	ctx     context.Context
+	mu      sync.Mutex
+	offsets []uint64
+}
+
+func (s *collectingSender) Send(result *pb.SubscriptionResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, record := range result.Results {
+		s.offsets = append(s.offsets, record.Offset)
+	}
+	return nil
+}
+
+func (s *collectingSender) Context() context.Context {
+	return s.ctx
+}
+
+func (s *collectingSender) sentOffsets() []uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]uint64(nil), s.offsets...)
+}
+
+var _ = Describe("Draining subscription streams", func() {
+	var db *storage.DB
+	var publishedOffsets storage.TopicFragmentOffsets
+	var publisher *Publisher
+	var sender *collectingSender
+	var cancel context.CancelFunc
+	topicName := "draining"
+	fragmentId := uint32(1)
+	fragKey := storage.NewFragmentKey(topicName, uint(fragmentId))
+
+	putRecord := func(offset uint64) {
+		Expect(db.PutRecord(topicName, fragmentId, offset, offset, []byte("record"), storage.GetNowTimestamp()+3600)).To(Succeed())
+		publishedOffsets.Store(fragKey, offset+1)
+	}
+	putCorruptedRecord := func(offset uint64) {
+		value := storage.NewRecordValueFromData(offset, []byte("record"))
+		value.Data()[value.Size()-1] ^= 0x01
+		Expect(db.PutRecordValue(topicName, fragmentId, offset, value, storage.GetNowTimestamp()+3600)).To(Succeed())
+		publishedOffsets.Store(fragKey, offset+1)
+	}
+	subscribe := func() chan error {
+		startOffset := uint64(1)
+		subscription := &pb.Subscription{
+			TopicName:    topicName,
+			Offsets:      []*pb.Subscription_FragmentOffset{{FragmentId: fragmentId, StartOffset: &startOffset}},
+			MaxBatchSize: 10,
+		}
+		done := make(chan error, 1)
+		go func() {
+			done <- publisher.subscribe(subscription, sender, newStreamCredit(nil))
+		}()
+		return done
+	}
+
+	BeforeEach(func() {
+		var err error
+		db, err = storage.NewDB(storage.MemoryEngine, "draining", ".")
+		Expect(err).NotTo(HaveOccurred())
+		publishedOffsets = storage.TopicFragmentOffsets{Map: &sync.Map{}}
+		p := NewPublisher("drain-test", "", db, nil, publishedOffsets, storage.TopicFragmentOffsets{Map: &sync.Map{}},
+			storage.NewDedupWindows(0), nil, BatchPolicy{}, StoreQuota{})
+		publisher = &p
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		sender = &collectingSender{ctx: ctx}
+	})
+	AfterEach(func() {
+		cancel()
+		publisher.Wait()
+		db.Close()
+		db.Destroy()
+	})
+
+	It("stops with a skipped record at the end of a fragment", func() {
+		putRecord(1)
+		putRecord(2)
+		putCorruptedRecord(3)
+
+		publisher.DrainStreams()
+		done := subscribe()
+		Eventually(done, time.Second).Should(Receive(BeNil()))
+		Expect(sender.sentOffsets()).To(Equal([]uint64{1, 2}))
+	})
+
+	It("stops with a skipped record at the end of a fragment followed by the shared reader", func() {
+		putRecord(1)
+		putRecord(2)
+		done := subscribe()
+		Eventually(sender.sentOffsets, time.Second).Should(Equal([]uint64{1, 2}))
+
+		putCorruptedRecord(3)
+		publisher.notifier.Notify(fragKey)
+		publisher.DrainStreams()
+		Eventually(done, time.Second).Should(Receive(BeNil()))
+		Expect(sender.sentOffsets()).To(Equal([]uint64{1, 2}))
+	})
+})
@@ -0,0 +1,157 @@
+package pubsub
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"github.com/paust-team/pirius/agent/storage"
+	"github.com/paust-team/pirius/proto/pb"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/protobuf/proto"
+	"sync"
+)
+
+// WithCredit enables flow control of the subscription. Publishers send at most `records` records and `bytes` bytes
+// not delivered yet, and the credit is granted again as the records are delivered. bytes of 0 means no limit of bytes
+func WithCredit(records uint32, bytes uint64) SubscriptionOption {
+	return func(p *startPositions) {
+		p.credit = &pb.Credit{Records: records, Bytes: bytes}
+	}
+}
+
+// creditOf returns the credit taken by the records
+func creditOf(records []*pb.SubscriptionResult_Fetched) *pb.Credit {
+	credit := &pb.Credit{Records: uint32(len(records))}
+	for _, record := range records {
+		credit.Bytes += uint64(proto.Size(record))
+	}
+	return credit
+}
+
+// streamCredit is the credit granted by the subscriber of a stream.
+// A stream without initial credit is not flow-controlled
+type streamCredit struct {
+	mu         sync.Mutex
+	enabled    bool
+	limitBytes bool
+	records    int64
+	bytes      int64         // can be negative as a record larger than the remaining bytes is sent
+	granted    chan struct{} // wakes up the stream waiting for credit
+}
+
+func newStreamCredit(initial *pb.Credit) *streamCredit {
+	c := &streamCredit{granted: make(chan struct{}, 1)}
+	if initial != nil {
+		c.enabled = true
+		c.limitBytes = initial.Bytes > 0
+		c.records = int64(initial.Records)
+		c.bytes = int64(initial.Bytes)
+	}
+	return c
+}
+
+func (c *streamCredit) grant(credit *pb.Credit) {
+	if !c.enabled {
+		return
+	}
+	c.mu.Lock()
+	c.records += int64(credit.Records)
+	c.bytes += int64(credit.Bytes)
+	c.mu.Unlock()
+
+	select {
+	case c.granted <- struct{}{}:
+	default:
+	}
+}
+
+// allows returns true if a record can be sent
+func (c *streamCredit) allows() bool {
+	if !c.enabled {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.records > 0 && (!c.limitBytes || c.bytes > 0)
+}
+
+// consume takes the credit of the record to be sent
+func (c *streamCredit) consume(record *pb.SubscriptionResult_Fetched) {
+	if !c.enabled {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.records--
+	if c.limitBytes {
+		c.bytes -= int64(proto.Size(record))
+	}
+}
+
+// streamLag exports the number of records a subscription stream falls behind the tail of each fragment
+// as `subscription_lag` of `pirius_publisher`, keyed by <topic>/<fragment id>/<subscriber address>
+type streamLag struct {
+	topicName   string
+	peerAddr    string
+	nextOffsets map[uint32]uint64 // next offset to be sent of each fragment
+}
+
+func newStreamLag(stream interface{ Context() context.Context }, topicName string) *streamLag {
+	peerAddr := "unknown"
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		peerAddr = p.Addr.String()
+	}
+	return &streamLag{topicName: topicName, peerAddr: peerAddr, nextOffsets: make(map[uint32]uint64)}
+}
+
+func (l *streamLag) start(fragmentId uint32, offset uint64) {
+	l.nextOffsets[fragmentId] = offset
+}
+
+func (l *streamLag) onSent(records []*pb.SubscriptionResult_Fetched) {
+	for _, record := range records {
+		l.advance(record.FragmentId, record.Offset)
+	}
+}
+
+// skip advances the lag over a record which is not sent, as it is deleted or cannot be read
+func (l *streamLag) skip(fragmentId uint32, offset uint64) {
+	l.advance(fragmentId, offset)
+}
+
+// advance does not move the next offset back, since a record batched before a skipped record can be sent after it
+func (l *streamLag) advance(fragmentId uint32, offset uint64) {
+	if nextOffset, ok := l.nextOffsets[fragmentId]; !ok || nextOffset <= offset {
+		l.nextOffsets[fragmentId] = offset + 1
+	}
+}
+
+func (l *streamLag) update(publishedOffsets storage.TopicFragmentOffsets) {
+	for fragmentId, nextOffset := range l.nextOffsets {
+		lag := new(expvar.Int)
+		if value, ok := publishedOffsets.Load(storage.NewFragmentKey(l.topicName, uint(fragmentId))); ok && value.(uint64) > nextOffset {
+			lag.Set(int64(value.(uint64) - nextOffset))
+		}
+		subscriptionLags.Set(l.key(fragmentId), lag)
+	}
+}
+
+// caughtUp returns true if all records written to the fragments are sent
+func (l *streamLag) caughtUp(publishedOffsets storage.TopicFragmentOffsets) bool {
+	for fragmentId, nextOffset := range l.nextOffsets {
+		if value, ok := publishedOffsets.Load(storage.NewFragmentKey(l.topicName, uint(fragmentId))); ok && value.(uint64) > nextOffset {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *streamLag) clear() {
+	for fragmentId := range l.nextOffsets {
+		subscriptionLags.Delete(l.key(fragmentId))
+	}
+}
+
+func (l *streamLag) key(fragmentId uint32) string {
+	return fmt.Sprintf("%s/%d/%s", l.topicName, fragmentId, l.peerAddr)
+}
@@ -0,0 +1,263 @@
+package pubsub
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/paust-team/pirius/agent/storage"
+	"github.com/paust-team/pirius/constants"
+	"github.com/paust-team/pirius/logger"
+	"github.com/paust-team/pirius/proto/pb"
+	"github.com/paust-team/pirius/qerror"
+	"go.uber.org/zap"
+	"sync"
+	"unsafe"
+)
+
+// fetchedRecord is a record fetched for a subscription stream. A skipped record is not sent to the subscriber,
+// but passed to the stream in order with the other records, so the stream advances its lag over the offset
+type fetchedRecord struct {
+	*pb.SubscriptionResult_Fetched
+	skipped bool
+}
+
+func newSkippedRecord(fragmentId uint32, offset uint64) fetchedRecord {
+	return fetchedRecord{SubscriptionResult_Fetched: &pb.SubscriptionResult_Fetched{FragmentId: fragmentId, Offset: offset}, skipped: true}
+}
+
+// readerStream is a subscription stream attached to a shared fragment reader
+type readerStream struct {
+	nextOffset uint64
+	recordCh   chan fetchedRecord
+}
+
+// fragmentReader reads newly written records of a fragment once and fans them out to attached streams
+type fragmentReader struct {
+	topicName  string
+	fragmentId uint32
+	nextOffset uint64 // next offset to be read from the storage
+	streams    map[*readerStream]struct{}
+	done       chan struct{}
+}
+
+// fragmentReaders manages shared tail readers for each fragment
+type fragmentReaders struct {
+	mu       sync.Mutex
+	db       *storage.DB
+	notifier *fragmentNotifier
+	readers  map[storage.FragmentKey]*fragmentReader
+}
+
+func newFragmentReaders(db *storage.DB, notifier *fragmentNotifier) *fragmentReaders {
+	return &fragmentReaders{
+		db:       db,
+		notifier: notifier,
+		readers:  make(map[storage.FragmentKey]*fragmentReader),
+	}
+}
+
+// attach registers a stream starting from `offset` to the shared reader of the fragment.
+// It fails when the shared reader has already passed the offset, then the stream should catch up by itself.
+func (f *fragmentReaders) attach(wg *sync.WaitGroup, topicName string, fragmentId uint32, offset uint64) (*readerStream, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fragKey := storage.NewFragmentKey(topicName, uint(fragmentId))
+	reader, ok := f.readers[fragKey]
+	if !ok {
+		reader = &fragmentReader{
+			topicName:  topicName,
+			fragmentId: fragmentId,
+			nextOffset: offset,
+			streams:    make(map[*readerStream]struct{}),
+			done:       make(chan struct{}),
+		}
+		f.readers[fragKey] = reader
+		f.run(wg, fragKey, reader)
+	} else if reader.nextOffset > offset {
+		return nil, false
+	}
+
+	stream := &readerStream{
+		nextOffset: offset,
+		recordCh:   make(chan fetchedRecord, constants.FragmentReaderBufferSize),
+	}
+	reader.streams[stream] = struct{}{}
+	return stream, true
+}
+
+// detach unregisters the stream from the shared reader of the fragment
+func (f *fragmentReaders) detach(topicName string, fragmentId uint32, stream *readerStream) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fragKey := storage.NewFragmentKey(topicName, uint(fragmentId))
+	if reader, ok := f.readers[fragKey]; ok {
+		f.removeStream(fragKey, reader, stream)
+	}
+}
+
+// removeStream should be called with lock held
+func (f *fragmentReaders) removeStream(fragKey storage.FragmentKey, reader *fragmentReader, stream *readerStream) {
+	if _, ok := reader.streams[stream]; !ok {
+		return
+	}
+	delete(reader.streams, stream)
+	close(stream.recordCh)
+
+	// stop the reader when no streams are attached
+	if len(reader.streams) == 0 && f.readers[fragKey] == reader {
+		delete(f.readers, fragKey)
+		close(reader.done)
+	}
+}
+
+// run starts the reader goroutine. it should be called with lock held
+func (f *fragmentReaders) run(wg *sync.WaitGroup, fragKey storage.FragmentKey, reader *fragmentReader) {
+	prefix := newFragmentPrefix(reader.topicName, reader.fragmentId)
+
+	currentOffset := reader.nextOffset
+	prevKey := storage.NewRecordKeyFromData(reader.topicName, reader.fragmentId, currentOffset)
+	it := f.db.Scan(storage.RecordCF)
+
+	logger.Debug("start shared fragment reader",
+		zap.String("topic", reader.topicName),
+		zap.Uint32("fragmentId", reader.fragmentId),
+		zap.Uint64("startOffset", currentOffset))
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer it.Close()
+
+		for {
+			newRecordCh := f.notifier.Wait(fragKey)
+			var records []fetchedRecord
+			for it.Seek(prevKey.Data()); it.Valid() && bytes.HasPrefix(it.Key().Data(), prefix); it.Next() {
+				key := storage.NewRecordKey(it.Key())
+				offset := key.Offset()
+				key.Free()
+				if offset < currentOffset {
+					break
+				}
+				// offsets are skipped when the records are deleted by retention or compaction
+				if offset > currentOffset {
+					records = append(records, newSkippedRecord(reader.fragmentId, offset-1))
+					currentOffset = offset
+				}
+				value := storage.NewRecordValue(it.Value())
+				if !value.Verify() {
+					quarantineRecord(f.db, reader.topicName, reader.fragmentId, currentOffset)
+					records = append(records, newSkippedRecord(reader.fragmentId, currentOffset))
+				} else if record, err := newFetchedRecord(f.db, reader.fragmentId, currentOffset, value); err != nil {
+					logger.Error("skip record cannot be decrypted", zap.Error(err),
+						zap.String("topic", reader.topicName),
+						zap.Uint32("fragmentId", reader.fragmentId),
+						zap.Uint64("offset", currentOffset))
+					records = append(records, newSkippedRecord(reader.fragmentId, currentOffset))
+				} else {
+					records = append(records, fetchedRecord{SubscriptionResult_Fetched: record})
+				}
+				value.Free()
+				currentOffset++
+				prevKey.SetOffset(currentOffset)
+			}
+
+			if len(records) > 0 {
+				f.fanOut(fragKey, reader, records, currentOffset)
+			}
+
+			select {
+			case <-reader.done:
+				logger.Debug("stop shared fragment reader",
+					zap.String("topic", reader.topicName),
+					zap.Uint32("fragmentId", reader.fragmentId))
+				return
+			case <-newRecordCh:
+			}
+		}
+	}()
+}
+
+func (f *fragmentReaders) fanOut(fragKey storage.FragmentKey, reader *fragmentReader, records []fetchedRecord, nextOffset uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for stream := range reader.streams {
+		for _, record := range records {
+			if record.Offset < stream.nextOffset {
+				continue
+			}
+			select {
+			case stream.recordCh <- record:
+				stream.nextOffset = record.Offset + 1
+			default:
+				// the stream falls behind. detach it to catch up by its own iterator
+				logger.Debug("detach slow stream from shared fragment reader",
+					zap.String("topic", reader.topicName),
+					zap.Uint32("fragmentId", reader.fragmentId),
+					zap.Uint64("offset", stream.nextOffset))
+				f.removeStream(fragKey, reader, stream)
+			}
+			if _, ok := reader.streams[stream]; !ok {
+				break
+			}
+		}
+	}
+	reader.nextOffset = nextOffset
+}
+
+func newFragmentPrefix(topicName string, fragmentId uint32) []byte {
+	prefix := make([]byte, len(topicName)+1+int(unsafe.Sizeof(uint32(0))))
+	copy(prefix, topicName+"@")
+	binary.BigEndian.PutUint32(prefix[len(topicName)+1:], fragmentId)
+	return prefix
+}
+
+func newFetchedRecord(db *storage.DB, fragmentId uint32, offset uint64, value *storage.RecordValue) (*pb.SubscriptionResult_Fetched, error) {
+	publishedData, err := db.DecryptedData(value)
+	if err != nil {
+		return nil, err
+	}
+	// copy the published data since the iterator owns the underlying memory
+	data := publishedData
+	if value.EncryptionKeyId() == 0 {
+		data = make([]byte, len(publishedData))
+		copy(data, publishedData)
+	}
+	var key []byte
+	if value.Key() != nil {
+		key = make([]byte, len(value.Key()))
+		copy(key, value.Key())
+	}
+	fetched := &pb.SubscriptionResult_Fetched{
+		FragmentId:  fragmentId,
+		Offset:      offset,
+		SeqNum:      value.SeqNum(),
+		Data:        data,
+		Key:         key,
+		Timestamp:   value.Timestamp(),
+		Headers:     value.Headers(),
+		Compression: pb.Compression(value.Compression()),
+	}
+	// the stored checksum also covers the encoding of the value, so the subscriber verifies the sent fields
+	if _, ok := value.Checksum(); ok {
+		checksum := storage.FieldsChecksum(fetched.SeqNum, fetched.Timestamp, fetched.Key, fetched.Headers, fetched.Data)
+		fetched.Checksum = &checksum
+	}
+	return fetched, nil
+}
+
+// quarantineRecord moves a corrupted record out of the fragment, so subscribers skip it.
+// The shared reader and catching up streams can find the same record, so it is counted only by the one moving it
+func quarantineRecord(db *storage.DB, topicName string, fragmentId uint32, offset uint64) {
+	quarantined, err := db.QuarantineRecord(topicName, fragmentId, offset)
+	if err != nil {
+		logger.Error("failed to quarantine record", zap.Error(err))
+		return
+	}
+	if quarantined {
+		corruptedErr := qerror.CorruptedRecordError{Topic: topicName, FragmentId: fragmentId, Offset: offset}
+		logger.Warn("quarantine corrupted record", zap.Error(corruptedErr))
+		publisherMetrics.Add(metricCorruptedRecords, 1)
+	}
+}
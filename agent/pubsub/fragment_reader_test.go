@@ -0,0 +1,121 @@
+package pubsub
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/paust-team/pirius/agent/storage"
+	"github.com/paust-team/pirius/constants"
+	"sync"
+)
+
+var _ = Describe("FragmentReaders", func() {
+	var db *storage.DB
+	var notifier *fragmentNotifier
+	var readers *fragmentReaders
+	var wg sync.WaitGroup
+	var streams []*readerStream
+	topicName := "shared"
+	fragmentId := uint32(1)
+	fragKey := storage.NewFragmentKey(topicName, uint(fragmentId))
+
+	putRecords := func(from, to uint64) {
+		for offset := from; offset <= to; offset++ {
+			err := db.PutRecord(topicName, fragmentId, offset, offset, []byte("record"), storage.GetNowTimestamp()+3600)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		notifier.Notify(fragKey)
+	}
+	attach := func(offset uint64) *readerStream {
+		stream, ok := readers.attach(&wg, topicName, fragmentId, offset)
+		Expect(ok).To(BeTrue())
+		streams = append(streams, stream)
+		return stream
+	}
+	receiveOffsets := func(stream *readerStream, n int) []uint64 {
+		var offsets []uint64
+		for i := 0; i < n; i++ {
+			var record fetchedRecord
+			Eventually(stream.recordCh).Should(Receive(&record))
+			offsets = append(offsets, record.Offset)
+		}
+		return offsets
+	}
+
+	BeforeEach(func() {
+		var err error
+		db, err = storage.NewDB(storage.MemoryEngine, "fragment-reader", ".")
+		Expect(err).NotTo(HaveOccurred())
+		notifier = newFragmentNotifier()
+		readers = newFragmentReaders(db, notifier)
+		streams = nil
+	})
+	AfterEach(func() {
+		for _, stream := range streams {
+			readers.detach(topicName, fragmentId, stream)
+		}
+		wg.Wait()
+		db.Close()
+		db.Destroy()
+	})
+
+	When("streams are attached to the same fragment", func() {
+		It("fans out each record to all streams", func() {
+			first, second := attach(1), attach(1)
+			putRecords(1, 3)
+
+			Expect(receiveOffsets(first, 3)).To(Equal([]uint64{1, 2, 3}))
+			Expect(receiveOffsets(second, 3)).To(Equal([]uint64{1, 2, 3}))
+		})
+	})
+
+	When("a stream falls behind the shared reader", func() {
+		var fast, slow *readerStream
+		bufferSize := uint64(constants.FragmentReaderBufferSize)
+
+		BeforeEach(func() {
+			fast, slow = attach(1), attach(1)
+			// fill the buffer of the slow stream
+			putRecords(1, bufferSize)
+			Expect(receiveOffsets(fast, int(bufferSize))).To(HaveLen(int(bufferSize)))
+			putRecords(bufferSize+1, bufferSize+1)
+			Expect(receiveOffsets(fast, 1)).To(Equal([]uint64{bufferSize + 1}))
+		})
+
+		It("detaches the slow stream after its buffered records", func() {
+			Expect(receiveOffsets(slow, int(bufferSize))).To(HaveLen(int(bufferSize)))
+			Eventually(slow.recordCh).Should(BeClosed())
+		})
+
+		It("re-attaches the stream caught up to the tail", func() {
+			// the shared reader already passed the offset the slow stream stopped at
+			_, ok := readers.attach(&wg, topicName, fragmentId, bufferSize+1)
+			Expect(ok).To(BeFalse())
+
+			caughtUp := attach(bufferSize + 2)
+			putRecords(bufferSize+2, bufferSize+2)
+			Expect(receiveOffsets(caughtUp, 1)).To(Equal([]uint64{bufferSize + 2}))
+			Expect(receiveOffsets(fast, 1)).To(Equal([]uint64{bufferSize + 2}))
+		})
+	})
+
+	When("a corrupted record is found by more than one reader", func() {
+		BeforeEach(func() {
+			value := storage.NewRecordValueFromData(1, []byte("record"))
+			value.Data()[value.Size()-1] ^= 0x01
+			Expect(db.PutRecordValue(topicName, fragmentId, 1, value, storage.GetNowTimestamp()+3600)).To(Succeed())
+		})
+
+		It("quarantines and counts the record once", func() {
+			counted := func() int64 {
+				if counter := publisherMetrics.Get(metricCorruptedRecords); counter != nil {
+					return counter.(interface{ Value() int64 }).Value()
+				}
+				return 0
+			}
+			before := counted()
+			quarantineRecord(db, topicName, fragmentId, 1)
+			quarantineRecord(db, topicName, fragmentId, 1)
+			Expect(counted() - before).To(Equal(int64(1)))
+		})
+	})
+})
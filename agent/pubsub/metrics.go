@@ -0,0 +1,23 @@
+package pubsub
+
+import "expvar"
+
+// publisher and subscriber metrics are exported through expvar
+var (
+	publisherMetrics  = expvar.NewMap("pirius_publisher")
+	subscriberMetrics = expvar.NewMap("pirius_subscriber")
+	subscriptionLags  = new(expvar.Map).Init()
+)
+
+func init() {
+	publisherMetrics.Set(metricSubscriptionLag, subscriptionLags)
+}
+
+const (
+	metricReconnectAttempts  = "reconnect_attempts"
+	metricReconnectSuccesses = "reconnect_successes"
+	metricReconnectFailures  = "reconnect_failures"
+	metricCorruptedRecords   = "corrupted_records"
+	metricDuplicatedRecords  = "duplicated_records"
+	metricSubscriptionLag    = "subscription_lag"
+)
@@ -0,0 +1,41 @@
+package pubsub
+
+import (
+	"github.com/paust-team/pirius/agent/storage"
+	"sync"
+)
+
+// fragmentNotifier wakes up fetching goroutines when new records are written to a fragment
+type fragmentNotifier struct {
+	mu      sync.Mutex
+	waiters map[storage.FragmentKey]chan struct{}
+}
+
+func newFragmentNotifier() *fragmentNotifier {
+	return &fragmentNotifier{
+		waiters: make(map[storage.FragmentKey]chan struct{}),
+	}
+}
+
+// Wait returns a channel that is closed when the next record is written to the fragment.
+// It should be called before checking the storage to not miss a notification.
+func (n *fragmentNotifier) Wait(fragKey storage.FragmentKey) <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	ch, ok := n.waiters[fragKey]
+	if !ok {
+		ch = make(chan struct{})
+		n.waiters[fragKey] = ch
+	}
+	return ch
+}
+
+// Notify wakes up all goroutines waiting for new records of the fragment
+func (n *fragmentNotifier) Notify(fragKey storage.FragmentKey) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if ch, ok := n.waiters[fragKey]; ok {
+		close(ch)
+		delete(n.waiters, fragKey)
+	}
+}
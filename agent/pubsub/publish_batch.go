@@ -0,0 +1,198 @@
+package pubsub
+
+import (
+	"fmt"
+	"github.com/paust-team/pirius/agent/storage"
+	"github.com/paust-team/pirius/bootstrapping/topic"
+	"github.com/paust-team/pirius/compression"
+	"github.com/paust-team/pirius/constants"
+	"github.com/paust-team/pirius/qerror"
+	"time"
+)
+
+// BatchPolicy decides when published records are written to the storage.
+// A batch is written when it reaches MaxRecords or MaxBytes, or FlushInterval passes after its first record.
+// When FlushInterval is 0, a batch is written as soon as no more records are waiting.
+type BatchPolicy struct {
+	MaxRecords    int
+	MaxBytes      int
+	FlushInterval time.Duration
+}
+
+// PublishReceipt tells where a published record is persisted
+type PublishReceipt struct {
+	Topic      string
+	SeqNum     uint64
+	Offsets    []FragmentOffset // the record is written to each fragment at the offset
+	Duplicated bool             // the record is dropped as its SeqNum is already persisted
+}
+
+type FragmentOffset struct {
+	FragmentId uint32
+	Offset     uint64
+}
+
+// PublishCallback is called by the publishing goroutine when the record is persisted or failed. it should not block
+type PublishCallback func(receipt PublishReceipt, err error)
+
+type pendingReceipt struct {
+	receipt  PublishReceipt
+	callback PublishCallback
+}
+
+// publishBatch gathers published records to write them to the storage at once
+type publishBatch struct {
+	topicName          string
+	retentionPeriodSec uint64
+	maxBytes           uint64 // max bytes of the topic. 0 means unlimited
+	compacted          bool
+	codec              compression.Codec // codec compressing the published data
+	records            []storage.Record
+	numBytes           int
+	nextOffsets        map[storage.FragmentKey]uint64 // publish offsets after the batch is written
+	seqNums            []uint64                       // SeqNums of the records in added order
+	fragments          map[uint64]uint32              // fragment each SeqNum is written to first
+	receipts           []pendingReceipt               // receipts of the records to be completed after the batch is written
+	lastTimestamp      uint64                         // timestamp of the last record added. kept across batches
+	timer              *time.Timer
+}
+
+func newPublishBatch(topicName string, retention topic.RetentionPolicy, option topic.Option, codec compression.Codec) *publishBatch {
+	return &publishBatch{
+		topicName:          topicName,
+		retentionPeriodSec: retention.PeriodSec,
+		maxBytes:           retention.MaxBytes,
+		compacted:          option&topic.Compacted != 0,
+		codec:              codec,
+		nextOffsets:        make(map[storage.FragmentKey]uint64),
+		fragments:          make(map[uint64]uint32),
+	}
+}
+
+// add assigns offsets of the fragments to the data. it fails when there is no fragment to write the data
+func (b *publishBatch) add(data TopicData, fragmentIds []uint, publishedOffsets storage.TopicFragmentOffsets) error {
+	if len(fragmentIds) == 0 {
+		return qerror.InvalidStateError{State: fmt.Sprintf("no fragment to write the record(seqNum=%d) of topic(%s)", data.SeqNum, b.topicName)}
+	}
+	// subscribers cannot receive or decompress larger records
+	if len(data.Data) > constants.MaxRecordSize {
+		return qerror.ValidationError{Value: fmt.Sprintf("%d bytes", len(data.Data)),
+			HintMsg: fmt.Sprintf("data of a record should not be larger than %d bytes", constants.MaxRecordSize)}
+	}
+	expirationDate := storage.GetNowTimestamp() + b.retentionPeriodSec
+	timestamp := data.Timestamp
+	if timestamp == 0 {
+		timestamp = uint64(time.Now().UnixMilli())
+	}
+	// timestamps should not decrease in a fragment to find offsets by time
+	if timestamp < b.lastTimestamp {
+		timestamp = b.lastTimestamp
+	}
+	b.lastTimestamp = timestamp
+	value := b.newRecordValue(data, timestamp)
+	if _, ok := b.fragments[data.SeqNum]; !ok {
+		b.seqNums = append(b.seqNums, data.SeqNum)
+		b.fragments[data.SeqNum] = uint32(fragmentIds[0])
+	}
+	if b.compacted && len(data.Key) > 0 && !value.IsTombstone() {
+		// the newest record of a key is kept until it is replaced. only tombstones expire
+		expirationDate = storage.NeverExpire
+	}
+
+	receipt := PublishReceipt{Topic: b.topicName, SeqNum: data.SeqNum}
+	for _, fragmentId := range fragmentIds {
+		fragKey := storage.NewFragmentKey(b.topicName, fragmentId)
+		offset, ok := b.nextOffsets[fragKey]
+		if !ok {
+			loaded, _ := publishedOffsets.LoadOrStore(fragKey, uint64(1))
+			offset = loaded.(uint64)
+		}
+		b.records = append(b.records, storage.Record{
+			Topic:          b.topicName,
+			FragmentId:     uint32(fragmentId),
+			Offset:         offset,
+			Value:          value,
+			ExpirationDate: expirationDate,
+			Compacted:      b.compacted,
+		})
+		b.numBytes += value.Size()
+		b.nextOffsets[fragKey] = offset + 1
+		receipt.Offsets = append(receipt.Offsets, FragmentOffset{FragmentId: uint32(fragmentId), Offset: offset})
+	}
+	if data.Callback != nil {
+		b.receipts = append(b.receipts, pendingReceipt{receipt: receipt, callback: data.Callback})
+	}
+	return nil
+}
+
+// newRecordValue compresses the published data by the codec of the topic.
+// data is stored as it is if it cannot be compressed smaller
+func (b *publishBatch) newRecordValue(data TopicData, timestamp uint64) *storage.RecordValue {
+	if b.codec != compression.None && len(data.Data) > 0 {
+		compressed, err := compression.Compress(b.codec, data.Data)
+		if err == nil && len(compressed) < len(data.Data) {
+			return storage.NewCompressedRecordValue(data.SeqNum, timestamp, data.Key, data.Headers, b.codec, compressed)
+		}
+	}
+	return storage.NewRecordValueFromFields(data.SeqNum, timestamp, data.Key, data.Headers, data.Data)
+}
+
+// isDuplicate returns true if a record of the same SeqNum is in the batch
+func (b *publishBatch) isDuplicate(data TopicData) bool {
+	_, ok := b.fragments[data.SeqNum]
+	return ok
+}
+
+// complete calls the callbacks of the records with their receipts, or with the error if the batch is not written
+func (b *publishBatch) complete(err error) {
+	for _, pending := range b.receipts {
+		if err != nil {
+			pending.callback(PublishReceipt{Topic: pending.receipt.Topic, SeqNum: pending.receipt.SeqNum}, err)
+		} else {
+			pending.callback(pending.receipt, nil)
+		}
+	}
+	b.receipts = nil
+}
+
+// hasReceipts returns true if a record of the batch waits for its receipt
+func (b *publishBatch) hasReceipts() bool {
+	return len(b.receipts) > 0
+}
+
+func (b *publishBatch) isEmpty() bool {
+	return len(b.records) == 0
+}
+
+func (b *publishBatch) isFull(policy BatchPolicy) bool {
+	return (policy.MaxRecords > 0 && len(b.records) >= policy.MaxRecords) ||
+		(policy.MaxBytes > 0 && b.numBytes >= policy.MaxBytes)
+}
+
+// startTimer starts the flush timer of the batch if not started
+func (b *publishBatch) startTimer(interval time.Duration) {
+	if b.timer == nil && interval > 0 {
+		b.timer = time.NewTimer(interval)
+	}
+}
+
+// timeout returns a channel fired when the flush interval passes. it is nil when the timer is not started
+func (b *publishBatch) timeout() <-chan time.Time {
+	if b.timer == nil {
+		return nil
+	}
+	return b.timer.C
+}
+
+func (b *publishBatch) reset() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.records = nil
+	b.numBytes = 0
+	b.nextOffsets = make(map[storage.FragmentKey]uint64)
+	b.seqNums = nil
+	b.fragments = make(map[uint64]uint32)
+	b.receipts = nil
+}
@@ -0,0 +1,51 @@
+package pubsub
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/paust-team/pirius/agent/storage"
+	"github.com/paust-team/pirius/bootstrapping/topic"
+	"github.com/paust-team/pirius/compression"
+	"github.com/paust-team/pirius/constants"
+	"github.com/paust-team/pirius/qerror"
+)
+
+var _ = Describe("PublishBatch", func() {
+	var batch *publishBatch
+	var offsets storage.TopicFragmentOffsets
+	var receipts []PublishReceipt
+	var errs []error
+	callback := func(receipt PublishReceipt, err error) {
+		receipts = append(receipts, receipt)
+		errs = append(errs, err)
+	}
+
+	BeforeEach(func() {
+		batch = newPublishBatch("receipts", topic.RetentionPolicy{PeriodSec: 3600}, 0, compression.None)
+		offsets = storage.NewTopicFragmentOffsets(map[storage.FragmentKey]uint64{})
+		receipts, errs = nil, nil
+	})
+
+	It("fails to add a record of no fragment to write", func() {
+		err := batch.add(TopicData{SeqNum: 1, Data: []byte("record"), Callback: callback}, nil, offsets)
+		Expect(err).To(BeAssignableToTypeOf(qerror.InvalidStateError{}))
+		Expect(batch.isEmpty()).To(BeTrue())
+		Expect(batch.hasReceipts()).To(BeFalse())
+	})
+
+	It("fails to add a record larger than the max record size", func() {
+		err := batch.add(TopicData{SeqNum: 1, Data: make([]byte, constants.MaxRecordSize+1), Callback: callback}, []uint{1}, offsets)
+		Expect(err).To(BeAssignableToTypeOf(qerror.ValidationError{}))
+		Expect(batch.isEmpty()).To(BeTrue())
+	})
+
+	It("completes the receipts once", func() {
+		Expect(batch.add(TopicData{SeqNum: 1, Data: []byte("record"), Callback: callback}, []uint{1, 2}, offsets)).To(Succeed())
+		Expect(batch.hasReceipts()).To(BeTrue())
+
+		batch.complete(nil)
+		batch.complete(qerror.InvalidStateError{State: "stopped"})
+		Expect(errs).To(Equal([]error{nil}))
+		Expect(receipts[0].Offsets).To(Equal([]FragmentOffset{{FragmentId: 1, Offset: 1}, {FragmentId: 2, Offset: 1}}))
+	})
+})
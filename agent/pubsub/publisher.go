@@ -3,7 +3,6 @@ package pubsub
 import (
 	"bytes"
 	"context"
-	"encoding/binary"
 	"fmt"
 	"github.com/paust-team/pirius/agent/storage"
 	"github.com/paust-team/pirius/bootstrapping"
@@ -17,7 +16,6 @@ import (
 	"runtime"
 	"sync"
 	"time"
-	"unsafe"
 )
 
 type publisherBase struct {
@@ -28,13 +26,20 @@ type publisherBase struct {
 	currentPublishOffsets storage.TopicFragmentOffsets // current write offsets
 	lastFetchedOffsets    storage.TopicFragmentOffsets // last read offsets
 	currentFragMappings   topic.FragMappingInfo
+	notifier              *fragmentNotifier // wakes up fetching goroutines on new records
+	readers               *fragmentReaders  // shared tail readers of fragments
+	batchPolicy           BatchPolicy
+	quota                 StoreQuota
+	dedupWindows          *storage.DedupWindows // SeqNums persisted to each topic
+	rateLimits            *RateLimits           // limits of records sent to subscribers
+	drainer               *drainer
 }
 
-func (p publisherBase) prepare(ctx context.Context, topicName string) (chan topic.FragMappingInfo, topic.FragMappingInfo, topic.Option, error) {
+func (p publisherBase) prepare(ctx context.Context, topicName string) (chan topic.FragMappingInfo, topic.FragMappingInfo, topic.Frame, error) {
 	var fragMappings topic.FragMappingInfo
 	fragmentWatchCh, err := p.bootstrapper.WatchFragmentInfoChanged(ctx, topicName)
 	if err != nil {
-		return nil, nil, 0, err
+		return nil, nil, topic.Frame{}, err
 	}
 	logger.Info("watcher for fragments registered", zap.String("publisher-id", p.id), zap.String("topic", topicName))
 
@@ -43,12 +48,12 @@ func (p publisherBase) prepare(ctx context.Context, topicName string) (chan topi
 	if _, ok := err.(qerror.CoordTargetAlreadyExistsError); ok { // if already registered, check fragment info
 		fragmentFrame, err := p.bootstrapper.GetTopicFragments(topicName)
 		if err != nil {
-			return nil, nil, 0, err
+			return nil, nil, topic.Frame{}, err
 		}
 		initialFragment := fragmentFrame.FragMappingInfo()
 		fragMappings = initialFragment
 	} else if err != nil {
-		return nil, nil, 0, err
+		return nil, nil, topic.Frame{}, err
 	} else { // wait watch event for initial fragment assignment
 		timer := time.After(time.Second * constants.InitialRebalanceTimeout)
 		for fragMappings == nil {
@@ -59,7 +64,7 @@ func (p publisherBase) prepare(ctx context.Context, topicName string) (chan topi
 				}
 				fragMappings = initialFragment
 			case <-timer:
-				return nil, nil, 0, qerror.InvalidStateError{State: fmt.Sprintf("initial rebalance timed out for topic(%s)", topicName)}
+				return nil, nil, topic.Frame{}, qerror.InvalidStateError{State: fmt.Sprintf("initial rebalance timed out for topic(%s)", topicName)}
 			}
 		}
 	}
@@ -67,10 +72,10 @@ func (p publisherBase) prepare(ctx context.Context, topicName string) (chan topi
 	// load topic policy and set fragments selecting rule
 	topicInfo, err := p.bootstrapper.GetTopic(topicName)
 	if err != nil {
-		return nil, nil, 0, err
+		return nil, nil, topic.Frame{}, err
 	}
 
-	return fragmentWatchCh, fragMappings, topicInfo.Options(), nil
+	return fragmentWatchCh, fragMappings, topicInfo, nil
 }
 
 func (p publisherBase) transferStaledRecords(ctx context.Context, wg *sync.WaitGroup, topicName string, fragmentIds []uint) chan TopicData {
@@ -107,11 +112,29 @@ func (p publisherBase) transferStaledRecords(ctx context.Context, wg *sync.WaitG
 				if err != nil {
 					logger.Error(err.Error(), zap.String("publisher-id", p.id))
 					continue
+				} else if !record.Exists() { // deleted by retention
+					record.Free()
+					continue
 				}
 				recordValue := storage.NewRecordValue(record)
+				if !recordValue.Verify() {
+					record.Free()
+					quarantineRecord(p.db, topicName, uint32(staledFragId), i)
+					continue
+				}
+				publishedData, err := p.db.DecodedData(recordValue)
+				if err != nil {
+					logger.Error(err.Error(), zap.String("publisher-id", p.id))
+					record.Free()
+					continue
+				}
 				staled := TopicData{
-					SeqNum: recordValue.SeqNum(),
-					Data:   recordValue.PublishedData(),
+					SeqNum:           recordValue.SeqNum(),
+					Data:             publishedData,
+					Key:              recordValue.Key(),
+					Timestamp:        recordValue.Timestamp(),
+					Headers:          recordValue.Headers(),
+					staledFragmentId: uint32(staledFragId),
 				}
 				select {
 				case <-ctx.Done():
@@ -130,13 +153,232 @@ func (p publisherBase) transferStaledRecords(ctx context.Context, wg *sync.WaitG
 	return staleCh
 }
 
-func (p publisherBase) onReceiveData(data TopicData, topicName string, fragmentId uint, offset uint64, retentionPeriodSec uint64) error {
-	expirationDate := storage.GetNowTimestamp() + retentionPeriodSec
-	logger.Debug("write to", zap.String("publisher-id", p.id), zap.String("topic", topicName), zap.Uint("fragmentId", fragmentId), zap.Uint64("offset", offset))
-	return p.db.PutRecord(topicName, uint32(fragmentId), offset, data.SeqNum, data.Data, expirationDate)
+// gatherRecords adds the records already waiting in the stream to the batch without blocking.
+// It returns false when the stream is closed
+func (p publisherBase) gatherRecords(batch *publishBatch, inStream chan TopicData, getFragmentsToWrite func(key []byte) []uint) bool {
+	for !batch.isFull(p.batchPolicy) {
+		select {
+		case data, ok := <-inStream:
+			if !ok {
+				return false
+			}
+			p.addToBatch(batch, data, getFragmentsToWrite)
+		default:
+			return true
+		}
+	}
+	return true
+}
+
+// addToBatch adds the data to the batch unless its SeqNum is already persisted or gathered in the batch
+func (p publisherBase) addToBatch(batch *publishBatch, data TopicData, getFragmentsToWrite func(key []byte) []uint) {
+	if p.dedupWindows.Size() > 0 &&
+		(batch.isDuplicate(data) || p.dedupWindows.IsDuplicate(batch.topicName, data.SeqNum, data.staledFragmentId)) {
+		logger.Debug("drop duplicated record",
+			zap.String("publisher-id", p.id),
+			zap.String("topic", batch.topicName),
+			zap.Uint64("seqNum", data.SeqNum))
+		publisherMetrics.Add(metricDuplicatedRecords, 1)
+		if data.Callback != nil {
+			data.Callback(PublishReceipt{Topic: batch.topicName, SeqNum: data.SeqNum, Duplicated: true}, nil)
+		}
+		return
+	}
+	if err := batch.add(data, getFragmentsToWrite(data.Key), p.currentPublishOffsets); err != nil {
+		logger.Warn("drop record", zap.String("publisher-id", p.id), zap.Error(err))
+		if data.Callback != nil {
+			data.Callback(PublishReceipt{Topic: batch.topicName, SeqNum: data.SeqNum}, err)
+		}
+	}
 }
 
-func (p publisherBase) setupTopicWriter(ctx context.Context, wg *sync.WaitGroup, topicName string, topicOption topic.Option, fragMappings topic.FragMappingInfo) (func() []uint, chan TopicData, error) {
+// flushBatch writes the batch to the storage and wakes up fetching goroutines of the written fragments.
+// When the batch is rejected by the quota, qerror.QuotaExceededError is sent to errCh and the batch is discarded.
+// Callbacks of the records are completed with their receipts, or with the error when the batch is not written.
+func (p publisherBase) flushBatch(ctx context.Context, batch *publishBatch, errCh chan error) error {
+	if batch.isEmpty() {
+		batch.complete(nil) // records of no fragments to write
+		return nil
+	}
+	if err := p.ensureQuota(ctx, batch); err != nil {
+		batch.complete(err)
+		quotaErr, ok := err.(qerror.QuotaExceededError)
+		if !ok {
+			return err
+		}
+		logger.Warn("reject records over quota",
+			zap.String("publisher-id", p.id),
+			zap.String("topic", batch.topicName),
+			zap.Int("num records", len(batch.records)),
+			zap.Error(quotaErr))
+		batch.reset()
+		select {
+		case <-ctx.Done():
+		case errCh <- quotaErr:
+		}
+		return nil
+	}
+	// records waiting for their receipts are synced to the disk before the receipts tell they are persisted
+	putRecords := p.db.PutRecords
+	if batch.hasReceipts() {
+		putRecords = p.db.PutDurableRecords
+	}
+	if err := putRecords(batch.records); err != nil {
+		batch.complete(err)
+		return err
+	}
+	logger.Debug("write batch", zap.String("publisher-id", p.id), zap.String("topic", batch.topicName), zap.Int("num records", len(batch.records)))
+	// SeqNums should be kept before the offsets move, to be checkpointed with the offsets
+	for _, seqNum := range batch.seqNums {
+		p.dedupWindows.Add(batch.topicName, seqNum, batch.fragments[seqNum])
+	}
+	for fragKey, nextOffset := range batch.nextOffsets {
+		p.currentPublishOffsets.Store(fragKey, nextOffset)
+		p.notifier.Notify(fragKey)
+	}
+	batch.complete(nil)
+	batch.reset()
+	return nil
+}
+
+// ensureQuota makes room for the batch by the quota policy
+func (p publisherBase) ensureQuota(ctx context.Context, batch *publishBatch) error {
+	for {
+		quotaErr, exceeded := p.checkQuota(batch)
+		if !exceeded {
+			return nil
+		}
+		switch p.quota.Policy {
+		case RejectPublish:
+			return quotaErr
+		case BlockPublish:
+			logger.Debug("wait for records to be expired", zap.String("publisher-id", p.id), zap.Error(quotaErr))
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Millisecond * constants.QuotaCheckInterval):
+			}
+		default:
+			topicName := batch.topicName
+			if quotaErr.AgentWide {
+				topicName = ""
+			}
+			freed, err := p.dropOldestRecords(topicName, quotaErr.Size+uint64(batch.numBytes)-quotaErr.MaxBytes)
+			if err != nil {
+				return err
+			} else if freed == 0 { // the batch is larger than the quota
+				return quotaErr
+			}
+		}
+	}
+}
+
+// checkQuota checks whether the batch fits the quota of the topic and the agent
+func (p publisherBase) checkQuota(batch *publishBatch) (qerror.QuotaExceededError, bool) {
+	if batch.maxBytes > 0 {
+		if size := p.db.TopicSize(batch.topicName); size+uint64(batch.numBytes) > batch.maxBytes {
+			return qerror.QuotaExceededError{Topic: batch.topicName, Size: size, MaxBytes: batch.maxBytes}, true
+		}
+	}
+	if p.quota.MaxBytes > 0 {
+		if size := p.db.TotalSize(); size+uint64(batch.numBytes) > p.quota.MaxBytes {
+			return qerror.QuotaExceededError{Topic: batch.topicName, AgentWide: true, Size: size, MaxBytes: p.quota.MaxBytes}, true
+		}
+	}
+	return qerror.QuotaExceededError{}, false
+}
+
+// dropOldestRecords deletes the oldest records from the largest fragment first until `numBytes` are freed.
+// All topics are targeted when topicName is empty.
+func (p publisherBase) dropOldestRecords(topicName string, numBytes uint64) (uint64, error) {
+	var freed uint64
+	sizes := p.db.FragmentSizes()
+	for freed < numBytes {
+		var targetTopic string
+		var targetFragmentId uint32
+		var largest uint64
+		for name, fragments := range sizes {
+			if topicName != "" && name != topicName {
+				continue
+			}
+			for fragmentId, size := range fragments {
+				if size > largest {
+					targetTopic, targetFragmentId, largest = name, fragmentId, size
+				}
+			}
+		}
+		if largest == 0 {
+			break
+		}
+
+		deleted, err := p.db.DeleteOldestRecords(targetTopic, targetFragmentId, numBytes-freed)
+		if err != nil {
+			return freed, err
+		}
+		logger.Info("dropped oldest records over quota",
+			zap.String("publisher-id", p.id),
+			zap.String("topic", targetTopic),
+			zap.Uint32("fragmentId", targetFragmentId),
+			zap.Uint64("freed bytes", deleted))
+		freed += deleted
+		if deleted == 0 || deleted >= largest {
+			delete(sizes[targetTopic], targetFragmentId)
+		} else {
+			sizes[targetTopic][targetFragmentId] -= deleted
+		}
+	}
+	return freed, nil
+}
+
+// resolveStartOffset finds the offset to start fetching from the requested start position of the fragment
+func (p publisherBase) resolveStartOffset(topicName string, offsetInfo *pb.Subscription_FragmentOffset) (uint64, error) {
+	fragKey := storage.NewFragmentKey(topicName, uint(offsetInfo.FragmentId))
+	latestOffset := uint64(1)
+	if value, ok := p.currentPublishOffsets.Load(fragKey); ok {
+		latestOffset = value.(uint64)
+	}
+	firstOffset, found, err := p.db.FirstRecordOffset(topicName, offsetInfo.FragmentId)
+	if err != nil {
+		return 0, err
+	} else if !found { // all records are expired or not published yet
+		firstOffset = latestOffset
+	}
+
+	var startOffset uint64
+	if offsetInfo.Earliest {
+		startOffset = firstOffset
+	} else if offsetInfo.StartTimestamp != nil {
+		offset, found, err := p.db.FindOffsetByTime(topicName, offsetInfo.FragmentId, *offsetInfo.StartTimestamp)
+		if err != nil {
+			return 0, err
+		} else if found {
+			startOffset = offset
+		} else { // no records published after the timestamp
+			startOffset = latestOffset
+		}
+	} else if offsetInfo.StartOffset == nil { // when start offset is not set, set current offset as last offset
+		startOffset = latestOffset
+	} else {
+		startOffset = *offsetInfo.StartOffset
+	}
+
+	if startOffset == 0 {
+		logger.Warn("start offset should be greater than 0. adjust start offset to 1", zap.String("publisher-id", p.id))
+		startOffset = 1
+	}
+	if startOffset < firstOffset {
+		logger.Warn("start offset is already expired. adjust start offset to the first retained offset",
+			zap.String("publisher-id", p.id),
+			zap.String("topic", topicName),
+			zap.Uint32("fragmentId", offsetInfo.FragmentId),
+			zap.Uint64("startOffset", startOffset),
+			zap.Uint64("firstOffset", firstOffset))
+		startOffset = firstOffset
+	}
+	return startOffset, nil
+}
+
+func (p publisherBase) setupTopicWriter(ctx context.Context, wg *sync.WaitGroup, topicName string, topicOption topic.Option, fragMappings topic.FragMappingInfo) (func(key []byte) []uint, chan TopicData, error) {
 	// setup  publishing fragments
 	var transferCh chan TopicData
 	activeFragIds, staleFragIds := p.findPublishingFragments(fragMappings)
@@ -157,21 +399,7 @@ func (p publisherBase) setupTopicWriter(ctx context.Context, wg *sync.WaitGroup,
 	return getFragmentsToWrite, transferCh, nil
 }
 
-func (p publisherBase) onFetchData(ctx context.Context, wg *sync.WaitGroup, topicName string, fragmentId uint32, startOffset uint64, outStream chan *pb.SubscriptionResult_Fetched) {
-
-	prefix := make([]byte, len(topicName)+1+int(unsafe.Sizeof(uint32(0))))
-	copy(prefix, topicName+"@")
-	binary.BigEndian.PutUint32(prefix[len(topicName)+1:], fragmentId)
-	waitInterval := time.Millisecond * 10
-	timer := time.NewTimer(waitInterval)
-
-	currentOffset := startOffset
-	prevKey := storage.NewRecordKeyFromData(topicName, fragmentId, currentOffset)
-
-	iterateCount := 0
-	rescanCheckPoint := 0
-	rescanThreshold := 1000
-	it := p.db.Scan(storage.RecordCF)
+func (p publisherBase) onFetchData(ctx context.Context, wg *sync.WaitGroup, topicName string, fragmentId uint32, startOffset uint64, outStream chan fetchedRecord) {
 
 	logger.Debug("start subscription goroutine",
 		zap.String("topic", topicName),
@@ -179,58 +407,145 @@ func (p publisherBase) onFetchData(ctx context.Context, wg *sync.WaitGroup, topi
 		zap.Uint64("startOffset", startOffset))
 
 	wg.Add(1)
-	fragIdUint := uint(fragmentId)
-
 	go func() {
 		defer wg.Done()
-		defer timer.Stop()
-		defer it.Close()
 
+		fragKey := storage.NewFragmentKey(topicName, uint(fragmentId))
+		currentOffset := startOffset
 		for {
-			select {
-			case <-ctx.Done():
+			// take the notification before reading the storage not to miss records written after reaching the tail
+			newRecordCh := p.notifier.Wait(fragKey)
+
+			// read stored records by own iterator until reaching the tail of the fragment
+			nextOffset, ok := p.catchUpRecords(ctx, topicName, fragmentId, currentOffset, outStream)
+			if !ok {
 				return
-			case <-timer.C:
-				for it.Seek(prevKey.Data()); it.Valid() && bytes.HasPrefix(it.Key().Data(), prefix); it.Next() {
-					key := storage.NewRecordKey(it.Key())
-					offset := key.Offset()
-					key.Free()
-					if offset != currentOffset {
-						break
-					}
+			}
 
-					value := storage.NewRecordValue(it.Value())
-					topicData := &pb.SubscriptionResult_Fetched{
-						FragmentId: fragmentId,
-						Offset:     currentOffset,
-						SeqNum:     value.SeqNum(),
-						Data:       value.PublishedData(),
-					}
-					value.Free()
+			// attach to the shared reader of the fragment to follow newly written records
+			stream, attached := p.readers.attach(wg, topicName, fragmentId, nextOffset)
+			if !attached {
+				if nextOffset == currentOffset { // no progress. wait for new records not to spin
 					select {
 					case <-ctx.Done():
 						return
-					default:
-						outStream <- topicData
-						p.lastFetchedOffsets.Store(storage.NewFragmentKey(topicName, fragIdUint), currentOffset)
-						currentOffset++
-						prevKey.SetOffset(currentOffset)
+					case <-newRecordCh:
 					}
-					iterateCount++
-					runtime.Gosched()
 				}
+				currentOffset = nextOffset
+				continue
+			}
 
-				if iterateCount-rescanCheckPoint > rescanThreshold {
-					rescanCheckPoint = iterateCount
-					it.Close()
-					it = p.db.Scan(storage.RecordCF)
-				}
+			currentOffset, ok = p.followRecords(ctx, topicName, fragmentId, nextOffset, stream, outStream)
+			if !ok {
+				p.readers.detach(topicName, fragmentId, stream)
+				return
 			}
-			timer.Reset(waitInterval)
+			logger.Debug("fell behind the shared fragment reader",
+				zap.String("topic", topicName),
+				zap.Uint32("fragmentId", fragmentId),
+				zap.Uint64("offset", currentOffset))
 		}
 	}()
 }
 
+// catchUpRecords sends stored records from startOffset and returns the next offset to read.
+// Records which are deleted or cannot be read are sent as skipped records
+func (p publisherBase) catchUpRecords(ctx context.Context, topicName string, fragmentId uint32, startOffset uint64, outStream chan fetchedRecord) (uint64, bool) {
+	prefix := newFragmentPrefix(topicName, fragmentId)
+	fragKey := storage.NewFragmentKey(topicName, uint(fragmentId))
+
+	currentOffset := startOffset
+	prevKey := storage.NewRecordKeyFromData(topicName, fragmentId, currentOffset)
+	it := p.db.Scan(storage.RecordCF)
+	defer it.Close()
+
+	for it.Seek(prevKey.Data()); it.Valid() && bytes.HasPrefix(it.Key().Data(), prefix); it.Next() {
+		key := storage.NewRecordKey(it.Key())
+		offset := key.Offset()
+		key.Free()
+		if offset > currentOffset { // records are deleted by retention or compaction
+			logger.Debug("skip deleted records",
+				zap.String("topic", topicName),
+				zap.Uint32("fragmentId", fragmentId),
+				zap.Uint64("from", currentOffset),
+				zap.Uint64("to", offset))
+			if !sendFetched(ctx, outStream, newSkippedRecord(fragmentId, offset-1)) {
+				return currentOffset, false
+			}
+			currentOffset = offset
+		} else if offset != currentOffset {
+			break
+		}
+
+		value := storage.NewRecordValue(it.Value())
+		if !value.Verify() {
+			value.Free()
+			quarantineRecord(p.db, topicName, fragmentId, currentOffset)
+			if !sendFetched(ctx, outStream, newSkippedRecord(fragmentId, currentOffset)) {
+				return currentOffset, false
+			}
+			currentOffset++
+			continue
+		}
+		topicData, err := newFetchedRecord(p.db, fragmentId, currentOffset, value)
+		value.Free()
+		if err != nil {
+			logger.Error("skip record cannot be decrypted", zap.Error(err),
+				zap.String("topic", topicName),
+				zap.Uint32("fragmentId", fragmentId),
+				zap.Uint64("offset", currentOffset))
+			if !sendFetched(ctx, outStream, newSkippedRecord(fragmentId, currentOffset)) {
+				return currentOffset, false
+			}
+			currentOffset++
+			continue
+		}
+		if !sendFetched(ctx, outStream, fetchedRecord{SubscriptionResult_Fetched: topicData}) {
+			return currentOffset, false
+		}
+		p.lastFetchedOffsets.Store(fragKey, currentOffset)
+		currentOffset++
+		runtime.Gosched()
+	}
+	return currentOffset, true
+}
+
+// followRecords sends records from the shared reader until the stream is detached
+func (p publisherBase) followRecords(ctx context.Context, topicName string, fragmentId uint32, startOffset uint64,
+	stream *readerStream, outStream chan fetchedRecord) (uint64, bool) {
+	fragKey := storage.NewFragmentKey(topicName, uint(fragmentId))
+
+	currentOffset := startOffset
+	for {
+		select {
+		case <-ctx.Done():
+			return currentOffset, false
+		case record, ok := <-stream.recordCh:
+			if !ok { // detached from the shared reader
+				return currentOffset, true
+			}
+			if !sendFetched(ctx, outStream, record) {
+				return currentOffset, false
+			}
+			if !record.skipped {
+				p.lastFetchedOffsets.Store(fragKey, record.Offset)
+			}
+			currentOffset = record.Offset + 1
+		}
+	}
+}
+
+// sendFetched returns false when ctx is done before the record is sent
+func sendFetched(ctx context.Context, outStream chan fetchedRecord, record fetchedRecord) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case outStream <- record:
+		return true
+	}
+}
+
 // helper functions
 func (p publisherBase) findPublishingFragments(fragMappings topic.FragMappingInfo) (activeFragments, staleFragments []uint) {
 	for fragId, fragInfo := range fragMappings {
@@ -260,18 +575,27 @@ func (p publisherBase) isMappingUpdated(new topic.FragMappingInfo) bool {
 }
 
 type TopicData struct {
-	SeqNum uint64
-	Data   []byte
+	SeqNum    uint64
+	Data      []byte
+	Key       []byte            // optional. used to select a fragment on KeyBasedRouting topic, and to compact records on Compacted topic
+	Timestamp uint64            // optional. unix milliseconds, set to the publish time if not given. raised to the previous record's if earlier
+	Headers   map[string]string // optional. e.g. trace-id, content-type, producer-id
+	Callback  PublishCallback   // optional. called with the receipt when the record is persisted, or with the error
+
+	staledFragmentId uint32 // fragment the record is transferred from. 0 for published records
 }
 
 type Publisher struct {
 	pb.PubSubServer
 	publisherBase
-	wg sync.WaitGroup
+	wg     sync.WaitGroup
+	topics sync.Map // topics being published. a topic is published by one publication at a time
 }
 
 func NewPublisher(id string, address string, db *storage.DB, bootstrapper *bootstrapping.BootstrapService,
-	publishedOffsets, fetchedOffsets storage.TopicFragmentOffsets) Publisher {
+	publishedOffsets, fetchedOffsets storage.TopicFragmentOffsets, dedupWindows *storage.DedupWindows, rateLimits *RateLimits,
+	batchPolicy BatchPolicy, quota StoreQuota) Publisher {
+	notifier := newFragmentNotifier()
 	return Publisher{
 		publisherBase: publisherBase{
 			id:                    id,
@@ -280,24 +604,53 @@ func NewPublisher(id string, address string, db *storage.DB, bootstrapper *boots
 			bootstrapper:          bootstrapper,
 			currentPublishOffsets: publishedOffsets,
 			lastFetchedOffsets:    fetchedOffsets,
+			notifier:              notifier,
+			readers:               newFragmentReaders(db, notifier),
+			batchPolicy:           batchPolicy,
+			quota:                 quota,
+			dedupWindows:          dedupWindows,
+			rateLimits:            rateLimits,
+			drainer:               newDrainer(),
 		},
 		wg: sync.WaitGroup{},
 	}
 }
 
-func (p *Publisher) StartTopicPublication(ctx context.Context, topicName string, retentionPeriodSec uint64,
+func (p *Publisher) StartTopicPublication(ctx context.Context, topicName string, retention topic.RetentionPolicy,
 	inStream chan TopicData) (chan error, error) {
 
+	if _, loaded := p.topics.LoadOrStore(topicName, struct{}{}); loaded {
+		return nil, qerror.InvalidStateError{State: fmt.Sprintf("publication already exists for topic(%s)", topicName)}
+	}
+	drained, err := p.drainer.startPublication()
+	if err != nil {
+		p.topics.Delete(topicName)
+		return nil, err
+	}
+
 	// register watcher for topic fragment info
 	watcherCtx, cancel := context.WithCancel(ctx)
-	fragmentWatchCh, fragMappings, topicOption, err := p.prepare(watcherCtx, topicName)
+	fragmentWatchCh, fragMappings, topicInfo, err := p.prepare(watcherCtx, topicName)
 	if err != nil {
 		cancel()
+		drained()
+		p.topics.Delete(topicName)
+		return nil, err
+	}
+	topicOption := topicInfo.Options()
+	// timestamps of a fragment should not decrease across publications, so they are raised to the stored records
+	lastTimestamp, err := p.db.LastRecordTimestamp(topicName)
+	if err != nil {
+		cancel()
+		drained()
+		p.topics.Delete(topicName)
 		return nil, err
 	}
 	getFragmentsToWrite, transferCh, err := p.setupTopicWriter(ctx, &p.wg, topicName, topicOption, fragMappings)
 	if err != nil {
 		cancel()
+		drained()
+		p.topics.Delete(topicName)
 		return nil, err
 	}
 
@@ -310,44 +663,77 @@ func (p *Publisher) StartTopicPublication(ctx context.Context, topicName string,
 	}
 
 	errCh := make(chan error, 2)
+	batch := newPublishBatch(topicName, retention, topicOption, topicInfo.Compression())
+	batch.lastTimestamp = lastTimestamp
 	p.wg.Add(1)
 	go func() {
 		defer close(errCh)
+		defer p.topics.Delete(topicName)
 		defer p.wg.Done()
 		defer cancel()
+		defer drained()
+		// records not written when the publication stops are completed with the error, so no receipt is left waiting
+		defer batch.complete(qerror.InvalidStateError{State: fmt.Sprintf("publication of topic(%s) stopped", topicName)})
 		for {
 			select {
+			case <-p.drainer.publishing:
+				logger.Info("stop publishing: draining", zap.String("publisher-id", p.id))
+				if err = p.drainPublication(ctx, batch, inStreams, getFragmentsToWrite, errCh); err != nil {
+					errCh <- err
+				}
+				return
 			case <-ctx.Done():
 				logger.Info("stop publishing: ctx.Done()", zap.String("publisher-id", p.id))
+				if err = p.flushBatch(ctx, batch, errCh); err != nil {
+					errCh <- err
+				}
 				return
 			case data, ok := <-inStreams:
 				if !ok {
 					logger.Info("stop publishing: send buffer closed", zap.String("publisher-id", p.id))
+					if err = p.flushBatch(ctx, batch, errCh); err != nil {
+						errCh <- err
+					}
 					return
 				}
-				for _, fragmentId := range getFragmentsToWrite() {
-					fragKey := storage.NewFragmentKey(topicName, fragmentId)
-					value, _ := p.currentPublishOffsets.LoadOrStore(fragKey, uint64(1))
-					currentOffset := value.(uint64)
-					err = p.onReceiveData(data, topicName, fragmentId, currentOffset, retentionPeriodSec)
-					if err != nil {
+				p.addToBatch(batch, data, getFragmentsToWrite)
+				opened := p.gatherRecords(batch, inStreams, getFragmentsToWrite)
+				if !opened || batch.isFull(p.batchPolicy) || p.batchPolicy.FlushInterval == 0 {
+					if err = p.flushBatch(ctx, batch, errCh); err != nil {
 						errCh <- err
 						return
 					}
-					p.currentPublishOffsets.Store(fragKey, currentOffset+1)
+				} else {
+					batch.startTimer(p.batchPolicy.FlushInterval)
+				}
+				if !opened {
+					logger.Info("stop publishing: send buffer closed", zap.String("publisher-id", p.id))
+					return
+				}
+			case <-batch.timeout():
+				if err = p.flushBatch(ctx, batch, errCh); err != nil {
+					errCh <- err
+					return
 				}
 			case fragMappingInfo, ok := <-fragmentWatchCh:
 				if !ok {
 					logger.Error("stop publishing: watch closed", zap.String("publisher-id", p.id))
-					errCh <- qerror.InvalidStateError{State: "watcher channel closed unexpectedly"}
+					err = qerror.InvalidStateError{State: "watcher channel closed unexpectedly"}
+					batch.complete(err)
+					errCh <- err
 					return
 				}
 				logger.Info("received new fragment mapping info", zap.String("topic", topicName))
 
 				if p.isMappingUpdated(fragMappingInfo) {
+					// records gathered before are written to the previous fragments
+					if err = p.flushBatch(ctx, batch, errCh); err != nil {
+						errCh <- err
+						return
+					}
 					// reset publishing fragments
 					logger.Info("resetting publishing fragments", zap.String("publisher-id", p.id))
-					writeFn, staleCh, err := p.setupTopicWriter(ctx, &p.wg, topicName, topicOption, fragMappings)
+					writeFn, staleCh, err := p.setupTopicWriter(ctx, &p.wg, topicName, topicOption, fragMappingInfo)
 					if err != nil {
 						logger.Error("failed to reset publishing fragments", zap.String("publisher-id", p.id))
 						errCh <- err
@@ -368,19 +754,77 @@ func (p *Publisher) StartTopicPublication(ctx context.Context, topicName string,
 
 // gRPC implementation
 
+// Subscribe sends the records of the subscription without flow control
 func (p *Publisher) Subscribe(subscription *pb.Subscription, stream pb.PubSub_SubscribeServer) error {
-	sendBuf := make(chan *pb.SubscriptionResult_Fetched)
-	defer close(sendBuf)
+	return p.subscribe(subscription, stream, newStreamCredit(nil))
+}
+
+// SubscribeWithCredit sends the records of the subscription while the credit granted by the subscriber remains
+func (p *Publisher) SubscribeWithCredit(stream pb.PubSub_SubscribeWithCreditServer) error {
+	request, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	// get subscription
+	var subscription *pb.Subscription
+	switch v := request.Type.(type) {
+	case *pb.SubscriptionRequest_Subscription:
+		subscription = v.Subscription
+	default:
+		return qerror.ValidationError{
+			Value:   "Credit",
+			HintMsg: "Initial request should be a Subscription",
+		}
+	}
+	credit := newStreamCredit(subscription.Credit)
+
+	// receive credits granted by the subscriber
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		for {
+			request, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			if v, ok := request.Type.(*pb.SubscriptionRequest_Credit); ok {
+				credit.grant(v.Credit)
+			} else {
+				logger.Error("invalid request of subscription stream", zap.String("publisher-id", p.id))
+			}
+		}
+	}()
+
+	return p.subscribe(subscription, stream, credit)
+}
+
+// subscriptionSender is the server stream of Subscribe and SubscribeWithCredit
+type subscriptionSender interface {
+	Send(*pb.SubscriptionResult) error
+	Context() context.Context
+}
+
+func (p *Publisher) subscribe(subscription *pb.Subscription, stream subscriptionSender, credit *streamCredit) error {
+	sendBuf := make(chan fetchedRecord)
+	lag := newStreamLag(stream, subscription.TopicName)
+	defer lag.clear()
+	limiter := p.rateLimits.acquire(stream.Context(), subscription.TopicName)
+	defer limiter.release()
 
 	dontWait := false
 	var batched []*pb.SubscriptionResult_Fetched
 	maxBatchSize := int(subscription.MaxBatchSize)
+	accepted := newAcceptedCodecs(subscription.Compressions)
 
 	flushIntervalMs := time.Millisecond * time.Duration(subscription.FlushInterval)
 	timer := time.NewTimer(flushIntervalMs)
 	defer timer.Stop()
 
 	flush := func() error {
+		if err := limiter.wait(stream.Context(), batched); err != nil {
+			return err
+		}
 		if err := stream.Send(&pb.SubscriptionResult{Magic: 1, Results: batched}); err != nil {
 			logger.Error(err.Error())
 			return err
@@ -391,6 +835,8 @@ func (p *Publisher) Subscribe(subscription *pb.Subscription, stream pb.PubSub_Su
 			zap.Int("num data", len(batched)),
 			zap.Uint64("last seqNum", batched[len(batched)-1].SeqNum))
 
+		lag.onSent(batched)
+		lag.update(p.currentPublishOffsets)
 		timer.Reset(flushIntervalMs)
 		batched = nil
 		dontWait = false
@@ -403,38 +849,58 @@ func (p *Publisher) Subscribe(subscription *pb.Subscription, stream pb.PubSub_Su
 	logger.Info("received new subscription stream", zap.String("publisher-id", p.id), zap.String("topic", subscription.TopicName))
 
 	for _, offsetInfo := range subscription.Offsets {
-		var startOffset uint64
-		// when start offset is not set, set current offset as last offset
-		if offsetInfo.StartOffset == nil {
-			value, _ := p.currentPublishOffsets.Load(storage.NewFragmentKey(subscription.TopicName, uint(offsetInfo.FragmentId)))
-			currentOffset := value.(uint64)
-			startOffset = currentOffset
-		} else {
-			startOffset = *offsetInfo.StartOffset
-		}
-		if startOffset == 0 {
-			logger.Warn("start offset should be greater than 0. adjust start offset to 1", zap.String("publisher-id", p.id))
-			startOffset = 1
+		startOffset, err := p.resolveStartOffset(subscription.TopicName, offsetInfo)
+		if err != nil {
+			return err
 		}
 		p.onFetchData(ctx, &p.wg, subscription.TopicName, offsetInfo.FragmentId, startOffset, sendBuf)
+		lag.start(offsetInfo.FragmentId, startOffset)
 	}
 
 	p.wg.Add(1)
 	defer p.wg.Done()
+	drainCh := p.drainer.streaming
+	draining := false
 	for {
+		if draining && len(batched) == 0 && lag.caughtUp(p.currentPublishOffsets) {
+			logger.Debug("stream drained", zap.String("publisher-id", p.id))
+			return nil
+		}
+		// fetched records are not received until the subscriber grants credit
+		recvBuf := sendBuf
+		if !credit.allows() {
+			recvBuf = nil
+		}
 		select {
 		case <-stream.Context().Done():
 			logger.Debug("stream closed from client", zap.String("publisher-id", p.id))
 			return nil
 
-		case fetched := <-sendBuf:
-			batched = append(batched, fetched)
-			if len(batched) >= maxBatchSize || (len(batched) > 0 && dontWait) {
+		case <-drainCh:
+			// send the records written so far without waiting for full batches
+			drainCh = nil
+			draining = true
+		case <-credit.granted:
+		case fetched := <-recvBuf:
+			if fetched.skipped {
+				lag.skip(fetched.FragmentId, fetched.Offset)
+				continue
+			}
+			record, err := accepted.negotiate(fetched.SubscriptionResult_Fetched)
+			if err != nil {
+				logger.Error("skip record cannot be decompressed", zap.Error(err), zap.String("publisher-id", p.id))
+				lag.skip(fetched.FragmentId, fetched.Offset)
+				continue
+			}
+			credit.consume(record)
+			batched = append(batched, record)
+			if len(batched) >= maxBatchSize || (len(batched) > 0 && dontWait) || !credit.allows() || draining {
 				if err := flush(); err != nil {
 					return err
 				}
 			}
 		case <-timer.C:
+			lag.update(p.currentPublishOffsets)
 			if len(batched) > 0 {
 				if err := flush(); err != nil {
 					timer.Reset(flushIntervalMs)
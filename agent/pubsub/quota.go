@@ -0,0 +1,43 @@
+package pubsub
+
+import (
+	"github.com/paust-team/pirius/qerror"
+)
+
+// QuotaPolicy decides how to publish records when the store is over quota
+type QuotaPolicy int
+
+const (
+	DropOldest    QuotaPolicy = iota // delete the oldest records of the fragments to make room
+	BlockPublish                     // wait until expired records are deleted
+	RejectPublish                    // discard the records with qerror.QuotaExceededError
+)
+
+func ParseQuotaPolicy(policy string) (QuotaPolicy, error) {
+	switch policy {
+	case "drop-oldest":
+		return DropOldest, nil
+	case "block":
+		return BlockPublish, nil
+	case "reject":
+		return RejectPublish, nil
+	}
+	return 0, qerror.ValidationError{Value: policy, HintMsg: "quota policy should be one of drop-oldest, block and reject"}
+}
+
+func (q QuotaPolicy) String() string {
+	switch q {
+	case BlockPublish:
+		return "block"
+	case RejectPublish:
+		return "reject"
+	default:
+		return "drop-oldest"
+	}
+}
+
+// StoreQuota limits the stored bytes of the agent. the max bytes of each topic are set by its retention policy
+type StoreQuota struct {
+	MaxBytes uint64 // 0 means unlimited
+	Policy   QuotaPolicy
+}
@@ -0,0 +1,74 @@
+package pubsub
+
+import (
+	"context"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/paust-team/pirius/agent/storage"
+	"github.com/paust-team/pirius/bootstrapping/topic"
+	"github.com/paust-team/pirius/compression"
+	"github.com/paust-team/pirius/qerror"
+)
+
+var _ = Describe("Quota", func() {
+	var db *storage.DB
+	var publisher publisherBase
+	var batch *publishBatch
+	numRecords := 10
+
+	// a topic named agent should not be taken for the quota of the agent
+	newBatch := func(maxBytes uint64) *publishBatch {
+		batch := newPublishBatch("agent", topic.RetentionPolicy{PeriodSec: 3600, MaxBytes: maxBytes}, 0, compression.None)
+		err := batch.add(TopicData{SeqNum: uint64(numRecords), Data: []byte("new-record")}, []uint{1},
+			storage.NewTopicFragmentOffsets(map[storage.FragmentKey]uint64{storage.NewFragmentKey("agent", 1): uint64(numRecords)}))
+		Expect(err).NotTo(HaveOccurred())
+		return batch
+	}
+
+	BeforeEach(func() {
+		var err error
+		db, err = storage.NewDB(storage.MemoryEngine, "quota", ".")
+		Expect(err).NotTo(HaveOccurred())
+		for _, topicName := range []string{"agent", "other"} {
+			for offset := 0; offset < numRecords; offset++ {
+				err = db.PutRecord(topicName, 1, uint64(offset), uint64(offset), []byte("old-record"), storage.GetNowTimestamp()+3600)
+				Expect(err).NotTo(HaveOccurred())
+			}
+		}
+		publisher = publisherBase{id: "test-publisher", db: db, quota: StoreQuota{Policy: DropOldest}}
+	})
+	AfterEach(func() {
+		db.Close()
+		db.Destroy()
+	})
+
+	When("the quota of a topic named agent is exceeded", func() {
+		BeforeEach(func() {
+			batch = newBatch(db.TopicSize("agent"))
+		})
+
+		It("drops the oldest records of the topic only", func() {
+			otherSize := db.TopicSize("other")
+			quotaErr, exceeded := publisher.checkQuota(batch)
+			Expect(exceeded).To(BeTrue())
+			Expect(quotaErr.AgentWide).To(BeFalse())
+
+			Expect(publisher.ensureQuota(context.Background(), batch)).To(Succeed())
+			Expect(db.TopicSize("other")).To(Equal(otherSize))
+			Expect(db.TopicSize("agent") + uint64(batch.numBytes)).To(BeNumerically("<=", batch.maxBytes))
+		})
+	})
+
+	When("the quota of the agent is exceeded", func() {
+		BeforeEach(func() {
+			batch = newBatch(0)
+			publisher.quota.MaxBytes = db.TotalSize()
+		})
+
+		It("reports the quota of the agent", func() {
+			quotaErr, exceeded := publisher.checkQuota(batch)
+			Expect(exceeded).To(BeTrue())
+			Expect(quotaErr).To(Equal(qerror.QuotaExceededError{Topic: "agent", AgentWide: true, Size: db.TotalSize(), MaxBytes: db.TotalSize()}))
+		})
+	})
+})
@@ -0,0 +1,343 @@
+package pubsub
+
+import (
+	"context"
+	"github.com/paust-team/pirius/proto/pb"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/protobuf/proto"
+	"net"
+	"sync"
+	"time"
+)
+
+// anonymousSubscriber is the bucket of subscriptions whose peer address is unknown
+const anonymousSubscriber = "anonymous"
+
+// RateLimit limits the records sent to subscribers per second. 0 means unlimited
+type RateLimit struct {
+	RecordsPerSec uint64
+	BytesPerSec   uint64
+}
+
+// RateLimits keeps token buckets of topics and subscribers. The bucket of a topic is shared by all subscribers of the topic,
+// and the bucket of a subscriber is shared by all topics it subscribes. A subscriber is identified by its host address,
+// which cannot be changed by a subscription like its subscriber id. Limits can be changed while records are sent.
+// Buckets without a limit set explicitly are removed when their last stream ends
+type RateLimits struct {
+	mu              sync.Mutex
+	topicLimit      func(topicName string) RateLimit // initial limit of a topic
+	subscriberLimit func(host string) RateLimit
+	topics          map[string]*rateLimiter
+	subscribers     map[string]*rateLimiter
+	changed         chan struct{} // closed when a limit is changed, to wake up waiting streams
+}
+
+// NewRateLimits creates limits resolving the initial limit of a topic or a subscriber host by the given functions
+func NewRateLimits(topicLimit func(topicName string) RateLimit, subscriberLimit func(host string) RateLimit) *RateLimits {
+	return &RateLimits{
+		topicLimit:      topicLimit,
+		subscriberLimit: subscriberLimit,
+		topics:          make(map[string]*rateLimiter),
+		subscribers:     make(map[string]*rateLimiter),
+		changed:         make(chan struct{}),
+	}
+}
+
+func (r *RateLimits) SetTopicLimit(topicName string, limit RateLimit) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.setLimit(r.topics, topicName, r.topicLimit, limit)
+}
+
+// SetSubscriberLimit sets the limit of the subscribers of the host
+func (r *RateLimits) SetSubscriberLimit(host string, limit RateLimit) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.setLimit(r.subscribers, host, r.subscriberLimit, limit)
+}
+
+func (r *RateLimits) setLimit(limiters map[string]*rateLimiter, name string, initialLimit func(string) RateLimit, limit RateLimit) {
+	limiter := r.limiter(limiters, name, initialLimit)
+	limiter.explicit = true
+	limiter.set(limit)
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+func (r *RateLimits) TopicLimit(topicName string) RateLimit {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return limitOf(r.topics, topicName, r.topicLimit)
+}
+
+func (r *RateLimits) SubscriberLimit(host string) RateLimit {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return limitOf(r.subscribers, host, r.subscriberLimit)
+}
+
+// TopicLimits returns the limits of the topics which are being sent to or set
+func (r *RateLimits) TopicLimits() map[string]RateLimit {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return limitsOf(r.topics)
+}
+
+// SubscriberLimits returns the limits of the subscriber hosts which are being sent to or set
+func (r *RateLimits) SubscriberLimits() map[string]RateLimit {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return limitsOf(r.subscribers)
+}
+
+// acquire returns the limiter of a subscription stream to the topic, limited by the buckets of the topic and the peer
+// host of the stream. It should be released when the stream ends
+func (r *RateLimits) acquire(ctx context.Context, topicName string) *streamLimiter {
+	if r == nil {
+		return nil
+	}
+	host := peerHost(ctx)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	topicLimiter := r.limiter(r.topics, topicName, r.topicLimit)
+	subscriberLimiter := r.limiter(r.subscribers, host, r.subscriberLimit)
+	topicLimiter.streams++
+	subscriberLimiter.streams++
+	return &streamLimiter{
+		rateLimits: r,
+		topicName:  topicName,
+		host:       host,
+		limiters:   []*rateLimiter{topicLimiter, subscriberLimiter},
+	}
+}
+
+func (r *RateLimits) limiter(limiters map[string]*rateLimiter, name string, initialLimit func(string) RateLimit) *rateLimiter {
+	limiter, ok := limiters[name]
+	if !ok {
+		limiter = &rateLimiter{}
+		if initialLimit != nil {
+			limiter.set(initialLimit(name))
+		}
+		limiters[name] = limiter
+	}
+	return limiter
+}
+
+// releaseLimiter removes the limiter when its last stream ends, unless its limit has been set explicitly
+func (r *RateLimits) releaseLimiter(limiters map[string]*rateLimiter, name string) {
+	limiter, ok := limiters[name]
+	if !ok {
+		return
+	}
+	if limiter.streams--; limiter.streams <= 0 && !limiter.explicit {
+		delete(limiters, name)
+	}
+}
+
+// peerHost returns the host of the subscriber connected to the stream of ctx
+func peerHost(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return anonymousSubscriber
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// streamLimiter limits the records sent by a subscription stream
+type streamLimiter struct {
+	rateLimits *RateLimits
+	topicName  string
+	host       string
+	limiters   []*rateLimiter
+}
+
+// wait blocks until the records can be sent within the limits of the topic and the subscriber
+func (l *streamLimiter) wait(ctx context.Context, records []*pb.SubscriptionResult_Fetched) error {
+	if l == nil {
+		return nil
+	}
+	var numBytes int
+	for _, record := range records {
+		numBytes += proto.Size(record)
+	}
+
+	l.rateLimits.mu.Lock()
+	changed := l.rateLimits.changed
+	l.rateLimits.mu.Unlock()
+
+	// tokens are taken from all buckets at once, and the records wait for the slowest bucket
+	now := time.Now()
+	reservations := make([]reservation, len(l.limiters))
+	for i, limiter := range l.limiters {
+		reservations[i] = limiter.reserve(len(records), numBytes, now)
+	}
+	for {
+		var delay time.Duration
+		now = time.Now()
+		for i, limiter := range l.limiters {
+			if d := limiter.delay(reservations[i], now); d > delay {
+				delay = d
+			}
+		}
+		if delay == 0 {
+			return nil
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+			return nil
+		case <-changed: // the rest of the wait follows the changed limits
+			timer.Stop()
+			l.rateLimits.mu.Lock()
+			changed = l.rateLimits.changed
+			l.rateLimits.mu.Unlock()
+		}
+	}
+}
+
+// release removes the buckets of the stream which are not used by other streams
+func (l *streamLimiter) release() {
+	if l == nil {
+		return
+	}
+	l.rateLimits.mu.Lock()
+	defer l.rateLimits.mu.Unlock()
+	l.rateLimits.releaseLimiter(l.rateLimits.topics, l.topicName)
+	l.rateLimits.releaseLimiter(l.rateLimits.subscribers, l.host)
+}
+
+func limitOf(limiters map[string]*rateLimiter, name string, initialLimit func(string) RateLimit) RateLimit {
+	if limiter, ok := limiters[name]; ok {
+		return limiter.get()
+	}
+	if initialLimit != nil {
+		return initialLimit(name)
+	}
+	return RateLimit{}
+}
+
+func limitsOf(limiters map[string]*rateLimiter) map[string]RateLimit {
+	limits := make(map[string]RateLimit, len(limiters))
+	for name, limiter := range limiters {
+		limits[name] = limiter.get()
+	}
+	return limits
+}
+
+// rateLimiter limits records and bytes by a token bucket for each
+type rateLimiter struct {
+	mu       sync.Mutex
+	records  tokenBucket
+	bytes    tokenBucket
+	streams  int  // streams using the limiter. guarded by the mutex of RateLimits
+	explicit bool // the limit has been set explicitly. guarded by the mutex of RateLimits
+}
+
+func (l *rateLimiter) set(limit RateLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.records.setRate(limit.RecordsPerSec, now)
+	l.bytes.setRate(limit.BytesPerSec, now)
+}
+
+func (l *rateLimiter) get() RateLimit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return RateLimit{RecordsPerSec: l.records.rate, BytesPerSec: l.bytes.rate}
+}
+
+// reservation is the level of refilled tokens of each bucket at which reserved tokens are paid
+type reservation struct {
+	records float64
+	bytes   float64
+}
+
+func (l *rateLimiter) reserve(numRecords, numBytes int, now time.Time) reservation {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return reservation{
+		records: l.records.reserve(float64(numRecords), now),
+		bytes:   l.bytes.reserve(float64(numBytes), now),
+	}
+}
+
+// delay returns the time until the reserved tokens are paid at the current rates
+func (l *rateLimiter) delay(r reservation, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delay := l.records.delay(r.records, now)
+	if d := l.bytes.delay(r.bytes, now); d > delay {
+		delay = d
+	}
+	return delay
+}
+
+// tokenBucket is refilled by `rate` tokens per second and holds tokens of a second at most
+type tokenBucket struct {
+	rate     uint64 // 0 means unlimited
+	tokens   float64
+	refilled float64 // tokens refilled so far. reserved tokens are paid when it reaches their level
+	last     time.Time
+}
+
+func (b *tokenBucket) setRate(rate uint64, now time.Time) {
+	if b.rate == 0 { // start with a full bucket
+		b.tokens = float64(rate)
+	} else {
+		b.refill(now)
+	}
+	b.rate = rate
+	b.last = now
+	if b.tokens > float64(rate) {
+		b.tokens = float64(rate)
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		tokens := elapsed.Seconds() * float64(b.rate)
+		if b.tokens+tokens > float64(b.rate) {
+			tokens = float64(b.rate) - b.tokens
+		}
+		if tokens > 0 {
+			b.tokens += tokens
+			b.refilled += tokens
+		}
+		b.last = now
+	}
+}
+
+// reserve takes n tokens and returns the level of refilled tokens at which they are paid.
+// Tokens can be taken over the bucket, so a batch larger than the rate waits proportionally
+func (b *tokenBucket) reserve(n float64, now time.Time) float64 {
+	if b.rate == 0 {
+		return b.refilled
+	}
+	b.refill(now)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return b.refilled
+	}
+	return b.refilled - b.tokens
+}
+
+// delay returns the time until the tokens are refilled to the level at the current rate
+func (b *tokenBucket) delay(level float64, now time.Time) time.Duration {
+	if b.rate == 0 {
+		return 0
+	}
+	b.refill(now)
+	if level <= b.refilled {
+		return 0
+	}
+	return time.Duration((level - b.refilled) / float64(b.rate) * float64(time.Second))
+}
@@ -0,0 +1,38 @@
+package pubsub_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/paust-team/pirius/agent/pubsub"
+)
+
+var _ = Describe("RateLimits", func() {
+	var rateLimits *pubsub.RateLimits
+
+	BeforeEach(func() {
+		rateLimits = pubsub.NewRateLimits(
+			func(topicName string) pubsub.RateLimit {
+				if topicName == "limited" {
+					return pubsub.RateLimit{RecordsPerSec: 10, BytesPerSec: 1024}
+				}
+				return pubsub.RateLimit{}
+			},
+			func(host string) pubsub.RateLimit {
+				return pubsub.RateLimit{RecordsPerSec: 5}
+			})
+	})
+
+	It("resolves initial limits of topics and subscribers", func() {
+		Expect(rateLimits.TopicLimit("limited")).To(Equal(pubsub.RateLimit{RecordsPerSec: 10, BytesPerSec: 1024}))
+		Expect(rateLimits.TopicLimit("unlimited")).To(Equal(pubsub.RateLimit{}))
+		Expect(rateLimits.SubscriberLimit("10.0.0.5")).To(Equal(pubsub.RateLimit{RecordsPerSec: 5}))
+	})
+
+	It("changes limits at runtime", func() {
+		rateLimits.SetTopicLimit("limited", pubsub.RateLimit{RecordsPerSec: 100})
+		rateLimits.SetSubscriberLimit("10.0.0.5", pubsub.RateLimit{})
+
+		Expect(rateLimits.TopicLimits()).To(Equal(map[string]pubsub.RateLimit{"limited": {RecordsPerSec: 100}}))
+		Expect(rateLimits.SubscriberLimits()).To(Equal(map[string]pubsub.RateLimit{"10.0.0.5": {}}))
+	})
+})
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/paust-team/pirius/agent/storage"
 	"github.com/paust-team/pirius/bootstrapping"
+	"github.com/paust-team/pirius/bootstrapping/topic"
 	"github.com/paust-team/pirius/helper"
 	"github.com/paust-team/pirius/logger"
 	"github.com/paust-team/pirius/proto/pb"
@@ -28,6 +29,9 @@ type TopicDataResult struct {
 	FragmentId uint32
 	SeqNum     uint64
 	Data       []byte
+	Key        []byte
+	Timestamp  uint64
+	Headers    map[string]string
 }
 
 type RetrievablePublisher struct {
@@ -38,7 +42,9 @@ type RetrievablePublisher struct {
 }
 
 func NewRetrievablePublisher(id string, address string, db *storage.DB, bootstrapper *bootstrapping.BootstrapService,
-	publishedOffsets, fetchedOffsets storage.TopicFragmentOffsets) RetrievablePublisher {
+	publishedOffsets, fetchedOffsets storage.TopicFragmentOffsets, dedupWindows *storage.DedupWindows, rateLimits *RateLimits,
+	batchPolicy BatchPolicy, quota StoreQuota) RetrievablePublisher {
+	notifier := newFragmentNotifier()
 	return RetrievablePublisher{
 		publisherBase: publisherBase{
 			id:                    id,
@@ -47,25 +53,47 @@ func NewRetrievablePublisher(id string, address string, db *storage.DB, bootstra
 			bootstrapper:          bootstrapper,
 			currentPublishOffsets: publishedOffsets,
 			lastFetchedOffsets:    fetchedOffsets,
+			notifier:              notifier,
+			readers:               newFragmentReaders(db, notifier),
+			batchPolicy:           batchPolicy,
+			quota:                 quota,
+			dedupWindows:          dedupWindows,
+			rateLimits:            rateLimits,
+			drainer:               newDrainer(),
 		},
 		wg:            sync.WaitGroup{},
 		topicContexts: sync.Map{},
 	}
 }
 
-func (p *RetrievablePublisher) StartTopicPublication(ctx context.Context, topicName string, retentionPeriodSec uint64,
+func (p *RetrievablePublisher) StartTopicPublication(ctx context.Context, topicName string, retention topic.RetentionPolicy,
 	inStream chan TopicData) (chan []TopicDataResult, chan error, error) {
 
+	drained, err := p.drainer.startPublication()
+	if err != nil {
+		return nil, nil, err
+	}
+
 	// register watcher for topic fragment info
 	pubCtx, cancel := context.WithCancel(ctx)
-	fragmentWatchCh, fragMappings, topicOption, err := p.prepare(pubCtx, topicName)
+	fragmentWatchCh, fragMappings, topicInfo, err := p.prepare(pubCtx, topicName)
 	if err != nil {
 		cancel()
+		drained()
+		return nil, nil, err
+	}
+	topicOption := topicInfo.Options()
+	// timestamps of a fragment should not decrease across publications, so they are raised to the stored records
+	lastTimestamp, err := p.db.LastRecordTimestamp(topicName)
+	if err != nil {
+		cancel()
+		drained()
 		return nil, nil, err
 	}
 	getFragmentsToWrite, transferCh, err := p.setupTopicWriter(ctx, &p.wg, topicName, topicOption, fragMappings)
 	if err != nil {
 		cancel()
+		drained()
 		return nil, nil, err
 	}
 
@@ -79,6 +107,7 @@ func (p *RetrievablePublisher) StartTopicPublication(ctx context.Context, topicN
 
 	if _, ok := p.topicContexts.Load(topicName); ok {
 		cancel()
+		drained()
 		return nil, nil, qerror.InvalidStateError{State: fmt.Sprintf("stream already exists for topic(%s)", topicName)}
 	}
 
@@ -91,6 +120,8 @@ func (p *RetrievablePublisher) StartTopicPublication(ctx context.Context, topicN
 		topicWg:    &topicWg,
 	})
 	errCh := make(chan error, 2)
+	batch := newPublishBatch(topicName, retention, topicOption, topicInfo.Compression())
+	batch.lastTimestamp = lastTimestamp
 	p.wg.Add(1)
 	go func() {
 		defer p.wg.Done()
@@ -101,36 +132,70 @@ func (p *RetrievablePublisher) StartTopicPublication(ctx context.Context, topicN
 			close(retrieveCh)
 			p.topicContexts.Delete(topicName)
 		}()
+		defer drained()
+		// records not written when the publication stops are completed with the error, so no receipt is left waiting
+		defer batch.complete(qerror.InvalidStateError{State: fmt.Sprintf("publication of topic(%s) stopped", topicName)})
 		for {
 			select {
+			case <-p.drainer.publishing:
+				logger.Info("stop publishing: draining", zap.String("publisher-id", p.id))
+				if err = p.drainPublication(ctx, batch, inStreams, getFragmentsToWrite, errCh); err != nil {
+					errCh <- err
+					return
+				}
+				drained()
+				// the topic context is kept for subscription streams to drain and to send back results
+				<-ctx.Done()
+				return
 			case <-ctx.Done():
 				logger.Info("stop publishing: ctx.Done()", zap.String("publisher-id", p.id))
+				if err = p.flushBatch(ctx, batch, errCh); err != nil {
+					errCh <- err
+				}
 				return
 			case data, ok := <-inStreams:
 				if !ok {
 					logger.Info("stop publishing: send buffer closed", zap.String("publisher-id", p.id))
+					if err = p.flushBatch(ctx, batch, errCh); err != nil {
+						errCh <- err
+					}
 					return
 				}
-				for _, fragmentId := range getFragmentsToWrite() {
-					fragKey := storage.NewFragmentKey(topicName, fragmentId)
-					value, _ := p.currentPublishOffsets.LoadOrStore(fragKey, uint64(1))
-					currentOffset := value.(uint64)
-					err = p.onReceiveData(data, topicName, fragmentId, currentOffset, retentionPeriodSec)
-					if err != nil {
+				p.addToBatch(batch, data, getFragmentsToWrite)
+				opened := p.gatherRecords(batch, inStreams, getFragmentsToWrite)
+				if !opened || batch.isFull(p.batchPolicy) || p.batchPolicy.FlushInterval == 0 {
+					if err = p.flushBatch(ctx, batch, errCh); err != nil {
 						errCh <- err
 						return
 					}
-					p.currentPublishOffsets.Store(fragKey, currentOffset+1)
+				} else {
+					batch.startTimer(p.batchPolicy.FlushInterval)
+				}
+				if !opened {
+					logger.Info("stop publishing: send buffer closed", zap.String("publisher-id", p.id))
+					return
+				}
+			case <-batch.timeout():
+				if err = p.flushBatch(ctx, batch, errCh); err != nil {
+					errCh <- err
+					return
 				}
 			case fragMappings, ok := <-fragmentWatchCh:
 				if !ok {
 					logger.Error("stop publishing: watch closed", zap.String("publisher-id", p.id))
-					errCh <- qerror.InvalidStateError{State: "watcher channel closed unexpectedly"}
+					err = qerror.InvalidStateError{State: "watcher channel closed unexpectedly"}
+					batch.complete(err)
+					errCh <- err
 					return
 				}
 				logger.Info("received new fragment mapping info", zap.String("topic", topicName))
 
 				if p.isMappingUpdated(fragMappings) {
+					// records gathered before are written to the previous fragments
+					if err = p.flushBatch(ctx, batch, errCh); err != nil {
+						errCh <- err
+						return
+					}
 					// reset publishing fragments
 					logger.Info("resetting publishing fragments", zap.String("publisher-id", p.id))
 					writeFn, staleCh, err := p.setupTopicWriter(ctx, &p.wg, topicName, topicOption, fragMappings)
@@ -180,18 +245,26 @@ func (p *RetrievablePublisher) RetrievableSubscribe(stream pb.RetrievablePubSub_
 		}
 	}
 	topicCtx := v.(*topicContext)
-	sendBuf := make(chan *pb.SubscriptionResult_Fetched)
-	defer close(sendBuf)
+	sendBuf := make(chan fetchedRecord)
+	credit := newStreamCredit(subscription.Credit)
+	lag := newStreamLag(stream, subscription.TopicName)
+	defer lag.clear()
+	limiter := p.rateLimits.acquire(stream.Context(), subscription.TopicName)
+	defer limiter.release()
 
 	dontWait := false
 	var batched []*pb.SubscriptionResult_Fetched
 	maxBatchSize := int(subscription.MaxBatchSize)
+	accepted := newAcceptedCodecs(subscription.Compressions)
 
 	flushIntervalMs := time.Millisecond * time.Duration(subscription.FlushInterval)
 	timer := time.NewTimer(flushIntervalMs)
 	defer timer.Stop()
 
 	flush := func() error {
+		if err := limiter.wait(stream.Context(), batched); err != nil {
+			return err
+		}
 		if err := stream.Send(&pb.SubscriptionResult{Magic: 1, Results: batched}); err != nil {
 			logger.Error(err.Error())
 			return err
@@ -202,6 +275,8 @@ func (p *RetrievablePublisher) RetrievableSubscribe(stream pb.RetrievablePubSub_
 			zap.Int("num data", len(batched)),
 			zap.Uint64("last seqNum", batched[len(batched)-1].SeqNum))
 
+		lag.onSent(batched)
+		lag.update(p.currentPublishOffsets)
 		timer.Reset(flushIntervalMs)
 		batched = nil
 		dontWait = false
@@ -214,20 +289,12 @@ func (p *RetrievablePublisher) RetrievableSubscribe(stream pb.RetrievablePubSub_
 	logger.Info("received new retrievable subscription stream", zap.String("publisher-id", p.id), zap.String("topic", subscription.TopicName))
 
 	for _, offsetInfo := range subscription.Offsets {
-		var startOffset uint64
-		// when start offset is not set, set current offset as last offset
-		if offsetInfo.StartOffset == nil {
-			value, _ := p.currentPublishOffsets.Load(storage.NewFragmentKey(subscription.TopicName, uint(offsetInfo.FragmentId)))
-			currentOffset := value.(uint64)
-			startOffset = currentOffset
-		} else {
-			startOffset = *offsetInfo.StartOffset
-		}
-		if startOffset == 0 {
-			logger.Warn("start offset should be greater than 0. adjust start offset to 1", zap.String("publisher-id", p.id))
-			startOffset = 1
+		startOffset, err := p.resolveStartOffset(subscription.TopicName, offsetInfo)
+		if err != nil {
+			return err
 		}
 		p.onFetchData(ctx, &p.wg, subscription.TopicName, offsetInfo.FragmentId, startOffset, sendBuf)
+		lag.start(offsetInfo.FragmentId, startOffset)
 	}
 
 	// handle retrieved topic data
@@ -259,6 +326,9 @@ func (p *RetrievablePublisher) RetrievableSubscribe(stream pb.RetrievablePubSub_
 						FragmentId: res.FragmentId,
 						SeqNum:     res.SeqNum,
 						Data:       res.Data,
+						Key:        res.Key,
+						Timestamp:  res.Timestamp,
+						Headers:    res.Headers,
 					})
 				}
 				select {
@@ -271,6 +341,9 @@ func (p *RetrievablePublisher) RetrievableSubscribe(stream pb.RetrievablePubSub_
 						zap.String("publisher-id", p.id))
 				}
 
+			case *pb.RetrievableSubscription_Credit:
+				credit.grant(v.Credit)
+
 			default:
 				logger.Error("invalid request of Bidirection stream")
 			}
@@ -279,8 +352,19 @@ func (p *RetrievablePublisher) RetrievableSubscribe(stream pb.RetrievablePubSub_
 
 	p.wg.Add(1)
 	defer p.wg.Done()
+	drainCh := p.drainer.streaming
+	draining := false
 	// flush to stream when batch is full
 	for {
+		if draining && len(batched) == 0 && lag.caughtUp(p.currentPublishOffsets) {
+			logger.Debug("stream drained", zap.String("topic", subscription.TopicName), zap.String("publisher-id", p.id))
+			return nil
+		}
+		// fetched records are not received until the subscriber grants credit
+		recvBuf := sendBuf
+		if !credit.allows() {
+			recvBuf = nil
+		}
 		select {
 		case <-topicCtx.ctx.Done():
 			logger.Debug("stream closed from topic-ctx.Done()", zap.String("topic", subscription.TopicName), zap.String("publisher-id", p.id))
@@ -289,14 +373,31 @@ func (p *RetrievablePublisher) RetrievableSubscribe(stream pb.RetrievablePubSub_
 			logger.Debug("stream closed from client", zap.String("topic", subscription.TopicName), zap.String("publisher-id", p.id))
 			return nil
 
-		case fetched := <-sendBuf:
-			batched = append(batched, fetched)
-			if len(batched) >= maxBatchSize || (len(batched) > 0 && dontWait) {
+		case <-drainCh:
+			// send the records written so far without waiting for full batches
+			drainCh = nil
+			draining = true
+		case <-credit.granted:
+		case fetched := <-recvBuf:
+			if fetched.skipped {
+				lag.skip(fetched.FragmentId, fetched.Offset)
+				continue
+			}
+			record, err := accepted.negotiate(fetched.SubscriptionResult_Fetched)
+			if err != nil {
+				logger.Error("skip record cannot be decompressed", zap.Error(err), zap.String("publisher-id", p.id))
+				lag.skip(fetched.FragmentId, fetched.Offset)
+				continue
+			}
+			credit.consume(record)
+			batched = append(batched, record)
+			if len(batched) >= maxBatchSize || (len(batched) > 0 && dontWait) || !credit.allows() || draining {
 				if err := flush(); err != nil {
 					logger.Error("error occurred on flushing records", zap.Error(err))
 				}
 			}
 		case <-timer.C:
+			lag.update(p.currentPublishOffsets)
 			if len(batched) > 0 {
 				if err := flush(); err != nil {
 					logger.Error("error occurred on flushing records", zap.Error(err))
@@ -5,18 +5,13 @@ import (
 	"fmt"
 	"github.com/paust-team/pirius/agent/storage"
 	"github.com/paust-team/pirius/bootstrapping"
-	"github.com/paust-team/pirius/constants"
 	"github.com/paust-team/pirius/logger"
 	"github.com/paust-team/pirius/proto/pb"
 	"github.com/paust-team/pirius/qerror"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
-	"io"
 	"runtime"
 	"sync"
-	"time"
 )
 
 type RetrievableSubscriptionResults struct {
@@ -24,23 +19,69 @@ type RetrievableSubscriptionResults struct {
 	SendBack func([]SubscriptionResult) error
 }
 
+// Ack commits the offsets of the results. Results should be acknowledged after they are processed, as SubscriptionResults
+func (r RetrievableSubscriptionResults) Ack() {
+	SubscriptionResults(r.Results).Ack()
+}
+
+// Nack requests redelivery of the results
+func (r RetrievableSubscriptionResults) Nack() {
+	SubscriptionResults(r.Results).Nack()
+}
+
+// retrievableStream holds the current stream of a publisher to send back results after reconnecting
+type retrievableStream struct {
+	mu     sync.Mutex
+	stream pb.RetrievablePubSub_RetrievableSubscribeClient
+}
+
+func (r *retrievableStream) get() pb.RetrievablePubSub_RetrievableSubscribeClient {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stream
+}
+
+func (r *retrievableStream) set(stream pb.RetrievablePubSub_RetrievableSubscribeClient) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stream = stream
+}
+
+func (r *retrievableStream) send(msg *pb.RetrievableSubscription) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stream.Send(msg)
+}
+
+func (r *retrievableStream) closeSend() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stream.CloseSend()
+}
+
 type RetrievableSubscriber struct {
 	subscriberBase
 	wg sync.WaitGroup
 }
 
-func NewRetrievableSubscriber(id string, bootstrapper *bootstrapping.BootstrapService, subscribedOffsets storage.TopicFragmentOffsets) RetrievableSubscriber {
+func NewRetrievableSubscriber(id string, bootstrapper *bootstrapping.BootstrapService, subscribedOffsets storage.TopicFragmentOffsets,
+	reconnectPolicy ReconnectPolicy) RetrievableSubscriber {
 	return RetrievableSubscriber{
 		subscriberBase: subscriberBase{
 			id:                   id,
 			bootstrapper:         bootstrapper,
 			lastSubscribedOffset: subscribedOffsets,
+			reconnectPolicy:      reconnectPolicy,
 		},
 		wg: sync.WaitGroup{},
 	}
 }
 
-func (s *RetrievableSubscriber) StartTopicSubscription(ctx context.Context, topicName string, batchSize, flushInterval uint32) (chan RetrievableSubscriptionResults, chan error, error) {
+// StartTopicSubscription starts to subscribe the topic. Subscribed offsets are committed only when the results are acknowledged,
+// and unacknowledged results are delivered again when the subscription is restarted.
+// The subscription resumes from the committed offsets unless a start position is given by opts.
+func (s *RetrievableSubscriber) StartTopicSubscription(ctx context.Context, topicName string, batchSize, flushInterval uint32,
+	opts ...SubscriptionOption) (chan RetrievableSubscriptionResults, chan error, error) {
 
 	// register watcher for subscription info
 	watcherCtx, cancel := context.WithCancel(ctx)
@@ -52,7 +93,9 @@ func (s *RetrievableSubscriber) StartTopicSubscription(ctx context.Context, topi
 
 	subscriptionCtx, subscriptionCtxCancel := context.WithCancel(ctx)
 	subscriptionWg := sync.WaitGroup{}
-	subscriptionCh, sErrCh, err := s.startSubscriptions(subscriptionCtx, &subscriptionWg, topicName, subscriptions, batchSize, flushInterval)
+	tracker := newAckTracker(topicName, s.lastSubscribedOffset)
+	positions := newStartPositions(opts...)
+	subscriptionCh, sErrCh, err := s.startSubscriptions(subscriptionCtx, &subscriptionWg, topicName, subscriptions, batchSize, flushInterval, tracker, positions)
 	if err != nil {
 		cancel()
 		subscriptionCtxCancel()
@@ -109,7 +152,7 @@ func (s *RetrievableSubscriber) StartTopicSubscription(ctx context.Context, topi
 							zap.String("subscriber-id", s.id),
 							zap.Uints("old-fragments", s.currentSubscriptions))
 					} else {
-						subscriptionCh, sErrCh, err = s.startSubscriptions(subscriptionCtx, &subscriptionWg, topicName, subscriptions, batchSize, flushInterval)
+						subscriptionCh, sErrCh, err = s.startSubscriptions(subscriptionCtx, &subscriptionWg, topicName, subscriptions, batchSize, flushInterval, tracker, positions)
 						if err != nil {
 							errStream <- err
 							return
@@ -134,7 +177,7 @@ func (s *RetrievableSubscriber) StartTopicSubscription(ctx context.Context, topi
 }
 
 func (s *RetrievableSubscriber) startSubscriptions(ctx context.Context, subscriptionWg *sync.WaitGroup, topicName string, subscriptionFragments []uint,
-	batchSize, flushInterval uint32) (chan RetrievableSubscriptionResults, chan error, error) {
+	batchSize, flushInterval uint32, tracker *ackTracker, positions *startPositions) (chan RetrievableSubscriptionResults, chan error, error) {
 
 	logger.Info("setup subscription streams", zap.String("subscriber-id", s.id), zap.String("topic", topicName), zap.Uints("fragmentIds", subscriptionFragments))
 	endpointMap, err := s.findSubscriptionEndpoints(topicName, subscriptionFragments)
@@ -146,6 +189,8 @@ func (s *RetrievableSubscriber) startSubscriptions(ctx context.Context, subscrip
 		return nil, nil, qerror.TargetNotExistError{Target: fmt.Sprintf("publishers of topic '%s', fragments %v", topicName, s.currentSubscriptions)}
 	}
 
+	// unacknowledged records of previous subscriptions are redelivered from the committed offsets
+	tracker.resetAll()
 	outStream := make(chan RetrievableSubscriptionResults)
 	errStream := make(chan error)
 
@@ -158,41 +203,15 @@ func (s *RetrievableSubscriber) startSubscriptions(ctx context.Context, subscrip
 			return nil, nil, err
 		}
 
-		// load last offsets
-		var subscriptionOffsets []*pb.Subscription_FragmentOffset
-		for _, fragmentId := range fragmentIds {
-			value, _ := s.lastSubscribedOffset.LoadOrStore(storage.NewFragmentKey(topicName, fragmentId), uint64(0))
-			lastFetchedOffset := value.(uint64)
-
-			startOffset := lastFetchedOffset + 1
-			subscriptionOffsets = append(subscriptionOffsets, &pb.Subscription_FragmentOffset{
-				FragmentId:  uint32(fragmentId),
-				StartOffset: &startOffset,
-			})
-		}
-
 		// start bidirectional subscribe stream
-		publisher := pb.NewRetrievablePubSubClient(conn)
-		stream, err := publisher.RetrievableSubscribe(ctx)
+		streamCtx, streamCancel := context.WithCancel(ctx)
+		stream, err := s.openStream(streamCtx, conn, topicName, fragmentIds, batchSize, flushInterval, positions)
 		if err != nil {
+			streamCancel()
 			conn.Close()
 			return nil, nil, err
 		}
-		err = stream.Send(&pb.RetrievableSubscription{
-			Magic: 1,
-			Type: &pb.RetrievableSubscription_Subscription{Subscription: &pb.Subscription{
-				Magic:         1,
-				TopicName:     topicName,
-				Offsets:       subscriptionOffsets,
-				MaxBatchSize:  batchSize,
-				FlushInterval: flushInterval,
-			}},
-		})
-		if err != nil {
-			stream.CloseSend()
-			conn.Close()
-			return nil, nil, err
-		}
+		current := &retrievableStream{stream: stream}
 
 		onSendBack := func(res []SubscriptionResult) error {
 			var batched []*pb.SubscriptionResult_Fetched
@@ -201,10 +220,13 @@ func (s *RetrievableSubscriber) startSubscriptions(ctx context.Context, subscrip
 					FragmentId: uint32(res.FragmentId),
 					SeqNum:     res.SeqNum,
 					Data:       res.Data,
+					Key:        res.Key,
+					Timestamp:  res.Timestamp,
+					Headers:    res.Headers,
 				})
 			}
 
-			err := stream.Send(&pb.RetrievableSubscription{
+			err := current.send(&pb.RetrievableSubscription{
 				Magic: 1,
 				Type: &pb.RetrievableSubscription_Result{Result: &pb.SubscriptionResult{
 					Magic:   1,
@@ -222,88 +244,55 @@ func (s *RetrievableSubscriber) startSubscriptions(ctx context.Context, subscrip
 		}
 
 		wg.Add(1)
-		go func(pubEndpoint string) {
+		go func(pubEndpoint string, fragmentIds []uint) {
 			defer wg.Done()
 			defer conn.Close()
-			defer stream.CloseSend()
-			retryCount := 0
+
+			bo := newBackoff(s.reconnectPolicy)
 			for {
-				select {
-				case <-ctx.Done():
-					logger.Info("stop subscribe from ctx.Done()",
-						zap.String("subscriber-id", s.id),
-						zap.String("topic", topicName),
-						zap.String("publisher-endpoint", pubEndpoint))
-					return
-				default:
-					subscriptionResult, err := stream.Recv()
-					if err != nil {
-						if err == io.EOF {
-							// TODO :: this is abnormal case. should be restarted?
-							logger.Info("stop subscribe from io.EOF",
-								zap.String("subscriber-id", s.id),
-								zap.String("topic", topicName),
-								zap.String("publisher-endpoint", pubEndpoint))
-						} else if status.Code(err) == codes.Canceled { // client closing (subscriber context canceled)
-							logger.Info("stop subscribe from inner context canceled",
-								zap.String("subscriber-id", s.id),
-								zap.String("topic", topicName),
-								zap.String("publisher-endpoint", pubEndpoint))
-						} else if status.Code(err) == codes.Unavailable { // server closing (publisher context canceled)
-							logger.Info("stop subscribe from publisher closed",
-								zap.String("subscriber-id", s.id),
-								zap.String("topic", topicName),
-								zap.String("publisher-endpoint", pubEndpoint))
-						} else {
-							select {
-							case <-ctx.Done():
-								return
-							default:
-								logger.Warn("failed to receive from stream. retrying..", zap.Error(err), zap.Int("retry-count", retryCount))
-								retryCount++
-								if retryCount >= constants.MaxRetryCountForSubscription {
-									errStream <- err
-								} else {
-									time.Sleep(1 * time.Second)
-									continue
-								}
-							}
-						}
-						return
-					}
-					retryCount = 0
-					fetchedResults := subscriptionResult.Results
-					logger.Debug("received",
-						zap.String("subscriber-id", s.id),
-						zap.String("topic", topicName),
-						zap.String("publisher-endpoint", pubEndpoint),
-						zap.Int("num data", len(fetchedResults)),
-						zap.Uint64("last seqNum", fetchedResults[len(fetchedResults)-1].SeqNum))
-
-					var results []SubscriptionResult
-
-					for _, result := range fetchedResults {
-						results = append(results, SubscriptionResult{
-							FragmentId: uint(result.FragmentId),
-							SeqNum:     result.SeqNum,
-							Data:       result.Data,
-						})
-						s.lastSubscribedOffset.Store(storage.NewFragmentKey(topicName, uint(result.FragmentId)), result.Offset)
-					}
-					select {
-					case <-ctx.Done():
-						logger.Info("stop subscribe from ctx.Done()",
+				redeliver, err := s.receiveStream(ctx, streamCtx, streamCancel, current, topicName, pubEndpoint, tracker, positions, onSendBack, outStream, errStream)
+				streamCancel()
+				for ctx.Err() == nil {
+					if redeliver {
+						logger.Info("restart subscribe to redeliver unacked records",
+							zap.String("subscriber-id", s.id),
+							zap.String("topic", topicName),
+							zap.String("publisher-endpoint", pubEndpoint),
+							zap.Uints("fragmentIds", fragmentIds))
+					} else if !isRetryableStreamError(err) {
+						logger.Error("stop subscribe from unexpected error",
+							zap.Error(err),
 							zap.String("subscriber-id", s.id),
 							zap.String("topic", topicName),
 							zap.String("publisher-endpoint", pubEndpoint))
+						sendError(ctx, errStream, err)
+						return
+					} else if err = s.waitReconnect(ctx, bo, topicName, pubEndpoint, err); err != nil {
+						sendError(ctx, errStream, err)
 						return
-					default:
-						outStream <- RetrievableSubscriptionResults{Results: results, SendBack: onSendBack}
 					}
-					runtime.Gosched()
+
+					// reopen the stream from the committed offsets
+					tracker.reset(fragmentIds)
+					streamCtx, streamCancel = context.WithCancel(ctx)
+					var stream pb.RetrievablePubSub_RetrievableSubscribeClient
+					if stream, err = s.openStream(streamCtx, conn, topicName, fragmentIds, batchSize, flushInterval, positions); err == nil {
+						current.set(stream)
+						s.onStreamOpened(bo, topicName, pubEndpoint)
+						break
+					}
+					streamCancel()
+					redeliver = false
+				}
+				if ctx.Err() != nil {
+					logger.Info("stop subscribe from ctx.Done()",
+						zap.String("subscriber-id", s.id),
+						zap.String("topic", topicName),
+						zap.String("publisher-endpoint", pubEndpoint))
+					return
 				}
 			}
-		}(endpoint)
+		}(endpoint, fragmentIds)
 	}
 
 	// wait for all subscription to be finished
@@ -319,6 +308,103 @@ func (s *RetrievableSubscriber) startSubscriptions(ctx context.Context, subscrip
 	return outStream, errStream, nil
 }
 
+func (s *RetrievableSubscriber) openStream(ctx context.Context, conn *grpc.ClientConn, topicName string, fragmentIds []uint,
+	batchSize, flushInterval uint32, positions *startPositions) (pb.RetrievablePubSub_RetrievableSubscribeClient, error) {
+
+	publisher := pb.NewRetrievablePubSubClient(conn)
+	stream, err := publisher.RetrievableSubscribe(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = stream.Send(&pb.RetrievableSubscription{
+		Magic: 1,
+		Type: &pb.RetrievableSubscription_Subscription{Subscription: &pb.Subscription{
+			Magic:         1,
+			TopicName:     topicName,
+			Offsets:       s.loadSubscriptionOffsets(topicName, fragmentIds, positions),
+			MaxBatchSize:  batchSize,
+			FlushInterval: flushInterval,
+			Compressions:  supportedCompressions(),
+			Credit:        positions.credit,
+			SubscriberId:  s.id,
+		}},
+	})
+	if err != nil {
+		stream.CloseSend()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// receiveStream delivers received records until the stream is closed.
+// It returns true when the stream is canceled by a nack and should be reopened to redeliver unacked records.
+func (s *RetrievableSubscriber) receiveStream(ctx, streamCtx context.Context, streamCancel context.CancelFunc, current *retrievableStream,
+	topicName, pubEndpoint string, tracker *ackTracker, positions *startPositions, onSendBack func([]SubscriptionResult) error,
+	outStream chan RetrievableSubscriptionResults, errStream chan error) (bool, error) {
+
+	stream := current.get()
+	defer current.closeSend()
+	onNack := func() {
+		streamCancel()
+	}
+	for {
+		subscriptionResult, err := stream.Recv()
+		if err != nil {
+			if ctx.Err() != nil { // client closing (subscriber context canceled)
+				return false, nil
+			} else if streamCtx.Err() != nil { // nack received
+				return true, nil
+			}
+			return false, err
+		}
+
+		fetchedResults := subscriptionResult.Results
+		logger.Debug("received",
+			zap.String("subscriber-id", s.id),
+			zap.String("topic", topicName),
+			zap.String("publisher-endpoint", pubEndpoint),
+			zap.Int("num data", len(fetchedResults)),
+			zap.Uint64("last seqNum", fetchedResults[len(fetchedResults)-1].SeqNum))
+
+		// wait for acknowledgements of delivered results not to pile up unacknowledged results
+		if err = tracker.waitCapacity(streamCtx); err != nil {
+			return ctx.Err() == nil, nil
+		}
+		var results []SubscriptionResult
+		for _, result := range fetchedResults {
+			positions.onReceived(topicName, uint(result.FragmentId), result.Offset, s.lastSubscribedOffset)
+			data, ok := decodeFetched(result)
+			if !ok {
+				s.skipCorrupted(ctx, errStream, topicName, result)
+				continue
+			}
+			results = append(results, SubscriptionResult{
+				FragmentId: uint(result.FragmentId),
+				SeqNum:     result.SeqNum,
+				Data:       data,
+				Key:        result.Key,
+				Timestamp:  result.Timestamp,
+				Headers:    result.Headers,
+				pending:    tracker.track(uint(result.FragmentId), result.Offset, onNack),
+			})
+		}
+		if len(results) > 0 {
+			select {
+			case <-ctx.Done():
+				return false, nil
+			case <-streamCtx.Done():
+				return true, nil
+			case outStream <- RetrievableSubscriptionResults{Results: results, SendBack: onSendBack}:
+			}
+		}
+		if positions.credit != nil {
+			// grant the credit of the delivered records again. a broken stream is reported by Recv
+			_ = current.send(&pb.RetrievableSubscription{Magic: 1, Type: &pb.RetrievableSubscription_Credit{Credit: creditOf(fetchedResults)}})
+		}
+		runtime.Gosched()
+	}
+}
+
 func (s *RetrievableSubscriber) Wait() {
 	s.wg.Wait()
 }
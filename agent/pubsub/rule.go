@@ -6,10 +6,19 @@ import (
 	"github.com/paust-team/pirius/logger"
 )
 
-func TopicWritingRule(option topic.Option, fragments []uint) func() []uint {
+func TopicWritingRule(option topic.Option, fragments []uint) func(key []byte) []uint {
 	if option&topic.UniquePerFragment != 0 {
 		rrSelect := helper.RoundRobinSelection(fragments)
-		return func() []uint { // round-robin write for fragments if topic write policy has UniquePerFragment
+		if option&topic.KeyBasedRouting != 0 {
+			hashSelect := helper.ConsistentHashSelection(fragments)
+			return func(key []byte) []uint { // write to the fragment selected by key. records without key are written round-robin
+				if len(key) == 0 {
+					return []uint{rrSelect()}
+				}
+				return []uint{hashSelect(key)}
+			}
+		}
+		return func([]byte) []uint { // round-robin write for fragments if topic write policy has UniquePerFragment
 			return []uint{rrSelect()}
 		}
 	} else {
@@ -17,7 +26,7 @@ func TopicWritingRule(option topic.Option, fragments []uint) func() []uint {
 			logger.Warn("This case should not be happened preferably. It's an in-efficient case because a single publisher save duplicate data.")
 		}
 		// else, write to all fragment
-		return func() []uint {
+		return func([]byte) []uint {
 			return fragments
 		}
 	}
@@ -0,0 +1,61 @@
+package pubsub_test
+
+import (
+	"fmt"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/paust-team/pirius/agent/pubsub"
+	"github.com/paust-team/pirius/bootstrapping/topic"
+	"github.com/paust-team/pirius/test"
+)
+
+var _ = Describe("TopicWritingRule", func() {
+
+	Describe("Writing to KeyBasedRouting topic", func() {
+		tp := test.NewTestParams()
+		var getFragmentsToWrite func(key []byte) []uint
+
+		BeforeEach(func() {
+			tp.Set("fragments", []uint{1, 2, 3, 4})
+			tp.Set("numKeys", 1000)
+			getFragmentsToWrite = pubsub.TopicWritingRule(topic.UniquePerFragment|topic.KeyBasedRouting, tp.Get("fragments").([]uint))
+		})
+		AfterEach(func() {
+			tp.Clear()
+		})
+
+		It("writes records of the same key to the same fragment", func() {
+			for i := 0; i < tp.GetInt("numKeys"); i++ {
+				key := []byte(fmt.Sprintf("device-%d", i))
+				selected := getFragmentsToWrite(key)
+				Expect(selected).To(HaveLen(1))
+				Expect(getFragmentsToWrite(key)).To(Equal(selected))
+			}
+		})
+
+		It("writes records without key round-robin", func() {
+			var selected []uint
+			for range tp.Get("fragments").([]uint) {
+				selected = append(selected, getFragmentsToWrite(nil)...)
+			}
+			Expect(selected).To(ConsistOf(tp.Get("fragments").([]uint)))
+		})
+
+		It("moves only the keys of the removed fragment", func() {
+			fragments := tp.Get("fragments").([]uint)
+			removed := fragments[0]
+			getFragmentsToWriteAfter := pubsub.TopicWritingRule(topic.UniquePerFragment|topic.KeyBasedRouting, fragments[1:])
+
+			for i := 0; i < tp.GetInt("numKeys"); i++ {
+				key := []byte(fmt.Sprintf("device-%d", i))
+				before := getFragmentsToWrite(key)[0]
+				after := getFragmentsToWriteAfter(key)[0]
+				if before != removed {
+					Expect(after).To(Equal(before))
+				} else {
+					Expect(after).NotTo(Equal(removed))
+				}
+			}
+		})
+	})
+})
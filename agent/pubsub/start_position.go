@@ -0,0 +1,116 @@
+package pubsub
+
+import (
+	"github.com/paust-team/pirius/agent/storage"
+	"github.com/paust-team/pirius/proto/pb"
+	"sync"
+)
+
+type startPositionType int
+
+const (
+	startFromCommitted startPositionType = iota
+	startFromEarliest
+	startFromLatest
+	startFromOffsets
+	startFromTimestamp
+)
+
+// SubscriptionOption sets where a subscription starts and its flow control. By default, it resumes from the last committed offsets
+type SubscriptionOption func(*startPositions)
+
+// StartFromEarliest starts from the first retained record of each fragment
+func StartFromEarliest() SubscriptionOption {
+	return func(p *startPositions) {
+		p.positionType = startFromEarliest
+	}
+}
+
+// StartFromLatest starts from the records published after subscribing
+func StartFromLatest() SubscriptionOption {
+	return func(p *startPositions) {
+		p.positionType = startFromLatest
+	}
+}
+
+// StartFromOffsets starts from the given offset of each fragment. fragments not in the map resume from the committed offsets
+func StartFromOffsets(offsets map[uint]uint64) SubscriptionOption {
+	return func(p *startPositions) {
+		p.positionType = startFromOffsets
+		p.offsets = offsets
+	}
+}
+
+// StartFromTimestamp starts from the first record of each fragment published at or after the timestamp(millisecond)
+func StartFromTimestamp(timestamp uint64) SubscriptionOption {
+	return func(p *startPositions) {
+		p.positionType = startFromTimestamp
+		p.timestamp = timestamp
+	}
+}
+
+// startPositions keeps the requested start position of each fragment until the first record of the fragment is received.
+// After that, the fragment resumes from the committed offset on reconnect.
+type startPositions struct {
+	mu           sync.Mutex
+	positionType startPositionType
+	offsets      map[uint]uint64
+	timestamp    uint64
+	started      map[uint]bool
+	credit       *pb.Credit // initial credit of flow control. nil when not flow-controlled
+}
+
+func newStartPositions(opts ...SubscriptionOption) *startPositions {
+	positions := &startPositions{
+		positionType: startFromCommitted,
+		started:      make(map[uint]bool),
+	}
+	for _, opt := range opts {
+		opt(positions)
+	}
+	return positions
+}
+
+// fragmentOffset returns the subscription offset of the fragment
+func (p *startPositions) fragmentOffset(topicName string, fragmentId uint, lastSubscribedOffset storage.TopicFragmentOffsets) *pb.Subscription_FragmentOffset {
+	p.mu.Lock()
+	positionType := p.positionType
+	if p.started[fragmentId] {
+		positionType = startFromCommitted
+	}
+	p.mu.Unlock()
+
+	fragmentOffset := &pb.Subscription_FragmentOffset{FragmentId: uint32(fragmentId)}
+	switch positionType {
+	case startFromEarliest:
+		fragmentOffset.Earliest = true
+		return fragmentOffset
+	case startFromLatest:
+		return fragmentOffset
+	case startFromTimestamp:
+		timestamp := p.timestamp
+		fragmentOffset.StartTimestamp = &timestamp
+		return fragmentOffset
+	case startFromOffsets:
+		if offset, ok := p.offsets[fragmentId]; ok {
+			fragmentOffset.StartOffset = &offset
+			return fragmentOffset
+		}
+	}
+
+	value, _ := lastSubscribedOffset.LoadOrStore(storage.NewFragmentKey(topicName, fragmentId), uint64(0))
+	startOffset := value.(uint64) + 1
+	fragmentOffset.StartOffset = &startOffset
+	return fragmentOffset
+}
+
+// onReceived moves the committed offset of the fragment to the start position when its first record is received
+func (p *startPositions) onReceived(topicName string, fragmentId uint, offset uint64, lastSubscribedOffset storage.TopicFragmentOffsets) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.positionType == startFromCommitted || p.started[fragmentId] {
+		return
+	}
+	p.started[fragmentId] = true
+	lastSubscribedOffset.Store(storage.NewFragmentKey(topicName, fragmentId), offset-1)
+}
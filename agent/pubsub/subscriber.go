@@ -6,6 +6,7 @@ import (
 	"github.com/paust-team/pirius/agent/storage"
 	"github.com/paust-team/pirius/bootstrapping"
 	"github.com/paust-team/pirius/bootstrapping/topic"
+	"github.com/paust-team/pirius/compression"
 	"github.com/paust-team/pirius/constants"
 	"github.com/paust-team/pirius/helper"
 	"github.com/paust-team/pirius/logger"
@@ -25,6 +26,40 @@ type SubscriptionResult struct {
 	FragmentId uint
 	SeqNum     uint64
 	Data       []byte
+	Key        []byte
+	Timestamp  uint64 // unix milliseconds
+	Headers    map[string]string
+	pending    *pendingRecord
+}
+
+// Ack commits the offset of the result. offsets are committed in order, so the offset is persisted
+// after all preceding results of the same fragment are acknowledged
+func (r SubscriptionResult) Ack() {
+	if r.pending != nil {
+		r.pending.ack()
+	}
+}
+
+// Nack requests redelivery of the result. The stream the result came from is restarted from the committed offsets,
+// so other unacknowledged results of the stream are delivered again as well
+func (r SubscriptionResult) Nack() {
+	if r.pending != nil {
+		r.pending.nack()
+	}
+}
+
+type SubscriptionResults []SubscriptionResult
+
+func (r SubscriptionResults) Ack() {
+	for _, result := range r {
+		result.Ack()
+	}
+}
+
+func (r SubscriptionResults) Nack() {
+	if len(r) > 0 {
+		r[0].Nack()
+	}
 }
 
 type SubscriptionAddrs map[string][]uint
@@ -33,6 +68,7 @@ type subscriberBase struct {
 	bootstrapper         *bootstrapping.BootstrapService
 	lastSubscribedOffset storage.TopicFragmentOffsets // last fetched offsets
 	currentSubscriptions []uint
+	reconnectPolicy      ReconnectPolicy
 }
 
 func (s subscriberBase) prepare(ctx context.Context, topicName string) (chan topic.SubscriptionInfo, []uint, error) {
@@ -78,6 +114,54 @@ func (s subscriberBase) prepare(ctx context.Context, topicName string) (chan top
 }
 
 // helper functions
+func isRetryableStreamError(err error) bool {
+	if err == io.EOF { // publisher closed the stream
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.Aborted, codes.Internal, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
+
+func sendError(ctx context.Context, errStream chan error, err error) {
+	select {
+	case <-ctx.Done():
+	case errStream <- err:
+	}
+}
+
+// decodeFetched verifies the checksum of a received record and decompresses the data.
+// records fetched without the checksum are not verified
+func decodeFetched(result *pb.SubscriptionResult_Fetched) ([]byte, bool) {
+	if result.Checksum != nil &&
+		storage.FieldsChecksum(result.SeqNum, result.Timestamp, result.Key, result.Headers, result.Data) != *result.Checksum {
+		return nil, false
+	}
+	data, err := compression.Decompress(compression.Codec(result.Compression), result.Data)
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// skipCorrupted reports a record failed on decodeFetched, which is skipped by the subscriber
+func (s subscriberBase) skipCorrupted(ctx context.Context, errStream chan error, topicName string, result *pb.SubscriptionResult_Fetched) {
+	err := qerror.CorruptedRecordError{Topic: topicName, FragmentId: result.FragmentId, Offset: result.Offset}
+	logger.Warn("skip corrupted record", zap.Error(err), zap.String("subscriber-id", s.id))
+	subscriberMetrics.Add(metricCorruptedRecords, 1)
+	sendError(ctx, errStream, err)
+}
+
+func (s subscriberBase) loadSubscriptionOffsets(topicName string, fragmentIds []uint, positions *startPositions) []*pb.Subscription_FragmentOffset {
+	var subscriptionOffsets []*pb.Subscription_FragmentOffset
+	for _, fragmentId := range fragmentIds {
+		subscriptionOffsets = append(subscriptionOffsets, positions.fragmentOffset(topicName, fragmentId, s.lastSubscribedOffset))
+	}
+	return subscriptionOffsets
+}
+
 func (s subscriberBase) findSubscriptionEndpoints(topicName string, fragmentIds []uint) (SubscriptionAddrs, error) {
 	topicFragmentFrame, err := s.bootstrapper.GetTopicFragments(topicName)
 	if err != nil {
@@ -98,6 +182,51 @@ func (s subscriberBase) findSubscriptionEndpoints(topicName string, fragmentIds
 	return endpoints, nil
 }
 
+// waitReconnect waits for the backoff delay before reconnecting to the publisher
+func (s subscriberBase) waitReconnect(ctx context.Context, bo *backoff, topicName, pubEndpoint string, cause error) error {
+	delay, ok := bo.next()
+	if !ok {
+		subscriberMetrics.Add(metricReconnectFailures, 1)
+		logger.Error("gave up reconnecting to publisher",
+			zap.Error(cause),
+			zap.String("subscriber-id", s.id),
+			zap.String("topic", topicName),
+			zap.String("publisher-endpoint", pubEndpoint),
+			zap.Uint("attempts", bo.attempts))
+		return qerror.ReconnectFailedError{Endpoint: pubEndpoint, Attempts: bo.attempts, ErrStr: cause.Error()}
+	}
+
+	subscriberMetrics.Add(metricReconnectAttempts, 1)
+	logger.Warn("reconnecting to publisher",
+		zap.Error(cause),
+		zap.String("subscriber-id", s.id),
+		zap.String("topic", topicName),
+		zap.String("publisher-endpoint", pubEndpoint),
+		zap.Uint("attempt", bo.attempts),
+		zap.Duration("backoff", delay))
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// onStreamOpened resets the backoff once the stream is reopened, so a later disconnection starts from the initial backoff
+func (s subscriberBase) onStreamOpened(bo *backoff, topicName, pubEndpoint string) {
+	if bo.attempts > 0 {
+		subscriberMetrics.Add(metricReconnectSuccesses, 1)
+		logger.Info("reconnected to publisher",
+			zap.String("subscriber-id", s.id),
+			zap.String("topic", topicName),
+			zap.String("publisher-endpoint", pubEndpoint),
+			zap.Uint("attempts", bo.attempts))
+		bo.reset()
+	}
+}
+
 func (s subscriberBase) isSubscriptionUpdated(new topic.SubscriptionInfo) bool {
 	newSubscription, ok := new[s.id]
 	if !ok {
@@ -116,18 +245,24 @@ type Subscriber struct {
 	wg sync.WaitGroup
 }
 
-func NewSubscriber(id string, bootstrapper *bootstrapping.BootstrapService, subscribedOffsets storage.TopicFragmentOffsets) Subscriber {
+func NewSubscriber(id string, bootstrapper *bootstrapping.BootstrapService, subscribedOffsets storage.TopicFragmentOffsets,
+	reconnectPolicy ReconnectPolicy) Subscriber {
 	return Subscriber{
 		subscriberBase: subscriberBase{
 			id:                   id,
 			bootstrapper:         bootstrapper,
 			lastSubscribedOffset: subscribedOffsets,
+			reconnectPolicy:      reconnectPolicy,
 		},
 		wg: sync.WaitGroup{},
 	}
 }
 
-func (s *Subscriber) StartTopicSubscription(ctx context.Context, topicName string, batchSize, flushInterval uint32) (chan []SubscriptionResult, chan error, error) {
+// StartTopicSubscription starts to subscribe the topic. Subscribed offsets are committed only when the results are acknowledged,
+// and unacknowledged results are delivered again when the subscription is restarted.
+// The subscription resumes from the committed offsets unless a start position is given by opts.
+func (s *Subscriber) StartTopicSubscription(ctx context.Context, topicName string, batchSize, flushInterval uint32,
+	opts ...SubscriptionOption) (chan SubscriptionResults, chan error, error) {
 
 	// register watcher for subscription info
 	watcherCtx, cancel := context.WithCancel(ctx)
@@ -139,14 +274,16 @@ func (s *Subscriber) StartTopicSubscription(ctx context.Context, topicName strin
 
 	subscriptionCtx, subscriptionCtxCancel := context.WithCancel(ctx)
 	subscriptionWg := sync.WaitGroup{}
-	subscriptionCh, sErrCh, err := s.startSubscriptions(subscriptionCtx, &subscriptionWg, topicName, subscriptions, batchSize, flushInterval)
+	tracker := newAckTracker(topicName, s.lastSubscribedOffset)
+	positions := newStartPositions(opts...)
+	subscriptionCh, sErrCh, err := s.startSubscriptions(subscriptionCtx, &subscriptionWg, topicName, subscriptions, batchSize, flushInterval, tracker, positions)
 	if err != nil {
 		cancel()
 		subscriptionCtxCancel()
 		return nil, nil, err
 	}
 	s.currentSubscriptions = subscriptions
-	outStream := make(chan []SubscriptionResult)
+	outStream := make(chan SubscriptionResults)
 	errStream := make(chan error, 2)
 
 	s.wg.Add(1)
@@ -197,7 +334,7 @@ func (s *Subscriber) StartTopicSubscription(ctx context.Context, topicName strin
 							zap.String("subscriber-id", s.id),
 							zap.Uints("old-fragments", s.currentSubscriptions))
 					} else {
-						subscriptionCh, sErrCh, err = s.startSubscriptions(subscriptionCtx, &subscriptionWg, topicName, subscriptions, batchSize, flushInterval)
+						subscriptionCh, sErrCh, err = s.startSubscriptions(subscriptionCtx, &subscriptionWg, topicName, subscriptions, batchSize, flushInterval, tracker, positions)
 						if err != nil {
 							errStream <- err
 							return
@@ -222,7 +359,7 @@ func (s *Subscriber) StartTopicSubscription(ctx context.Context, topicName strin
 }
 
 func (s *Subscriber) startSubscriptions(ctx context.Context, subscriptionWg *sync.WaitGroup, topicName string, subscriptionFragments []uint,
-	batchSize, flushInterval uint32) (chan []SubscriptionResult, chan error, error) {
+	batchSize, flushInterval uint32, tracker *ackTracker, positions *startPositions) (chan SubscriptionResults, chan error, error) {
 
 	logger.Info("setup subscription streams", zap.String("subscriber-id", s.id), zap.String("topic", topicName), zap.Uints("fragmentIds", subscriptionFragments))
 	endpointMap, err := s.findSubscriptionEndpoints(topicName, subscriptionFragments)
@@ -234,7 +371,9 @@ func (s *Subscriber) startSubscriptions(ctx context.Context, subscriptionWg *syn
 		return nil, nil, qerror.TargetNotExistError{Target: fmt.Sprintf("publishers of topic '%s', fragments %v", topicName, s.currentSubscriptions)}
 	}
 
-	outStream := make(chan []SubscriptionResult)
+	// unacknowledged records of previous subscriptions are redelivered from the committed offsets
+	tracker.resetAll()
+	outStream := make(chan SubscriptionResults)
 	errStream := make(chan error)
 
 	// create subscription stream for each endpoint
@@ -246,102 +385,62 @@ func (s *Subscriber) startSubscriptions(ctx context.Context, subscriptionWg *syn
 			return nil, nil, err
 		}
 
-		// load last offsets
-		var subscriptionOffsets []*pb.Subscription_FragmentOffset
-		for _, fragmentId := range fragmentIds {
-			value, _ := s.lastSubscribedOffset.LoadOrStore(storage.NewFragmentKey(topicName, fragmentId), uint64(0))
-			lastFetchedOffset := value.(uint64)
-
-			startOffset := lastFetchedOffset + 1
-			subscriptionOffsets = append(subscriptionOffsets, &pb.Subscription_FragmentOffset{
-				FragmentId:  uint32(fragmentId),
-				StartOffset: &startOffset,
-			})
-		}
-
 		// start gRPC stream
-		publisher := pb.NewPubSubClient(conn)
-		stream, err := publisher.Subscribe(ctx, &pb.Subscription{
-			Magic:         1,
-			TopicName:     topicName,
-			Offsets:       subscriptionOffsets,
-			MaxBatchSize:  batchSize,
-			FlushInterval: flushInterval,
-		})
+		streamCtx, streamCancel := context.WithCancel(ctx)
+		stream, err := s.openStream(streamCtx, conn, topicName, fragmentIds, batchSize, flushInterval, positions)
 		if err != nil {
-			stream.CloseSend()
+			streamCancel()
 			conn.Close()
 			return nil, nil, err
 		}
 		wg.Add(1)
-		go func(pubEndpoint string) {
+		go func(pubEndpoint string, fragmentIds []uint) {
 			defer wg.Done()
 			defer conn.Close()
-			defer stream.CloseSend()
 
+			bo := newBackoff(s.reconnectPolicy)
 			for {
-				select {
-				case <-ctx.Done():
-					logger.Info("stop subscribe from ctx.Done()",
-						zap.String("subscriber-id", s.id),
-						zap.String("topic", topicName),
-						zap.String("publisher-endpoint", pubEndpoint))
-					return
-				default:
-					subscriptionResult, err := stream.Recv()
-					if err != nil {
-						if err == io.EOF {
-							// TODO :: this is abnormal case. should be restarted?
-							logger.Info("stop subscribe from io.EOF",
-								zap.String("subscriber-id", s.id),
-								zap.String("topic", topicName),
-								zap.String("publisher-endpoint", pubEndpoint))
-						} else if status.Code(err) == codes.Canceled { // client closing (subscriber context canceled)
-							logger.Info("stop subscribe from inner context canceled",
-								zap.String("subscriber-id", s.id),
-								zap.String("topic", topicName),
-								zap.String("publisher-endpoint", pubEndpoint))
-						} else if status.Code(err) == codes.Unavailable { // server closing (publisher context canceled)
-							logger.Info("stop subscribe from publisher closed",
-								zap.String("subscriber-id", s.id),
-								zap.String("topic", topicName),
-								zap.String("publisher-endpoint", pubEndpoint))
-						} else {
-							errStream <- err
-						}
-						return
-					}
-					fetchedResults := subscriptionResult.Results
-					logger.Debug("received",
-						zap.String("subscriber-id", s.id),
-						zap.String("topic", topicName),
-						zap.String("publisher-endpoint", pubEndpoint),
-						zap.Int("num data", len(fetchedResults)),
-						zap.Uint64("last seqNum", fetchedResults[len(fetchedResults)-1].SeqNum))
-
-					var results []SubscriptionResult
-					for _, result := range fetchedResults {
-						results = append(results, SubscriptionResult{
-							FragmentId: uint(result.FragmentId),
-							SeqNum:     result.SeqNum,
-							Data:       result.Data,
-						})
-						s.lastSubscribedOffset.Store(storage.NewFragmentKey(topicName, uint(result.FragmentId)), result.Offset)
-					}
-					select {
-					case <-ctx.Done():
-						logger.Info("stop subscribe from ctx.Done()",
+				redeliver, err := s.receiveStream(ctx, streamCtx, streamCancel, stream, topicName, pubEndpoint, tracker, positions, outStream, errStream)
+				streamCancel()
+				for ctx.Err() == nil {
+					if redeliver {
+						logger.Info("restart subscribe to redeliver unacked records",
+							zap.String("subscriber-id", s.id),
+							zap.String("topic", topicName),
+							zap.String("publisher-endpoint", pubEndpoint),
+							zap.Uints("fragmentIds", fragmentIds))
+					} else if !isRetryableStreamError(err) {
+						logger.Error("stop subscribe from unexpected error",
+							zap.Error(err),
 							zap.String("subscriber-id", s.id),
 							zap.String("topic", topicName),
 							zap.String("publisher-endpoint", pubEndpoint))
+						sendError(ctx, errStream, err)
+						return
+					} else if err = s.waitReconnect(ctx, bo, topicName, pubEndpoint, err); err != nil {
+						sendError(ctx, errStream, err)
 						return
-					default:
-						outStream <- results
 					}
-					runtime.Gosched()
+
+					// reopen the stream from the committed offsets
+					tracker.reset(fragmentIds)
+					streamCtx, streamCancel = context.WithCancel(ctx)
+					if stream, err = s.openStream(streamCtx, conn, topicName, fragmentIds, batchSize, flushInterval, positions); err == nil {
+						s.onStreamOpened(bo, topicName, pubEndpoint)
+						break
+					}
+					streamCancel()
+					redeliver = false
+				}
+				if ctx.Err() != nil {
+					logger.Info("stop subscribe from ctx.Done()",
+						zap.String("subscriber-id", s.id),
+						zap.String("topic", topicName),
+						zap.String("publisher-endpoint", pubEndpoint))
+					return
 				}
 			}
-		}(endpoint)
+		}(endpoint, fragmentIds)
 	}
 
 	// wait for all subscription to be finished
@@ -357,6 +456,107 @@ func (s *Subscriber) startSubscriptions(ctx context.Context, subscriptionWg *syn
 	return outStream, errStream, nil
 }
 
+// openStream subscribes by SubscribeWithCredit when the subscription has the initial credit, or by Subscribe otherwise
+func (s *Subscriber) openStream(ctx context.Context, conn *grpc.ClientConn, topicName string, fragmentIds []uint,
+	batchSize, flushInterval uint32, positions *startPositions) (pb.PubSub_SubscribeClient, error) {
+
+	publisher := pb.NewPubSubClient(conn)
+	subscription := &pb.Subscription{
+		Magic:         1,
+		TopicName:     topicName,
+		Offsets:       s.loadSubscriptionOffsets(topicName, fragmentIds, positions),
+		MaxBatchSize:  batchSize,
+		FlushInterval: flushInterval,
+		Compressions:  supportedCompressions(),
+		SubscriberId:  s.id,
+	}
+	if positions.credit == nil {
+		return publisher.Subscribe(ctx, subscription)
+	}
+
+	subscription.Credit = positions.credit
+	stream, err := publisher.SubscribeWithCredit(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = stream.Send(&pb.SubscriptionRequest{
+		Magic: 1,
+		Type:  &pb.SubscriptionRequest_Subscription{Subscription: subscription},
+	})
+	if err != nil {
+		stream.CloseSend()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// receiveStream delivers received records until the stream is closed.
+// It returns true when the stream is canceled by a nack and should be reopened to redeliver unacked records.
+func (s *Subscriber) receiveStream(ctx, streamCtx context.Context, streamCancel context.CancelFunc, stream pb.PubSub_SubscribeClient,
+	topicName, pubEndpoint string, tracker *ackTracker, positions *startPositions, outStream chan SubscriptionResults, errStream chan error) (bool, error) {
+
+	defer stream.CloseSend()
+	onNack := func() {
+		streamCancel()
+	}
+	for {
+		subscriptionResult, err := stream.Recv()
+		if err != nil {
+			if ctx.Err() != nil { // client closing (subscriber context canceled)
+				return false, nil
+			} else if streamCtx.Err() != nil { // nack received
+				return true, nil
+			}
+			return false, err
+		}
+
+		fetchedResults := subscriptionResult.Results
+		logger.Debug("received",
+			zap.String("subscriber-id", s.id),
+			zap.String("topic", topicName),
+			zap.String("publisher-endpoint", pubEndpoint),
+			zap.Int("num data", len(fetchedResults)),
+			zap.Uint64("last seqNum", fetchedResults[len(fetchedResults)-1].SeqNum))
+
+		// wait for acknowledgements of delivered results not to pile up unacknowledged results
+		if err = tracker.waitCapacity(streamCtx); err != nil {
+			return ctx.Err() == nil, nil
+		}
+		var results SubscriptionResults
+		for _, result := range fetchedResults {
+			positions.onReceived(topicName, uint(result.FragmentId), result.Offset, s.lastSubscribedOffset)
+			data, ok := decodeFetched(result)
+			if !ok {
+				s.skipCorrupted(ctx, errStream, topicName, result)
+				continue
+			}
+			results = append(results, SubscriptionResult{
+				FragmentId: uint(result.FragmentId),
+				SeqNum:     result.SeqNum,
+				Data:       data,
+				Key:        result.Key,
+				Timestamp:  result.Timestamp,
+				Headers:    result.Headers,
+				pending:    tracker.track(uint(result.FragmentId), result.Offset, onNack),
+			})
+		}
+		if len(results) > 0 {
+			select {
+			case <-ctx.Done():
+				return false, nil
+			case <-streamCtx.Done():
+				return true, nil
+			case outStream <- results:
+			}
+		}
+		if credited, ok := stream.(pb.PubSub_SubscribeWithCreditClient); ok {
+			// grant the credit of the delivered records again. a broken stream is reported by Recv
+			_ = credited.Send(&pb.SubscriptionRequest{Magic: 1, Type: &pb.SubscriptionRequest_Credit{Credit: creditOf(fetchedResults)}})
+		}
+		runtime.Gosched()
+	}
+}
+
 func (s *Subscriber) Wait() {
 	s.wg.Wait()
 }
@@ -0,0 +1,134 @@
+package pubsub
+
+import (
+	"context"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/paust-team/pirius/proto/pb"
+	"google.golang.org/grpc/peer"
+	"net"
+	"time"
+)
+
+var _ = Describe("TokenBucket", func() {
+	var bucket tokenBucket
+	var now time.Time
+
+	BeforeEach(func() {
+		bucket = tokenBucket{}
+		now = time.Now()
+		bucket.setRate(10, now)
+	})
+
+	It("does not delay tokens within the bucket", func() {
+		level := bucket.reserve(10, now)
+		Expect(bucket.delay(level, now)).To(BeZero())
+	})
+
+	It("delays tokens over the bucket until they are refilled", func() {
+		bucket.reserve(10, now)
+		level := bucket.reserve(5, now)
+		Expect(bucket.delay(level, now)).To(Equal(500 * time.Millisecond))
+		Expect(bucket.delay(level, now.Add(200*time.Millisecond))).To(Equal(300 * time.Millisecond))
+		Expect(bucket.delay(level, now.Add(time.Second))).To(BeZero())
+	})
+
+	It("delays a batch larger than the rate proportionally", func() {
+		level := bucket.reserve(30, now)
+		Expect(bucket.delay(level, now)).To(Equal(2 * time.Second))
+	})
+
+	It("does not delay tokens reserved earlier by later reservations", func() {
+		bucket.reserve(10, now)
+		first := bucket.reserve(5, now)
+		bucket.reserve(100, now)
+		Expect(bucket.delay(first, now)).To(Equal(500 * time.Millisecond))
+	})
+
+	It("applies a changed rate to the rest of the delay", func() {
+		level := bucket.reserve(20, now)
+		Expect(bucket.delay(level, now)).To(Equal(time.Second))
+
+		now = now.Add(500 * time.Millisecond)
+		bucket.setRate(20, now)
+		Expect(bucket.delay(level, now)).To(Equal(250 * time.Millisecond))
+
+		bucket.setRate(0, now)
+		Expect(bucket.delay(level, now)).To(BeZero())
+	})
+
+	It("does not delay tokens of an unlimited bucket", func() {
+		bucket.setRate(0, now)
+		level := bucket.reserve(1000, now)
+		Expect(bucket.delay(level, now)).To(BeZero())
+	})
+})
+
+var _ = Describe("RateLimits of streams", func() {
+	var rateLimits *RateLimits
+	records := make([]*pb.SubscriptionResult_Fetched, 10)
+	peerContext := func(host string, port int) context.Context {
+		return peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(host), Port: port}})
+	}
+
+	BeforeEach(func() {
+		rateLimits = NewRateLimits(func(string) RateLimit {
+			return RateLimit{RecordsPerSec: 1}
+		}, nil)
+	})
+
+	It("releases a waiting stream when the rate is changed", func() {
+		limiter := rateLimits.acquire(context.Background(), "limited")
+		defer limiter.release()
+		done := make(chan error, 1)
+		go func() {
+			done <- limiter.wait(context.Background(), records)
+		}()
+		Consistently(done, 200*time.Millisecond).ShouldNot(Receive())
+
+		rateLimits.SetTopicLimit("limited", RateLimit{RecordsPerSec: 1000})
+		Eventually(done, time.Second).Should(Receive(BeNil()))
+	})
+
+	It("stops waiting when the stream is canceled", func() {
+		limiter := rateLimits.acquire(context.Background(), "limited")
+		defer limiter.release()
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			done <- limiter.wait(ctx, records)
+		}()
+		cancel()
+		Eventually(done, time.Second).Should(Receive(MatchError(context.Canceled)))
+	})
+
+	It("limits streams by their peer host", func() {
+		rateLimits.SetSubscriberLimit("127.0.0.1", RateLimit{RecordsPerSec: 1})
+		first := rateLimits.acquire(peerContext("127.0.0.1", 5000), "unlimited")
+		defer first.release()
+		second := rateLimits.acquire(peerContext("127.0.0.1", 5001), "other")
+		defer second.release()
+		anonymous := rateLimits.acquire(context.Background(), "unlimited")
+		defer anonymous.release()
+
+		Expect(first.wait(context.Background(), records[:1])).To(Succeed())
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		Expect(second.wait(ctx, records[:1])).To(MatchError(context.DeadlineExceeded))
+		Expect(rateLimits.SubscriberLimits()).To(HaveKey(anonymousSubscriber))
+	})
+
+	It("removes buckets without an explicit limit when their last stream ends", func() {
+		rateLimits.SetTopicLimit("explicit", RateLimit{RecordsPerSec: 10})
+		first := rateLimits.acquire(peerContext("127.0.0.1", 5000), "implicit")
+		second := rateLimits.acquire(peerContext("127.0.0.1", 5001), "explicit")
+
+		first.release()
+		Expect(rateLimits.TopicLimits()).NotTo(HaveKey("implicit"))
+		Expect(rateLimits.SubscriberLimits()).To(HaveKey("127.0.0.1"))
+
+		second.release()
+		Expect(rateLimits.TopicLimits()).To(Equal(map[string]RateLimit{"explicit": {RecordsPerSec: 10}}))
+		Expect(rateLimits.SubscriberLimits()).To(BeEmpty())
+	})
+})
@@ -9,6 +9,7 @@ import (
 	"github.com/paust-team/pirius/agent/storage"
 	"github.com/paust-team/pirius/logger"
 	"github.com/paust-team/pirius/proto/pb"
+	"github.com/paust-team/pirius/qerror"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"net"
@@ -33,9 +34,9 @@ func (s *RetrievablePubSubAgent) StartWithServer() error {
 		return err
 	}
 
-	s.subscriber = pubsub.NewRetrievableSubscriber(s.meta.SubscriberID, s.bootstrapper, s.meta.SubscribedOffsets)
+	s.subscriber = pubsub.NewRetrievableSubscriber(s.meta.SubscriberID, s.bootstrapper, s.meta.SubscribedOffsets, s.reconnectPolicy())
 	agentAddress := fmt.Sprintf("%s:%d", s.config.Host(), s.config.Port())
-	s.publisher = pubsub.NewRetrievablePublisher(s.meta.PublisherID, agentAddress, s.db, s.bootstrapper, s.meta.PublishedOffsets, s.meta.LastFetchedOffset)
+	s.publisher = pubsub.NewRetrievablePublisher(s.meta.PublisherID, agentAddress, s.db, s.bootstrapper, s.meta.PublishedOffsets, s.meta.LastFetchedOffset, s.meta.DedupWindows, s.rateLimits, s.batchPolicy(), s.storeQuota())
 
 	var opts []grpc.ServerOption
 	grpcServer := grpc.NewServer(opts...)
@@ -47,6 +48,11 @@ func (s *RetrievablePubSubAgent) StartWithServer() error {
 		s.running = false
 		return err
 	}
+	if err = s.startAdminServer(); err != nil {
+		lis.Close()
+		s.running = false
+		return err
+	}
 
 	s.grpcServer = grpcServer
 	s.wg.Add(1)
@@ -73,26 +79,35 @@ func (s *RetrievablePubSubAgent) Start() error {
 		return err
 	}
 
-	s.subscriber = pubsub.NewRetrievableSubscriber(s.meta.SubscriberID, s.bootstrapper, s.meta.SubscribedOffsets)
+	s.subscriber = pubsub.NewRetrievableSubscriber(s.meta.SubscriberID, s.bootstrapper, s.meta.SubscribedOffsets, s.reconnectPolicy())
 	agentAddress := fmt.Sprintf("%s:%d", s.config.Host(), s.config.Port())
-	s.publisher = pubsub.NewRetrievablePublisher(s.meta.PublisherID, agentAddress, s.db, s.bootstrapper, s.meta.PublishedOffsets, s.meta.LastFetchedOffset)
+	s.publisher = pubsub.NewRetrievablePublisher(s.meta.PublisherID, agentAddress, s.db, s.bootstrapper, s.meta.PublishedOffsets, s.meta.LastFetchedOffset, s.meta.DedupWindows, s.rateLimits, s.batchPolicy(), s.storeQuota())
 
 	return nil
 }
 
+// StopGracefully stops the agent after draining the publications and the subscription streams until ctx is done
+func (s *RetrievablePubSubAgent) StopGracefully(ctx context.Context) error {
+	return s.stopGracefully(ctx, &s.publisher)
+}
+
 func (s *RetrievablePubSubAgent) StartRetrievablePublish(ctx context.Context, topicName string, sendChan chan pubsub.TopicData) (chan []pubsub.TopicDataResult, error) {
 	if !s.running || s.grpcServer == nil {
 		return nil, errors.New("not running state")
 	}
 
-	retentionPeriod := uint64(s.config.RetentionPeriod() * 60 * 60 * 24)
+	retention, err := s.topicRetention(topicName)
+	if err != nil {
+		return nil, err
+	}
 	ctx, cancel := context.WithCancel(ctx)
 
-	retrieveCh, errCh, err := s.publisher.StartTopicPublication(ctx, topicName, retentionPeriod, sendChan)
+	retrieveCh, errCh, err := s.publisher.StartTopicPublication(ctx, topicName, retention, sendChan)
 	if err != nil {
 		cancel()
 		return nil, err
 	}
+	s.publishedTopics.Store(topicName, struct{}{})
 
 	s.wg.Add(1)
 	go func() {
@@ -102,6 +117,10 @@ func (s *RetrievablePubSubAgent) StartRetrievablePublish(ctx context.Context, to
 		for {
 			select {
 			case err = <-errCh:
+				if _, ok := err.(qerror.QuotaExceededError); ok { // rejected records are discarded only
+					logger.Warn(err.Error())
+					continue
+				}
 				if err != nil {
 					logger.Error(err.Error())
 				}
@@ -116,18 +135,20 @@ func (s *RetrievablePubSubAgent) StartRetrievablePublish(ctx context.Context, to
 	return retrieveCh, nil
 }
 
-func (s *RetrievablePubSubAgent) StartRetrievableSubscribe(ctx context.Context, topicName string, batchSize, flushInterval uint32) (chan pubsub.RetrievableSubscriptionResults, error) {
+func (s *RetrievablePubSubAgent) StartRetrievableSubscribe(ctx context.Context, topicName string, batchSize, flushInterval uint32,
+	opts ...pubsub.SubscriptionOption) (chan pubsub.RetrievableSubscriptionResults, error) {
 	if !s.running {
 		return nil, errors.New("not running state")
 	}
 
 	ctx, cancel := context.WithCancel(ctx)
 
-	recvCh, errCh, err := s.subscriber.StartTopicSubscription(ctx, topicName, batchSize, flushInterval)
+	recvCh, errCh, err := s.subscriber.StartTopicSubscription(ctx, topicName, batchSize, flushInterval, opts...)
 	if err != nil {
 		cancel()
 		return nil, err
 	}
+	s.subscribedTopics.Store(topicName, struct{}{})
 	s.wg.Add(1)
 	go func() {
 		defer s.wg.Done()
@@ -136,6 +157,10 @@ func (s *RetrievablePubSubAgent) StartRetrievableSubscribe(ctx context.Context,
 		for {
 			select {
 			case err = <-errCh:
+				if _, ok := err.(qerror.CorruptedRecordError); ok { // corrupted records are skipped only
+					logger.Warn(err.Error())
+					continue
+				}
 				if err != nil {
 					logger.Error(err.Error())
 				}
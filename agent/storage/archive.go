@@ -0,0 +1,377 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/paust-team/pirius/qerror"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+// Archive layout: magic(8) | version(1) | record entries | trailer
+// record entry: type(1) | topicLen(2) | topic | fragmentId(4) | offset(8) | expirationDate(8) | flags(1) | valueLen(4) | value | checksum(4)
+// trailer: type(1) | numRecords(8) | checksum(4)
+// The checksum of a record entry is CRC32C of the entry, and the checksum of the trailer is CRC32C of the whole archive before it
+var archiveMagic = []byte("PIRIUSAR")
+
+const archiveVersion byte = 1
+
+const (
+	archiveEntryEnd byte = iota
+	archiveEntryRecord
+)
+
+const archiveFlagCompacted byte = 1
+
+const (
+	maxArchivedValueSize = 1 << 28
+	importBatchSize      = 1000
+)
+
+// ArchiveStats counts the records of an export or an import
+type ArchiveStats struct {
+	Records   int // records written to or read from the archive
+	Imported  int
+	Corrupted int // corrupted records not exported
+	Expired   int // records expired before they are imported
+	Existing  int // records not imported as their offsets are already stored
+}
+
+type archiveWriter struct {
+	w        *bufio.Writer
+	checksum hash.Hash32
+}
+
+func (a *archiveWriter) write(data []byte) error {
+	a.checksum.Write(data)
+	_, err := a.w.Write(data)
+	return err
+}
+
+func (a *archiveWriter) writeRecord(record Record) error {
+	topicLen := len(record.Topic)
+	entry := make([]byte, 1+2+topicLen+uint32Len+2*uint64Len+1+uint32Len+record.Value.Size()+uint32Len)
+	entry[0] = archiveEntryRecord
+	binary.BigEndian.PutUint16(entry[1:], uint16(topicLen))
+	pos := 3 + copy(entry[3:], record.Topic)
+	binary.BigEndian.PutUint32(entry[pos:], record.FragmentId)
+	pos += uint32Len
+	binary.BigEndian.PutUint64(entry[pos:], record.Offset)
+	pos += uint64Len
+	binary.BigEndian.PutUint64(entry[pos:], record.ExpirationDate)
+	pos += uint64Len
+	if record.Compacted {
+		entry[pos] |= archiveFlagCompacted
+	}
+	pos++
+	binary.BigEndian.PutUint32(entry[pos:], uint32(record.Value.Size()))
+	pos += uint32Len
+	pos += copy(entry[pos:], record.Value.Data())
+	binary.BigEndian.PutUint32(entry[pos:], crc32.Checksum(entry[:pos], castagnoliTable))
+	return a.write(entry)
+}
+
+func (a *archiveWriter) writeTrailer(numRecords uint64) error {
+	trailer := make([]byte, 1+uint64Len+uint32Len)
+	trailer[0] = archiveEntryEnd
+	binary.BigEndian.PutUint64(trailer[1:], numRecords)
+	a.checksum.Write(trailer[:1+uint64Len])
+	binary.BigEndian.PutUint32(trailer[1+uint64Len:], a.checksum.Sum32())
+	if _, err := a.w.Write(trailer); err != nil {
+		return err
+	}
+	return a.w.Flush()
+}
+
+// ExportArchive writes the records of the selected fragments to the archive with their expiration dates.
+// Encrypted records are exported sealed, so the importing store needs their keys to read them.
+// They are exported decrypted only if decrypt is set, and then the archive should be kept safe.
+// Corrupted records are not exported
+func (d *DB) ExportArchive(w io.Writer, selected func(topic string, fragmentId uint32) bool, decrypt bool) (ArchiveStats, error) {
+	var stats ArchiveStats
+	expirationDates, err := d.expirationDates(selected)
+	if err != nil {
+		return stats, err
+	}
+
+	aw := &archiveWriter{w: bufio.NewWriter(w), checksum: crc32.New(castagnoliTable)}
+	if err = aw.write(append(append([]byte{}, archiveMagic...), archiveVersion)); err != nil {
+		return stats, err
+	}
+
+	it := d.Scan(RecordCF)
+	defer it.Close()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		key := NewRecordKey(it.Key())
+		value := NewRecordValue(it.Value())
+		err = d.exportRecord(aw, key, value, expirationDates, selected, decrypt, &stats)
+		key.Free()
+		value.Free()
+		if err != nil {
+			return stats, err
+		}
+	}
+	if err = it.Err(); err != nil {
+		return stats, err
+	}
+	return stats, aw.writeTrailer(uint64(stats.Records))
+}
+
+func (d *DB) exportRecord(aw *archiveWriter, key *RecordKey, value *RecordValue, expirationDates map[string]uint64,
+	selected func(topic string, fragmentId uint32) bool, decrypt bool, stats *ArchiveStats) error {
+	topic, fragmentId, offset := key.Topic(), key.FragmentId(), key.Offset()
+	if !selected(topic, fragmentId) {
+		return nil
+	}
+	if !value.Verify() {
+		stats.Corrupted++
+		return nil
+	}
+
+	// values are exported in the current version
+	exported := value
+	if value.Version() != RecordValueVersion || (decrypt && value.EncryptionKeyId() != 0) {
+		data, err := d.DecryptedData(value)
+		if err != nil {
+			return err
+		}
+		exported = NewCompressedRecordValue(value.SeqNum(), value.Timestamp(), value.Key(), value.Headers(), value.Compression(), data)
+	}
+	// records without retention keys are never expired
+	expirationDate, ok := expirationDates[string(key.Data())]
+	if !ok {
+		expirationDate = math.MaxUint64
+	}
+	compacted, err := d.isCompactionIndexed(topic, fragmentId, offset, value)
+	if err != nil {
+		return err
+	}
+
+	if err = aw.writeRecord(Record{
+		Topic:          topic,
+		FragmentId:     fragmentId,
+		Offset:         offset,
+		Value:          exported,
+		ExpirationDate: expirationDate,
+		Compacted:      compacted,
+	}); err != nil {
+		return err
+	}
+	stats.Records++
+	return nil
+}
+
+// expirationDates returns the expiration dates of the records of the selected fragments by their keys
+func (d *DB) expirationDates(selected func(topic string, fragmentId uint32) bool) (map[string]uint64, error) {
+	expirationDates := make(map[string]uint64)
+	it := d.Scan(RecordExpCF)
+	defer it.Close()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		retentionKey := NewRetentionPeriodKey(it.Key())
+		recordKey := retentionKey.RecordKey()
+		if selected(recordKey.Topic(), recordKey.FragmentId()) {
+			expirationDates[string(recordKey.Data())] = retentionKey.ExpirationDate()
+		}
+		retentionKey.Free()
+	}
+	return expirationDates, it.Err()
+}
+
+// isCompactionIndexed returns true if the record is the newest record of its key on a compacted topic
+func (d *DB) isCompactionIndexed(topic string, fragmentId uint32, offset uint64, value *RecordValue) (bool, error) {
+	if value.Version() == 0 || len(value.Key()) == 0 {
+		return false, nil
+	}
+	index, err := d.engine.Get(RecordKeyCF, NewCompactionKey(topic, fragmentId, value.Key()).Data())
+	if err != nil {
+		return false, err
+	}
+	defer index.Free()
+	if !index.Exists() {
+		return false, nil
+	}
+	indexedOffset, _ := decodeCompactionIndex(index.Data())
+	return indexedOffset == offset, nil
+}
+
+// ImportArchive stores the records of the archive with their offsets and expiration dates.
+// Records already expired and records at offsets already stored are skipped.
+// The whole archive is verified before any record is stored, and read again from the same position to store them
+func (d *DB) ImportArchive(r io.ReadSeeker) (ArchiveStats, error) {
+	start, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return ArchiveStats{}, err
+	}
+	if stats, err := VerifyArchive(r); err != nil {
+		return stats, err
+	}
+	if _, err = r.Seek(start, io.SeekStart); err != nil {
+		return ArchiveStats{}, err
+	}
+
+	var stats ArchiveStats
+	var batch []Record
+	flush := func() error {
+		now := GetNowTimestamp()
+		records := batch[:0]
+		for _, record := range batch {
+			if record.ExpirationDate <= now {
+				stats.Expired++
+			} else {
+				records = append(records, record)
+			}
+		}
+		batch = batch[:0]
+		if len(records) == 0 {
+			return nil
+		}
+		if err := d.PutRecords(records); err != nil {
+			return err
+		}
+		stats.Imported += len(records)
+		return nil
+	}
+
+	numRecords, err := readArchive(r, func(record Record) error {
+		stored, err := d.GetRecord(record.Topic, record.FragmentId, record.Offset)
+		if err != nil {
+			return err
+		}
+		exists := stored.Exists()
+		stored.Free()
+		if exists {
+			stats.Existing++
+			return nil
+		}
+		if batch = append(batch, record); len(batch) >= importBatchSize {
+			return flush()
+		}
+		return nil
+	})
+	stats.Records = numRecords
+	if err != nil {
+		return stats, err
+	}
+	return stats, flush()
+}
+
+// VerifyArchive reads the whole archive and checks its checksums
+func VerifyArchive(r io.Reader) (ArchiveStats, error) {
+	numRecords, err := readArchive(r, func(Record) error { return nil })
+	return ArchiveStats{Records: numRecords}, err
+}
+
+// readArchive calls fn with each record of the archive. it returns the number of records read
+func readArchive(r io.Reader, fn func(Record) error) (int, error) {
+	checksum := crc32.New(castagnoliTable)
+	reader := io.TeeReader(bufio.NewReader(r), checksum)
+	readFull := func(size int) ([]byte, error) {
+		data := make([]byte, size)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, qerror.CorruptedArchiveError{ErrStr: "archive is truncated"}
+			}
+			return nil, err
+		}
+		return data, nil
+	}
+
+	header, err := readFull(len(archiveMagic) + 1)
+	if err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(header[:len(archiveMagic)], archiveMagic) {
+		return 0, qerror.CorruptedArchiveError{ErrStr: "not an archive of records"}
+	}
+	if header[len(archiveMagic)] != archiveVersion {
+		return 0, qerror.CorruptedArchiveError{ErrStr: fmt.Sprintf("unsupported archive version %d", header[len(archiveMagic)])}
+	}
+
+	numRecords := 0
+	for {
+		entryType, err := readFull(1)
+		if err != nil {
+			return numRecords, err
+		}
+		switch entryType[0] {
+		case archiveEntryEnd:
+			count, err := readFull(uint64Len)
+			if err != nil {
+				return numRecords, err
+			}
+			expected := checksum.Sum32()
+			stored, err := readFull(uint32Len)
+			if err != nil {
+				return numRecords, err
+			}
+			if binary.BigEndian.Uint32(stored) != expected {
+				return numRecords, qerror.CorruptedArchiveError{ErrStr: "checksum of the archive mismatched"}
+			}
+			if binary.BigEndian.Uint64(count) != uint64(numRecords) {
+				return numRecords, qerror.CorruptedArchiveError{ErrStr: "number of records mismatched"}
+			}
+			return numRecords, nil
+		case archiveEntryRecord:
+			record, err := readArchivedRecord(readFull)
+			if err != nil {
+				return numRecords, err
+			}
+			if err = fn(record); err != nil {
+				return numRecords, err
+			}
+			numRecords++
+		default:
+			return numRecords, qerror.CorruptedArchiveError{ErrStr: fmt.Sprintf("unknown entry type %d", entryType[0])}
+		}
+	}
+}
+
+// readArchivedRecord reads a record entry after its type
+func readArchivedRecord(readFull func(size int) ([]byte, error)) (Record, error) {
+	topicLen, err := readFull(2)
+	if err != nil {
+		return Record{}, err
+	}
+	fieldsLen := int(binary.BigEndian.Uint16(topicLen)) + uint32Len + 2*uint64Len + 1 + uint32Len
+	fields, err := readFull(fieldsLen)
+	if err != nil {
+		return Record{}, err
+	}
+	valueLen := binary.BigEndian.Uint32(fields[fieldsLen-uint32Len:])
+	if valueLen > maxArchivedValueSize {
+		return Record{}, qerror.CorruptedArchiveError{ErrStr: fmt.Sprintf("record value of %d bytes is too large", valueLen)}
+	}
+	valueAndChecksum, err := readFull(int(valueLen) + uint32Len)
+	if err != nil {
+		return Record{}, err
+	}
+
+	entryChecksum := crc32.Checksum([]byte{archiveEntryRecord}, castagnoliTable)
+	entryChecksum = crc32.Update(entryChecksum, castagnoliTable, topicLen)
+	entryChecksum = crc32.Update(entryChecksum, castagnoliTable, fields)
+	entryChecksum = crc32.Update(entryChecksum, castagnoliTable, valueAndChecksum[:valueLen])
+	if binary.BigEndian.Uint32(valueAndChecksum[valueLen:]) != entryChecksum {
+		return Record{}, qerror.CorruptedArchiveError{ErrStr: "checksum of a record mismatched"}
+	}
+
+	topicEnd := len(fields) - uint32Len - 2*uint64Len - 1 - uint32Len
+	pos := topicEnd
+	record := Record{Topic: string(fields[:topicEnd])}
+	record.FragmentId = binary.BigEndian.Uint32(fields[pos:])
+	pos += uint32Len
+	record.Offset = binary.BigEndian.Uint64(fields[pos:])
+	pos += uint64Len
+	record.ExpirationDate = binary.BigEndian.Uint64(fields[pos:])
+	pos += uint64Len
+	record.Compacted = fields[pos]&archiveFlagCompacted != 0
+	record.Value = &RecordValue{data: valueAndChecksum[:valueLen], isSlice: false}
+	if !record.Value.Verify() {
+		return Record{}, qerror.CorruptedArchiveError{ErrStr: fmt.Sprintf("record of topic(%s) fragment(%d) offset(%d) is corrupted", record.Topic, record.FragmentId, record.Offset)}
+	}
+	return record, nil
+}
@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// NeverExpire is the expiration date of the newest record of a key on compacted topics, kept until it is replaced
+const NeverExpire uint64 = math.MaxUint64
+
+// CompactionKey indexes the newest record of a key in a fragment of a compacted topic.
+// Key layout: topic@ | fragmentId(4) | recordKey, value layout: offset(8) | expirationDate(8)
+type CompactionKey struct {
+	data []byte
+}
+
+func NewCompactionKey(topic string, fragmentId uint32, recordKey []byte) CompactionKey {
+	data := make([]byte, len(topic)+1+uint32Len, len(topic)+1+uint32Len+len(recordKey))
+	copy(data, topic+"@")
+	binary.BigEndian.PutUint32(data[len(topic)+1:], fragmentId)
+	return CompactionKey{data: append(data, recordKey...)}
+}
+
+func (k CompactionKey) Data() []byte {
+	return k.data
+}
+
+func encodeCompactionIndex(offset uint64, expirationDate uint64) []byte {
+	data := make([]byte, 2*uint64Len)
+	binary.BigEndian.PutUint64(data, offset)
+	binary.BigEndian.PutUint64(data[uint64Len:], expirationDate)
+	return data
+}
+
+func decodeCompactionIndex(data []byte) (offset uint64, expirationDate uint64) {
+	return binary.BigEndian.Uint64(data), binary.BigEndian.Uint64(data[uint64Len:])
+}
+
+// IsTombstone returns true if the record deletes its key on a compacted topic
+func (v RecordValue) IsTombstone() bool {
+	return len(v.Key()) > 0 && len(v.PublishedData()) == 0
+}
+
+// compactRecord adds deletions of the previous record of the same key to the batch,
+// and indexes the record as the newest one. It returns the bytes of the deleted record.
+// A record older than the indexed one, as imported from an archive, is superseded and deleted instead.
+// `pending` holds the records indexed in the same batch, which are not readable from the db yet.
+func (d *DB) compactRecord(wb *WriteBatch, record Record, pending map[string]Record) (uint64, error) {
+	compactionKey := NewCompactionKey(record.Topic, record.FragmentId, record.Value.Key())
+	var deletedSize uint64
+	if prev, ok := pending[string(compactionKey.Data())]; ok {
+		if prev.Offset > record.Offset {
+			d.deleteRecord(wb, record.Topic, record.FragmentId, record.Offset, record.ExpirationDate, record.Value)
+			return storedRecordSize(record.Topic, record.Value), nil
+		}
+		d.deleteRecord(wb, record.Topic, record.FragmentId, prev.Offset, prev.ExpirationDate, prev.Value)
+		deletedSize = storedRecordSize(record.Topic, prev.Value)
+	} else {
+		index, err := d.engine.Get(RecordKeyCF, compactionKey.Data())
+		if err != nil {
+			return 0, err
+		}
+		defer index.Free()
+		if index.Exists() {
+			prevOffset, prevExpirationDate := decodeCompactionIndex(index.Data())
+			if prevOffset > record.Offset {
+				d.deleteRecord(wb, record.Topic, record.FragmentId, record.Offset, record.ExpirationDate, record.Value)
+				return storedRecordSize(record.Topic, record.Value), nil
+			}
+			if prevOffset < record.Offset {
+				prevRecord, err := d.GetRecord(record.Topic, record.FragmentId, prevOffset)
+				if err != nil {
+					return 0, err
+				}
+				defer prevRecord.Free()
+				if prevRecord.Exists() { // unless already deleted by retention
+					prevValue := NewRecordValue(prevRecord)
+					d.deleteRecord(wb, record.Topic, record.FragmentId, prevOffset, prevExpirationDate, prevValue)
+					deletedSize = storedRecordSize(record.Topic, prevValue)
+				}
+			}
+		}
+	}
+	pending[string(compactionKey.Data())] = record
+	wb.PutCF(RecordKeyCF, compactionKey.Data(), encodeCompactionIndex(record.Offset, record.ExpirationDate))
+	return deletedSize, nil
+}
+
+// storedRecordSize returns the bytes of the record key and the value
+func storedRecordSize(topic string, value *RecordValue) uint64 {
+	return uint64(len(topic)+1+uint32Len+uint64Len) + uint64(value.Size())
+}
+
+// deleteRecord adds deletions of the record and its retention and timestamp index keys to the batch
+func (d *DB) deleteRecord(wb *WriteBatch, topic string, fragmentId uint32, offset uint64, expirationDate uint64, value *RecordValue) {
+	key := NewRecordKeyFromData(topic, fragmentId, offset)
+	wb.DeleteCF(RecordCF, key.Data())
+	wb.DeleteCF(RecordExpCF, NewRetentionPeriodKeyFromData(key, expirationDate).Data())
+	if value.Version() > 0 {
+		timeIndexKey := NewTimeIndexKeyFromData(topic, fragmentId, value.Timestamp(), offset)
+		wb.DeleteCF(RecordTimeCF, timeIndexKey.Data())
+	}
+}
+
+// deleteNeverExpiringKey adds a deletion of the retention key of the record if it never expires.
+// Retention keys of other deleted records are cleaned up on expiration
+func (d *DB) deleteNeverExpiringKey(wb *WriteBatch, key *RecordKey) {
+	wb.DeleteCF(RecordExpCF, NewRetentionPeriodKeyFromData(key, NeverExpire).Data())
+}
+
+// deleteCompactionIndex adds a deletion of the compaction index to the batch if it points to the deleted record
+func (d *DB) deleteCompactionIndex(wb *WriteBatch, topic string, fragmentId uint32, offset uint64, value *RecordValue) error {
+	if value.Version() == 0 || len(value.Key()) == 0 {
+		return nil
+	}
+	compactionKey := NewCompactionKey(topic, fragmentId, value.Key())
+	index, err := d.engine.Get(RecordKeyCF, compactionKey.Data())
+	if err != nil {
+		return err
+	}
+	defer index.Free()
+	if !index.Exists() {
+		return nil
+	}
+	if indexedOffset, _ := decodeCompactionIndex(index.Data()); indexedOffset == offset {
+		wb.DeleteCF(RecordKeyCF, compactionKey.Data())
+	}
+	return nil
+}
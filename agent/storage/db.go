@@ -1,11 +1,16 @@
 package storage
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
-	"github.com/linxGnu/grocksdb"
+	"github.com/paust-team/pirius/compression"
+	"github.com/paust-team/pirius/qerror"
+	"math"
 	"path/filepath"
 	"runtime"
+	"sync"
 	"time"
 	"unsafe"
 )
@@ -23,145 +28,591 @@ type CFIndex int
 const (
 	DefaultCF CFIndex = iota
 	RecordCF
-	RecordExpCF // column family for record-expiration
+	RecordExpCF  // column family for record-expiration
+	RecordTimeCF // column family for record-timestamp index
+	RecordKeyCF  // column family for the newest record of each key on compacted topics
+	QuarantineCF // column family for corrupted records moved out of the record column family
 )
 
 var columnFamilies = []string{
 	"default",
 	"record",
 	"record_exp",
+	"record_time",
+	"record_key",
+	"record_quarantine",
 }
 
 func (c CFIndex) String() string { return columnFamilies[c] }
 
-// DB is helper for grocksdb
+// Record is a record to be written with PutRecords. ExpirationDate is timestamp(second) type
+type Record struct {
+	Topic          string
+	FragmentId     uint32
+	Offset         uint64
+	Value          *RecordValue
+	ExpirationDate uint64
+	Compacted      bool // if set, the previous record of the same key in the fragment is deleted
+}
+
+// DB stores records of topics on a storage engine
 type DB struct {
-	dbPath              string
-	db                  *grocksdb.DB
-	ro                  *grocksdb.ReadOptions
-	wo                  *grocksdb.WriteOptions
-	dwo                 *grocksdb.WriteOptions
-	fo                  *grocksdb.FlushOptions
-	columnFamilyHandles grocksdb.ColumnFamilyHandles
-}
-
-func NewDB(name, dir string) (*DB, error) {
-
-	dbPath := filepath.Join(dir, name)
-
-	bbto := grocksdb.NewDefaultBlockBasedTableOptions()
-	blockCache := grocksdb.NewLRUCache(1 << 18)
-	bbto.SetBlockCache(blockCache)
-
-	defaultOpts := grocksdb.NewDefaultOptions()
-	defaultOpts.SetBlockBasedTableFactory(bbto)
-	defaultOpts.SetCreateIfMissing(true)
-	defaultOpts.SetCreateIfMissingColumnFamilies(true)
-	defaultOpts.SetCompression(grocksdb.SnappyCompression)
-	defaultOpts.SetMaxOpenFiles(16)
-	opts := grocksdb.NewDefaultOptions()
-	db, columnFamilyHandles, err := grocksdb.OpenDbColumnFamilies(defaultOpts, dbPath, columnFamilies, []*grocksdb.Options{opts, opts, opts})
+	engine     Engine
+	sizes      *recordSizes
+	keyRing    *KeyRing   // records are stored unencrypted if not set
+	deletionMu sync.Mutex // serializes removals of records, so removed bytes are counted once
+}
+
+func NewDB(engineType EngineType, name, dir string) (*DB, error) {
+	engine, err := openEngine(engineType, filepath.Join(dir, name), false)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &DB{engine: engine, sizes: newRecordSizes()}
+	if err = d.upgradeRecordValues(); err != nil {
+		engine.Close()
+		return nil, err
+	}
+	d.loadRecordSizes()
+	return d, nil
+}
+
+// NewReadOnlyDB opens the store to inspect it without writing anything. Legacy values are not upgraded,
+// so a store not upgraded yet cannot be opened. the records are read as they were when it is opened
+func NewReadOnlyDB(engineType EngineType, name, dir string) (*DB, error) {
+	engine, err := openEngine(engineType, filepath.Join(dir, name), true)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &DB{engine: engine, sizes: newRecordSizes()}
+	upgraded, err := d.recordValuesUpgraded()
 	if err != nil {
+		engine.Close()
 		return nil, err
 	}
+	if !upgraded && !d.isEmpty() {
+		engine.Close()
+		return nil, qerror.InvalidStateError{State: "store has legacy record values. open it for writing once to upgrade them"}
+	}
+	d.loadRecordSizes()
+	return d, nil
+}
+
+// isEmpty returns whether the store has no record
+func (d *DB) isEmpty() bool {
+	it := d.engine.NewIterator(RecordCF, false)
+	defer it.Close()
+	it.SeekToFirst()
+	return !it.Valid()
+}
+
+// loadRecordSizes counts the stored bytes of each fragment
+func (d *DB) loadRecordSizes() {
+	it := d.Scan(RecordCF)
+	defer it.Close()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		key := NewRecordKey(it.Key())
+		d.sizes.add(key.Topic(), key.FragmentId(), uint64(key.Size()+it.Value().Size()))
+		key.Free()
+	}
+}
 
-	ro := grocksdb.NewDefaultReadOptions()
-	ro.SetTailing(true)
-	wo := grocksdb.NewDefaultWriteOptions()
-	dwo := grocksdb.NewDefaultWriteOptions()
-	dwo.SetLowPri(true)
-	fo := grocksdb.NewDefaultFlushOptions()
-	fo.SetWait(false)
+// SetKeyRing enables encryption of the data of records written after it. it should be called before the DB is used
+func (d *DB) SetKeyRing(keyRing *KeyRing) {
+	d.keyRing = keyRing
+}
 
-	return &DB{dbPath: dbPath, db: db, ro: ro, wo: wo, dwo: dwo, fo: fo, columnFamilyHandles: columnFamilyHandles}, nil
+// DecryptedData returns the published data of the value, decrypting it if it is encrypted
+func (d *DB) DecryptedData(value *RecordValue) ([]byte, error) {
+	return d.keyRing.Open(value)
+}
+
+// DecodedData returns the published data of the value as it was published, decrypting and decompressing it
+func (d *DB) DecodedData(value *RecordValue) ([]byte, error) {
+	data, err := d.DecryptedData(value)
+	if err != nil {
+		return nil, err
+	}
+	return compression.Decompress(value.Compression(), data)
 }
 
 func (d *DB) Flush() error {
-	return d.db.Flush(&grocksdb.FlushOptions{})
+	return d.engine.Flush(DefaultCF)
 }
 
-func (d *DB) GetRecord(topic string, fragmentId uint32, offset uint64) (*grocksdb.Slice, error) {
+func (d *DB) GetRecord(topic string, fragmentId uint32, offset uint64) (Slice, error) {
 	key := NewRecordKeyFromData(topic, fragmentId, offset)
-	return d.db.GetCF(d.ro, d.ColumnFamilyHandles()[RecordCF], key.Data())
+	return d.engine.Get(RecordCF, key.Data())
 }
 
 // PutRecord expirationDate is timestamp(second) type
 func (d *DB) PutRecord(topic string, fragmentId uint32, offset uint64, seqNum uint64, data []byte, expirationDate uint64) error {
-	if expirationDate <= GetNowTimestamp() {
-		return errors.New("invalid retentionPeriod: expiration date should be greater than current timestamp")
-	}
+	return d.PutRecordValue(topic, fragmentId, offset, NewRecordValueFromData(seqNum, data), expirationDate)
+}
 
-	// put record
-	key := NewRecordKeyFromData(topic, fragmentId, offset)
-	value := NewRecordValueFromData(seqNum, data)
-	if err := d.db.PutCF(d.wo, d.ColumnFamilyHandles()[RecordCF], key.Data(), value.Data()); err != nil {
-		return err
+// PutRecordValue expirationDate is timestamp(second) type
+func (d *DB) PutRecordValue(topic string, fragmentId uint32, offset uint64, value *RecordValue, expirationDate uint64) error {
+	return d.PutRecords([]Record{{
+		Topic:          topic,
+		FragmentId:     fragmentId,
+		Offset:         offset,
+		Value:          value,
+		ExpirationDate: expirationDate,
+	}})
+}
+
+// PutRecords writes records with their retention periods and timestamp indexes atomically
+func (d *DB) PutRecords(records []Record) error {
+	return d.putRecords(records, false)
+}
+
+// PutDurableRecords writes records like PutRecords, and returns after the write is synced to the disk
+func (d *DB) PutDurableRecords(records []Record) error {
+	return d.putRecords(records, true)
+}
+
+func (d *DB) putRecords(records []Record, sync bool) error {
+	now := GetNowTimestamp()
+	wb := NewWriteBatch()
+	if sync {
+		wb.SetSync()
 	}
+	compacted := make(map[string]Record)
+	sealed := make(map[*RecordValue]*RecordValue) // a value written to several fragments is sealed once
+	var putSizes, deletedSizes []fragmentSize
+	for _, record := range records {
+		if record.ExpirationDate <= now {
+			return errors.New("invalid retentionPeriod: expiration date should be greater than current timestamp")
+		}
+		if d.keyRing != nil && record.Value.Version() == RecordValueVersion && record.Value.EncryptionKeyId() == 0 {
+			value, ok := sealed[record.Value]
+			if !ok {
+				var err error
+				if value, err = d.keyRing.Seal(record.Value); err != nil {
+					return err
+				}
+				sealed[record.Value] = value
+			}
+			record.Value = value
+		}
+		key := NewRecordKeyFromData(record.Topic, record.FragmentId, record.Offset)
+		wb.PutCF(RecordCF, key.Data(), record.Value.Data())
+		putSizes = append(putSizes, fragmentSize{topic: record.Topic, fragmentId: record.FragmentId, size: uint64(key.Size() + record.Value.Size())})
+
+		// retention key holds the timestamp of the record to delete its index on expiration
+		timestamp := make([]byte, uint64Len)
+		binary.BigEndian.PutUint64(timestamp, record.Value.Timestamp())
+		retentionKey := NewRetentionPeriodKeyFromData(key, record.ExpirationDate)
+		wb.PutCF(RecordExpCF, retentionKey.Data(), timestamp)
+
+		timeIndexKey := NewTimeIndexKeyFromData(record.Topic, record.FragmentId, record.Value.Timestamp(), record.Offset)
+		wb.PutCF(RecordTimeCF, timeIndexKey.Data(), []byte{})
 
-	// put retention period
-	retentionKey := NewRetentionPeriodKeyFromData(key, expirationDate)
-	if err := d.db.PutCF(d.wo, d.ColumnFamilyHandles()[RecordExpCF], retentionKey.Data(), []byte{}); err != nil {
+		if record.Compacted && len(record.Value.Key()) > 0 {
+			size, err := d.compactRecord(wb, record, compacted)
+			if err != nil {
+				return err
+			} else if size > 0 {
+				deletedSizes = append(deletedSizes, fragmentSize{topic: record.Topic, fragmentId: record.FragmentId, size: size})
+			}
+		}
+	}
+	if err := d.engine.Write(wb, false); err != nil {
 		return err
 	}
+	for _, put := range putSizes {
+		d.sizes.add(put.topic, put.fragmentId, put.size)
+	}
+	for _, deleted := range deletedSizes {
+		d.sizes.sub(deleted.topic, deleted.fragmentId, deleted.size)
+	}
 	return nil
 }
 
+// FragmentSize returns the stored bytes of the fragment
+func (d *DB) FragmentSize(topic string, fragmentId uint32) uint64 {
+	return d.sizes.fragment(topic, fragmentId)
+}
+
+// TopicSize returns the stored bytes of the topic
+func (d *DB) TopicSize(topic string) uint64 {
+	return d.sizes.topic(topic)
+}
+
+// TotalSize returns the stored bytes of all topics
+func (d *DB) TotalSize() uint64 {
+	return d.sizes.total()
+}
+
+// FragmentSizes returns the stored bytes of each fragment by topic
+func (d *DB) FragmentSizes() map[string]map[uint32]uint64 {
+	return d.sizes.snapshot()
+}
+
+// DeleteOldestRecords deletes records from the head of the fragment until `numBytes` are freed.
+// Retention keys of the deleted records are left to be cleaned up on expiration, except the ones never expiring.
+func (d *DB) DeleteOldestRecords(topic string, fragmentId uint32, numBytes uint64) (uint64, error) {
+	d.deletionMu.Lock()
+	defer d.deletionMu.Unlock()
+
+	it := d.Scan(RecordCF)
+	defer it.Close()
+	wb := NewWriteBatch()
+
+	var freed uint64
+	firstKey := NewRecordKeyFromData(topic, fragmentId, 0)
+	for it.Seek(firstKey.Data()); it.Valid() && freed < numBytes; it.Next() {
+		key := NewRecordKey(it.Key())
+		if key.Topic() != topic || key.FragmentId() != fragmentId {
+			key.Free()
+			break
+		}
+		value := NewRecordValue(it.Value())
+		wb.DeleteCF(RecordCF, key.Data())
+		if err := d.deleteCompactionIndex(wb, topic, fragmentId, key.Offset(), value); err != nil {
+			key.Free()
+			value.Free()
+			return 0, err
+		}
+		if len(value.Key()) > 0 {
+			d.deleteNeverExpiringKey(wb, key)
+		}
+		if value.Version() > 0 {
+			timeIndexKey := NewTimeIndexKeyFromData(topic, fragmentId, value.Timestamp(), key.Offset())
+			wb.DeleteCF(RecordTimeCF, timeIndexKey.Data())
+		}
+		freed += uint64(key.Size() + value.Size())
+		key.Free()
+		value.Free()
+	}
+	if err := it.Err(); err != nil {
+		return 0, err
+	}
+	if freed == 0 {
+		return 0, nil
+	}
+	if err := d.engine.Write(wb, true); err != nil {
+		return 0, err
+	}
+	d.sizes.sub(topic, fragmentId, freed)
+	return freed, nil
+}
+
+// QuarantineRecord moves a corrupted record to the quarantine column family, so it is not read again.
+// The fields of the record are not parsed, and its retention key is left to be cleaned up on expiration unless it never expires.
+// It returns false when the record is already moved or deleted by another reader of the fragment.
+func (d *DB) QuarantineRecord(topic string, fragmentId uint32, offset uint64) (bool, error) {
+	d.deletionMu.Lock()
+	defer d.deletionMu.Unlock()
+
+	key := NewRecordKeyFromData(topic, fragmentId, offset)
+	value, err := d.engine.Get(RecordCF, key.Data())
+	if err != nil {
+		return false, err
+	}
+	defer value.Free()
+	if !value.Exists() {
+		return false, nil
+	}
+
+	wb := NewWriteBatch()
+	wb.PutCF(QuarantineCF, key.Data(), value.Data())
+	wb.DeleteCF(RecordCF, key.Data())
+	d.deleteNeverExpiringKey(wb, key)
+	if err = d.engine.Write(wb, false); err != nil {
+		return false, err
+	}
+	d.sizes.sub(topic, fragmentId, uint64(key.Size()+value.Size()))
+	return true, nil
+}
+
+// LastRecordOffsets returns the last stored offset of each fragment
+func (d *DB) LastRecordOffsets() (map[FragmentKey]uint64, error) {
+	// tailing iterator does not support SeekForPrev
+	it := d.engine.NewIterator(RecordCF, false)
+	defer it.Close()
+
+	lastOffsets := make(map[FragmentKey]uint64)
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		// jump to the last record of the fragment
+		key := NewRecordKey(it.Key())
+		lastKey := NewRecordKeyFromData(key.Topic(), key.FragmentId(), math.MaxUint64)
+		key.Free()
+		it.SeekForPrev(lastKey.Data())
+
+		key = NewRecordKey(it.Key())
+		lastOffsets[NewFragmentKey(key.Topic(), uint(key.FragmentId()))] = key.Offset()
+		key.Free()
+	}
+	return lastOffsets, it.Err()
+}
+
+// LastRecordTimestamp returns the latest timestamp of the last stored records of the topic's fragments.
+// It is 0 when the topic has no records
+func (d *DB) LastRecordTimestamp(topic string) (uint64, error) {
+	it := d.engine.NewIterator(RecordCF, false)
+	defer it.Close()
+
+	var lastTimestamp uint64
+	firstKey := NewRecordKeyFromData(topic, 0, 0)
+	for it.Seek(firstKey.Data()); it.Valid(); it.Next() {
+		key := NewRecordKey(it.Key())
+		if key.Topic() != topic {
+			key.Free()
+			break
+		}
+		// jump to the last record of the fragment
+		lastKey := NewRecordKeyFromData(topic, key.FragmentId(), math.MaxUint64)
+		key.Free()
+		it.SeekForPrev(lastKey.Data())
+
+		value := NewRecordValue(it.Value())
+		if value.Verify() && value.Timestamp() > lastTimestamp {
+			lastTimestamp = value.Timestamp()
+		}
+		value.Free()
+	}
+	return lastTimestamp, it.Err()
+}
+
+// FirstRecordOffset returns the first retained offset of the fragment
+func (d *DB) FirstRecordOffset(topic string, fragmentId uint32) (uint64, bool, error) {
+	it := d.Scan(RecordCF)
+	defer it.Close()
+
+	firstKey := NewRecordKeyFromData(topic, fragmentId, 0)
+	it.Seek(firstKey.Data())
+	if !it.Valid() {
+		return 0, false, it.Err()
+	}
+	key := NewRecordKey(it.Key())
+	defer key.Free()
+	if key.Topic() != topic || key.FragmentId() != fragmentId {
+		return 0, false, nil
+	}
+	return key.Offset(), true, nil
+}
+
+// FindOffsetByTime returns the first offset of the fragment published at or after the timestamp(millisecond).
+// It stops at the first timestamp at or after the given one, so timestamps should not decrease with offsets in a fragment.
+// The publisher raises a timestamp earlier than the previous record to it
+func (d *DB) FindOffsetByTime(topic string, fragmentId uint32, timestamp uint64) (uint64, bool, error) {
+	it := d.Scan(RecordTimeCF)
+	defer it.Close()
+
+	// records stored before the timestamp index existed are not indexed
+	firstKey := NewTimeIndexKeyFromData(topic, fragmentId, 0, 0)
+	it.Seek(firstKey.Data())
+	if !isTimeIndexOf(it, topic, fragmentId) {
+		return d.findOffsetByScan(topic, fragmentId, timestamp)
+	}
+
+	startKey := NewTimeIndexKeyFromData(topic, fragmentId, timestamp, 0)
+	it.Seek(startKey.Data())
+	if !isTimeIndexOf(it, topic, fragmentId) {
+		return 0, false, it.Err()
+	}
+	indexKey := NewTimeIndexKey(it.Key())
+	defer indexKey.Free()
+	return indexKey.Offset(), true, nil
+}
+
+func isTimeIndexOf(it Iterator, topic string, fragmentId uint32) bool {
+	if !it.Valid() {
+		return false
+	}
+	indexKey := NewTimeIndexKey(it.Key())
+	defer indexKey.Free()
+	return indexKey.Topic() == topic && indexKey.FragmentId() == fragmentId
+}
+
+func (d *DB) findOffsetByScan(topic string, fragmentId uint32, timestamp uint64) (uint64, bool, error) {
+	it := d.Scan(RecordCF)
+	defer it.Close()
+
+	firstKey := NewRecordKeyFromData(topic, fragmentId, 0)
+	for it.Seek(firstKey.Data()); it.Valid(); it.Next() {
+		key := NewRecordKey(it.Key())
+		if key.Topic() != topic || key.FragmentId() != fragmentId {
+			key.Free()
+			break
+		}
+		value := NewRecordValue(it.Value())
+		if value.Timestamp() >= timestamp {
+			offset := key.Offset()
+			key.Free()
+			value.Free()
+			return offset, true, nil
+		}
+		key.Free()
+		value.Free()
+	}
+	return 0, false, it.Err()
+}
+
 // DeleteExpiredRecords Record only can be deleted on expired
 func (d *DB) DeleteExpiredRecords() (numDeleted int, deletionErr error) {
+	return d.deleteExpiredRecords(GetNowTimestamp())
+}
+
+// expiredRange is a contiguous range of expired offsets in a fragment
+type expiredRange struct {
+	topic      string
+	fragmentId uint32
+	first      uint64
+	last       uint64
+}
+
+type fragmentSize struct {
+	topic      string
+	fragmentId uint32
+	size       uint64
+}
+
+// deleteExpiredRecords deletes records expired at `now`.
+// Retention keys are sorted by the expiration date, so the scan stops at the first unexpired key
+// and contiguous offsets of each fragment are deleted with a single range deletion.
+func (d *DB) deleteExpiredRecords(now uint64) (numDeleted int, deletionErr error) {
+	d.deletionMu.Lock()
+	defer d.deletionMu.Unlock()
+
 	it := d.Scan(RecordExpCF)
 	defer it.Close()
-	now := GetNowTimestamp()
+	wb := NewWriteBatch()
 
 	var accError []error
+	var firstRetentionKey []byte
+	ranges := make(map[FragmentKey]*expiredRange)
+	var deletedSizes []fragmentSize
+
+	deleteRange := func(r *expiredRange) {
+		size, count, err := d.deleteRecordRange(wb, r)
+		if err != nil {
+			accError = append(accError, err)
+			return
+		}
+		numDeleted += count
+		deletedSizes = append(deletedSizes, fragmentSize{topic: r.topic, fragmentId: r.fragmentId, size: size})
+	}
+
 	for it.SeekToFirst(); it.Valid(); it.Next() {
 		retentionKey := NewRetentionPeriodKey(it.Key())
-		if retentionKey.ExpirationDate() <= now {
-			if err := d.db.DeleteCF(d.dwo, d.ColumnFamilyHandles()[RecordCF], retentionKey.RecordKey().Data()); err != nil {
-				accError = append(accError, err)
-				continue
-			}
-			if err := d.db.DeleteCF(d.dwo, d.ColumnFamilyHandles()[RecordExpCF], retentionKey.Data()); err != nil {
-				accError = append(accError, err)
-				continue
+		if retentionKey.ExpirationDate() > now {
+			retentionKey.Free()
+			break
+		}
+		if firstRetentionKey == nil {
+			firstRetentionKey = append([]byte{}, retentionKey.Data()...)
+		}
+		recordKey := retentionKey.RecordKey()
+		// the retention value holds the timestamp of the indexed record. legacy records have no value and no timestamp index
+		if it.Value().Size() == uint64Len {
+			timeIndexKey := NewTimeIndexKeyFromData(recordKey.Topic(), recordKey.FragmentId(), binary.BigEndian.Uint64(it.Value().Data()), recordKey.Offset())
+			wb.DeleteCF(RecordTimeCF, timeIndexKey.Data())
+		}
+
+		fragKey := NewFragmentKey(recordKey.Topic(), uint(recordKey.FragmentId()))
+		offset := recordKey.Offset()
+		if r, ok := ranges[fragKey]; ok && r.last+1 == offset {
+			r.last = offset
+		} else {
+			if ok {
+				deleteRange(r)
 			}
-			numDeleted++
+			ranges[fragKey] = &expiredRange{topic: recordKey.Topic(), fragmentId: recordKey.FragmentId(), first: offset, last: offset}
 		}
 		retentionKey.Free()
 		runtime.Gosched()
 	}
+	if err := it.Err(); err != nil {
+		accError = append(accError, err)
+	}
+	if firstRetentionKey == nil {
+		return 0, joinErrors(accError)
+	}
+	for _, r := range ranges {
+		deleteRange(r)
+	}
+
+	// all retention keys before the first unexpired date are deleted
+	lastRetentionKey := make([]byte, uint64Len)
+	binary.BigEndian.PutUint64(lastRetentionKey, now+1)
+	wb.DeleteRangeCF(RecordExpCF, firstRetentionKey, lastRetentionKey)
+
+	if err := d.engine.Write(wb, true); err != nil {
+		accError = append(accError, err)
+		return 0, joinErrors(accError)
+	}
+	for _, deleted := range deletedSizes {
+		d.sizes.sub(deleted.topic, deleted.fragmentId, deleted.size)
+	}
+
 	if numDeleted > 0 {
-		if err := d.db.FlushCF(d.ColumnFamilyHandles()[RecordCF], d.fo); err != nil {
+		if err := d.engine.Flush(RecordCF); err != nil {
 			accError = append(accError, err)
 		}
-		if err := d.db.FlushCF(d.ColumnFamilyHandles()[RecordExpCF], d.fo); err != nil {
+		if err := d.engine.Flush(RecordExpCF); err != nil {
+			accError = append(accError, err)
+		}
+		if err := d.engine.Flush(RecordTimeCF); err != nil {
 			accError = append(accError, err)
 		}
 	}
-	if len(accError) > 0 {
-		errorStr := ""
-		for idx, err := range accError {
-			errorStr += fmt.Sprintf("error no(%d): %s\n", idx, err.Error())
+	return numDeleted, joinErrors(accError)
+}
+
+// deleteRecordRange adds a range deletion of the records to the batch.
+// It returns the bytes and the number of records in the range,
+// which can be less than the range when records are already deleted by DeleteOldestRecords
+func (d *DB) deleteRecordRange(wb *WriteBatch, r *expiredRange) (uint64, int, error) {
+	firstKey := NewRecordKeyFromData(r.topic, r.fragmentId, r.first)
+	endKey := NewRecordKeyFromData(r.topic, r.fragmentId, r.last+1)
+
+	it := d.Scan(RecordCF)
+	defer it.Close()
+	var size uint64
+	var count int
+	for it.Seek(firstKey.Data()); it.Valid() && bytes.Compare(it.Key().Data(), endKey.Data()) < 0; it.Next() {
+		key := NewRecordKey(it.Key())
+		value := NewRecordValue(it.Value())
+		err := d.deleteCompactionIndex(wb, r.topic, r.fragmentId, key.Offset(), value)
+		size += uint64(key.Size() + value.Size())
+		key.Free()
+		value.Free()
+		if err != nil {
+			return 0, 0, err
 		}
-		deletionErr = errors.New(errorStr)
+		count++
 	}
+	if err := it.Err(); err != nil {
+		return 0, 0, err
+	}
+	wb.DeleteRangeCF(RecordCF, firstKey.Data(), endKey.Data())
+	return size, count, nil
+}
 
-	return
+func joinErrors(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	errorStr := ""
+	for idx, err := range errs {
+		errorStr += fmt.Sprintf("error no(%d): %s\n", idx, err.Error())
+	}
+	return errors.New(errorStr)
 }
 
 func (d *DB) Close() {
-	d.db.Close()
-	d.ro.Destroy()
-	d.wo.Destroy()
+	d.engine.Close()
 }
 
 func (d *DB) Destroy() error {
-	return grocksdb.DestroyDb(d.dbPath, grocksdb.NewDefaultOptions())
-}
-
-func (d *DB) ColumnFamilyHandles() grocksdb.ColumnFamilyHandles {
-	return d.columnFamilyHandles
+	return d.engine.Destroy()
 }
 
-func (d *DB) Scan(cfIndex CFIndex) *grocksdb.Iterator {
-	return d.db.NewIteratorCF(d.ro, d.ColumnFamilyHandles()[cfIndex])
+// Scan returns a tailing iterator of the column family
+func (d *DB) Scan(cfIndex CFIndex) Iterator {
+	return d.engine.NewIterator(cfIndex, true)
 }
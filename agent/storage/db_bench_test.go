@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+const (
+	benchExpiredPerTick = 10000
+	benchBatchSize      = 10000
+	benchFragments      = 4
+)
+
+// putBenchRecords spreads records over the fragments with contiguous offsets in each fragment as a publisher writes them
+func putBenchRecords(b *testing.B, db *DB, topic string, firstOffset uint64, count int, expirationDate uint64) {
+	records := make([]Record, 0, benchBatchSize)
+	for i := 0; i < count; i++ {
+		offset := firstOffset + uint64(i/benchFragments)
+		records = append(records, Record{
+			Topic:          topic,
+			FragmentId:     uint32(i % benchFragments),
+			Offset:         offset,
+			Value:          NewRecordValueFromData(offset, []byte("benchmark-record")),
+			ExpirationDate: expirationDate,
+		})
+		if len(records) == benchBatchSize || i == count-1 {
+			if err := db.PutRecords(records); err != nil {
+				b.Fatal(err)
+			}
+			records = records[:0]
+		}
+	}
+}
+
+// BenchmarkDeleteExpiredRecords measures a retention tick deleting a fixed number of expired records.
+// The cost should not grow with the number of live records.
+func BenchmarkDeleteExpiredRecords(b *testing.B) {
+	for _, numLive := range []int{10000, 1000000, 4000000} {
+		b.Run(fmt.Sprintf("live=%d", numLive), func(b *testing.B) {
+			dir, err := os.MkdirTemp("", "pirius-bench")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			db, err := NewDB(RocksDBEngine, "bench-store", dir)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+
+			putBenchRecords(b, db, "live", 1, numLive, GetNowTimestamp()+1000000)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				expirationDate := GetNowTimestamp() + 1000
+				putBenchRecords(b, db, "expiring", uint64(i*benchExpiredPerTick/benchFragments)+1, benchExpiredPerTick, expirationDate)
+				b.StartTimer()
+
+				numDeleted, err := db.deleteExpiredRecords(expirationDate)
+				if err != nil {
+					b.Fatal(err)
+				} else if numDeleted != benchExpiredPerTick {
+					b.Fatalf("expected %d deleted records, got %d", benchExpiredPerTick, numDeleted)
+				}
+			}
+		})
+	}
+}
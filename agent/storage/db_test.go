@@ -4,12 +4,14 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
-	"github.com/linxGnu/grocksdb"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"github.com/paust-team/pirius/agent/storage"
+	"github.com/paust-team/pirius/compression"
+	"github.com/paust-team/pirius/qerror"
 	"github.com/paust-team/pirius/test"
 	"runtime"
+	"sync"
 	"time"
 	"unsafe"
 )
@@ -39,6 +41,135 @@ var _ = Describe("DB", func() {
 		})
 	})
 
+	Context("RecordValue", func() {
+		Describe("Generating new RecordValue", func() {
+			tp := test.NewTestParams()
+
+			BeforeEach(func() {
+				tp.Set("expSeqNum", uint64(10))
+				tp.Set("expTimestamp", uint64(time.Now().UnixMilli()))
+				tp.Set("expKey", []byte("device-1"))
+				tp.Set("expHeaders", map[string]string{"trace-id": "abcd", "content-type": "application/json"})
+				tp.Set("expData", []byte{1, 2, 3, 4, 5})
+			})
+
+			It("should be equal", func() {
+				recordValue := storage.NewRecordValueFromFields(
+					tp.GetUint64("expSeqNum"),
+					tp.GetUint64("expTimestamp"),
+					tp.GetBytes("expKey"),
+					tp.Get("expHeaders").(map[string]string),
+					tp.GetBytes("expData"))
+
+				Expect(recordValue.Version()).To(Equal(storage.RecordValueVersion))
+				Expect(recordValue.SeqNum()).To(Equal(tp.GetUint64("expSeqNum")))
+				Expect(recordValue.Timestamp()).To(Equal(tp.GetUint64("expTimestamp")))
+				Expect(recordValue.Key()).To(Equal(tp.GetBytes("expKey")))
+				Expect(recordValue.Headers()).To(Equal(tp.Get("expHeaders").(map[string]string)))
+				Expect(recordValue.PublishedData()).To(Equal(tp.GetBytes("expData")))
+			})
+		})
+
+		Describe("Decoding legacy RecordValue", func() {
+			tp := test.NewTestParams()
+			var recordValue *storage.RecordValue
+
+			BeforeEach(func() {
+				// the first byte of the seqNum is a version byte of versioned values
+				tp.Set("expSeqNum", uint64(storage.RecordValueVersion)<<56|7)
+				tp.Set("expData", []byte{1, 2, 3, 4, 5})
+
+				data := make([]byte, 8)
+				binary.BigEndian.PutUint64(data, tp.GetUint64("expSeqNum"))
+				recordValue = storage.NewLegacyRecordValue(append(data, tp.GetBytes("expData")...))
+			})
+
+			It("should be equal", func() {
+				Expect(recordValue.Version()).To(BeZero())
+				Expect(recordValue.SeqNum()).To(Equal(tp.GetUint64("expSeqNum")))
+				Expect(recordValue.Timestamp()).To(BeZero())
+				Expect(recordValue.Key()).To(BeNil())
+				Expect(recordValue.Headers()).To(BeNil())
+				Expect(recordValue.PublishedData()).To(Equal(tp.GetBytes("expData")))
+			})
+			It("should be valid without checksum", func() {
+				_, ok := recordValue.Checksum()
+				Expect(ok).To(BeFalse())
+				Expect(recordValue.Verify()).To(BeTrue())
+			})
+			It("should be invalid when shorter than the seqNum", func() {
+				Expect(storage.NewLegacyRecordValue([]byte{1, 2, 3}).Verify()).To(BeFalse())
+			})
+		})
+
+		Describe("Verifying checksum", func() {
+			var recordValue *storage.RecordValue
+
+			BeforeEach(func() {
+				recordValue = storage.NewRecordValueFromFields(10, uint64(time.Now().UnixMilli()), []byte("device-1"),
+					map[string]string{"trace-id": "abcd", "content-type": "application/json"}, []byte{1, 2, 3, 4, 5})
+			})
+
+			It("should be valid", func() {
+				checksum, ok := recordValue.Checksum()
+				Expect(ok).To(BeTrue())
+				Expect(checksum).To(Equal(recordValue.ComputeChecksum()))
+				Expect(recordValue.Verify()).To(BeTrue())
+			})
+			It("should be invalid when a bit is flipped", func() {
+				recordValue.Data()[recordValue.Size()-1] ^= 0x01
+				Expect(recordValue.Verify()).To(BeFalse())
+			})
+			It("should be invalid when the encoding fields are changed", func() {
+				recordValue.Data()[1] ^= 0x01
+				Expect(recordValue.Verify()).To(BeFalse())
+			})
+			It("should be invalid with an unknown version", func() {
+				recordValue.Data()[0] ^= 0x01
+				Expect(recordValue.Verify()).To(BeFalse())
+			})
+		})
+
+		Describe("Encrypting RecordValue", func() {
+			var keyRing *storage.KeyRing
+			var recordValue, sealed *storage.RecordValue
+
+			BeforeEach(func() {
+				var err error
+				keyRing, err = storage.NewKeyRing(map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)}, 1)
+				Expect(err).NotTo(HaveOccurred())
+				recordValue = storage.NewRecordValueFromFields(10, uint64(time.Now().UnixMilli()), []byte("device-1"),
+					map[string]string{"trace-id": "abcd"}, []byte{1, 2, 3, 4, 5})
+				sealed, err = keyRing.Seal(recordValue)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("should keep the fields except the data", func() {
+				Expect(sealed.EncryptionKeyId()).To(Equal(uint32(1)))
+				Expect(sealed.SeqNum()).To(Equal(recordValue.SeqNum()))
+				Expect(sealed.Key()).To(Equal(recordValue.Key()))
+				Expect(sealed.Headers()).To(Equal(recordValue.Headers()))
+				Expect(sealed.PublishedData()).NotTo(ContainSubstring(string(recordValue.PublishedData())))
+				Expect(sealed.Verify()).To(BeTrue())
+			})
+			It("can be opened by the rotated key ring", func() {
+				rotated, err := storage.NewKeyRing(map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32), 2: bytes.Repeat([]byte{2}, 16)}, 2)
+				Expect(err).NotTo(HaveOccurred())
+				data, err := rotated.Open(sealed)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(data).To(Equal(recordValue.PublishedData()))
+				Expect(storage.FieldsChecksum(sealed.SeqNum(), sealed.Timestamp(), sealed.Key(), sealed.Headers(), data)).
+					To(Equal(storage.FieldsChecksum(recordValue.SeqNum(), recordValue.Timestamp(), recordValue.Key(), recordValue.Headers(), recordValue.PublishedData())))
+			})
+			It("cannot be opened without the key", func() {
+				other, err := storage.NewKeyRing(map[uint32][]byte{2: bytes.Repeat([]byte{2}, 16)}, 2)
+				Expect(err).NotTo(HaveOccurred())
+				_, err = other.Open(sealed)
+				Expect(err).To(HaveOccurred())
+			})
+		})
+	})
+
 	Context("RetentionPeriodKey", func() {
 		Describe("Generating new RetentionPeriodKey", func() {
 			tp := test.NewTestParams()
@@ -65,227 +196,961 @@ var _ = Describe("DB", func() {
 		})
 	})
 
-	Context("DB", Ordered, func() {
-		var db *storage.DB
-		var err error
+	for _, engineType := range testEngineTypes {
+		engineType := engineType
+		Context(fmt.Sprintf("DB on %s engine", engineType), Ordered, func() {
+			var db *storage.DB
+			var err error
 
-		BeforeAll(func() {
-			db, err = storage.NewDB("dbstore", ".")
-			Expect(err).NotTo(HaveOccurred())
-		})
-		AfterAll(func() {
-			db.Close()
-			db.Destroy()
-		})
+			BeforeAll(func() {
+				db, err = storage.NewDB(engineType, "dbstore", ".")
+				Expect(err).NotTo(HaveOccurred())
+			})
+			AfterAll(func() {
+				db.Close()
+				db.Destroy()
+			})
+
+			Describe("Fetching a topic record", func() {
+				When("the record not exists", func() {
+					var record storage.Slice
+					BeforeEach(func() {
+						record, err = db.GetRecord("non-exists-topic", 0, 0)
+						Expect(err).NotTo(HaveOccurred())
+					})
+					AfterEach(func() {
+						record.Free()
+					})
+
+					It("must have nil data", func() {
+						Expect(record.Data()).To(BeNil())
+					})
+				})
+				When("the record exists", func() {
+					tp := test.NewTestParams()
+					BeforeEach(func() {
+						tp.Set("expRecord", []byte{1, 2, 3, 4, 5})
+						tp.Set("expTopic", "test_topic")
+						tp.Set("expSeqNum", uint64(10))
+						tp.Set("expFragmentId", uint32(1))
+						tp.Set("expOffset", uint64(1))
+						tp.Set("expExpirationDate", storage.GetNowTimestamp()+10)
+						err = db.PutRecord(tp.GetString("expTopic"),
+							tp.GetUint32("expFragmentId"),
+							tp.GetUint64("expOffset"),
+							tp.GetUint64("expSeqNum"),
+							tp.GetBytes("expRecord"),
+							tp.GetUint64("expExpirationDate"))
+						Expect(err).NotTo(HaveOccurred())
+					})
+
+					It("must have same record value", func() {
+						record, err := db.GetRecord(tp.GetString("expTopic"), tp.GetUint32("expFragmentId"), tp.GetUint64("expOffset"))
+						Expect(err).NotTo(HaveOccurred())
+						Expect(record.Data()).NotTo(BeNil())
+						recordValue := storage.NewRecordValue(record)
+						defer recordValue.Free()
+
+						Expect(recordValue.PublishedData()).To(Equal(tp.GetBytes("expRecord")))
+						Expect(recordValue.SeqNum()).To(Equal(tp.GetUint64("expSeqNum")))
+					})
+				})
+			})
+
+			Describe("Putting records in a batch", func() {
+				tp := test.NewTestParams()
 
-		Describe("Fetching a topic record", func() {
-			When("the record not exists", func() {
-				var record *grocksdb.Slice
 				BeforeEach(func() {
-					record, err = db.GetRecord("non-exists-topic", 0, 0)
-					Expect(err).NotTo(HaveOccurred())
+					tp.Set("expTopic", "test_batch_topic")
+					tp.Set("expFragmentIds", []uint32{1, 2})
+					tp.Set("count", 10)
+					tp.Set("expExpirationDate", storage.GetNowTimestamp()+10)
 				})
 				AfterEach(func() {
-					record.Free()
+					tp.Clear()
 				})
 
-				It("must have nil data", func() {
+				It("can fetch all records of the batch", func() {
+					var records []storage.Record
+					for _, fragmentId := range tp.Get("expFragmentIds").([]uint32) {
+						for offset := uint64(1); offset <= uint64(tp.GetInt("count")); offset++ {
+							records = append(records, storage.Record{
+								Topic:          tp.GetString("expTopic"),
+								FragmentId:     fragmentId,
+								Offset:         offset,
+								Value:          storage.NewRecordValueFromData(offset, []byte{byte(fragmentId), byte(offset)}),
+								ExpirationDate: tp.GetUint64("expExpirationDate"),
+							})
+						}
+					}
+					err = db.PutRecords(records)
+					Expect(err).NotTo(HaveOccurred())
+
+					for _, fragmentId := range tp.Get("expFragmentIds").([]uint32) {
+						for offset := uint64(1); offset <= uint64(tp.GetInt("count")); offset++ {
+							record, err := db.GetRecord(tp.GetString("expTopic"), fragmentId, offset)
+							Expect(err).NotTo(HaveOccurred())
+							recordValue := storage.NewRecordValue(record)
+							Expect(recordValue.SeqNum()).To(Equal(offset))
+							Expect(recordValue.PublishedData()).To(Equal([]byte{byte(fragmentId), byte(offset)}))
+							recordValue.Free()
+						}
+					}
+				})
+
+				It("writes nothing when a record of the batch is invalid", func() {
+					records := []storage.Record{
+						{
+							Topic:          tp.GetString("expTopic"),
+							FragmentId:     3,
+							Offset:         1,
+							Value:          storage.NewRecordValueFromData(1, []byte{1}),
+							ExpirationDate: tp.GetUint64("expExpirationDate"),
+						},
+						{
+							Topic:          tp.GetString("expTopic"),
+							FragmentId:     3,
+							Offset:         2,
+							Value:          storage.NewRecordValueFromData(2, []byte{2}),
+							ExpirationDate: storage.GetNowTimestamp() - 1,
+						},
+					}
+					err = db.PutRecords(records)
+					Expect(err).To(HaveOccurred())
+
+					record, err := db.GetRecord(tp.GetString("expTopic"), 3, 1)
+					Expect(err).NotTo(HaveOccurred())
 					Expect(record.Data()).To(BeNil())
+					record.Free()
 				})
 			})
-			When("the record exists", func() {
+
+			Describe("Deleting oldest records", Ordered, func() {
 				tp := test.NewTestParams()
-				BeforeEach(func() {
-					tp.Set("expRecord", []byte{1, 2, 3, 4, 5})
-					tp.Set("expTopic", "test_topic")
-					tp.Set("expSeqNum", uint64(10))
+				var sizeBefore, freed uint64
+
+				BeforeAll(func() {
+					tp.Set("expTopic", "test_quota_topic")
+					tp.Set("expFragmentId", uint32(1))
+					tp.Set("count", 10)
+					for i := 1; i <= tp.GetInt("count"); i++ {
+						err = db.PutRecord(tp.GetString("expTopic"),
+							tp.GetUint32("expFragmentId"),
+							uint64(i),
+							uint64(i),
+							[]byte{byte(i)},
+							storage.GetNowTimestamp()+10000)
+						Expect(err).NotTo(HaveOccurred())
+					}
+					sizeBefore = db.FragmentSize(tp.GetString("expTopic"), tp.GetUint32("expFragmentId"))
+					freed, err = db.DeleteOldestRecords(tp.GetString("expTopic"), tp.GetUint32("expFragmentId"), 1)
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("should track the size of the records", func() {
+					Expect(sizeBefore).To(BeNumerically(">", 0))
+					Expect(db.TopicSize(tp.GetString("expTopic"))).To(Equal(sizeBefore - freed))
+					Expect(db.TotalSize()).To(BeNumerically(">=", sizeBefore-freed))
+				})
+				It("only the oldest record is deleted", func() {
+					Expect(freed).To(Equal(sizeBefore / uint64(tp.GetInt("count"))))
+
+					record, err := db.GetRecord(tp.GetString("expTopic"), tp.GetUint32("expFragmentId"), 1)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(record.Exists()).To(BeFalse())
+					record.Free()
+
+					record, err = db.GetRecord(tp.GetString("expTopic"), tp.GetUint32("expFragmentId"), 2)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(record.Exists()).To(BeTrue())
+					record.Free()
+				})
+			})
+
+			Describe("Deleting records concurrently", Ordered, func() {
+				topic := "test_concurrent_deletion_topic"
+
+				BeforeAll(func() {
+					for i := 1; i <= 100; i++ {
+						err = db.PutRecord(topic, 1, uint64(i), uint64(i), []byte{byte(i)}, storage.GetNowTimestamp()+10000)
+						Expect(err).NotTo(HaveOccurred())
+					}
+					size := db.TopicSize(topic)
+
+					wg := sync.WaitGroup{}
+					for i := 0; i < 4; i++ {
+						wg.Add(1)
+						go func() {
+							defer GinkgoRecover()
+							defer wg.Done()
+							_, err := db.DeleteOldestRecords(topic, 1, size)
+							Expect(err).NotTo(HaveOccurred())
+						}()
+					}
+					wg.Wait()
+				})
+
+				It("counts the size of each deleted record once", func() {
+					Expect(db.TopicSize(topic)).To(BeZero())
+					Expect(db.FragmentSize(topic, 1)).To(BeZero())
+				})
+			})
+
+			Describe("Quarantining a corrupted record", Ordered, func() {
+				tp := test.NewTestParams()
+				var sizeBefore uint64
+
+				BeforeAll(func() {
+					tp.Set("expTopic", "test_corrupted_topic")
 					tp.Set("expFragmentId", uint32(1))
 					tp.Set("expOffset", uint64(1))
-					tp.Set("expExpirationDate", storage.GetNowTimestamp()+10)
-					err = db.PutRecord(tp.GetString("expTopic"),
+					recordValue := storage.NewRecordValueFromData(1, []byte{1, 2, 3})
+					recordValue.Data()[recordValue.Size()-1] ^= 0x01
+					err = db.PutRecordValue(tp.GetString("expTopic"),
 						tp.GetUint32("expFragmentId"),
 						tp.GetUint64("expOffset"),
-						tp.GetUint64("expSeqNum"),
-						tp.GetBytes("expRecord"),
-						tp.GetUint64("expExpirationDate"))
+						recordValue,
+						storage.GetNowTimestamp()+10000)
 					Expect(err).NotTo(HaveOccurred())
+					sizeBefore = db.TopicSize(tp.GetString("expTopic"))
 				})
 
-				It("must have same record value", func() {
+				It("should fail to verify the stored record", func() {
 					record, err := db.GetRecord(tp.GetString("expTopic"), tp.GetUint32("expFragmentId"), tp.GetUint64("expOffset"))
 					Expect(err).NotTo(HaveOccurred())
-					Expect(record.Data()).NotTo(BeNil())
-					recordValue := storage.NewRecordValue(record)
-					defer recordValue.Free()
+					defer record.Free()
+					Expect(storage.NewRecordValue(record).Verify()).To(BeFalse())
+				})
+				It("moves the record to the quarantine", func() {
+					quarantined, err := db.QuarantineRecord(tp.GetString("expTopic"), tp.GetUint32("expFragmentId"), tp.GetUint64("expOffset"))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(quarantined).To(BeTrue())
+					Expect(sizeBefore).To(BeNumerically(">", 0))
+					Expect(db.TopicSize(tp.GetString("expTopic"))).To(BeZero())
 
-					Expect(recordValue.PublishedData()).To(Equal(tp.GetBytes("expRecord")))
-					Expect(recordValue.SeqNum()).To(Equal(tp.GetUint64("expSeqNum")))
+					record, err := db.GetRecord(tp.GetString("expTopic"), tp.GetUint32("expFragmentId"), tp.GetUint64("expOffset"))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(record.Exists()).To(BeFalse())
+					record.Free()
+
+					it := db.Scan(storage.QuarantineCF)
+					defer it.Close()
+					key := storage.NewRecordKeyFromData(tp.GetString("expTopic"), tp.GetUint32("expFragmentId"), tp.GetUint64("expOffset"))
+					it.Seek(key.Data())
+					Expect(it.Valid()).To(BeTrue())
+					Expect(it.Key().Data()).To(Equal(key.Data()))
+				})
+				It("does not move the record again", func() {
+					quarantined, err := db.QuarantineRecord(tp.GetString("expTopic"), tp.GetUint32("expFragmentId"), tp.GetUint64("expOffset"))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(quarantined).To(BeFalse())
+					Expect(db.TopicSize(tp.GetString("expTopic"))).To(BeZero())
 				})
 			})
-		})
 
-		Describe("Deleting expired record", Ordered, func() {
-			tp := test.NewTestParams()
-			var deletedCount int
+			Describe("Inspecting stored records", Ordered, func() {
+				tp := test.NewTestParams()
+				var report storage.VerificationReport
 
-			BeforeAll(func() {
-				tp.Set("expTopic", "test_topic")
-				tp.Set("expFragmentId", uint32(1))
-				tp.Set("offsetShouldBeDeleted", uint64(1))
-				tp.Set("offsetShouldBeRemained", uint64(0))
-				tp.Set("shortExpirationDate", storage.GetNowTimestamp()+1)
-				tp.Set("longExpirationDate", storage.GetNowTimestamp()+10000)
+				BeforeAll(func() {
+					tp.Set("expTopic", "test_inspected_topic")
+					tp.Set("expFragmentId", uint32(1))
+					tp.Set("count", 5)
+					for i := 1; i <= tp.GetInt("count"); i++ {
+						err = db.PutRecord(tp.GetString("expTopic"),
+							tp.GetUint32("expFragmentId"),
+							uint64(i),
+							uint64(i*10),
+							[]byte{byte(i)},
+							storage.GetNowTimestamp()+10000)
+						Expect(err).NotTo(HaveOccurred())
+					}
+					_, err = db.DeleteOldestRecords(tp.GetString("expTopic"), tp.GetUint32("expFragmentId"), 1)
+					Expect(err).NotTo(HaveOccurred())
 
-				err = db.PutRecord(tp.GetString("expTopic"),
-					tp.GetUint32("expFragmentId"),
-					tp.GetUint64("offsetShouldBeDeleted"),
-					1,
-					[]byte{1},
-					tp.GetUint64("shortExpirationDate"))
-				Expect(err).NotTo(HaveOccurred())
+					corrupted := storage.NewRecordValueFromData(100, []byte{1, 2, 3})
+					corrupted.Data()[corrupted.Size()-1] ^= 0x01
+					err = db.PutRecordValue(tp.GetString("expTopic"), tp.GetUint32("expFragmentId")+1, 1, corrupted, storage.GetNowTimestamp()+10000)
+					Expect(err).NotTo(HaveOccurred())
 
-				err = db.PutRecord(tp.GetString("expTopic"),
-					tp.GetUint32("expFragmentId"),
-					tp.GetUint64("offsetShouldBeRemained"),
-					1,
-					[]byte{1},
-					tp.GetUint64("longExpirationDate"))
-				Expect(err).NotTo(HaveOccurred())
+					report, err = db.VerifyRecords()
+					Expect(err).NotTo(HaveOccurred())
+				})
 
-				time.Sleep(2 * time.Second)
-				deletedCount, err = db.DeleteExpiredRecords()
-				Expect(err).NotTo(HaveOccurred())
-			})
-			It("cannot delete again", func() {
-				count, err := db.DeleteExpiredRecords()
-				Expect(err).NotTo(HaveOccurred())
-				Expect(count).To(Equal(0))
+				It("lists the stored fragments", func() {
+					fragments, err := db.Fragments()
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fragments).To(ContainElement(storage.FragmentInfo{
+						Topic:       tp.GetString("expTopic"),
+						FragmentId:  tp.GetUint32("expFragmentId"),
+						FirstOffset: 2,
+						LastOffset:  uint64(tp.GetInt("count")),
+						NumRecords:  uint64(tp.GetInt("count") - 1),
+						Size:        db.FragmentSize(tp.GetString("expTopic"), tp.GetUint32("expFragmentId")),
+					}))
+				})
+				It("iterates records in the range", func() {
+					var offsets, seqNums []uint64
+					err := db.ForEachRecord(tp.GetString("expTopic"), tp.GetUint32("expFragmentId"), 0, 3, func(offset uint64, value *storage.RecordValue) error {
+						offsets = append(offsets, offset)
+						seqNums = append(seqNums, value.SeqNum())
+						return nil
+					})
+					Expect(err).NotTo(HaveOccurred())
+					Expect(offsets).To(Equal([]uint64{2, 3}))
+					Expect(seqNums).To(Equal([]uint64{20, 30}))
+				})
+				It("reports retention keys of deleted records", func() {
+					Expect(report.DanglingRetentionKeys).To(ContainElement(storage.RecordLocation{
+						Topic: tp.GetString("expTopic"), FragmentId: tp.GetUint32("expFragmentId"), Offset: 1}))
+				})
+				It("reports corrupted records", func() {
+					Expect(report.CorruptedRecords).To(ContainElement(storage.RecordLocation{
+						Topic: tp.GetString("expTopic"), FragmentId: tp.GetUint32("expFragmentId") + 1, Offset: 1}))
+					Expect(report.MissingRetentionKeys).To(BeEmpty())
+					Expect(report.IsHealthy()).To(BeFalse())
+				})
 			})
-			It("only expired records are deleted", func() {
-				Expect(deletedCount).To(Equal(1))
+
+			Describe("Putting records with encryption", Ordered, func() {
+				tp := test.NewTestParams()
+
+				BeforeAll(func() {
+					tp.Set("expTopic", "test_encrypted_topic")
+					tp.Set("expFragmentId", uint32(1))
+					tp.Set("expData", []byte("plaintext"))
+					keyRing, err := storage.NewKeyRing(map[uint32][]byte{7: bytes.Repeat([]byte{7}, 32)}, 7)
+					Expect(err).NotTo(HaveOccurred())
+					db.SetKeyRing(keyRing)
+					err = db.PutRecord(tp.GetString("expTopic"), tp.GetUint32("expFragmentId"), 1, 1,
+						tp.GetBytes("expData"), storage.GetNowTimestamp()+10000)
+					Expect(err).NotTo(HaveOccurred())
+				})
+				AfterAll(func() {
+					db.SetKeyRing(nil)
+				})
+
+				It("stores the data encrypted", func() {
+					record, err := db.GetRecord(tp.GetString("expTopic"), tp.GetUint32("expFragmentId"), 1)
+					Expect(err).NotTo(HaveOccurred())
+					defer record.Free()
+					value := storage.NewRecordValue(record)
+					Expect(value.EncryptionKeyId()).To(Equal(uint32(7)))
+					Expect(bytes.Contains(record.Data(), tp.GetBytes("expData"))).To(BeFalse())
+				})
+				It("decrypts the data", func() {
+					record, err := db.GetRecord(tp.GetString("expTopic"), tp.GetUint32("expFragmentId"), 1)
+					Expect(err).NotTo(HaveOccurred())
+					defer record.Free()
+					data, err := db.DecryptedData(storage.NewRecordValue(record))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(data).To(Equal(tp.GetBytes("expData")))
+				})
 			})
 
-			It("can fetch non-expired record", func() {
-				record, err := db.GetRecord(tp.GetString("expTopic"), tp.GetUint32("expFragmentId"), tp.GetUint64("offsetShouldBeRemained"))
-				defer record.Free()
-				Expect(err).NotTo(HaveOccurred())
-				Expect(record.Data()).NotTo(BeNil())
+			Describe("Putting compressed records", Ordered, func() {
+				tp := test.NewTestParams()
+
+				BeforeAll(func() {
+					tp.Set("expTopic", "test_compressed_topic")
+					tp.Set("expFragmentId", uint32(1))
+					tp.Set("expData", bytes.Repeat([]byte("compressible"), 100))
+					compressed, err := compression.Compress(compression.Zstd, tp.GetBytes("expData"))
+					Expect(err).NotTo(HaveOccurred())
+					value := storage.NewCompressedRecordValue(1, uint64(time.Now().UnixMilli()), nil, nil, compression.Zstd, compressed)
+					err = db.PutRecordValue(tp.GetString("expTopic"), tp.GetUint32("expFragmentId"), 1, value, storage.GetNowTimestamp()+10000)
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("keeps the compressed form", func() {
+					record, err := db.GetRecord(tp.GetString("expTopic"), tp.GetUint32("expFragmentId"), 1)
+					Expect(err).NotTo(HaveOccurred())
+					defer record.Free()
+					value := storage.NewRecordValue(record)
+					Expect(value.Compression()).To(Equal(compression.Zstd))
+					Expect(value.Verify()).To(BeTrue())
+					Expect(len(value.PublishedData())).To(BeNumerically("<", len(tp.GetBytes("expData"))))
+				})
+				It("decodes the published data", func() {
+					record, err := db.GetRecord(tp.GetString("expTopic"), tp.GetUint32("expFragmentId"), 1)
+					Expect(err).NotTo(HaveOccurred())
+					defer record.Free()
+					data, err := db.DecodedData(storage.NewRecordValue(record))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(data).To(Equal(tp.GetBytes("expData")))
+				})
 			})
-			It("cannot fetch expired record", func() {
-				record, err := db.GetRecord(tp.GetString("expTopic"), tp.GetUint32("expFragmentId"), tp.GetUint64("offsetShouldBeDeleted"))
-				defer record.Free()
-				Expect(err).NotTo(HaveOccurred())
-				Expect(record.Data()).To(BeNil())
+
+			Describe("Putting records of a compacted topic", Ordered, func() {
+				tp := test.NewTestParams()
+
+				BeforeAll(func() {
+					tp.Set("expTopic", "test_compacted_topic")
+					tp.Set("expFragmentId", uint32(1))
+					newRecord := func(offset uint64, key string, data []byte) storage.Record {
+						return storage.Record{
+							Topic:          tp.GetString("expTopic"),
+							FragmentId:     tp.GetUint32("expFragmentId"),
+							Offset:         offset,
+							Value:          storage.NewRecordValueFromFields(offset, uint64(time.Now().UnixMilli()), []byte(key), nil, data),
+							ExpirationDate: storage.GetNowTimestamp() + 10000,
+							Compacted:      true,
+						}
+					}
+					// the first batch is compacted with the stored records, and the second one within the batch
+					err = db.PutRecords([]storage.Record{
+						newRecord(1, "device-1", []byte{1}),
+						newRecord(2, "device-2", []byte{2}),
+					})
+					Expect(err).NotTo(HaveOccurred())
+					err = db.PutRecords([]storage.Record{
+						newRecord(3, "device-1", []byte{3}),
+						newRecord(4, "device-2", []byte{4}),
+						newRecord(5, "device-2", nil),
+					})
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("keeps only the newest record of each key", func() {
+					var offsets []uint64
+					for offset := uint64(1); offset <= 5; offset++ {
+						record, err := db.GetRecord(tp.GetString("expTopic"), tp.GetUint32("expFragmentId"), offset)
+						Expect(err).NotTo(HaveOccurred())
+						if record.Exists() {
+							offsets = append(offsets, offset)
+						}
+						record.Free()
+					}
+					Expect(offsets).To(Equal([]uint64{3, 5}))
+				})
+				It("keeps the tombstone of the deleted key", func() {
+					record, err := db.GetRecord(tp.GetString("expTopic"), tp.GetUint32("expFragmentId"), 5)
+					Expect(err).NotTo(HaveOccurred())
+					recordValue := storage.NewRecordValue(record)
+					defer recordValue.Free()
+					Expect(recordValue.IsTombstone()).To(BeTrue())
+					Expect(recordValue.Key()).To(Equal([]byte("device-2")))
+				})
+				It("should track the size of the newest records only", func() {
+					var size uint64
+					for _, offset := range []uint64{3, 5} {
+						record, err := db.GetRecord(tp.GetString("expTopic"), tp.GetUint32("expFragmentId"), offset)
+						Expect(err).NotTo(HaveOccurred())
+						size += uint64(storage.NewRecordKeyFromData(tp.GetString("expTopic"), tp.GetUint32("expFragmentId"), offset).Size() + record.Size())
+						record.Free()
+					}
+					Expect(db.TopicSize(tp.GetString("expTopic"))).To(Equal(size))
+				})
 			})
-		})
 
-		Describe("Deleting expired records (ranged delete)", Ordered, func() {
-			tp := test.NewTestParams()
-			var deletedCount int
+			Describe("Deleting never expiring records of a compacted topic", Ordered, func() {
+				topic := "test_compacted_quota_topic"
 
-			BeforeAll(func() {
-				tp.Set("expTopic", "test_topic3")
-				tp.Set("expFragmentId", uint32(1))
-				tp.Set("expireDate", storage.GetNowTimestamp()+1)
-				tp.Set("count", 10)
-				for i := 0; i < tp.GetInt("count"); i++ {
-					err = db.PutRecord(tp.GetString("expTopic"),
-						tp.GetUint32("expFragmentId"),
-						uint64(i+1),
-						uint64(i+1),
-						[]byte{1},
-						tp.GetUint64("expireDate"))
+				BeforeAll(func() {
+					var records []storage.Record
+					for offset := uint64(1); offset <= 3; offset++ {
+						records = append(records, storage.Record{
+							Topic:          topic,
+							FragmentId:     1,
+							Offset:         offset,
+							Value:          storage.NewRecordValueFromFields(offset, uint64(time.Now().UnixMilli()), []byte(fmt.Sprintf("device-%d", offset)), nil, []byte{1}),
+							ExpirationDate: storage.NeverExpire,
+							Compacted:      true,
+						})
+					}
+					Expect(db.PutRecords(records)).To(Succeed())
+
+					_, err = db.DeleteOldestRecords(topic, 1, 1)
 					Expect(err).NotTo(HaveOccurred())
-				}
+					_, err = db.QuarantineRecord(topic, 1, 2)
+					Expect(err).NotTo(HaveOccurred())
+				})
 
-				time.Sleep(2 * time.Second)
-				deletedCount, err = db.DeleteExpiredRecords()
-				Expect(err).NotTo(HaveOccurred())
+				It("deletes the retention keys with the records", func() {
+					it := db.Scan(storage.RecordExpCF)
+					defer it.Close()
+					var offsets []uint64
+					for it.SeekToFirst(); it.Valid(); it.Next() {
+						retentionKey := storage.NewRetentionPeriodKey(it.Key())
+						if recordKey := retentionKey.RecordKey(); recordKey.Topic() == topic {
+							offsets = append(offsets, recordKey.Offset())
+						}
+						retentionKey.Free()
+					}
+					Expect(offsets).To(Equal([]uint64{3}))
+				})
 			})
-			It("cannot delete again", func() {
-				count, err := db.DeleteExpiredRecords()
-				Expect(err).NotTo(HaveOccurred())
-				Expect(count).To(Equal(0))
+
+			Describe("Exporting and importing records", Ordered, func() {
+				tp := test.NewTestParams()
+				var imported *storage.DB
+				var archive []byte
+				var exportStats storage.ArchiveStats
+
+				BeforeAll(func() {
+					tp.Set("expTopic", "test_exported_topic")
+					tp.Set("expFragmentId", uint32(1))
+					tp.Set("expExpirationDate", storage.GetNowTimestamp()+10000)
+					var records []storage.Record
+					for i := 1; i <= 3; i++ {
+						records = append(records, storage.Record{
+							Topic:          tp.GetString("expTopic"),
+							FragmentId:     tp.GetUint32("expFragmentId"),
+							Offset:         uint64(i),
+							Value:          storage.NewRecordValueFromData(uint64(i), []byte{byte(i)}),
+							ExpirationDate: tp.GetUint64("expExpirationDate"),
+						})
+					}
+					records = append(records, storage.Record{
+						Topic:          tp.GetString("expTopic"),
+						FragmentId:     tp.GetUint32("expFragmentId"),
+						Offset:         4,
+						Value:          storage.NewRecordValueFromFields(4, 0, []byte("key"), nil, []byte{4}),
+						ExpirationDate: tp.GetUint64("expExpirationDate"),
+						Compacted:      true,
+					}, storage.Record{
+						Topic:          tp.GetString("expTopic"),
+						FragmentId:     tp.GetUint32("expFragmentId") + 1,
+						Offset:         1,
+						Value:          storage.NewRecordValueFromData(1, []byte{1}),
+						ExpirationDate: tp.GetUint64("expExpirationDate"),
+					})
+					Expect(db.PutRecords(records)).To(Succeed())
+
+					buf := &bytes.Buffer{}
+					exportStats, err = db.ExportArchive(buf, func(topic string, fragmentId uint32) bool {
+						return topic == tp.GetString("expTopic") && fragmentId == tp.GetUint32("expFragmentId")
+					}, false)
+					Expect(err).NotTo(HaveOccurred())
+					archive = buf.Bytes()
+
+					imported, err = storage.NewDB(storage.MemoryEngine, "dbstore_imported", ".")
+					Expect(err).NotTo(HaveOccurred())
+				})
+				AfterAll(func() {
+					imported.Close()
+					imported.Destroy()
+				})
+
+				It("exports the records of the selected fragments", func() {
+					Expect(exportStats.Records).To(Equal(4))
+					stats, err := storage.VerifyArchive(bytes.NewReader(archive))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(stats.Records).To(Equal(4))
+				})
+				It("imports the records with their offsets and expiration dates", func() {
+					stats, err := imported.ImportArchive(bytes.NewReader(archive))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(stats.Imported).To(Equal(4))
+
+					var offsets []uint64
+					var data [][]byte
+					err = imported.ForEachRecord(tp.GetString("expTopic"), tp.GetUint32("expFragmentId"), 0, 10, func(offset uint64, value *storage.RecordValue) error {
+						offsets = append(offsets, offset)
+						data = append(data, append([]byte{}, value.PublishedData()...))
+						return nil
+					})
+					Expect(err).NotTo(HaveOccurred())
+					Expect(offsets).To(Equal([]uint64{1, 2, 3, 4}))
+					Expect(data).To(Equal([][]byte{{1}, {2}, {3}, {4}}))
+					Expect(imported.FragmentSize(tp.GetString("expTopic"), tp.GetUint32("expFragmentId")+1)).To(BeZero())
+
+					it := imported.Scan(storage.RecordExpCF)
+					defer it.Close()
+					for it.SeekToFirst(); it.Valid(); it.Next() {
+						Expect(storage.NewRetentionPeriodKey(it.Key()).ExpirationDate()).To(Equal(tp.GetUint64("expExpirationDate")))
+					}
+				})
+				It("skips records already stored", func() {
+					stats, err := imported.ImportArchive(bytes.NewReader(archive))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(stats.Imported).To(BeZero())
+					Expect(stats.Existing).To(Equal(4))
+				})
+				It("keeps the newest record of the key on compacted topics", func() {
+					err := imported.PutRecords([]storage.Record{{
+						Topic:          tp.GetString("expTopic"),
+						FragmentId:     tp.GetUint32("expFragmentId"),
+						Offset:         5,
+						Value:          storage.NewRecordValueFromFields(5, 0, []byte("key"), nil, []byte{5}),
+						ExpirationDate: tp.GetUint64("expExpirationDate"),
+						Compacted:      true,
+					}})
+					Expect(err).NotTo(HaveOccurred())
+					record, err := imported.GetRecord(tp.GetString("expTopic"), tp.GetUint32("expFragmentId"), 4)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(record.Exists()).To(BeFalse())
+					record.Free()
+				})
+				It("does not replace a newer record of the key on import", func() {
+					_, err := imported.ImportArchive(bytes.NewReader(archive))
+					Expect(err).NotTo(HaveOccurred())
+
+					exists := func(offset uint64) bool {
+						record, err := imported.GetRecord(tp.GetString("expTopic"), tp.GetUint32("expFragmentId"), offset)
+						Expect(err).NotTo(HaveOccurred())
+						defer record.Free()
+						return record.Exists()
+					}
+					Expect(exists(4)).To(BeFalse())
+					Expect(exists(5)).To(BeTrue())
+
+					// the newer record is still indexed, so it is replaced by the next record of the key
+					err = imported.PutRecords([]storage.Record{{
+						Topic:          tp.GetString("expTopic"),
+						FragmentId:     tp.GetUint32("expFragmentId"),
+						Offset:         6,
+						Value:          storage.NewRecordValueFromFields(6, 0, []byte("key"), nil, []byte{6}),
+						ExpirationDate: tp.GetUint64("expExpirationDate"),
+						Compacted:      true,
+					}})
+					Expect(err).NotTo(HaveOccurred())
+					Expect(exists(5)).To(BeFalse())
+					Expect(exists(6)).To(BeTrue())
+				})
+				It("does not import a part of a corrupted archive", func() {
+					source, err := storage.NewDB(storage.MemoryEngine, "dbstore_archive_source", ".")
+					Expect(err).NotTo(HaveOccurred())
+					defer func() {
+						source.Close()
+						source.Destroy()
+					}()
+					var records []storage.Record
+					for i := 1; i <= 1500; i++ { // more than a batch of importing
+						records = append(records, storage.Record{
+							Topic:          "test_corrupted_archive_topic",
+							FragmentId:     1,
+							Offset:         uint64(i),
+							Value:          storage.NewRecordValueFromData(uint64(i), []byte{byte(i)}),
+							ExpirationDate: tp.GetUint64("expExpirationDate"),
+						})
+					}
+					Expect(source.PutRecords(records)).To(Succeed())
+					buf := &bytes.Buffer{}
+					_, err = source.ExportArchive(buf, func(string, uint32) bool { return true }, false)
+					Expect(err).NotTo(HaveOccurred())
+
+					target, err := storage.NewDB(storage.MemoryEngine, "dbstore_archive_target", ".")
+					Expect(err).NotTo(HaveOccurred())
+					defer func() {
+						target.Close()
+						target.Destroy()
+					}()
+					_, err = target.ImportArchive(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+					Expect(err).To(BeAssignableToTypeOf(qerror.CorruptedArchiveError{}))
+					Expect(target.TotalSize()).To(BeZero())
+				})
+				It("detects corrupted archives", func() {
+					corrupted := append([]byte{}, archive...)
+					corrupted[len(corrupted)/2] ^= 0x01
+					_, err := storage.VerifyArchive(bytes.NewReader(corrupted))
+					Expect(err).To(BeAssignableToTypeOf(qerror.CorruptedArchiveError{}))
+
+					_, err = storage.VerifyArchive(bytes.NewReader(archive[:len(archive)-1]))
+					Expect(err).To(BeAssignableToTypeOf(qerror.CorruptedArchiveError{}))
+				})
 			})
-			It("all records are deleted", func() {
-				Expect(deletedCount).To(Equal(tp.GetInt("count")))
+
+			Describe("Exporting encrypted records", Ordered, func() {
+				var encrypted *storage.DB
+				var keyRing *storage.KeyRing
+				topic := "test_exported_encrypted_topic"
+				plaintext := []byte("plaintext-record")
+				selected := func(t string, _ uint32) bool { return t == topic }
+
+				exportAndImport := func(decrypt bool, importingKeyRing *storage.KeyRing) ([]byte, uint32, []byte) {
+					buf := &bytes.Buffer{}
+					stats, err := encrypted.ExportArchive(buf, selected, decrypt)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(stats.Records).To(Equal(1))
+
+					imported, err := storage.NewDB(storage.MemoryEngine, "dbstore_imported_encrypted", ".")
+					Expect(err).NotTo(HaveOccurred())
+					defer func() {
+						imported.Close()
+						imported.Destroy()
+					}()
+					imported.SetKeyRing(importingKeyRing)
+					_, err = imported.ImportArchive(bytes.NewReader(buf.Bytes()))
+					Expect(err).NotTo(HaveOccurred())
+
+					record, err := imported.GetRecord(topic, 1, 1)
+					Expect(err).NotTo(HaveOccurred())
+					defer record.Free()
+					value := storage.NewRecordValue(record)
+					data, err := imported.DecryptedData(value)
+					Expect(err).NotTo(HaveOccurred())
+					return buf.Bytes(), value.EncryptionKeyId(), append([]byte{}, data...)
+				}
+
+				BeforeAll(func() {
+					var err error
+					keyRing, err = storage.NewKeyRing(map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)}, 1)
+					Expect(err).NotTo(HaveOccurred())
+					encrypted, err = storage.NewDB(storage.MemoryEngine, "dbstore_encrypted", ".")
+					Expect(err).NotTo(HaveOccurred())
+					encrypted.SetKeyRing(keyRing)
+					Expect(encrypted.PutRecord(topic, 1, 1, 1, plaintext, storage.GetNowTimestamp()+10000)).To(Succeed())
+				})
+				AfterAll(func() {
+					encrypted.Close()
+					encrypted.Destroy()
+				})
+
+				It("exports the records sealed by default", func() {
+					archive, keyId, data := exportAndImport(false, keyRing)
+					Expect(archive).NotTo(ContainSubstring(string(plaintext)))
+					Expect(keyId).To(Equal(uint32(1)))
+					Expect(data).To(Equal(plaintext))
+				})
+				It("exports the records decrypted when it is requested", func() {
+					archive, keyId, data := exportAndImport(true, nil)
+					Expect(archive).To(ContainSubstring(string(plaintext)))
+					Expect(keyId).To(BeZero())
+					Expect(data).To(Equal(plaintext))
+				})
 			})
-		})
 
-		Describe("Iterating topic records", Ordered, func() {
-			tp := test.NewTestParams()
-			var it *grocksdb.Iterator
+			Describe("Deleting expired record", Ordered, func() {
+				tp := test.NewTestParams()
+				var deletedCount int
 
-			BeforeEach(func() {
-				tp.Set("expTopic", "test_topic2")
-				tp.Set("expSeqNum", uint64(10))
-				tp.Set("expFragmentId", uint32(1))
-				tp.Set("expOffset", uint64(1))
-				tp.Set("totNumOffset", 1000)
-				tp.Set("expExpirationDate", storage.GetNowTimestamp()+10)
-				prefix := make([]byte, len(tp.GetString("expTopic"))+1+int(unsafe.Sizeof(uint32(0))))
-				copy(prefix, tp.GetString("expTopic")+"@")
-				binary.BigEndian.PutUint32(prefix[len(tp.GetString("expTopic"))+1:], tp.GetUint32("expFragmentId"))
-				tp.Set("prefix", prefix)
+				BeforeAll(func() {
+					tp.Set("expTopic", "test_topic")
+					tp.Set("expFragmentId", uint32(1))
+					tp.Set("offsetShouldBeDeleted", uint64(1))
+					tp.Set("offsetShouldBeRemained", uint64(0))
+					tp.Set("shortExpirationDate", storage.GetNowTimestamp()+1)
+					tp.Set("longExpirationDate", storage.GetNowTimestamp()+10000)
 
-				it = db.Scan(storage.RecordCF)
-				for i := 0; i < tp.GetInt("totNumOffset"); i++ {
 					err = db.PutRecord(tp.GetString("expTopic"),
 						tp.GetUint32("expFragmentId"),
-						uint64(i),
-						0,
-						[]byte(fmt.Sprintf("data%d", i)),
-						tp.GetUint64("expExpirationDate"))
+						tp.GetUint64("offsetShouldBeDeleted"),
+						1,
+						[]byte{1},
+						tp.GetUint64("shortExpirationDate"))
 					Expect(err).NotTo(HaveOccurred())
-				}
-			})
-			AfterEach(func() {
-				tp.Clear()
+
+					err = db.PutRecord(tp.GetString("expTopic"),
+						tp.GetUint32("expFragmentId"),
+						tp.GetUint64("offsetShouldBeRemained"),
+						1,
+						[]byte{1},
+						tp.GetUint64("longExpirationDate"))
+					Expect(err).NotTo(HaveOccurred())
+
+					time.Sleep(2 * time.Second)
+					deletedCount, err = db.DeleteExpiredRecords()
+					Expect(err).NotTo(HaveOccurred())
+				})
+				It("cannot delete again", func() {
+					count, err := db.DeleteExpiredRecords()
+					Expect(err).NotTo(HaveOccurred())
+					Expect(count).To(Equal(0))
+				})
+				It("only expired records are deleted", func() {
+					Expect(deletedCount).To(Equal(1))
+				})
+
+				It("can fetch non-expired record", func() {
+					record, err := db.GetRecord(tp.GetString("expTopic"), tp.GetUint32("expFragmentId"), tp.GetUint64("offsetShouldBeRemained"))
+					defer record.Free()
+					Expect(err).NotTo(HaveOccurred())
+					Expect(record.Data()).NotTo(BeNil())
+				})
+				It("cannot fetch expired record", func() {
+					record, err := db.GetRecord(tp.GetString("expTopic"), tp.GetUint32("expFragmentId"), tp.GetUint64("offsetShouldBeDeleted"))
+					defer record.Free()
+					Expect(err).NotTo(HaveOccurred())
+					Expect(record.Data()).To(BeNil())
+				})
 			})
 
-			When("iterating old records", func() {
-				It("can iterate all stored records", func() {
-					var startOffset uint64 = 0
-					var receivedData [][]byte
-					prevKey := storage.NewRecordKeyFromData(tp.GetString("expTopic"), tp.GetUint32("expFragmentId"), startOffset)
+			Describe("Deleting expired records (ranged delete)", Ordered, func() {
+				tp := test.NewTestParams()
+				var deletedCount int
 
-					for it.Seek(prevKey.Data()); it.Valid() && bytes.HasPrefix(it.Key().Data(), tp.GetBytes("prefix")); it.Next() {
-						key := storage.NewRecordKey(it.Key())
-						if key.Offset() != startOffset {
-							break
-						}
-						value := storage.NewRecordValue(it.Value())
-						receivedData = append(receivedData, value.PublishedData())
-						startOffset++
-						prevKey.SetOffset(startOffset)
+				BeforeAll(func() {
+					tp.Set("expTopic", "test_topic3")
+					tp.Set("expFragmentId", uint32(1))
+					tp.Set("expireDate", storage.GetNowTimestamp()+1)
+					tp.Set("count", 10)
+					for i := 0; i < tp.GetInt("count"); i++ {
+						err = db.PutRecord(tp.GetString("expTopic"),
+							tp.GetUint32("expFragmentId"),
+							uint64(i+1),
+							uint64(i+1),
+							[]byte{1},
+							tp.GetUint64("expireDate"))
+						Expect(err).NotTo(HaveOccurred())
+					}
+
+					time.Sleep(2 * time.Second)
+					deletedCount, err = db.DeleteExpiredRecords()
+					Expect(err).NotTo(HaveOccurred())
+				})
+				It("cannot delete again", func() {
+					count, err := db.DeleteExpiredRecords()
+					Expect(err).NotTo(HaveOccurred())
+					Expect(count).To(Equal(0))
+				})
+				It("all records are deleted", func() {
+					Expect(deletedCount).To(Equal(tp.GetInt("count")))
+				})
+				It("size of the deleted records is released", func() {
+					Expect(db.TopicSize(tp.GetString("expTopic"))).To(BeZero())
+				})
+				It("timestamp index of the records are deleted", func() {
+					it := db.Scan(storage.RecordTimeCF)
+					defer it.Close()
+					for it.SeekToFirst(); it.Valid(); it.Next() {
+						indexKey := storage.NewTimeIndexKey(it.Key())
+						Expect(indexKey.Topic()).NotTo(Equal(tp.GetString("expTopic")))
+						indexKey.Free()
 					}
-					Expect(receivedData).To(HaveLen(tp.GetInt("totNumOffset")))
 				})
 			})
 
-			When("iterating live records", func() {
-				BeforeEach(func() {
-					tp.Set("newlyAddedOffsets", 2000)
-					go func() {
-						for i := tp.GetInt("totNumOffset"); i < tp.GetInt("totNumOffset")+tp.GetInt("newlyAddedOffsets"); i++ {
+			Describe("Finding last record offsets", Ordered, func() {
+				tp := test.NewTestParams()
+				var lastOffsets map[storage.FragmentKey]uint64
+
+				BeforeAll(func() {
+					tp.Set("expTopic", "test_topic4")
+					tp.Set("expFragmentIds", []uint32{1, 2})
+					tp.Set("expLastOffsets", []uint64{5, 10})
+					tp.Set("expExpirationDate", storage.GetNowTimestamp()+10)
+					for i, fragmentId := range tp.Get("expFragmentIds").([]uint32) {
+						for offset := uint64(1); offset <= tp.Get("expLastOffsets").([]uint64)[i]; offset++ {
 							err = db.PutRecord(tp.GetString("expTopic"),
-								tp.GetUint32("expFragmentId"),
-								uint64(i),
-								0,
-								[]byte(fmt.Sprintf("data%d", i)),
+								fragmentId,
+								offset,
+								offset,
+								[]byte{1},
 								tp.GetUint64("expExpirationDate"))
 							Expect(err).NotTo(HaveOccurred())
-							time.Sleep(1 * time.Millisecond)
 						}
-					}()
+					}
+					lastOffsets, err = db.LastRecordOffsets()
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("should be equal to the last stored offset of each fragment", func() {
+					for i, fragmentId := range tp.Get("expFragmentIds").([]uint32) {
+						fragKey := storage.NewFragmentKey(tp.GetString("expTopic"), uint(fragmentId))
+						Expect(lastOffsets).To(HaveKeyWithValue(fragKey, tp.Get("expLastOffsets").([]uint64)[i]))
+					}
+				})
+			})
+
+			Describe("Finding the last record timestamp", Ordered, func() {
+				topic := "test_topic_last_timestamp"
+
+				BeforeAll(func() {
+					for fragmentId, timestamps := range map[uint32][]uint64{1: {100, 300}, 2: {200, 400, 500}} {
+						for i, timestamp := range timestamps {
+							err = db.PutRecordValue(topic, fragmentId, uint64(i+1),
+								storage.NewRecordValueFromFields(uint64(i+1), timestamp, nil, nil, []byte{1}), storage.GetNowTimestamp()+10)
+							Expect(err).NotTo(HaveOccurred())
+						}
+					}
 				})
 
-				It("can iterate all new records", func() {
-					var receivedData [][]byte
-					var startOffset = uint64(tp.GetInt("totNumOffset"))
-					prevKey := storage.NewRecordKeyFromData(tp.GetString("expTopic"), tp.GetUint32("expFragmentId"), startOffset)
+				It("should be the latest timestamp of the last records of the fragments", func() {
+					Expect(db.LastRecordTimestamp(topic)).To(Equal(uint64(500)))
+				})
+				It("should be zero when the topic has no records", func() {
+					Expect(db.LastRecordTimestamp("test_topic_no_records")).To(BeZero())
+				})
+			})
+
+			Describe("Finding start offsets", Ordered, func() {
+				tp := test.NewTestParams()
+
+				BeforeAll(func() {
+					tp.Set("expTopic", "test_topic5")
+					tp.Set("expFragmentId", uint32(1))
+					tp.Set("expFirstOffset", uint64(3))
+					tp.Set("expLastOffset", uint64(10))
+					tp.Set("expBaseTimestamp", uint64(1000))
+					tp.Set("expExpirationDate", storage.GetNowTimestamp()+10)
+					for offset := tp.GetUint64("expFirstOffset"); offset <= tp.GetUint64("expLastOffset"); offset++ {
+						// timestamps are 100ms apart
+						value := storage.NewRecordValueFromFields(offset, tp.GetUint64("expBaseTimestamp")+offset*100, nil, nil, []byte{1})
+						err = db.PutRecordValue(tp.GetString("expTopic"),
+							tp.GetUint32("expFragmentId"),
+							offset,
+							value,
+							tp.GetUint64("expExpirationDate"))
+						Expect(err).NotTo(HaveOccurred())
+					}
+				})
+
+				It("should find the first retained offset of the fragment", func() {
+					offset, found, err := db.FirstRecordOffset(tp.GetString("expTopic"), tp.GetUint32("expFragmentId"))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(found).To(BeTrue())
+					Expect(offset).To(Equal(tp.GetUint64("expFirstOffset")))
+
+					_, found, err = db.FirstRecordOffset(tp.GetString("expTopic"), tp.GetUint32("expFragmentId")+1)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(found).To(BeFalse())
+				})
+
+				It("should find the first offset published at or after the timestamp", func() {
+					offset, found, err := db.FindOffsetByTime(tp.GetString("expTopic"), tp.GetUint32("expFragmentId"), tp.GetUint64("expBaseTimestamp")+550)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(found).To(BeTrue())
+					Expect(offset).To(Equal(uint64(6)))
+
+					offset, found, err = db.FindOffsetByTime(tp.GetString("expTopic"), tp.GetUint32("expFragmentId"), 0)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(found).To(BeTrue())
+					Expect(offset).To(Equal(tp.GetUint64("expFirstOffset")))
+
+					_, found, err = db.FindOffsetByTime(tp.GetString("expTopic"), tp.GetUint32("expFragmentId"), tp.GetUint64("expBaseTimestamp")+10000)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(found).To(BeFalse())
+				})
+			})
+
+			Describe("Iterating topic records", Ordered, func() {
+				tp := test.NewTestParams()
+				var it storage.Iterator
+
+				BeforeEach(func() {
+					tp.Set("expTopic", "test_topic2")
+					tp.Set("expSeqNum", uint64(10))
+					tp.Set("expFragmentId", uint32(1))
+					tp.Set("expOffset", uint64(1))
+					tp.Set("totNumOffset", 1000)
+					tp.Set("expExpirationDate", storage.GetNowTimestamp()+10)
+					prefix := make([]byte, len(tp.GetString("expTopic"))+1+int(unsafe.Sizeof(uint32(0))))
+					copy(prefix, tp.GetString("expTopic")+"@")
+					binary.BigEndian.PutUint32(prefix[len(tp.GetString("expTopic"))+1:], tp.GetUint32("expFragmentId"))
+					tp.Set("prefix", prefix)
+
+					it = db.Scan(storage.RecordCF)
+					for i := 0; i < tp.GetInt("totNumOffset"); i++ {
+						err = db.PutRecord(tp.GetString("expTopic"),
+							tp.GetUint32("expFragmentId"),
+							uint64(i),
+							0,
+							[]byte(fmt.Sprintf("data%d", i)),
+							tp.GetUint64("expExpirationDate"))
+						Expect(err).NotTo(HaveOccurred())
+					}
+				})
+				AfterEach(func() {
+					tp.Clear()
+				})
+
+				When("iterating old records", func() {
+					It("can iterate all stored records", func() {
+						var startOffset uint64 = 0
+						var receivedData [][]byte
+						prevKey := storage.NewRecordKeyFromData(tp.GetString("expTopic"), tp.GetUint32("expFragmentId"), startOffset)
 
-					for {
 						for it.Seek(prevKey.Data()); it.Valid() && bytes.HasPrefix(it.Key().Data(), tp.GetBytes("prefix")); it.Next() {
 							key := storage.NewRecordKey(it.Key())
 							if key.Offset() != startOffset {
@@ -295,17 +1160,55 @@ var _ = Describe("DB", func() {
 							receivedData = append(receivedData, value.PublishedData())
 							startOffset++
 							prevKey.SetOffset(startOffset)
-							runtime.Gosched()
 						}
-						if len(receivedData) == tp.GetInt("newlyAddedOffsets") {
-							break
+						Expect(receivedData).To(HaveLen(tp.GetInt("totNumOffset")))
+					})
+				})
+
+				When("iterating live records", func() {
+					BeforeEach(func() {
+						tp.Set("newlyAddedOffsets", 2000)
+						go func() {
+							for i := tp.GetInt("totNumOffset"); i < tp.GetInt("totNumOffset")+tp.GetInt("newlyAddedOffsets"); i++ {
+								err = db.PutRecord(tp.GetString("expTopic"),
+									tp.GetUint32("expFragmentId"),
+									uint64(i),
+									0,
+									[]byte(fmt.Sprintf("data%d", i)),
+									tp.GetUint64("expExpirationDate"))
+								Expect(err).NotTo(HaveOccurred())
+								time.Sleep(1 * time.Millisecond)
+							}
+						}()
+					})
+
+					It("can iterate all new records", func() {
+						var receivedData [][]byte
+						var startOffset = uint64(tp.GetInt("totNumOffset"))
+						prevKey := storage.NewRecordKeyFromData(tp.GetString("expTopic"), tp.GetUint32("expFragmentId"), startOffset)
+
+						for {
+							for it.Seek(prevKey.Data()); it.Valid() && bytes.HasPrefix(it.Key().Data(), tp.GetBytes("prefix")); it.Next() {
+								key := storage.NewRecordKey(it.Key())
+								if key.Offset() != startOffset {
+									break
+								}
+								value := storage.NewRecordValue(it.Value())
+								receivedData = append(receivedData, value.PublishedData())
+								startOffset++
+								prevKey.SetOffset(startOffset)
+								runtime.Gosched()
+							}
+							if len(receivedData) == tp.GetInt("newlyAddedOffsets") {
+								break
+							}
+							// wait for iterator to be updated
+							time.Sleep(10 * time.Millisecond)
 						}
-						// wait for iterator to be updated
-						time.Sleep(10 * time.Millisecond)
-					}
-					Expect(receivedData).To(HaveLen(tp.GetInt("newlyAddedOffsets")))
+						Expect(receivedData).To(HaveLen(tp.GetInt("newlyAddedOffsets")))
+					})
 				})
 			})
 		})
-	})
+	}
 })
@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"sync"
+)
+
+// DedupWindows keeps the SeqNums of the records recently persisted to each topic, to drop records published again.
+// A SeqNum is kept with the fragment it is written to, so a record transferred from the fragment is not a duplicate
+// until it is written to another fragment. Deduplication is disabled when the size is 0
+type DedupWindows struct {
+	mu      sync.Mutex
+	size    int
+	windows map[string]*dedupWindow
+}
+
+type dedupEntry struct {
+	SeqNum     uint64
+	FragmentId uint32
+}
+
+type dedupWindow struct {
+	fragments map[uint64]uint32 // fragment id of each SeqNum
+	seqNums   []uint64          // in written order from head. the oldest one is evicted when the window is full
+	head      int
+}
+
+func newDedupWindow() *dedupWindow {
+	return &dedupWindow{fragments: make(map[uint64]uint32)}
+}
+
+// NewDedupWindows creates windows keeping `size` SeqNums per topic
+func NewDedupWindows(size int) *DedupWindows {
+	return &DedupWindows{size: size, windows: make(map[string]*dedupWindow)}
+}
+
+func newDedupWindowsFromEntries(entries map[string][]dedupEntry) *DedupWindows {
+	w := &DedupWindows{windows: make(map[string]*dedupWindow)}
+	for topic, topicEntries := range entries {
+		window := newDedupWindow()
+		for _, entry := range topicEntries {
+			window.fragments[entry.SeqNum] = entry.FragmentId
+			window.seqNums = append(window.seqNums, entry.SeqNum)
+		}
+		w.windows[topic] = window
+		if len(window.seqNums) > w.size {
+			w.size = len(window.seqNums)
+		}
+	}
+	return w
+}
+
+func (w *DedupWindows) Size() int {
+	if w == nil {
+		return 0
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.size
+}
+
+// Resize evicts the oldest SeqNums over the new size. all SeqNums are cleared when the size is 0
+func (w *DedupWindows) Resize(size int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.size = size
+	for topic, window := range w.windows {
+		if size == 0 {
+			delete(w.windows, topic)
+		} else {
+			window.evict(size)
+		}
+	}
+}
+
+// IsDuplicate returns true if the SeqNum was persisted to the topic.
+// transferredFrom is the fragment a staled record is transferred from, and 0 for published records
+func (w *DedupWindows) IsDuplicate(topic string, seqNum uint64, transferredFrom uint32) bool {
+	if w == nil {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	window, ok := w.windows[topic]
+	if !ok {
+		return false
+	}
+	fragmentId, ok := window.fragments[seqNum]
+	return ok && (transferredFrom == 0 || fragmentId != transferredFrom)
+}
+
+// Add keeps the SeqNum persisted to the fragment. the fragment of a SeqNum already kept is replaced
+func (w *DedupWindows) Add(topic string, seqNum uint64, fragmentId uint32) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.size == 0 {
+		return
+	}
+	window, ok := w.windows[topic]
+	if !ok {
+		window = newDedupWindow()
+		w.windows[topic] = window
+	}
+	if _, ok = window.fragments[seqNum]; !ok {
+		window.seqNums = append(window.seqNums, seqNum)
+	}
+	window.fragments[seqNum] = fragmentId
+	window.evict(w.size)
+}
+
+func (w *DedupWindows) entries() map[string][]dedupEntry {
+	entries := make(map[string][]dedupEntry)
+	if w == nil {
+		return entries
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for topic, window := range w.windows {
+		topicEntries := make([]dedupEntry, 0, window.len())
+		for _, seqNum := range window.seqNums[window.head:] {
+			topicEntries = append(topicEntries, dedupEntry{SeqNum: seqNum, FragmentId: window.fragments[seqNum]})
+		}
+		entries[topic] = topicEntries
+	}
+	return entries
+}
+
+func (d *dedupWindow) len() int {
+	return len(d.seqNums) - d.head
+}
+
+func (d *dedupWindow) evict(size int) {
+	for d.len() > size {
+		delete(d.fragments, d.seqNums[d.head])
+		d.head++
+	}
+	// reclaim the space of evicted SeqNums not to grow the slice forever
+	if d.head > size {
+		d.seqNums = append(d.seqNums[:0], d.seqNums[d.head:]...)
+		d.head = 0
+	}
+}
@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/paust-team/pirius/qerror"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// KeyRing holds AES-GCM keys to encrypt stored records by their ids.
+// New records are sealed by the active key, and the other keys are kept to open records sealed before a rotation
+type KeyRing struct {
+	keys        map[uint32]cipher.AEAD
+	activeKeyId uint32
+}
+
+// NewKeyRing keys should be 16, 24 or 32 bytes to use AES-128, AES-192 or AES-256. key id 0 is reserved for unencrypted records
+func NewKeyRing(keys map[uint32][]byte, activeKeyId uint32) (*KeyRing, error) {
+	keyRing := &KeyRing{keys: make(map[uint32]cipher.AEAD), activeKeyId: activeKeyId}
+	for keyId, key := range keys {
+		if keyId == 0 {
+			return nil, qerror.ValidationError{Value: "0", HintMsg: "encryption key id should not be 0"}
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, qerror.ValidationError{Value: strconv.Itoa(int(keyId)), HintMsg: err.Error()}
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		keyRing.keys[keyId] = aead
+	}
+	if _, ok := keyRing.keys[activeKeyId]; !ok {
+		return nil, qerror.ValidationError{Value: strconv.Itoa(int(activeKeyId)), HintMsg: "active encryption key does not exist"}
+	}
+	return keyRing, nil
+}
+
+// LoadKeyRing reads keys from the key file. Each line of the file is `<key-id>:<hex-encoded key>`,
+// and the key of the last line is the active key. Lines starting with # are ignored
+func LoadKeyRing(keyFilePath string) (*KeyRing, error) {
+	file, err := os.Open(keyFilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	keys := make(map[uint32][]byte)
+	var activeKeyId uint32
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) != 2 {
+			return nil, qerror.ValidationError{Value: fmt.Sprintf("line %d of %s", lineNum, keyFilePath), HintMsg: "key should be written as <key-id>:<hex-encoded key>"}
+		}
+		keyId, err := strconv.ParseUint(strings.TrimSpace(fields[0]), 10, 32)
+		if err != nil {
+			return nil, qerror.ValidationError{Value: fmt.Sprintf("line %d of %s", lineNum, keyFilePath), HintMsg: "key id should be a 32-bit unsigned integer"}
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(fields[1]))
+		if err != nil {
+			return nil, qerror.ValidationError{Value: fmt.Sprintf("line %d of %s", lineNum, keyFilePath), HintMsg: "key should be hex-encoded"}
+		}
+		keys[uint32(keyId)] = key
+		activeKeyId = uint32(keyId)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, qerror.ValidationError{Value: keyFilePath, HintMsg: "no encryption key in the key file"}
+	}
+	return NewKeyRing(keys, activeKeyId)
+}
+
+func (r *KeyRing) ActiveKeyId() uint32 {
+	return r.activeKeyId
+}
+
+// Seal returns a copy of the unencrypted value with the data sealed by the active key.
+// The data is stored as nonce(12) | ciphertext | tag, and the other fields and the header except the checksum
+// are authenticated with it.
+// Empty data is not sealed to keep tombstones of compacted topics
+func (r *KeyRing) Seal(value *RecordValue) (*RecordValue, error) {
+	if value.Version() != RecordValueVersion || value.EncryptionKeyId() != 0 {
+		return nil, qerror.InvalidStateError{State: "only unencrypted values of the current version can be sealed"}
+	}
+	plaintext := value.PublishedData()
+	if len(plaintext) == 0 {
+		return value, nil
+	}
+	aead := r.keys[r.activeKeyId]
+	dataPos := value.dataPos()
+	data := make([]byte, dataPos+aead.NonceSize(), dataPos+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	copy(data, value.Data()[:dataPos])
+	binary.BigEndian.PutUint32(data[recordEncryptionKeyIdPos:], r.activeKeyId)
+	nonce := data[dataPos:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	data = aead.Seal(data, nonce, plaintext, additionalData(data, dataPos))
+	binary.BigEndian.PutUint32(data[recordChecksumPos:], valueChecksum(data))
+	return &RecordValue{data: data, isSlice: false}, nil
+}
+
+// Open returns the unencrypted data of the value. data of values not encrypted is returned as it is
+func (r *KeyRing) Open(value *RecordValue) ([]byte, error) {
+	keyId := value.EncryptionKeyId()
+	if keyId == 0 {
+		return value.PublishedData(), nil
+	}
+	if r == nil {
+		return nil, qerror.DecryptionFailedError{KeyId: keyId, ErrStr: "encryption is not enabled"}
+	}
+	aead, ok := r.keys[keyId]
+	if !ok {
+		return nil, qerror.DecryptionFailedError{KeyId: keyId, ErrStr: "key does not exist in the key file"}
+	}
+	dataPos := value.dataPos()
+	sealed := value.Data()[dataPos:]
+	if dataPos < value.fieldsPos() || len(sealed) < aead.NonceSize() {
+		return nil, qerror.DecryptionFailedError{KeyId: keyId, ErrStr: "sealed data is too short"}
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, additionalData(value.Data(), dataPos))
+	if err != nil {
+		return nil, qerror.DecryptionFailedError{KeyId: keyId, ErrStr: err.Error()}
+	}
+	return plaintext, nil
+}
+
+// additionalData returns the header except the checksum and the fields before the data, which are authenticated with
+// the sealed data. the version and the codec are included not to decode the opened data by a changed codec
+func additionalData(data []byte, dataPos int) []byte {
+	ad := make([]byte, 0, recordChecksumPos+dataPos-recordFieldsPos)
+	ad = append(ad, data[:recordChecksumPos]...)
+	return append(ad, data[recordFieldsPos:dataPos]...)
+}
@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"github.com/paust-team/pirius/qerror"
+)
+
+// EngineType is the name of a storage engine
+type EngineType string
+
+const (
+	RocksDBEngine EngineType = "rocksdb" // persistent engine. requires cgo
+	MemoryEngine  EngineType = "memory"  // pure-go engine. records are kept only while the agent runs
+)
+
+func ParseEngineType(name string) (EngineType, error) {
+	switch EngineType(name) {
+	case RocksDBEngine, MemoryEngine:
+		return EngineType(name), nil
+	}
+	return "", qerror.ValidationError{Value: name, HintMsg: "storage engine should be one of rocksdb and memory"}
+}
+
+// Engine is an ordered key-value store with column families, which DB stores records on
+type Engine interface {
+	Get(cf CFIndex, key []byte) (Slice, error)
+	// Write applies the batch atomically. low priority writes are used for deletions.
+	// a persistent engine returns after a batch set to sync is written to the disk
+	Write(batch *WriteBatch, lowPriority bool) error
+	// NewIterator returns an iterator of the column family. a tailing iterator can see new records after Seek
+	NewIterator(cf CFIndex, tailing bool) Iterator
+	Flush(cf CFIndex) error
+	Close()
+	Destroy() error
+}
+
+// Slice is a value read from the engine. it should be freed after use
+type Slice interface {
+	Data() []byte
+	Size() int
+	Exists() bool
+	Free()
+}
+
+type Iterator interface {
+	Valid() bool
+	Next()
+	Seek(key []byte)
+	SeekForPrev(key []byte)
+	SeekToFirst()
+	Key() Slice
+	Value() Slice
+	Err() error
+	Close()
+}
+
+type batchOpType int
+
+const (
+	putOp batchOpType = iota
+	deleteOp
+	deleteRangeOp
+)
+
+type batchOp struct {
+	opType batchOpType
+	cf     CFIndex
+	key    []byte
+	value  []byte // end key of deleteRangeOp
+}
+
+// WriteBatch collects updates to be written atomically. keys and values are copied
+type WriteBatch struct {
+	ops  []batchOp
+	sync bool
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+func (wb *WriteBatch) PutCF(cf CFIndex, key, value []byte) {
+	wb.ops = append(wb.ops, batchOp{opType: putOp, cf: cf, key: copyBytes(key), value: copyBytes(value)})
+}
+
+func (wb *WriteBatch) DeleteCF(cf CFIndex, key []byte) {
+	wb.ops = append(wb.ops, batchOp{opType: deleteOp, cf: cf, key: copyBytes(key)})
+}
+
+// DeleteRangeCF deletes keys in [startKey, endKey)
+func (wb *WriteBatch) DeleteRangeCF(cf CFIndex, startKey, endKey []byte) {
+	wb.ops = append(wb.ops, batchOp{opType: deleteRangeOp, cf: cf, key: copyBytes(startKey), value: copyBytes(endKey)})
+}
+
+// SetSync makes the batch written with syncing the write-ahead log, so it is not lost by a crash of the machine
+func (wb *WriteBatch) SetSync() {
+	wb.sync = true
+}
+
+func (wb *WriteBatch) Count() int {
+	return len(wb.ops)
+}
+
+func copyBytes(data []byte) []byte {
+	copied := make([]byte, len(data))
+	copy(copied, data)
+	return copied
+}
+
+func openEngine(engineType EngineType, dbPath string, readOnly bool) (Engine, error) {
+	switch engineType {
+	case RocksDBEngine:
+		return openRocksDBEngine(dbPath, readOnly)
+	case MemoryEngine:
+		return newMemoryEngine(), nil
+	}
+	_, err := ParseEngineType(string(engineType))
+	return nil, err
+}
@@ -0,0 +1,229 @@
+package storage
+
+import (
+	"bytes"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const memoryMaxLevel = 20
+
+// memoryEngine is a pure-go engine keeping each column family in a skip list.
+// Iterators always see the newest records, so they are tailing iterators regardless of the option
+type memoryEngine struct {
+	mu     sync.RWMutex
+	tables []*memoryTable
+	rnd    *rand.Rand
+}
+
+func newMemoryEngine() *memoryEngine {
+	tables := make([]*memoryTable, len(columnFamilies))
+	for i := range tables {
+		tables[i] = newMemoryTable()
+	}
+	return &memoryEngine{tables: tables, rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (e *memoryEngine) Get(cf CFIndex, key []byte) (Slice, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if node := e.tables[cf].findGreaterOrEqual(key, nil); node != nil && bytes.Equal(node.key, key) {
+		return memorySlice{data: node.value, exists: true}, nil
+	}
+	return memorySlice{}, nil
+}
+
+func (e *memoryEngine) Write(batch *WriteBatch, _ bool) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, op := range batch.ops {
+		table := e.tables[op.cf]
+		switch op.opType {
+		case putOp:
+			table.put(op.key, op.value, e.randomLevel())
+		case deleteOp:
+			table.delete(op.key)
+		case deleteRangeOp:
+			for node := table.findGreaterOrEqual(op.key, nil); node != nil && bytes.Compare(node.key, op.value) < 0; {
+				next := node.next[0]
+				table.delete(node.key)
+				node = next
+			}
+		}
+	}
+	return nil
+}
+
+func (e *memoryEngine) NewIterator(cf CFIndex, _ bool) Iterator {
+	return &memoryIterator{engine: e, table: e.tables[cf]}
+}
+
+func (e *memoryEngine) Flush(CFIndex) error {
+	return nil
+}
+
+func (e *memoryEngine) Close() {}
+
+func (e *memoryEngine) Destroy() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for i := range e.tables {
+		e.tables[i] = newMemoryTable()
+	}
+	return nil
+}
+
+// randomLevel should be called with lock held
+func (e *memoryEngine) randomLevel() int {
+	level := 1
+	for level < memoryMaxLevel && e.rnd.Intn(4) == 0 {
+		level++
+	}
+	return level
+}
+
+type memoryNode struct {
+	key   []byte
+	value []byte
+	next  []*memoryNode
+}
+
+type memoryTable struct {
+	head  *memoryNode
+	level int
+}
+
+func newMemoryTable() *memoryTable {
+	return &memoryTable{head: &memoryNode{next: make([]*memoryNode, memoryMaxLevel)}, level: 1}
+}
+
+// findGreaterOrEqual returns the first node whose key is not less than the key.
+// if prev is given, it is filled with the last node before the key at each level
+func (t *memoryTable) findGreaterOrEqual(key []byte, prev []*memoryNode) *memoryNode {
+	node := t.head
+	for level := t.level - 1; level >= 0; level-- {
+		for node.next[level] != nil && bytes.Compare(node.next[level].key, key) < 0 {
+			node = node.next[level]
+		}
+		if prev != nil {
+			prev[level] = node
+		}
+	}
+	return node.next[0]
+}
+
+// findLessOrEqual returns the last node whose key is not greater than the key
+func (t *memoryTable) findLessOrEqual(key []byte) *memoryNode {
+	node := t.head
+	for level := t.level - 1; level >= 0; level-- {
+		for node.next[level] != nil && bytes.Compare(node.next[level].key, key) <= 0 {
+			node = node.next[level]
+		}
+	}
+	if node == t.head {
+		return nil
+	}
+	return node
+}
+
+func (t *memoryTable) put(key, value []byte, level int) {
+	prev := make([]*memoryNode, memoryMaxLevel)
+	if node := t.findGreaterOrEqual(key, prev); node != nil && bytes.Equal(node.key, key) {
+		node.value = value // values are not modified in place, so readers holding the old value are safe
+		return
+	}
+	if level > t.level {
+		for i := t.level; i < level; i++ {
+			prev[i] = t.head
+		}
+		t.level = level
+	}
+	node := &memoryNode{key: key, value: value, next: make([]*memoryNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = prev[i].next[i]
+		prev[i].next[i] = node
+	}
+}
+
+func (t *memoryTable) delete(key []byte) {
+	prev := make([]*memoryNode, memoryMaxLevel)
+	node := t.findGreaterOrEqual(key, prev)
+	if node == nil || !bytes.Equal(node.key, key) {
+		return
+	}
+	for i := 0; i < len(node.next); i++ {
+		prev[i].next[i] = node.next[i]
+	}
+	for t.level > 1 && t.head.next[t.level-1] == nil {
+		t.level--
+	}
+}
+
+type memorySlice struct {
+	data   []byte
+	exists bool
+}
+
+func (s memorySlice) Data() []byte { return s.data }
+func (s memorySlice) Size() int    { return len(s.data) }
+func (s memorySlice) Exists() bool { return s.exists }
+func (s memorySlice) Free()        {}
+
+type memoryIterator struct {
+	engine *memoryEngine
+	table  *memoryTable
+	node   *memoryNode
+}
+
+func (it *memoryIterator) Valid() bool {
+	return it.node != nil
+}
+
+func (it *memoryIterator) Next() {
+	if it.node == nil {
+		return
+	}
+	it.engine.mu.RLock()
+	defer it.engine.mu.RUnlock()
+	// the current node can be deleted after it is read. find the next one from the key
+	next := it.table.findGreaterOrEqual(it.node.key, nil)
+	if next != nil && bytes.Equal(next.key, it.node.key) {
+		next = next.next[0]
+	}
+	it.node = next
+}
+
+func (it *memoryIterator) Seek(key []byte) {
+	it.engine.mu.RLock()
+	defer it.engine.mu.RUnlock()
+	it.node = it.table.findGreaterOrEqual(key, nil)
+}
+
+func (it *memoryIterator) SeekForPrev(key []byte) {
+	it.engine.mu.RLock()
+	defer it.engine.mu.RUnlock()
+	it.node = it.table.findLessOrEqual(key)
+}
+
+func (it *memoryIterator) SeekToFirst() {
+	it.engine.mu.RLock()
+	defer it.engine.mu.RUnlock()
+	it.node = it.table.head.next[0]
+}
+
+func (it *memoryIterator) Key() Slice {
+	return memorySlice{data: it.node.key, exists: true}
+}
+
+func (it *memoryIterator) Value() Slice {
+	it.engine.mu.RLock()
+	defer it.engine.mu.RUnlock()
+	return memorySlice{data: it.node.value, exists: true}
+}
+
+func (it *memoryIterator) Err() error {
+	return nil
+}
+
+func (it *memoryIterator) Close() {}
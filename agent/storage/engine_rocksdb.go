@@ -0,0 +1,140 @@
+//go:build !norocksdb
+
+package storage
+
+import (
+	"github.com/linxGnu/grocksdb"
+)
+
+// rocksDBEngine is the engine on grocksdb
+type rocksDBEngine struct {
+	dbPath              string
+	db                  *grocksdb.DB
+	ro                  *grocksdb.ReadOptions
+	wo                  *grocksdb.WriteOptions
+	swo                 *grocksdb.WriteOptions // write options of batches to sync
+	dwo                 *grocksdb.WriteOptions
+	fo                  *grocksdb.FlushOptions
+	columnFamilyHandles grocksdb.ColumnFamilyHandles
+}
+
+// openRocksDBEngine opens the db. a read-only db can be opened while another process writes it, and new records
+// are not seen by its iterators
+func openRocksDBEngine(dbPath string, readOnly bool) (Engine, error) {
+	bbto := grocksdb.NewDefaultBlockBasedTableOptions()
+	blockCache := grocksdb.NewLRUCache(1 << 18)
+	bbto.SetBlockCache(blockCache)
+
+	defaultOpts := grocksdb.NewDefaultOptions()
+	defaultOpts.SetBlockBasedTableFactory(bbto)
+	defaultOpts.SetCreateIfMissing(true)
+	defaultOpts.SetCreateIfMissingColumnFamilies(true)
+	defaultOpts.SetCompression(grocksdb.SnappyCompression)
+	defaultOpts.SetMaxOpenFiles(16)
+	opts := grocksdb.NewDefaultOptions()
+	cfOpts := make([]*grocksdb.Options, len(columnFamilies))
+	for i := range cfOpts {
+		cfOpts[i] = opts
+	}
+	var db *grocksdb.DB
+	var columnFamilyHandles grocksdb.ColumnFamilyHandles
+	var err error
+	if readOnly {
+		db, columnFamilyHandles, err = grocksdb.OpenDbForReadOnlyColumnFamilies(defaultOpts, dbPath, columnFamilies, cfOpts, false)
+	} else {
+		db, columnFamilyHandles, err = grocksdb.OpenDbColumnFamilies(defaultOpts, dbPath, columnFamilies, cfOpts)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ro := grocksdb.NewDefaultReadOptions()
+	// tailing iterators are not supported in read-only mode
+	ro.SetTailing(!readOnly)
+	wo := grocksdb.NewDefaultWriteOptions()
+	swo := grocksdb.NewDefaultWriteOptions()
+	swo.SetSync(true)
+	dwo := grocksdb.NewDefaultWriteOptions()
+	dwo.SetLowPri(true)
+	fo := grocksdb.NewDefaultFlushOptions()
+	fo.SetWait(false)
+
+	return &rocksDBEngine{dbPath: dbPath, db: db, ro: ro, wo: wo, swo: swo, dwo: dwo, fo: fo, columnFamilyHandles: columnFamilyHandles}, nil
+}
+
+func (e *rocksDBEngine) Get(cf CFIndex, key []byte) (Slice, error) {
+	slice, err := e.db.GetCF(e.ro, e.columnFamilyHandles[cf], key)
+	if err != nil {
+		return nil, err
+	}
+	return slice, nil
+}
+
+func (e *rocksDBEngine) Write(batch *WriteBatch, lowPriority bool) error {
+	wb := grocksdb.NewWriteBatch()
+	defer wb.Destroy()
+	for _, op := range batch.ops {
+		switch op.opType {
+		case putOp:
+			wb.PutCF(e.columnFamilyHandles[op.cf], op.key, op.value)
+		case deleteOp:
+			wb.DeleteCF(e.columnFamilyHandles[op.cf], op.key)
+		case deleteRangeOp:
+			wb.DeleteRangeCF(e.columnFamilyHandles[op.cf], op.key, op.value)
+		}
+	}
+	if batch.sync {
+		return e.db.Write(e.swo, wb)
+	}
+	if lowPriority {
+		return e.db.Write(e.dwo, wb)
+	}
+	return e.db.Write(e.wo, wb)
+}
+
+func (e *rocksDBEngine) NewIterator(cf CFIndex, tailing bool) Iterator {
+	if tailing {
+		return &rocksDBIterator{Iterator: e.db.NewIteratorCF(e.ro, e.columnFamilyHandles[cf])}
+	}
+	ro := grocksdb.NewDefaultReadOptions()
+	return &rocksDBIterator{Iterator: e.db.NewIteratorCF(ro, e.columnFamilyHandles[cf]), ro: ro}
+}
+
+func (e *rocksDBEngine) Flush(cf CFIndex) error {
+	return e.db.FlushCF(e.columnFamilyHandles[cf], e.fo)
+}
+
+func (e *rocksDBEngine) Close() {
+	e.db.Close()
+	e.ro.Destroy()
+	e.wo.Destroy()
+	e.swo.Destroy()
+	e.dwo.Destroy()
+	e.fo.Destroy()
+}
+
+func (e *rocksDBEngine) Destroy() error {
+	opts := grocksdb.NewDefaultOptions()
+	defer opts.Destroy()
+	return grocksdb.DestroyDb(e.dbPath, opts)
+}
+
+type rocksDBIterator struct {
+	*grocksdb.Iterator
+	ro *grocksdb.ReadOptions // read options of a non-tailing iterator
+}
+
+func (it *rocksDBIterator) Key() Slice {
+	return it.Iterator.Key()
+}
+
+func (it *rocksDBIterator) Value() Slice {
+	return it.Iterator.Value()
+}
+
+func (it *rocksDBIterator) Close() {
+	it.Iterator.Close()
+	if it.ro != nil {
+		it.ro.Destroy()
+	}
+}
@@ -0,0 +1,9 @@
+//go:build norocksdb
+
+package storage
+
+import "errors"
+
+func openRocksDBEngine(string, bool) (Engine, error) {
+	return nil, errors.New("rocksdb engine is not included in this build(norocksdb)")
+}
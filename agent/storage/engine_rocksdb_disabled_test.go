@@ -0,0 +1,8 @@
+//go:build norocksdb
+
+package storage_test
+
+import "github.com/paust-team/pirius/agent/storage"
+
+// testEngineTypes are the engines included in this build
+var testEngineTypes = []storage.EngineType{storage.MemoryEngine}
@@ -0,0 +1,45 @@
+//go:build !norocksdb
+
+package storage_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/paust-team/pirius/agent/storage"
+)
+
+// testEngineTypes are the engines included in this build
+var testEngineTypes = []storage.EngineType{storage.RocksDBEngine, storage.MemoryEngine}
+
+var _ = Describe("Opening a rocksdb store read-only", Ordered, func() {
+	var db, readOnlyDB *storage.DB
+	topic := "read_only_topic"
+
+	BeforeAll(func() {
+		var err error
+		db, err = storage.NewDB(storage.RocksDBEngine, "read-only", ".")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(db.PutRecord(topic, 1, 1, 1, []byte("stored"), storage.GetNowTimestamp()+3600)).To(Succeed())
+		Expect(db.Flush()).To(Succeed())
+		db.Close()
+
+		readOnlyDB, err = storage.NewReadOnlyDB(storage.RocksDBEngine, "read-only", ".")
+		Expect(err).NotTo(HaveOccurred())
+	})
+	AfterAll(func() {
+		readOnlyDB.Close()
+		readOnlyDB.Destroy()
+	})
+
+	It("reads the stored records", func() {
+		record, err := readOnlyDB.GetRecord(topic, 1, 1)
+		Expect(err).NotTo(HaveOccurred())
+		defer record.Free()
+		Expect(storage.NewRecordValue(record).PublishedData()).To(Equal([]byte("stored")))
+		Expect(readOnlyDB.FragmentSize(topic, 1)).NotTo(BeZero())
+	})
+
+	It("does not write the store", func() {
+		Expect(readOnlyDB.PutRecord(topic, 1, 2, 2, []byte("new"), storage.GetNowTimestamp()+3600)).NotTo(Succeed())
+	})
+})
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"math"
+	"sort"
+)
+
+// FragmentInfo describes the stored records of a fragment
+type FragmentInfo struct {
+	Topic       string
+	FragmentId  uint32
+	FirstOffset uint64
+	LastOffset  uint64
+	NumRecords  uint64
+	Size        uint64
+}
+
+// RecordLocation points a record by its key
+type RecordLocation struct {
+	Topic      string
+	FragmentId uint32
+	Offset     uint64
+}
+
+func newRecordLocation(key *RecordKey) RecordLocation {
+	return RecordLocation{Topic: key.Topic(), FragmentId: key.FragmentId(), Offset: key.Offset()}
+}
+
+func (l RecordLocation) less(other RecordLocation) bool {
+	if l.Topic != other.Topic {
+		return l.Topic < other.Topic
+	}
+	if l.FragmentId != other.FragmentId {
+		return l.FragmentId < other.FragmentId
+	}
+	return l.Offset < other.Offset
+}
+
+// VerificationReport is the result of VerifyRecords
+type VerificationReport struct {
+	NumRecords            int
+	NumRetentionKeys      int
+	MissingRetentionKeys  []RecordLocation // records which are never expired
+	DanglingRetentionKeys []RecordLocation // retention keys of deleted records. they are cleaned up on expiration
+	CorruptedRecords      []RecordLocation
+}
+
+// IsHealthy is false if there are records never expired or corrupted. dangling retention keys are expected
+func (r VerificationReport) IsHealthy() bool {
+	return len(r.MissingRetentionKeys) == 0 && len(r.CorruptedRecords) == 0
+}
+
+// Fragments returns the stored fragments ordered by topic and fragment id
+func (d *DB) Fragments() ([]FragmentInfo, error) {
+	it := d.Scan(RecordCF)
+	defer it.Close()
+
+	var fragments []FragmentInfo
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		key := NewRecordKey(it.Key())
+		topic, fragmentId := key.Topic(), key.FragmentId()
+		if n := len(fragments); n == 0 || fragments[n-1].Topic != topic || fragments[n-1].FragmentId != fragmentId {
+			fragments = append(fragments, FragmentInfo{Topic: topic, FragmentId: fragmentId, FirstOffset: key.Offset()})
+		}
+		fragment := &fragments[len(fragments)-1]
+		fragment.LastOffset = key.Offset()
+		fragment.NumRecords++
+		fragment.Size += uint64(key.Size() + it.Value().Size())
+		key.Free()
+	}
+	return fragments, it.Err()
+}
+
+// ForEachRecord calls fn with the records of the fragment from `from` to `to` inclusively.
+// The value is freed after fn returns, and the iteration stops at the first error of fn
+func (d *DB) ForEachRecord(topic string, fragmentId uint32, from, to uint64, fn func(offset uint64, value *RecordValue) error) error {
+	it := d.Scan(RecordCF)
+	defer it.Close()
+
+	startKey := NewRecordKeyFromData(topic, fragmentId, from)
+	for it.Seek(startKey.Data()); it.Valid(); it.Next() {
+		key := NewRecordKey(it.Key())
+		offset := key.Offset()
+		inRange := key.Topic() == topic && key.FragmentId() == fragmentId && offset <= to
+		key.Free()
+		if !inRange {
+			break
+		}
+		value := NewRecordValue(it.Value())
+		err := fn(offset, value)
+		value.Free()
+		if err != nil {
+			return err
+		}
+		if offset == math.MaxUint64 {
+			break
+		}
+	}
+	return it.Err()
+}
+
+// VerifyRecords checks the checksum of every record and matches records with their retention keys
+func (d *DB) VerifyRecords() (VerificationReport, error) {
+	var report VerificationReport
+
+	// record keys are kept as strings to match them with the record column family
+	retained := make(map[string]RecordLocation)
+	expIt := d.Scan(RecordExpCF)
+	for expIt.SeekToFirst(); expIt.Valid(); expIt.Next() {
+		retentionKey := NewRetentionPeriodKey(expIt.Key())
+		recordKey := retentionKey.RecordKey()
+		retained[string(recordKey.Data())] = newRecordLocation(&recordKey)
+		retentionKey.Free()
+		report.NumRetentionKeys++
+	}
+	err := expIt.Err()
+	expIt.Close()
+	if err != nil {
+		return report, err
+	}
+
+	it := d.Scan(RecordCF)
+	defer it.Close()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		key := NewRecordKey(it.Key())
+		value := NewRecordValue(it.Value())
+		report.NumRecords++
+		if _, ok := retained[string(key.Data())]; ok {
+			delete(retained, string(key.Data()))
+		} else {
+			report.MissingRetentionKeys = append(report.MissingRetentionKeys, newRecordLocation(key))
+		}
+		if !value.Verify() {
+			report.CorruptedRecords = append(report.CorruptedRecords, newRecordLocation(key))
+		}
+		key.Free()
+		value.Free()
+	}
+	if err = it.Err(); err != nil {
+		return report, err
+	}
+	for _, location := range retained {
+		report.DanglingRetentionKeys = append(report.DanglingRetentionKeys, location)
+	}
+	sort.Slice(report.DanglingRetentionKeys, func(i, j int) bool {
+		return report.DanglingRetentionKeys[i].less(report.DanglingRetentionKeys[j])
+	})
+	return report, nil
+}
@@ -4,7 +4,11 @@ import (
 	"encoding/gob"
 	"fmt"
 	"github.com/paust-team/pirius/helper"
+	"github.com/paust-team/pirius/qerror"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 )
 
@@ -17,6 +21,18 @@ func NewFragmentKey(topicName string, fragmentId uint) FragmentKey {
 	return FragmentKey(fmt.Sprintf("%s/%d", topicName, fragmentId))
 }
 
+func (k FragmentKey) split() (string, uint32, error) {
+	pos := strings.LastIndex(string(k), "/")
+	if pos < 0 {
+		return "", 0, qerror.ValidationError{Value: string(k), HintMsg: "fragment key should be <topic>/<fragment-id>"}
+	}
+	fragmentId, err := strconv.ParseUint(string(k[pos+1:]), 10, 32)
+	if err != nil {
+		return "", 0, qerror.ValidationError{Value: string(k), HintMsg: "fragment key should be <topic>/<fragment-id>"}
+	}
+	return string(k[:pos]), uint32(fragmentId), nil
+}
+
 func NewTopicFragmentOffsets(m map[FragmentKey]uint64) TopicFragmentOffsets {
 	sm := sync.Map{}
 	for k, v := range m {
@@ -39,6 +55,7 @@ type agentMeta struct {
 	PubOffsets map[FragmentKey]uint64
 	SubOffsets map[FragmentKey]uint64
 	FetOffsets map[FragmentKey]uint64
+	SeqNums    map[string][]dedupEntry
 }
 
 func (a agentMeta) convert() AgentMeta {
@@ -48,6 +65,7 @@ func (a agentMeta) convert() AgentMeta {
 		PublishedOffsets:  NewTopicFragmentOffsets(a.PubOffsets),
 		SubscribedOffsets: NewTopicFragmentOffsets(a.SubOffsets),
 		LastFetchedOffset: NewTopicFragmentOffsets(a.FetOffsets),
+		DedupWindows:      newDedupWindowsFromEntries(a.SeqNums),
 	}
 }
 
@@ -57,43 +75,121 @@ type AgentMeta struct {
 	PublishedOffsets  TopicFragmentOffsets
 	SubscribedOffsets TopicFragmentOffsets
 	LastFetchedOffset TopicFragmentOffsets
+	DedupWindows      *DedupWindows // SeqNums persisted by the publisher
 }
 
 func (a AgentMeta) convert() agentMeta {
+	// SeqNums are added to the windows before the published offsets move,
+	// so the windows read after the offsets have the SeqNums of all records before the offsets
 	return agentMeta{
 		PubId:      a.PublisherID,
 		SubId:      a.SubscriberID,
 		PubOffsets: a.PublishedOffsets.ToMap(),
 		SubOffsets: a.SubscribedOffsets.ToMap(),
 		FetOffsets: a.LastFetchedOffset.ToMap(),
+		SeqNums:    a.DedupWindows.entries(),
+	}
+}
+
+// ReconcilePublishedOffsets moves the published offsets forward to the last stored records.
+// The meta can be behind the db when the agent is not stopped cleanly after the last checkpoint,
+// and SeqNums of the records written after the checkpoint are added to the dedup windows
+func (a AgentMeta) ReconcilePublishedOffsets(db *DB) error {
+	lastOffsets, err := db.LastRecordOffsets()
+	if err != nil {
+		return err
+	}
+	for fragKey, lastOffset := range lastOffsets {
+		var nextOffset uint64
+		if value, ok := a.PublishedOffsets.Load(fragKey); ok {
+			nextOffset = value.(uint64)
+		}
+		if nextOffset > lastOffset {
+			continue
+		}
+		if err = a.reconcileDedupWindow(db, fragKey, nextOffset, lastOffset); err != nil {
+			return err
+		}
+		a.PublishedOffsets.Store(fragKey, lastOffset+1)
+	}
+	return nil
+}
+
+func (a AgentMeta) reconcileDedupWindow(db *DB, fragKey FragmentKey, from, to uint64) error {
+	size := uint64(a.DedupWindows.Size())
+	if size == 0 {
+		return nil
+	}
+	if to >= size && from < to-size+1 { // older records are evicted anyway
+		from = to - size + 1
+	}
+	topicName, fragmentId, err := fragKey.split()
+	if err != nil {
+		return err
 	}
+	return db.ForEachRecord(topicName, fragmentId, from, to, func(_ uint64, value *RecordValue) error {
+		if value.Verify() {
+			a.DedupWindows.Add(topicName, value.SeqNum(), fragmentId)
+		}
+		return nil
+	})
 }
 
+// SaveAgentMeta writes the meta to a temp file and renames it, so the meta file is never partially written
 func SaveAgentMeta(path string, meta AgentMeta) error {
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 	dataEncoder := gob.NewEncoder(f)
-	return dataEncoder.Encode(meta.convert())
+	if err = dataEncoder.Encode(meta.convert()); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	// sync the directory to persist the rename
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
 }
 
+// LoadAgentMeta reads the meta file, and creates it with new ids if it does not exist
 func LoadAgentMeta(path string) (AgentMeta, error) {
+	meta, err := ReadAgentMeta(path)
+	if err != nil && os.IsNotExist(err) {
+		meta = AgentMeta{
+			PublisherID:       helper.GenerateNodeId(),
+			SubscriberID:      helper.GenerateNodeId(),
+			PublishedOffsets:  NewTopicFragmentOffsets(make(map[FragmentKey]uint64)),
+			SubscribedOffsets: NewTopicFragmentOffsets(make(map[FragmentKey]uint64)),
+			LastFetchedOffset: NewTopicFragmentOffsets(make(map[FragmentKey]uint64)),
+			DedupWindows:      NewDedupWindows(0),
+		}
+		if err = SaveAgentMeta(path, meta); err != nil {
+			return AgentMeta{}, err
+		}
+	}
+	return meta, err
+}
+
+// ReadAgentMeta reads the meta file without creating it, to inspect the meta of a stopped agent
+func ReadAgentMeta(path string) (AgentMeta, error) {
 	f, err := os.Open(path)
 	if err != nil {
-		if os.IsNotExist(err) {
-			meta := AgentMeta{
-				PublisherID:       helper.GenerateNodeId(),
-				SubscriberID:      helper.GenerateNodeId(),
-				PublishedOffsets:  NewTopicFragmentOffsets(make(map[FragmentKey]uint64)),
-				SubscribedOffsets: NewTopicFragmentOffsets(make(map[FragmentKey]uint64)),
-				LastFetchedOffset: NewTopicFragmentOffsets(make(map[FragmentKey]uint64)),
-			}
-			if err = SaveAgentMeta(path, meta); err == nil {
-				return meta, nil
-			}
-		}
 		return AgentMeta{}, err
 	}
 
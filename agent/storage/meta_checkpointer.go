@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"context"
+	"github.com/paust-team/pirius/logger"
+	"go.uber.org/zap"
+	"time"
+)
+
+type MetaCheckpointer struct {
+	path          string
+	meta          AgentMeta
+	checkInterval time.Duration
+	done          chan struct{}
+}
+
+// NewMetaCheckpointer interval is milliseconds
+func NewMetaCheckpointer(path string, meta AgentMeta, interval uint) *MetaCheckpointer {
+	return &MetaCheckpointer{
+		path:          path,
+		meta:          meta,
+		checkInterval: time.Millisecond * time.Duration(interval),
+		done:          make(chan struct{}),
+	}
+}
+
+func (c *MetaCheckpointer) Run(ctx context.Context) {
+	go func() {
+		defer close(c.done)
+		timer := time.NewTimer(c.checkInterval)
+		defer timer.Stop()
+
+		logger.Info("Start MetaCheckpointer")
+		for {
+			select {
+			case <-ctx.Done():
+				logger.Info("MetaCheckpointer is stopped from ctx.Done().")
+				return
+			case <-timer.C:
+				if err := SaveAgentMeta(c.path, c.meta); err != nil {
+					logger.Error("failed to checkpoint agent meta", zap.Error(err), zap.String("path", c.path))
+				}
+			}
+			timer.Reset(c.checkInterval)
+		}
+	}()
+}
+
+// Wait blocks until the running checkpoint is finished after ctx is canceled
+func (c *MetaCheckpointer) Wait() {
+	<-c.done
+}
@@ -1,6 +1,7 @@
 package storage_test
 
 import (
+	"fmt"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"github.com/paust-team/pirius/agent/storage"
@@ -82,5 +83,123 @@ var _ = Describe("Meta", func() {
 				Expect(fetOffsets).To(Equal(tp.Get("expFetOffsets").(uint64)))
 			})
 		})
+
+		When("saving the meta repeatedly", func() {
+			BeforeEach(func() {
+				for i := 0; i < 10; i++ {
+					agentMeta.PublishedOffsets.Store(storage.NewFragmentKey("testTopic", uint(i)), uint64(i))
+					err := storage.SaveAgentMeta(tp.GetString("testPath"), *agentMeta)
+					Expect(err).NotTo(HaveOccurred())
+				}
+			})
+			It("should not leave the temp file", func() {
+				_, err := os.Stat(tp.GetString("testPath") + ".tmp")
+				Expect(os.IsNotExist(err)).To(BeTrue())
+
+				loaded, err := storage.LoadAgentMeta(tp.GetString("testPath"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(loaded.PublishedOffsets.ToMap()).To(HaveLen(10))
+			})
+		})
+
+		When("keeping SeqNums in the dedup windows", func() {
+			BeforeEach(func() {
+				tp.Set("expTopic", "testTopic")
+				agentMeta.DedupWindows.Resize(2)
+				agentMeta.DedupWindows.Add(tp.GetString("expTopic"), 1, 1)
+				agentMeta.DedupWindows.Add(tp.GetString("expTopic"), 2, 1)
+				agentMeta.DedupWindows.Add(tp.GetString("expTopic"), 3, 2)
+			})
+			It("should drop SeqNums already persisted", func() {
+				Expect(agentMeta.DedupWindows.IsDuplicate(tp.GetString("expTopic"), 3, 0)).To(BeTrue())
+				Expect(agentMeta.DedupWindows.IsDuplicate(tp.GetString("expTopic"), 4, 0)).To(BeFalse())
+				Expect(agentMeta.DedupWindows.IsDuplicate("otherTopic", 3, 0)).To(BeFalse())
+			})
+			It("should evict the oldest SeqNum", func() {
+				Expect(agentMeta.DedupWindows.IsDuplicate(tp.GetString("expTopic"), 1, 0)).To(BeFalse())
+			})
+			It("should transfer records from their fragments only once", func() {
+				Expect(agentMeta.DedupWindows.IsDuplicate(tp.GetString("expTopic"), 2, 1)).To(BeFalse())
+				agentMeta.DedupWindows.Add(tp.GetString("expTopic"), 2, 3)
+				Expect(agentMeta.DedupWindows.IsDuplicate(tp.GetString("expTopic"), 2, 1)).To(BeTrue())
+			})
+			It("should be saved with the offsets", func() {
+				err := storage.SaveAgentMeta(tp.GetString("testPath"), *agentMeta)
+				Expect(err).NotTo(HaveOccurred())
+				loaded, err := storage.LoadAgentMeta(tp.GetString("testPath"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(loaded.DedupWindows.IsDuplicate(tp.GetString("expTopic"), 3, 0)).To(BeTrue())
+				Expect(loaded.DedupWindows.IsDuplicate(tp.GetString("expTopic"), 1, 0)).To(BeFalse())
+			})
+			It("should not drop any SeqNum when disabled", func() {
+				agentMeta.DedupWindows.Resize(0)
+				Expect(agentMeta.DedupWindows.IsDuplicate(tp.GetString("expTopic"), 3, 0)).To(BeFalse())
+				agentMeta.DedupWindows.Add(tp.GetString("expTopic"), 5, 1)
+				Expect(agentMeta.DedupWindows.IsDuplicate(tp.GetString("expTopic"), 5, 0)).To(BeFalse())
+			})
+		})
+
+		for _, engineType := range testEngineTypes {
+			engineType := engineType
+			When(fmt.Sprintf("reconciling the published offsets with stored records on %s engine", engineType), func() {
+				var db *storage.DB
+				BeforeEach(func() {
+					tp.Set("expTopic", "testTopic")
+					tp.Set("staleFragId", uint(1))
+					tp.Set("missingFragId", uint(2))
+					tp.Set("aheadFragId", uint(3))
+					tp.Set("lastStoredOffset", uint64(10))
+
+					var err error
+					db, err = storage.NewDB(engineType, "metastore", ".")
+					Expect(err).NotTo(HaveOccurred())
+					for _, fragmentId := range []uint{tp.GetUint("staleFragId"), tp.GetUint("missingFragId"), tp.GetUint("aheadFragId")} {
+						for offset := uint64(1); offset <= tp.GetUint64("lastStoredOffset"); offset++ {
+							err = db.PutRecord(tp.GetString("expTopic"), uint32(fragmentId), offset, offset, []byte{1}, storage.GetNowTimestamp()+10)
+							Expect(err).NotTo(HaveOccurred())
+						}
+					}
+					agentMeta.PublishedOffsets.Store(storage.NewFragmentKey(tp.GetString("expTopic"), tp.GetUint("staleFragId")), uint64(3))
+					agentMeta.PublishedOffsets.Store(storage.NewFragmentKey(tp.GetString("expTopic"), tp.GetUint("aheadFragId")), uint64(20))
+					agentMeta.DedupWindows.Resize(100)
+
+					err = agentMeta.ReconcilePublishedOffsets(db)
+					Expect(err).NotTo(HaveOccurred())
+				})
+				AfterEach(func() {
+					db.Close()
+					db.Destroy()
+				})
+				It("should be next to the last stored offset", func() {
+					offset, ok := agentMeta.PublishedOffsets.Load(storage.NewFragmentKey(tp.GetString("expTopic"), tp.GetUint("staleFragId")))
+					Expect(ok).To(BeTrue())
+					Expect(offset).To(Equal(tp.GetUint64("lastStoredOffset") + 1))
+
+					offset, ok = agentMeta.PublishedOffsets.Load(storage.NewFragmentKey(tp.GetString("expTopic"), tp.GetUint("missingFragId")))
+					Expect(ok).To(BeTrue())
+					Expect(offset).To(Equal(tp.GetUint64("lastStoredOffset") + 1))
+				})
+				It("should keep SeqNums of the records written after the checkpoint", func() {
+					Expect(agentMeta.DedupWindows.IsDuplicate(tp.GetString("expTopic"), tp.GetUint64("lastStoredOffset"), 0)).To(BeTrue())
+					Expect(agentMeta.DedupWindows.IsDuplicate(tp.GetString("expTopic"), tp.GetUint64("lastStoredOffset")+1, 0)).To(BeFalse())
+				})
+				It("should not move the offset backward", func() {
+					offset, ok := agentMeta.PublishedOffsets.Load(storage.NewFragmentKey(tp.GetString("expTopic"), tp.GetUint("aheadFragId")))
+					Expect(ok).To(BeTrue())
+					Expect(offset).To(Equal(uint64(20)))
+				})
+			})
+		}
+	})
+
+	Describe("Reading a missing AgentMeta", func() {
+		path := "test_missing_meta.gob"
+
+		It("should not create the meta file", func() {
+			_, err := storage.ReadAgentMeta(path)
+			Expect(os.IsNotExist(err)).To(BeTrue())
+			_, err = os.Stat(path)
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
 	})
 })
@@ -2,12 +2,14 @@ package storage
 
 import (
 	"encoding/binary"
-	"github.com/linxGnu/grocksdb"
-	"unsafe"
+	"github.com/paust-team/pirius/compression"
+	"hash/crc32"
+	"sort"
+	"time"
 )
 
 type RecordKey struct {
-	*grocksdb.Slice
+	Slice
 	data    []byte
 	isSlice bool
 }
@@ -20,7 +22,7 @@ func NewRecordKeyFromData(topic string, fragmentId uint32, offset uint64) *Recor
 	return &RecordKey{data: data, isSlice: false}
 }
 
-func NewRecordKey(slice *grocksdb.Slice) *RecordKey {
+func NewRecordKey(slice Slice) *RecordKey {
 	return &RecordKey{Slice: slice, isSlice: true}
 }
 
@@ -58,24 +60,94 @@ func (k *RecordKey) SetOffset(offset uint64) {
 	binary.BigEndian.PutUint64(k.Data()[k.Size()-uint64Len:], offset)
 }
 
+// RecordValueVersion is the encoding version of RecordValue.
+// Legacy values(version 0) have no version byte and start with the seqNum, so they cannot be told from
+// versioned values by their bytes. They are decoded by NewLegacyRecordValue, and upgraded when the store is opened
+const RecordValueVersion byte = 1
+
+var (
+	recordCompressionPos     = 1
+	recordEncryptionKeyIdPos = 2
+	recordChecksumPos        = recordEncryptionKeyIdPos + uint32Len
+	recordFieldsPos          = recordChecksumPos + uint32Len
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// RecordValue layout: version(1) | compression(1) | encryptionKeyId(4) | checksum(4) | seqNum(8) | timestamp(8) | keyLen(4) | key | headersLen(4) | headers | data
+// The checksum is CRC32C of the value except the checksum itself. The data is compressed by the codec of the topic,
+// and then sealed by the encryption key when the key id is not 0.
 type RecordValue struct {
-	*grocksdb.Slice
+	Slice
 	data    []byte
 	isSlice bool
+	legacy  bool
 }
 
 func NewRecordValueFromData(seqNum uint64, publishedData []byte) *RecordValue {
-	meta := make([]byte, int(unsafe.Sizeof(seqNum)))
-	binary.BigEndian.PutUint64(meta[0:], seqNum)
+	return NewRecordValueFromFields(seqNum, uint64(time.Now().UnixMilli()), nil, nil, publishedData)
+}
 
-	data := append(meta[:], publishedData[:]...)
+// NewRecordValueFromFields timestamp is unix milliseconds
+func NewRecordValueFromFields(seqNum uint64, timestamp uint64, key []byte, headers map[string]string, publishedData []byte) *RecordValue {
+	return NewCompressedRecordValue(seqNum, timestamp, key, headers, compression.None, publishedData)
+}
+
+// NewCompressedRecordValue publishedData should be compressed by the codec already
+func NewCompressedRecordValue(seqNum uint64, timestamp uint64, key []byte, headers map[string]string, codec compression.Codec, publishedData []byte) *RecordValue {
+	encodedHeaders := encodeHeaders(headers)
+	data := make([]byte, recordFieldsPos+2*uint64Len+uint32Len+len(key)+uint32Len, recordFieldsPos+2*uint64Len+2*uint32Len+len(key)+len(encodedHeaders)+len(publishedData))
+	data[0] = RecordValueVersion
+	data[recordCompressionPos] = byte(codec)
+	pos := recordFieldsPos
+	binary.BigEndian.PutUint64(data[pos:], seqNum)
+	pos += uint64Len
+	binary.BigEndian.PutUint64(data[pos:], timestamp)
+	pos += uint64Len
+	binary.BigEndian.PutUint32(data[pos:], uint32(len(key)))
+	pos += uint32Len
+	copy(data[pos:], key)
+	pos += len(key)
+	binary.BigEndian.PutUint32(data[pos:], uint32(len(encodedHeaders)))
+
+	data = append(data, encodedHeaders...)
+	data = append(data, publishedData...)
+	binary.BigEndian.PutUint32(data[recordChecksumPos:], valueChecksum(data))
 	return &RecordValue{data: data, isSlice: false}
 }
 
-func NewRecordValue(slice *grocksdb.Slice) *RecordValue {
+// valueChecksum returns CRC32C of the encoded value except the checksum field
+func valueChecksum(data []byte) uint32 {
+	checksum := crc32.Checksum(data[:recordChecksumPos], castagnoliTable)
+	return crc32.Update(checksum, castagnoliTable, data[recordFieldsPos:])
+}
+
+// FieldsChecksum returns the checksum of the fields sent to subscribers without encoding them.
+// publishedData is the data as it is sent, which is compressed if the record is compressed
+func FieldsChecksum(seqNum uint64, timestamp uint64, key []byte, headers map[string]string, publishedData []byte) uint32 {
+	buf := make([]byte, 2*uint64Len+uint32Len)
+	binary.BigEndian.PutUint64(buf, seqNum)
+	binary.BigEndian.PutUint64(buf[uint64Len:], timestamp)
+	binary.BigEndian.PutUint32(buf[2*uint64Len:], uint32(len(key)))
+	checksum := crc32.Update(0, castagnoliTable, buf)
+	checksum = crc32.Update(checksum, castagnoliTable, key)
+
+	encodedHeaders := encodeHeaders(headers)
+	binary.BigEndian.PutUint32(buf, uint32(len(encodedHeaders)))
+	checksum = crc32.Update(checksum, castagnoliTable, buf[:uint32Len])
+	checksum = crc32.Update(checksum, castagnoliTable, encodedHeaders)
+	return crc32.Update(checksum, castagnoliTable, publishedData)
+}
+
+func NewRecordValue(slice Slice) *RecordValue {
 	return &RecordValue{Slice: slice, isSlice: true}
 }
 
+// NewLegacyRecordValue decodes a value written before values had a version: seqNum(8) | data
+func NewLegacyRecordValue(data []byte) *RecordValue {
+	return &RecordValue{data: data, isSlice: false, legacy: true}
+}
+
 func (v RecordValue) Data() []byte {
 	if v.isSlice {
 		return v.Slice.Data()
@@ -94,10 +166,205 @@ func (v RecordValue) Size() int {
 	return len(v.data)
 }
 
+func (v RecordValue) Version() byte {
+	if v.legacy || v.Size() == 0 {
+		return 0
+	}
+	return v.Data()[0]
+}
+
+// Checksum returns the stored checksum. legacy values have no checksum
+func (v RecordValue) Checksum() (uint32, bool) {
+	if v.legacy || v.Size() < recordFieldsPos {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(v.Data()[recordChecksumPos:recordFieldsPos]), true
+}
+
+// ComputeChecksum returns CRC32C of the value except the checksum field. legacy values have no checksum
+func (v RecordValue) ComputeChecksum() uint32 {
+	if v.legacy || v.Size() < recordFieldsPos {
+		return 0
+	}
+	return valueChecksum(v.Data())
+}
+
+// Verify checks the record is not corrupted and its length-prefixed fields are within the value.
+// legacy values have no checksum and are valid if they have a seqNum
+func (v RecordValue) Verify() bool {
+	if v.legacy {
+		return v.Size() >= uint64Len
+	}
+	if v.Size() < v.keyPos() || v.Version() != RecordValueVersion {
+		return false
+	}
+	checksum, _ := v.Checksum()
+	if checksum != v.ComputeChecksum() {
+		return false
+	}
+	headersPos, headersLen, ok := v.headersPos()
+	if !ok {
+		return false
+	}
+	_, ok = decodeHeaders(v.Data()[headersPos : headersPos+headersLen])
+	return ok
+}
+
+// EncryptionKeyId returns the id of the key sealing the data. 0 means the data is not encrypted
+func (v RecordValue) EncryptionKeyId() uint32 {
+	if v.legacy || v.Size() < recordChecksumPos {
+		return 0
+	}
+	return binary.BigEndian.Uint32(v.Data()[recordEncryptionKeyIdPos:recordChecksumPos])
+}
+
+// Compression returns the codec compressing the data
+func (v RecordValue) Compression() compression.Codec {
+	if v.legacy || v.Size() <= recordCompressionPos {
+		return compression.None
+	}
+	return compression.Codec(v.Data()[recordCompressionPos])
+}
+
 func (v RecordValue) SeqNum() uint64 {
-	return binary.BigEndian.Uint64(v.Data()[0:int(unsafe.Sizeof(uint64(0)))])
+	pos := v.fieldsPos()
+	if v.Size() < pos+uint64Len {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v.Data()[pos : pos+uint64Len])
 }
 
+// Timestamp returns the publish time in unix milliseconds. legacy values have no timestamp
+func (v RecordValue) Timestamp() uint64 {
+	pos := v.fieldsPos() + uint64Len
+	if v.legacy || v.Size() < pos+uint64Len {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v.Data()[pos : pos+uint64Len])
+}
+
+func (v RecordValue) Key() []byte {
+	if v.legacy {
+		return nil
+	}
+	key, _, ok := lengthPrefixed(v.Data(), v.keyPos()-uint32Len)
+	if !ok || len(key) == 0 {
+		return nil
+	}
+	return key
+}
+
+func (v RecordValue) Headers() map[string]string {
+	if v.legacy {
+		return nil
+	}
+	headersPos, headersLen, ok := v.headersPos()
+	if !ok {
+		return nil
+	}
+	headers, _ := decodeHeaders(v.Data()[headersPos : headersPos+headersLen])
+	return headers
+}
+
+// PublishedData returns the stored data. encrypted data should be opened by KeyRing
 func (v RecordValue) PublishedData() []byte {
-	return v.Data()[int(unsafe.Sizeof(uint64(0))):]
+	if v.legacy {
+		if v.Size() < uint64Len {
+			return nil
+		}
+		return v.Data()[uint64Len:]
+	}
+	return v.Data()[v.dataPos():]
+}
+
+// fieldsPos returns the position of the seqNum
+func (v RecordValue) fieldsPos() int {
+	if v.legacy {
+		return 0
+	}
+	return recordFieldsPos
+}
+
+func (v RecordValue) keyPos() int {
+	return v.fieldsPos() + 2*uint64Len + uint32Len
+}
+
+// dataPos returns the end of the value if the fields before the data exceed the value
+func (v RecordValue) dataPos() int {
+	headersPos, headersLen, ok := v.headersPos()
+	if !ok {
+		return v.Size()
+	}
+	return headersPos + headersLen
+}
+
+// headersPos returns the position and the length of the encoded headers. ok is false if the key or
+// the headers exceed the value
+func (v RecordValue) headersPos() (int, int, bool) {
+	_, headersLenPos, ok := lengthPrefixed(v.Data(), v.keyPos()-uint32Len)
+	if !ok {
+		return 0, 0, false
+	}
+	headers, dataPos, ok := lengthPrefixed(v.Data(), headersLenPos)
+	if !ok {
+		return 0, 0, false
+	}
+	return dataPos - len(headers), len(headers), true
+}
+
+// lengthPrefixed returns the field encoded as len(4) | field at pos and the position after it.
+// ok is false if the field exceeds the data
+func lengthPrefixed(data []byte, pos int) ([]byte, int, bool) {
+	if pos < 0 || pos+uint32Len > len(data) {
+		return nil, pos, false
+	}
+	fieldLen := uint64(binary.BigEndian.Uint32(data[pos:]))
+	pos += uint32Len
+	if fieldLen > uint64(len(data)-pos) {
+		return nil, pos, false
+	}
+	return data[pos : pos+int(fieldLen)], pos + int(fieldLen), true
+}
+
+// headers are encoded as repeated keyLen(4) | key | valueLen(4) | value, sorted by the key
+// to make the checksum of the same fields deterministic
+func encodeHeaders(headers map[string]string) []byte {
+	var data []byte
+	lenBuf := make([]byte, uint32Len)
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := headers[k]
+		binary.BigEndian.PutUint32(lenBuf, uint32(len(k)))
+		data = append(data, lenBuf...)
+		data = append(data, k...)
+		binary.BigEndian.PutUint32(lenBuf, uint32(len(v)))
+		data = append(data, lenBuf...)
+		data = append(data, v...)
+	}
+	return data
+}
+
+// decodeHeaders returns the headers decoded before a key or a value exceeding the data, with ok false
+func decodeHeaders(data []byte) (map[string]string, bool) {
+	if len(data) == 0 {
+		return nil, true
+	}
+	headers := make(map[string]string)
+	for pos := 0; pos < len(data); {
+		k, valuePos, ok := lengthPrefixed(data, pos)
+		if !ok {
+			return headers, false
+		}
+		v, nextPos, ok := lengthPrefixed(data, valuePos)
+		if !ok {
+			return headers, false
+		}
+		headers[string(k)] = string(v)
+		pos = nextPos
+	}
+	return headers, true
 }
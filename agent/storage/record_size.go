@@ -0,0 +1,81 @@
+package storage
+
+import "sync"
+
+// recordSizes tracks the stored bytes(key and value) of each fragment
+type recordSizes struct {
+	mu    sync.Mutex
+	sizes map[string]map[uint32]uint64 // topic -> fragment -> bytes
+}
+
+func newRecordSizes() *recordSizes {
+	return &recordSizes{sizes: make(map[string]map[uint32]uint64)}
+}
+
+func (r *recordSizes) add(topic string, fragmentId uint32, size uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.sizes[topic]; !ok {
+		r.sizes[topic] = make(map[uint32]uint64)
+	}
+	r.sizes[topic][fragmentId] += size
+}
+
+func (r *recordSizes) sub(topic string, fragmentId uint32, size uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fragments, ok := r.sizes[topic]
+	if !ok {
+		return
+	}
+	if fragments[fragmentId] <= size {
+		delete(fragments, fragmentId)
+		if len(fragments) == 0 {
+			delete(r.sizes, topic)
+		}
+		return
+	}
+	fragments[fragmentId] -= size
+}
+
+func (r *recordSizes) fragment(topic string, fragmentId uint32) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sizes[topic][fragmentId]
+}
+
+func (r *recordSizes) topic(topic string) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var total uint64
+	for _, size := range r.sizes[topic] {
+		total += size
+	}
+	return total
+}
+
+func (r *recordSizes) total() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var total uint64
+	for _, fragments := range r.sizes {
+		for _, size := range fragments {
+			total += size
+		}
+	}
+	return total
+}
+
+// snapshot returns a copy of the sizes
+func (r *recordSizes) snapshot() map[string]map[uint32]uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sizes := make(map[string]map[uint32]uint64, len(r.sizes))
+	for topic, fragments := range r.sizes {
+		sizes[topic] = make(map[uint32]uint64, len(fragments))
+		for fragmentId, size := range fragments {
+			sizes[topic][fragmentId] = size
+		}
+	}
+	return sizes
+}
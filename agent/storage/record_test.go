@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/paust-team/pirius/compression"
+	"github.com/paust-team/pirius/qerror"
+)
+
+var _ = Describe("Decoding a malformed RecordValue", func() {
+	var data []byte
+
+	decodeAll := func(value *RecordValue) func() {
+		return func() {
+			value.SeqNum()
+			value.Timestamp()
+			value.Key()
+			value.Headers()
+			value.PublishedData()
+		}
+	}
+
+	BeforeEach(func() {
+		data = NewRecordValueFromFields(10, 20, []byte("device-1"), map[string]string{"trace-id": "abcd"}, []byte("data")).Data()
+	})
+
+	It("is invalid and decodable when truncated", func() {
+		for size := len(data) - 1; size >= 0; size-- {
+			value := NewRecordValue(memorySlice{data: data[:size], exists: true})
+			Expect(value.Verify()).To(BeFalse(), "size %d", size)
+			Expect(decodeAll(value)).NotTo(Panic(), "size %d", size)
+		}
+	})
+
+	When("a length exceeds the value with a matching checksum", func() {
+		keyLenPos := recordFieldsPos + 2*uint64Len
+
+		It("is invalid with the key exceeding the value", func() {
+			binary.BigEndian.PutUint32(data[keyLenPos:], uint32(len(data)))
+			binary.BigEndian.PutUint32(data[recordChecksumPos:], valueChecksum(data))
+			value := NewRecordValue(memorySlice{data: data, exists: true})
+
+			Expect(value.Verify()).To(BeFalse())
+			Expect(decodeAll(value)).NotTo(Panic())
+			Expect(value.Key()).To(BeNil())
+			Expect(value.PublishedData()).To(BeEmpty())
+		})
+
+		It("is invalid with a header exceeding the headers", func() {
+			headersPos := keyLenPos + uint32Len + len("device-1") + uint32Len
+			binary.BigEndian.PutUint32(data[headersPos:], uint32(len(data)))
+			binary.BigEndian.PutUint32(data[recordChecksumPos:], valueChecksum(data))
+			value := NewRecordValue(memorySlice{data: data, exists: true})
+
+			Expect(value.Verify()).To(BeFalse())
+			Expect(decodeAll(value)).NotTo(Panic())
+			Expect(value.PublishedData()).To(Equal([]byte("data")))
+		})
+	})
+})
+
+var _ = Describe("Opening a tampered RecordValue", func() {
+	var keyRing *KeyRing
+	var sealed []byte
+
+	BeforeEach(func() {
+		var err error
+		keyRing, err = NewKeyRing(map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)}, 1)
+		Expect(err).NotTo(HaveOccurred())
+		value, err := keyRing.Seal(NewRecordValueFromFields(10, 20, []byte("device-1"), nil, []byte("data")))
+		Expect(err).NotTo(HaveOccurred())
+		sealed = value.Data()
+	})
+
+	It("fails when the codec is changed with a matching checksum", func() {
+		sealed[recordCompressionPos] = byte(compression.LZ4)
+		binary.BigEndian.PutUint32(sealed[recordChecksumPos:], valueChecksum(sealed))
+		value := NewRecordValue(memorySlice{data: sealed, exists: true})
+
+		Expect(value.Verify()).To(BeTrue())
+		_, err := keyRing.Open(value)
+		Expect(err).To(BeAssignableToTypeOf(qerror.DecryptionFailedError{}))
+	})
+})
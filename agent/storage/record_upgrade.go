@@ -0,0 +1,80 @@
+package storage
+
+import "bytes"
+
+var (
+	recordValueVersionKey = []byte("record_value_version") // set when all values of the store are versioned
+	recordValueUpgradeKey = []byte("record_value_upgrade") // the last record key upgraded
+)
+
+const recordUpgradeBatchSize = 1000
+
+// recordValuesUpgraded returns whether the store has the version mark
+func (d *DB) recordValuesUpgraded() (bool, error) {
+	mark, err := d.engine.Get(DefaultCF, recordValueVersionKey)
+	if err != nil {
+		return false, err
+	}
+	defer mark.Free()
+	return mark.Exists(), nil
+}
+
+// upgradeRecordValues rewrites the values of a store written before values had a version byte.
+// Legacy values cannot be told from versioned values by their bytes, so all values of a store without
+// the version mark are legacy. The progress is written with each batch to resume an interrupted upgrade
+func (d *DB) upgradeRecordValues() error {
+	upgraded, err := d.recordValuesUpgraded()
+	if err != nil || upgraded {
+		return err
+	}
+
+	progress, err := d.engine.Get(DefaultCF, recordValueUpgradeKey)
+	if err != nil {
+		return err
+	}
+	resumed := progress.Exists()
+	lastKey := copyBytes(progress.Data())
+	progress.Free()
+
+	it := d.engine.NewIterator(RecordCF, false)
+	defer it.Close()
+	if resumed {
+		it.Seek(lastKey)
+		if it.Valid() {
+			key := it.Key()
+			if bytes.Equal(key.Data(), lastKey) {
+				it.Next()
+			}
+			key.Free()
+		}
+	} else {
+		it.SeekToFirst()
+	}
+
+	wb := NewWriteBatch()
+	for ; it.Valid(); it.Next() {
+		key, value := it.Key(), it.Value()
+		// corrupted values are left to be quarantined
+		if legacy := NewLegacyRecordValue(value.Data()); legacy.Verify() {
+			upgradedValue := NewRecordValueFromFields(legacy.SeqNum(), 0, nil, nil, legacy.PublishedData())
+			wb.PutCF(RecordCF, key.Data(), upgradedValue.Data())
+		}
+		lastKey = copyBytes(key.Data())
+		key.Free()
+		value.Free()
+
+		if wb.Count() >= recordUpgradeBatchSize {
+			wb.PutCF(DefaultCF, recordValueUpgradeKey, lastKey)
+			if err := d.engine.Write(wb, false); err != nil {
+				return err
+			}
+			wb = NewWriteBatch()
+		}
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	wb.PutCF(DefaultCF, recordValueVersionKey, []byte{RecordValueVersion})
+	wb.DeleteCF(DefaultCF, recordValueUpgradeKey)
+	return d.engine.Write(wb, false)
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"encoding/binary"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Upgrading legacy record values", Ordered, func() {
+	var db *DB
+	topic := "legacy_topic"
+	seqNums := []uint64{1, uint64(RecordValueVersion)<<56 | 7, 1 << 63}
+
+	legacyValue := func(seqNum uint64) []byte {
+		data := make([]byte, uint64Len)
+		binary.BigEndian.PutUint64(data, seqNum)
+		return append(data, "legacy"...)
+	}
+
+	BeforeAll(func() {
+		var err error
+		db, err = NewDB(MemoryEngine, "legacy", ".")
+		Expect(err).NotTo(HaveOccurred())
+
+		// a store written before values had a version. the first record was upgraded before the upgrade is interrupted
+		wb := NewWriteBatch()
+		wb.DeleteCF(DefaultCF, recordValueVersionKey)
+		for offset, seqNum := range seqNums {
+			key := NewRecordKeyFromData(topic, 1, uint64(offset))
+			if offset == 0 {
+				wb.PutCF(RecordCF, key.Data(), NewRecordValueFromFields(seqNum, 0, nil, nil, []byte("legacy")).Data())
+				wb.PutCF(DefaultCF, recordValueUpgradeKey, key.Data())
+			} else {
+				wb.PutCF(RecordCF, key.Data(), legacyValue(seqNum))
+			}
+		}
+		Expect(db.engine.Write(wb, false)).To(Succeed())
+
+		Expect(db.upgradeRecordValues()).To(Succeed())
+	})
+	AfterAll(func() {
+		db.Close()
+		db.Destroy()
+	})
+
+	It("keeps the fields of the legacy values", func() {
+		for offset, seqNum := range seqNums {
+			record, err := db.GetRecord(topic, 1, uint64(offset))
+			Expect(err).NotTo(HaveOccurred())
+			value := NewRecordValue(record)
+			Expect(value.Verify()).To(BeTrue())
+			Expect(value.Version()).To(Equal(RecordValueVersion))
+			Expect(value.SeqNum()).To(Equal(seqNum))
+			Expect(value.Timestamp()).To(BeZero())
+			Expect(value.PublishedData()).To(Equal([]byte("legacy")))
+			value.Free()
+		}
+	})
+
+	It("marks the store upgraded", func() {
+		mark, err := db.engine.Get(DefaultCF, recordValueVersionKey)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mark.Data()).To(Equal([]byte{RecordValueVersion}))
+		mark.Free()
+
+		progress, err := db.engine.Get(DefaultCF, recordValueUpgradeKey)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(progress.Exists()).To(BeFalse())
+		progress.Free()
+	})
+})
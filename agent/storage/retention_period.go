@@ -2,11 +2,10 @@ package storage
 
 import (
 	"encoding/binary"
-	"github.com/linxGnu/grocksdb"
 )
 
 type RetentionPeriodKey struct {
-	*grocksdb.Slice
+	Slice
 	data    []byte
 	isSlice bool
 }
@@ -17,7 +16,7 @@ func NewRetentionPeriodKeyFromData(recordKey *RecordKey, expirationDate uint64)
 	return &RetentionPeriodKey{data: append(data, recordKey.Data()...), isSlice: false}
 }
 
-func NewRetentionPeriodKey(slice *grocksdb.Slice) *RetentionPeriodKey {
+func NewRetentionPeriodKey(slice Slice) *RetentionPeriodKey {
 	return &RetentionPeriodKey{Slice: slice, isSlice: true}
 }
 
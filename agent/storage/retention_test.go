@@ -0,0 +1,60 @@
+package storage
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Deleting expired records of a fragment with live records", Ordered, func() {
+	var db *DB
+	var numDeleted int
+	topic := "mixed_retention_topic"
+	now := GetNowTimestamp()
+	expired, live := now+10, now+1000
+	expirationDates := map[uint64]uint64{1: expired, 2: expired, 3: live, 4: expired, 5: expired, 6: live}
+
+	BeforeAll(func() {
+		var err error
+		db, err = NewDB(MemoryEngine, "retention", ".")
+		Expect(err).NotTo(HaveOccurred())
+
+		for offset := uint64(1); offset <= uint64(len(expirationDates)); offset++ {
+			Expect(db.PutRecord(topic, 1, offset, offset, []byte{byte(offset)}, expirationDates[offset])).To(Succeed())
+		}
+		numDeleted, err = db.deleteExpiredRecords(expired)
+		Expect(err).NotTo(HaveOccurred())
+	})
+	AfterAll(func() {
+		db.Close()
+		db.Destroy()
+	})
+
+	It("deletes only the expired records", func() {
+		Expect(numDeleted).To(Equal(4))
+		for offset, expirationDate := range expirationDates {
+			record, err := db.GetRecord(topic, 1, offset)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(record.Exists()).To(Equal(expirationDate == live), "offset %d", offset)
+			record.Free()
+		}
+	})
+
+	It("stops at the first unexpired retention key", func() {
+		it := db.Scan(RecordExpCF)
+		defer it.Close()
+		var offsets []uint64
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			retentionKey := NewRetentionPeriodKey(it.Key())
+			Expect(retentionKey.ExpirationDate()).To(Equal(live))
+			offsets = append(offsets, retentionKey.RecordKey().Offset())
+			retentionKey.Free()
+		}
+		Expect(offsets).To(ConsistOf(uint64(3), uint64(6)))
+	})
+
+	It("keeps the size of the live records", func() {
+		key := NewRecordKeyFromData(topic, 1, 0)
+		value := NewRecordValueFromData(0, []byte{0})
+		Expect(db.FragmentSize(topic, 1)).To(Equal(uint64(2 * (key.Size() + value.Size()))))
+	})
+})
@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"encoding/binary"
+)
+
+// TimeIndexKey layout: topic | '@' | fragmentId(4) | timestamp(8) | offset(8)
+type TimeIndexKey struct {
+	Slice
+	data    []byte
+	isSlice bool
+}
+
+func NewTimeIndexKeyFromData(topic string, fragmentId uint32, timestamp uint64, offset uint64) *TimeIndexKey {
+	data := make([]byte, len(topic)+1+uint32Len+uint64Len+uint64Len)
+	copy(data, topic+"@")
+	binary.BigEndian.PutUint32(data[len(topic)+1:], fragmentId)
+	binary.BigEndian.PutUint64(data[len(topic)+1+uint32Len:], timestamp)
+	binary.BigEndian.PutUint64(data[len(topic)+1+uint32Len+uint64Len:], offset)
+	return &TimeIndexKey{data: data, isSlice: false}
+}
+
+func NewTimeIndexKey(slice Slice) *TimeIndexKey {
+	return &TimeIndexKey{Slice: slice, isSlice: true}
+}
+
+func (k TimeIndexKey) Data() []byte {
+	if k.isSlice {
+		return k.Slice.Data()
+	}
+	return k.data
+}
+
+func (k TimeIndexKey) Size() int {
+	if k.isSlice {
+		return k.Slice.Size()
+	}
+	return len(k.data)
+}
+
+func (k TimeIndexKey) Topic() string {
+	return string(k.Data()[:k.Size()-uint32Len-uint64Len-uint64Len-1])
+}
+
+func (k TimeIndexKey) FragmentId() uint32 {
+	return binary.BigEndian.Uint32(k.Data()[k.Size()-uint64Len-uint64Len-uint32Len : k.Size()-uint64Len-uint64Len])
+}
+
+func (k TimeIndexKey) Timestamp() uint64 {
+	return binary.BigEndian.Uint64(k.Data()[k.Size()-uint64Len-uint64Len : k.Size()-uint64Len])
+}
+
+func (k TimeIndexKey) Offset() uint64 {
+	return binary.BigEndian.Uint64(k.Data()[k.Size()-uint64Len:])
+}
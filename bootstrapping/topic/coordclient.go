@@ -197,6 +197,12 @@ func (t CoordClientTopicWrapper) AddPublisher(topicName string, id string, host
 		Run()
 }
 
+func (t CoordClientTopicWrapper) RemovePublisher(topicName string, id string) error {
+	return t.coordClient.
+		Delete([]string{path.TopicPublisherPath(topicName, id)}).
+		Run()
+}
+
 func (t CoordClientTopicWrapper) GetPublisher(topicName string, id string) (string, error) {
 	data, err := t.coordClient.Get(path.TopicPublisherPath(topicName, id)).Run()
 	if err != nil {
@@ -221,6 +227,13 @@ func (t CoordClientTopicWrapper) AddSubscriber(topicName string, id string) erro
 		AsEphemeral().
 		Run()
 }
+
+func (t CoordClientTopicWrapper) RemoveSubscriber(topicName string, id string) error {
+	return t.coordClient.
+		Delete([]string{path.TopicSubscriberPath(topicName, id)}).
+		Run()
+}
+
 func (t CoordClientTopicWrapper) GetSubscriber(topicName string, id string) (string, error) {
 	data, err := t.coordClient.Get(path.TopicSubscriberPath(topicName, id)).Run()
 	if err != nil {
@@ -3,7 +3,9 @@ package topic_test
 import (
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"github.com/paust-team/pirius/bootstrapping/path"
 	"github.com/paust-team/pirius/bootstrapping/topic"
+	"github.com/paust-team/pirius/compression"
 	"github.com/paust-team/pirius/coordinating"
 	"github.com/paust-team/pirius/coordinating/inmemory"
 	"github.com/paust-team/pirius/qerror"
@@ -60,6 +62,82 @@ var _ = Describe("CoordClient", func() {
 				})
 			})
 
+			When("the topic has a retention policy", Ordered, func() {
+				testTopicWithRetention := "test-topic-retention"
+				retention := topic.RetentionPolicy{PeriodSec: 600, MaxBytes: 1 << 20}
+				var topicFrame topic.Frame
+
+				BeforeAll(func() {
+					err = topicClient.CreateTopic(testTopicWithRetention, topic.NewTopicFrameWithRetention(testDescription, testOptions, retention))
+					Expect(err).NotTo(HaveOccurred())
+					topicFrame, err = topicClient.GetTopic(testTopicWithRetention)
+					Expect(err).NotTo(HaveOccurred())
+				})
+				AfterAll(func() {
+					topicClient.DeleteTopic(testTopicWithRetention)
+				})
+				It("must be equal to expected", func() {
+					Expect(topicFrame.Description()).To(Equal(testDescription))
+					Expect(topicFrame.Options()).To(Equal(testOptions))
+					Expect(topicFrame.RetentionPolicy()).To(Equal(retention))
+				})
+			})
+
+			When("the topic has a compression codec", Ordered, func() {
+				testTopicWithCompression := "test-topic-compression"
+				retention := topic.RetentionPolicy{PeriodSec: 600}
+				var topicFrame topic.Frame
+
+				BeforeAll(func() {
+					err = topicClient.CreateTopic(testTopicWithCompression, topic.NewTopicFrameWithCompression(testDescription, testOptions, retention, compression.Zstd))
+					Expect(err).NotTo(HaveOccurred())
+					topicFrame, err = topicClient.GetTopic(testTopicWithCompression)
+					Expect(err).NotTo(HaveOccurred())
+				})
+				AfterAll(func() {
+					topicClient.DeleteTopic(testTopicWithCompression)
+				})
+				It("must be equal to expected", func() {
+					Expect(topicFrame.Description()).To(Equal(testDescription))
+					Expect(topicFrame.Options()).To(Equal(testOptions))
+					Expect(topicFrame.RetentionPolicy()).To(Equal(retention))
+					Expect(topicFrame.Compression()).To(Equal(compression.Zstd))
+				})
+			})
+
+			When("the topic frame is truncated", Ordered, func() {
+				testTopicTruncated := "test-topic-truncated"
+				var topicFrame topic.Frame
+
+				BeforeAll(func() {
+					frame := topic.NewTopicFrameWithCompression(testDescription, testOptions, topic.RetentionPolicy{PeriodSec: 600}, compression.Zstd)
+					err = topicClient.CreateTopic(testTopicTruncated, frame)
+					Expect(err).NotTo(HaveOccurred())
+					// cut in the middle of the retention policy
+					err = coordClient.Set(path.TopicPath(testTopicTruncated), frame.Data()[:5]).Run()
+					Expect(err).NotTo(HaveOccurred())
+					topicFrame, err = topicClient.GetTopic(testTopicTruncated)
+					Expect(err).NotTo(HaveOccurred())
+				})
+				AfterAll(func() {
+					topicClient.DeleteTopic(testTopicTruncated)
+				})
+				It("reads the truncated fields as not set", func() {
+					Expect(topicFrame.Options()).To(Equal(testOptions))
+					Expect(topicFrame.RetentionPolicy().IsEmpty()).To(BeTrue())
+					Expect(topicFrame.Compression()).To(Equal(compression.None))
+					Expect(func() { _ = topicFrame.Description() }).NotTo(Panic())
+				})
+				It("reads an empty frame as not set", func() {
+					err = coordClient.Set(path.TopicPath(testTopicTruncated), []byte{}).Run()
+					Expect(err).NotTo(HaveOccurred())
+					topicFrame, err = topicClient.GetTopic(testTopicTruncated)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(topicFrame.Options()).To(BeZero())
+					Expect(topicFrame.Description()).To(BeEmpty())
+				})
+			})
+
 			When("the topic not exists", func() {
 				nonExistTopic := "no-exist-topic"
 				BeforeEach(func() {
@@ -1,19 +1,64 @@
 package topic
 
-import "encoding/json"
+import (
+	"encoding/binary"
+	"encoding/json"
+	"github.com/paust-team/pirius/compression"
+)
 
 type Option byte
 
 const (
 	UniquePerFragment Option = 1 << iota // if this option set, topic record should not be duplicated in multiple fragments
+	KeyBasedRouting                      // if this option set with UniquePerFragment, records of the same key are written to the same fragment
+	Compacted                            // if this option set, only the newest record of each key is kept in a fragment
 )
 
+const (
+	retentionPolicyFlag Option = 1 << 7 // if this flag set, the frame has a retention policy after the options
+	compressionFlag     Option = 1 << 6 // if this flag set, the frame has a compression codec after the retention policy
+	frameFlags                 = retentionPolicyFlag | compressionFlag
+	retentionPolicyLen         = 16
+)
+
+// RetentionPolicy of a topic. zero values mean the agent's retention is used
+type RetentionPolicy struct {
+	PeriodSec uint64 // retention period in seconds
+	MaxBytes  uint64 // max size of the stored records of a publisher
+}
+
+func (r RetentionPolicy) IsEmpty() bool {
+	return r.PeriodSec == 0 && r.MaxBytes == 0
+}
+
+// Frame layout: options(1) | [retentionPeriodSec(8) | maxBytes(8)] | [compression(1)] | description
+// Fields of a frame truncated by the coordinator are read as not set
 type Frame struct {
 	data []byte
 }
 
 func NewTopicFrame(description string, option Option) Frame {
+	return NewTopicFrameWithRetention(description, option, RetentionPolicy{})
+}
+
+func NewTopicFrameWithRetention(description string, option Option, retention RetentionPolicy) Frame {
+	return NewTopicFrameWithCompression(description, option, retention, compression.None)
+}
+
+// NewTopicFrameWithCompression the published data of the topic is compressed by the codec
+func NewTopicFrameWithCompression(description string, option Option, retention RetentionPolicy, codec compression.Codec) Frame {
 	data := []byte{byte(option)}
+	if !retention.IsEmpty() {
+		data[0] |= byte(retentionPolicyFlag)
+		policy := make([]byte, retentionPolicyLen)
+		binary.BigEndian.PutUint64(policy, retention.PeriodSec)
+		binary.BigEndian.PutUint64(policy[8:], retention.MaxBytes)
+		data = append(data, policy...)
+	}
+	if codec != compression.None {
+		data[0] |= byte(compressionFlag)
+		data = append(data, byte(codec))
+	}
 	data = append(data, description...)
 	return Frame{data: data}
 }
@@ -27,11 +72,58 @@ func (t Frame) Size() int {
 }
 
 func (t Frame) Options() Option {
-	return Option(t.Data()[0])
+	return t.flags() &^ frameFlags
+}
+
+func (t Frame) RetentionPolicy() RetentionPolicy {
+	if !t.hasRetentionPolicy() {
+		return RetentionPolicy{}
+	}
+	return RetentionPolicy{
+		PeriodSec: binary.BigEndian.Uint64(t.Data()[1:9]),
+		MaxBytes:  binary.BigEndian.Uint64(t.Data()[9 : 1+retentionPolicyLen]),
+	}
+}
+
+// Compression returns the codec compressing the published data of the topic
+func (t Frame) Compression() compression.Codec {
+	if !t.hasCompression() {
+		return compression.None
+	}
+	return compression.Codec(t.Data()[t.compressionPos()])
 }
 
 func (t Frame) Description() string {
-	return string(t.Data()[1:])
+	pos := t.compressionPos()
+	if t.hasCompression() {
+		pos++
+	}
+	if pos > t.Size() {
+		return ""
+	}
+	return string(t.Data()[pos:])
+}
+
+func (t Frame) flags() Option {
+	if t.Size() == 0 {
+		return 0
+	}
+	return Option(t.Data()[0])
+}
+
+func (t Frame) hasRetentionPolicy() bool {
+	return t.flags()&retentionPolicyFlag != 0 && t.Size() >= 1+retentionPolicyLen
+}
+
+func (t Frame) hasCompression() bool {
+	return t.flags()&compressionFlag != 0 && t.Size() > t.compressionPos()
+}
+
+func (t Frame) compressionPos() int {
+	if t.hasRetentionPolicy() {
+		return 1 + retentionPolicyLen
+	}
+	return 1
 }
 
 type FragState uint
@@ -3,8 +3,10 @@ package rpc
 import (
 	"context"
 	"github.com/paust-team/pirius/bootstrapping/topic"
+	"github.com/paust-team/pirius/compression"
 	"github.com/paust-team/pirius/proto/pb"
 	"github.com/paust-team/pirius/qerror"
+	"strconv"
 )
 
 type TopicService struct {
@@ -20,7 +22,23 @@ func (s TopicService) CreateTopic(ctx context.Context, request *pb.CreateTopicRe
 	if len(request.GetName()) == 0 {
 		return nil, qerror.ValidationError{Value: request.GetName(), HintMsg: "name should not be blank"}
 	}
-	topicFrame := topic.NewTopicFrame(request.GetDescription(), topic.Option(int(request.GetOptions())))
+	retention := topic.RetentionPolicy{
+		PeriodSec: request.GetRetentionPeriod(),
+		MaxBytes:  request.GetRetentionMaxBytes(),
+	}
+	if request.GetCompression() >= uint32(len(compression.Codecs)) {
+		return nil, qerror.ValidationError{Value: strconv.Itoa(int(request.GetCompression())), HintMsg: "compression should be one of none(0), snappy(1), zstd(2) and lz4(3)"}
+	}
+	option := topic.Option(int(request.GetOptions()))
+	if option&topic.KeyBasedRouting != 0 && option&topic.UniquePerFragment == 0 {
+		return nil, qerror.ValidationError{Value: strconv.Itoa(int(request.GetOptions())), HintMsg: "key-based routing can be set only for UniquePerFragment topic"}
+	}
+	// records of a key should be written to the same fragment to be compacted
+	if option&topic.Compacted != 0 && option&topic.KeyBasedRouting == 0 {
+		return nil, qerror.ValidationError{Value: strconv.Itoa(int(request.GetOptions())), HintMsg: "compaction can be set only for key-based routing topic"}
+	}
+	codec := compression.Codec(request.GetCompression())
+	topicFrame := topic.NewTopicFrameWithCompression(request.GetDescription(), option, retention, codec)
 	if err := s.coordClient.CreateTopic(request.GetName(), topicFrame); err != nil {
 		return nil, err
 	}
@@ -32,11 +50,19 @@ func (s TopicService) GetTopic(ctx context.Context, request *pb.TopicRequestWith
 		return nil, err
 	} else {
 		options := uint32(frame.Options())
-		return &pb.TopicInfo{
+		topicInfo := &pb.TopicInfo{
 			Name:        request.GetName(),
 			Description: frame.Description(),
 			Options:     &options,
-		}, nil
+		}
+		if retention := frame.RetentionPolicy(); !retention.IsEmpty() {
+			topicInfo.RetentionPeriod = &retention.PeriodSec
+			topicInfo.RetentionMaxBytes = &retention.MaxBytes
+		}
+		if codec := uint32(frame.Compression()); codec != uint32(compression.None) {
+			topicInfo.Compression = &codec
+		}
+		return topicInfo, nil
 	}
 }
 
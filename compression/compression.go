@@ -0,0 +1,119 @@
+package compression
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/paust-team/pirius/constants"
+	"github.com/paust-team/pirius/qerror"
+	"github.com/pierrec/lz4/v4"
+	"sync"
+)
+
+// Codec compresses the published data of records
+type Codec byte
+
+const (
+	None Codec = iota
+	Snappy
+	Zstd
+	LZ4
+)
+
+var codecNames = []string{"none", "snappy", "zstd", "lz4"}
+
+// Codecs are all codecs supported
+var Codecs = []Codec{None, Snappy, Zstd, LZ4}
+
+func (c Codec) String() string {
+	if !c.IsValid() {
+		return "unknown"
+	}
+	return codecNames[c]
+}
+
+func (c Codec) IsValid() bool {
+	return int(c) < len(codecNames)
+}
+
+func ParseCodec(name string) (Codec, error) {
+	for i, codecName := range codecNames {
+		if name == codecName {
+			return Codec(i), nil
+		}
+	}
+	return None, qerror.ValidationError{Value: name, HintMsg: "compression should be one of none, snappy, zstd and lz4"}
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+// encoder and decoder of zstd are safe for concurrent use with EncodeAll and DecodeAll
+func initZstd() {
+	zstdOnce.Do(func() {
+		zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(constants.MaxRecordSize))
+	})
+}
+
+// Compress returns the compressed data. lz4 blocks are prefixed with the length of the data to decompress them
+func Compress(codec Codec, data []byte) ([]byte, error) {
+	switch codec {
+	case None:
+		return data, nil
+	case Snappy:
+		return s2.EncodeSnappy(nil, data), nil
+	case Zstd:
+		initZstd()
+		return zstdEncoder.EncodeAll(data, nil), nil
+	case LZ4:
+		compressed := make([]byte, 4+lz4.CompressBlockBound(len(data)))
+		binary.BigEndian.PutUint32(compressed, uint32(len(data)))
+		n, err := lz4.CompressBlock(data, compressed[4:], nil)
+		if err != nil {
+			return nil, err
+		}
+		return compressed[:4+n], nil
+	}
+	return nil, qerror.ValidationError{Value: codec.String(), HintMsg: "unsupported compression"}
+}
+
+// Decompress returns the decompressed data. data decompressed longer than constants.MaxRecordSize is rejected
+// not to allocate the length written in a corrupted block
+func Decompress(codec Codec, data []byte) ([]byte, error) {
+	switch codec {
+	case None:
+		return data, nil
+	case Snappy:
+		size, err := s2.DecodedLen(data)
+		if err != nil {
+			return nil, err
+		}
+		if size > constants.MaxRecordSize {
+			return nil, errors.New("snappy block is larger than the max record size")
+		}
+		return s2.Decode(nil, data)
+	case Zstd:
+		initZstd()
+		return zstdDecoder.DecodeAll(data, nil)
+	case LZ4:
+		if len(data) < 4 {
+			return nil, errors.New("lz4 block is too short")
+		}
+		size := binary.BigEndian.Uint32(data)
+		if size > constants.MaxRecordSize {
+			return nil, errors.New("lz4 block is larger than the max record size")
+		}
+		decompressed := make([]byte, size)
+		n, err := lz4.UncompressBlock(data[4:], decompressed)
+		if err != nil {
+			return nil, err
+		}
+		return decompressed[:n], nil
+	}
+	return nil, qerror.ValidationError{Value: codec.String(), HintMsg: "unsupported compression"}
+}
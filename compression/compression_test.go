@@ -0,0 +1,77 @@
+package compression_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/paust-team/pirius/compression"
+	"github.com/paust-team/pirius/constants"
+)
+
+var _ = Describe("Codec", func() {
+
+	Describe("Parsing codec names", func() {
+		It("parses the name of each codec", func() {
+			for _, codec := range compression.Codecs {
+				parsed, err := compression.ParseCodec(codec.String())
+				Expect(err).NotTo(HaveOccurred())
+				Expect(parsed).To(Equal(codec))
+			}
+		})
+		It("fails on an unknown name", func() {
+			_, err := compression.ParseCodec("gzip")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("Compressing data", func() {
+		data := bytes.Repeat([]byte("pirius-compression "), 100)
+
+		It("restores the data of each codec", func() {
+			for _, codec := range compression.Codecs {
+				compressed, err := compression.Compress(codec, data)
+				Expect(err).NotTo(HaveOccurred())
+				if codec != compression.None {
+					Expect(len(compressed)).To(BeNumerically("<", len(data)))
+				}
+				decompressed, err := compression.Decompress(codec, compressed)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(decompressed).To(Equal(data))
+			}
+		})
+		It("rejects an lz4 block larger than the max record size", func() {
+			block := make([]byte, 4)
+			binary.BigEndian.PutUint32(block, constants.MaxRecordSize+1)
+			_, err := compression.Decompress(compression.LZ4, block)
+			Expect(err).To(HaveOccurred())
+		})
+		It("restores data of the max record size and rejects larger data of each codec", func() {
+			large := bytes.Repeat([]byte{'a'}, constants.MaxRecordSize+1)
+			for _, codec := range compression.Codecs {
+				if codec == compression.None {
+					continue
+				}
+				compressed, err := compression.Compress(codec, large[:constants.MaxRecordSize])
+				Expect(err).NotTo(HaveOccurred())
+				decompressed, err := compression.Decompress(codec, compressed)
+				Expect(err).NotTo(HaveOccurred(), codec.String())
+				Expect(decompressed).To(HaveLen(constants.MaxRecordSize))
+
+				compressed, err = compression.Compress(codec, large)
+				Expect(err).NotTo(HaveOccurred())
+				_, err = compression.Decompress(codec, compressed)
+				Expect(err).To(HaveOccurred(), codec.String())
+			}
+		})
+		It("restores empty data of each codec", func() {
+			for _, codec := range compression.Codecs {
+				compressed, err := compression.Compress(codec, nil)
+				Expect(err).NotTo(HaveOccurred())
+				decompressed, err := compression.Decompress(codec, compressed)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(decompressed).To(BeEmpty())
+			}
+		})
+	})
+})
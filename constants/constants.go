@@ -10,6 +10,7 @@ var (
 	DefaultBrokerConfigPath      = fmt.Sprintf("%s/config/broker/config.yml", DefaultHomeDir)
 	DefaultAgentConfigPath       = fmt.Sprintf("%s/config/agent/config.yml", DefaultHomeDir)
 	DefaultAgentPort        uint = 11010
+	DefaultAdminPort        uint = 11020
 	DefaultBrokerPort       uint = 1101
 )
 
@@ -22,4 +23,10 @@ const MaxRetentionPeriod = 30
 const WatchEventBuffer = 5
 const InitialRebalanceTimeout = 10
 
-const MaxRetryCountForSubscription = 5
+const FragmentReaderBufferSize = 1000
+const MaxUnackedRecords = 10000
+const MaxRecordSize = 4 << 20 // default max receive message size of grpc
+
+const QuotaCheckInterval = 100 // millisecond
+
+const HashRingVirtualNodes = 100
@@ -3,8 +3,12 @@ package helper
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"github.com/google/uuid"
+	"github.com/paust-team/pirius/constants"
+	"hash/fnv"
 	"net"
+	"sort"
 	"strings"
 	"sync"
 )
@@ -140,6 +144,37 @@ func RoundRobinSelection[T any](list []T) func() T {
 	}
 }
 
+// ConsistentHashSelection selects an element by the hash of key on a consistent hash ring,
+// so only a few keys are moved to other elements when the list is changed
+func ConsistentHashSelection[T any](list []T) func(key []byte) T {
+	type virtualNode struct {
+		hash  uint32
+		index int
+	}
+	ring := make([]virtualNode, 0, len(list)*constants.HashRingVirtualNodes)
+	for i, e := range list {
+		for v := 0; v < constants.HashRingVirtualNodes; v++ {
+			ring = append(ring, virtualNode{hash: hashBytes([]byte(fmt.Sprintf("%v#%d", e, v))), index: i})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+
+	return func(key []byte) T {
+		hash := hashBytes(key)
+		i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= hash })
+		if i == len(ring) {
+			i = 0
+		}
+		return list[ring[i].index]
+	}
+}
+
+func hashBytes(data []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(data)
+	return h.Sum32()
+}
+
 func IsContainBytes(e []byte, s [][]byte) bool {
 	for _, a := range s {
 		if bytes.Compare(a, e) == 0 {
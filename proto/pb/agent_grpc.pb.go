@@ -19,6 +19,7 @@ const _ = grpc.SupportPackageIsVersion7
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type PubSubClient interface {
 	Subscribe(ctx context.Context, in *Subscription, opts ...grpc.CallOption) (PubSub_SubscribeClient, error)
+	SubscribeWithCredit(ctx context.Context, opts ...grpc.CallOption) (PubSub_SubscribeWithCreditClient, error)
 }
 
 type pubSubClient struct {
@@ -61,11 +62,43 @@ func (x *pubSubSubscribeClient) Recv() (*SubscriptionResult, error) {
 	return m, nil
 }
 
+func (c *pubSubClient) SubscribeWithCredit(ctx context.Context, opts ...grpc.CallOption) (PubSub_SubscribeWithCreditClient, error) {
+	stream, err := c.cc.NewStream(ctx, &PubSub_ServiceDesc.Streams[1], "/agent.proto.PubSub/SubscribeWithCredit", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &pubSubSubscribeWithCreditClient{stream}
+	return x, nil
+}
+
+type PubSub_SubscribeWithCreditClient interface {
+	Send(*SubscriptionRequest) error
+	Recv() (*SubscriptionResult, error)
+	grpc.ClientStream
+}
+
+type pubSubSubscribeWithCreditClient struct {
+	grpc.ClientStream
+}
+
+func (x *pubSubSubscribeWithCreditClient) Send(m *SubscriptionRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *pubSubSubscribeWithCreditClient) Recv() (*SubscriptionResult, error) {
+	m := new(SubscriptionResult)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // PubSubServer is the server API for PubSub service.
 // All implementations must embed UnimplementedPubSubServer
 // for forward compatibility
 type PubSubServer interface {
 	Subscribe(*Subscription, PubSub_SubscribeServer) error
+	SubscribeWithCredit(PubSub_SubscribeWithCreditServer) error
 	mustEmbedUnimplementedPubSubServer()
 }
 
@@ -76,6 +109,9 @@ type UnimplementedPubSubServer struct {
 func (UnimplementedPubSubServer) Subscribe(*Subscription, PubSub_SubscribeServer) error {
 	return status.Errorf(codes.Unimplemented, "method Subscribe not implemented")
 }
+func (UnimplementedPubSubServer) SubscribeWithCredit(PubSub_SubscribeWithCreditServer) error {
+	return status.Errorf(codes.Unimplemented, "method SubscribeWithCredit not implemented")
+}
 func (UnimplementedPubSubServer) mustEmbedUnimplementedPubSubServer() {}
 
 // UnsafePubSubServer may be embedded to opt out of forward compatibility for this service.
@@ -110,6 +146,32 @@ func (x *pubSubSubscribeServer) Send(m *SubscriptionResult) error {
 	return x.ServerStream.SendMsg(m)
 }
 
+func _PubSub_SubscribeWithCredit_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(PubSubServer).SubscribeWithCredit(&pubSubSubscribeWithCreditServer{stream})
+}
+
+type PubSub_SubscribeWithCreditServer interface {
+	Send(*SubscriptionResult) error
+	Recv() (*SubscriptionRequest, error)
+	grpc.ServerStream
+}
+
+type pubSubSubscribeWithCreditServer struct {
+	grpc.ServerStream
+}
+
+func (x *pubSubSubscribeWithCreditServer) Send(m *SubscriptionResult) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *pubSubSubscribeWithCreditServer) Recv() (*SubscriptionRequest, error) {
+	m := new(SubscriptionRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // PubSub_ServiceDesc is the grpc.ServiceDesc for PubSub service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -123,6 +185,12 @@ var PubSub_ServiceDesc = grpc.ServiceDesc{
 			Handler:       _PubSub_Subscribe_Handler,
 			ServerStreams: true,
 		},
+		{
+			StreamName:    "SubscribeWithCredit",
+			Handler:       _PubSub_SubscribeWithCredit_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
 	},
 	Metadata: "agent.proto",
 }
@@ -244,3 +312,125 @@ var RetrievablePubSub_ServiceDesc = grpc.ServiceDesc{
 	},
 	Metadata: "agent.proto",
 }
+
+// AdminClient is the client API for Admin service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type AdminClient interface {
+	SetRateLimit(ctx context.Context, in *SetRateLimitRequest, opts ...grpc.CallOption) (*SetRateLimitResponse, error)
+	GetRateLimits(ctx context.Context, in *GetRateLimitsRequest, opts ...grpc.CallOption) (*GetRateLimitsResponse, error)
+}
+
+type adminClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAdminClient(cc grpc.ClientConnInterface) AdminClient {
+	return &adminClient{cc}
+}
+
+func (c *adminClient) SetRateLimit(ctx context.Context, in *SetRateLimitRequest, opts ...grpc.CallOption) (*SetRateLimitResponse, error) {
+	out := new(SetRateLimitResponse)
+	err := c.cc.Invoke(ctx, "/agent.proto.Admin/SetRateLimit", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) GetRateLimits(ctx context.Context, in *GetRateLimitsRequest, opts ...grpc.CallOption) (*GetRateLimitsResponse, error) {
+	out := new(GetRateLimitsResponse)
+	err := c.cc.Invoke(ctx, "/agent.proto.Admin/GetRateLimits", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AdminServer is the server API for Admin service.
+// All implementations must embed UnimplementedAdminServer
+// for forward compatibility
+type AdminServer interface {
+	SetRateLimit(context.Context, *SetRateLimitRequest) (*SetRateLimitResponse, error)
+	GetRateLimits(context.Context, *GetRateLimitsRequest) (*GetRateLimitsResponse, error)
+	mustEmbedUnimplementedAdminServer()
+}
+
+// UnimplementedAdminServer must be embedded to have forward compatible implementations.
+type UnimplementedAdminServer struct {
+}
+
+func (UnimplementedAdminServer) SetRateLimit(context.Context, *SetRateLimitRequest) (*SetRateLimitResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetRateLimit not implemented")
+}
+func (UnimplementedAdminServer) GetRateLimits(context.Context, *GetRateLimitsRequest) (*GetRateLimitsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetRateLimits not implemented")
+}
+func (UnimplementedAdminServer) mustEmbedUnimplementedAdminServer() {}
+
+// UnsafeAdminServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AdminServer will
+// result in compilation errors.
+type UnsafeAdminServer interface {
+	mustEmbedUnimplementedAdminServer()
+}
+
+func RegisterAdminServer(s grpc.ServiceRegistrar, srv AdminServer) {
+	s.RegisterService(&Admin_ServiceDesc, srv)
+}
+
+func _Admin_SetRateLimit_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetRateLimitRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).SetRateLimit(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/agent.proto.Admin/SetRateLimit",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).SetRateLimit(ctx, req.(*SetRateLimitRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_GetRateLimits_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRateLimitsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).GetRateLimits(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/agent.proto.Admin/GetRateLimits",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).GetRateLimits(ctx, req.(*GetRateLimitsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Admin_ServiceDesc is the grpc.ServiceDesc for Admin service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Admin_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "agent.proto.Admin",
+	HandlerType: (*AdminServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "SetRateLimit",
+			Handler:    _Admin_SetRateLimit_Handler,
+		},
+		{
+			MethodName: "GetRateLimits",
+			Handler:    _Admin_GetRateLimits_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "agent.proto",
+}
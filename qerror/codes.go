@@ -30,12 +30,17 @@ const (
 	ErrCoordNoNode              = 0x0208
 
 	// 03 - rocksdb related error
-	ErrDBOperate = 0x0300
+	ErrDBOperate        = 0x0300
+	ErrQuotaExceeded    = 0x0301
+	ErrCorruptedRecord  = 0x0302
+	ErrDecryptionFailed = 0x0303
+	ErrCorruptedArchive = 0x0304
 
 	// 04 - network related error
 	ErrNotConnected     = 0x0400
 	ErrAlreadyConnected = 0x0401
 	ErrDialFailed       = 0x0402
+	ErrReconnectFailed  = 0x0403
 
 	// 05 - config related error
 	ErrConfigValueNotSet = 0x0500
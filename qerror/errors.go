@@ -162,3 +162,76 @@ func (e CoordNoNodeError) Error() string {
 func (e CoordNoNodeError) Code() QErrCode {
 	return ErrCoordNoNode
 }
+
+// storage
+type QuotaExceededError struct {
+	Topic     string // topic of the rejected records
+	AgentWide bool   // true if the quota of the agent is exceeded, not the quota of the topic
+	Size      uint64
+	MaxBytes  uint64
+}
+
+func (e QuotaExceededError) Error() string {
+	if e.AgentWide {
+		return fmt.Sprintf("quota of agent exceeded by topic %s: %d bytes stored, max %d bytes", e.Topic, e.Size, e.MaxBytes)
+	}
+	return fmt.Sprintf("quota of topic %s exceeded: %d bytes stored, max %d bytes", e.Topic, e.Size, e.MaxBytes)
+}
+
+func (e QuotaExceededError) Code() QErrCode {
+	return ErrQuotaExceeded
+}
+
+type CorruptedRecordError struct {
+	Topic      string
+	FragmentId uint32
+	Offset     uint64
+}
+
+func (e CorruptedRecordError) Error() string {
+	return fmt.Sprintf("record of topic(%s) fragment(%d) offset(%d) is corrupted", e.Topic, e.FragmentId, e.Offset)
+}
+
+func (e CorruptedRecordError) Code() QErrCode {
+	return ErrCorruptedRecord
+}
+
+type DecryptionFailedError struct {
+	KeyId  uint32
+	ErrStr string
+}
+
+func (e DecryptionFailedError) Error() string {
+	return fmt.Sprintf("cannot decrypt record sealed by key(%d): %s", e.KeyId, e.ErrStr)
+}
+
+func (e DecryptionFailedError) Code() QErrCode {
+	return ErrDecryptionFailed
+}
+
+type CorruptedArchiveError struct {
+	ErrStr string
+}
+
+func (e CorruptedArchiveError) Error() string {
+	return fmt.Sprintf("archive is corrupted: %s", e.ErrStr)
+}
+
+func (e CorruptedArchiveError) Code() QErrCode {
+	return ErrCorruptedArchive
+}
+
+// network
+type ReconnectFailedError struct {
+	Endpoint string
+	Attempts uint
+	ErrStr   string
+}
+
+func (e ReconnectFailedError) Error() string {
+	return fmt.Sprintf("failed to reconnect to %s after %d attempts : %s", e.Endpoint, e.Attempts, e.ErrStr)
+}
+
+func (e ReconnectFailedError) Code() QErrCode {
+	return ErrReconnectFailed
+}
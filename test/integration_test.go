@@ -138,6 +138,7 @@ var _ = Describe("IntegrationTest_WithDistributionRule", Ordered, func() {
 					Expect(subscriptionResult).To(HaveLen(1))
 					Expect(subscriptionResult[0].SeqNum).To(Equal(uint64(idx)))
 					Expect(subscriptionResult[0].Data).To(Equal(tp.GetBytesList("records1")[idx]))
+					subscriptionResult.Ack()
 					idx++
 					if idx == totalRecords {
 						break
@@ -182,6 +183,7 @@ var _ = Describe("IntegrationTest_WithDistributionRule", Ordered, func() {
 						Expect(subscriptionResult[i].SeqNum).To(Equal(uint64(idx + i)))
 						Expect(subscriptionResult[i].Data).To(Equal(tp.GetBytesList("records1")[idx+i]))
 					}
+					subscriptionResult.Ack()
 
 					idx += batchSize
 					if idx == totalRecords {
@@ -271,7 +273,7 @@ var _ = Describe("IntegrationTest_WithDistributionRule", Ordered, func() {
 			})
 
 			When("a new publisher connected while subscribing", func() {
-				var recvChs []chan []pubsub.SubscriptionResult
+				var recvChs []chan pubsub.SubscriptionResults
 				BeforeEach(func() {
 					By("prepare a new publisher")
 					pubConfig := config2.NewAgentConfig()
@@ -314,6 +316,7 @@ var _ = Describe("IntegrationTest_WithDistributionRule", Ordered, func() {
 						Expect(helper.IsContainBytes(subscriptionResult[0].Data, totalRecords)).To(BeTrue())
 						Expect(helper.IsContainBytes(subscriptionResult[0].Data, receivedRecords)).To(BeFalse())
 						receivedRecords = append(receivedRecords, subscriptionResult[0].Data)
+						subscriptionResult.Ack()
 
 						if len(receivedRecords) == len(totalRecords) {
 							break
@@ -358,7 +361,7 @@ var _ = Describe("IntegrationTest_WithDistributionRule", Ordered, func() {
 				}
 			})
 			When("a publisher disconnected while subscribing", func() {
-				var recvChs []chan []pubsub.SubscriptionResult
+				var recvChs []chan pubsub.SubscriptionResults
 				BeforeEach(func() {
 					By("start subscribing")
 					for _, subscriber := range subscribers {
@@ -383,6 +386,7 @@ var _ = Describe("IntegrationTest_WithDistributionRule", Ordered, func() {
 						Expect(helper.IsContainBytes(subscriptionResult[0].Data, totalRecords)).To(BeTrue())
 						Expect(helper.IsContainBytes(subscriptionResult[0].Data, receivedRecords)).To(BeFalse())
 						receivedRecords = append(receivedRecords, subscriptionResult[0].Data)
+						subscriptionResult.Ack()
 
 						if helper.IsContainBytes(subscriptionResult[0].Data, activeRecords) {
 							idx++
@@ -449,7 +453,7 @@ var _ = Describe("IntegrationTest_WithDistributionRule", Ordered, func() {
 			sendChs = []chan pubsub.TopicData{}
 		})
 		Describe("Scale up subscriber 1 to 2", func() {
-			var recvChs []chan []pubsub.SubscriptionResult
+			var recvChs []chan pubsub.SubscriptionResults
 
 			BeforeEach(func() {
 				By("start publishing slowly")
@@ -509,6 +513,7 @@ var _ = Describe("IntegrationTest_WithDistributionRule", Ordered, func() {
 						Expect(helper.IsContainBytes(subscriptionResult[0].Data, totalRecords)).To(BeTrue())
 						Expect(helper.IsContainBytes(subscriptionResult[0].Data, receivedRecords)).To(BeFalse())
 						receivedRecords = append(receivedRecords, subscriptionResult[0].Data)
+						subscriptionResult.Ack()
 						if len(receivedRecords) == len(totalRecords) {
 							break
 						}
@@ -550,7 +555,7 @@ var _ = Describe("IntegrationTest_WithDistributionRule", Ordered, func() {
 				}
 			})
 			When("a subscriber disconnected while subscribing", func() {
-				var recvChs []chan []pubsub.SubscriptionResult
+				var recvChs []chan pubsub.SubscriptionResults
 				BeforeEach(func() {
 					By("start subscribing")
 					for _, subscriber := range subscribers {
@@ -584,6 +589,7 @@ var _ = Describe("IntegrationTest_WithDistributionRule", Ordered, func() {
 									Expect(result).To(HaveLen(int(tp.GetUint32("batchSize"))))
 									Expect(helper.IsContainBytes(result[0].Data, totalRecords)).To(BeTrue())
 									receivedRecords = append(receivedRecords, result[0].Data)
+									result.Ack()
 								}
 
 							case result, ok := <-recvChs[0]:
@@ -595,6 +601,7 @@ var _ = Describe("IntegrationTest_WithDistributionRule", Ordered, func() {
 								Expect(helper.IsContainBytes(result[0].Data, totalRecords)).To(BeTrue())
 								Expect(helper.IsContainBytes(result[0].Data, receivedRecords)).To(BeFalse())
 								receivedRecords = append(receivedRecords, result[0].Data)
+								result.Ack()
 							}
 						}
 					}()